@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var drainCmd = &cobra.Command{
+	Use:   "drain",
+	Short: "Stop taking new requests and leave the network once in-flight requests finish",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		timeout, _ := cmd.Flags().GetDuration("timeout")
+		addr, _ := cmd.Flags().GetString("addr")
+		if addr == "" {
+			addr = "http://127.0.0.1:" + viper.GetString("port")
+		}
+		payload := map[string]string{}
+		if timeout > 0 {
+			payload["timeout"] = timeout.String()
+		}
+		body, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		client := &http.Client{Timeout: 10 * time.Second}
+		resp, err := client.Post(addr+"/v1/dnt/_drain", "application/json", bytes.NewReader(body))
+		if err != nil {
+			return fmt.Errorf("could not reach node at %s: %w", addr, err)
+		}
+		defer resp.Body.Close()
+		out, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("drain request failed (%d): %s", resp.StatusCode, string(out))
+		}
+		fmt.Println(string(out))
+		return nil
+	},
+}
+
+func init() {
+	drainCmd.Flags().Duration("timeout", 0, "maximum time to wait for in-flight requests (default: drain.timeout on the node)")
+	drainCmd.Flags().String("addr", "", "HTTP address of the node (default: http://127.0.0.1:<port>)")
+}
@@ -7,6 +7,13 @@ import (
 var initCmd = &cobra.Command{
 	Use:   "init",
 	Short: "Initialize the system, create the database and the config file",
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if swarmKey, _ := cmd.Flags().GetBool("swarm-key"); swarmKey {
+			return generateSwarmKey("", false)
+		}
+		return nil
+	}}
 
-	}}
\ No newline at end of file
+func init() {
+	initCmd.Flags().Bool("swarm-key", false, "also generate a swarm key for running a private network")
+}
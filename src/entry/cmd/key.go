@@ -0,0 +1,197 @@
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"opentela/internal/common"
+	"opentela/internal/protocol"
+	"os"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/spf13/cobra"
+)
+
+var keyCmd = &cobra.Command{
+	Use:   "key",
+	Short: "Manage the keys of this node",
+}
+
+var keySwarmCmd = &cobra.Command{
+	Use:   "swarm",
+	Short: "Generate a swarm key for running a private network",
+	Long: `Generate a swarm key for running a private network.
+
+Copy the key to every node of the network and start them with
+--network.private. Nodes only connect to peers holding the same key.
+With --network.id, the key is stored with the keys of that network.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := common.ValidateNetworkID(common.NetworkID()); err != nil {
+			return err
+		}
+		out, _ := cmd.Flags().GetString("out")
+		force, _ := cmd.Flags().GetBool("force")
+		return generateSwarmKey(out, force)
+	},
+}
+
+// generateSwarmKey writes a new swarm key to out, or to the default location
+// if out is empty, and prints its fingerprint.
+func generateSwarmKey(out string, force bool) error {
+	if out == "" {
+		var err error
+		if out, err = protocol.DefaultSwarmKeyPath(); err != nil {
+			return err
+		}
+	}
+	if err := protocol.WriteSwarmKey(out, force); err != nil {
+		return err
+	}
+	psk, err := protocol.LoadSwarmKey(out)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Swarm key written to %s (fingerprint %s)\n", out, protocol.SwarmKeyFingerprint(psk))
+	return nil
+}
+
+var keyGenerateCmd = &cobra.Command{
+	Use:   "generate",
+	Short: "Generate the identity key of this node",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		keyType, _ := cmd.Flags().GetString("type")
+		force, _ := cmd.Flags().GetBool("force")
+		priv, err := protocol.GenerateIdentityKey(keyType)
+		if err != nil {
+			return err
+		}
+		return saveIdentityKey(priv, force)
+	},
+}
+
+var keyShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Show the peer ID of this node",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		keyPath := protocol.IdentityKeyPath()
+		priv, err := protocol.LoadIdentityKey(keyPath)
+		if err != nil {
+			return err
+		}
+		id, err := peer.IDFromPrivateKey(priv)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Peer ID: %s\nKey type: %s\nKey file: %s\n", id, protocol.KeyTypeName(priv), keyPath)
+		return nil
+	},
+}
+
+var keyExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export the identity key of this node",
+	Long: `Export the identity key of this node, to standard output unless --out
+is given. The protobuf format is the one of the key file and of other libp2p
+nodes; pem is a PKCS #8 block, which secp256k1 keys cannot be exported to.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		format, _ := cmd.Flags().GetString("format")
+		out, _ := cmd.Flags().GetString("out")
+		priv, err := protocol.LoadIdentityKey(protocol.IdentityKeyPath())
+		if err != nil {
+			return err
+		}
+		data, err := protocol.MarshalIdentityKey(priv, format)
+		if err != nil {
+			return err
+		}
+		if out == "" {
+			_, err = os.Stdout.Write(data)
+			return err
+		}
+		return os.WriteFile(out, data, 0600)
+	},
+}
+
+var keyImportCmd = &cobra.Command{
+	Use:   "import <file>",
+	Short: "Import an identity key in protobuf or PEM format",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		force, _ := cmd.Flags().GetBool("force")
+		priv, err := protocol.LoadIdentityKey(args[0])
+		if err != nil {
+			return err
+		}
+		return saveIdentityKey(priv, force)
+	},
+}
+
+var keyDeriveCmd = &cobra.Command{
+	Use:   "derive",
+	Short: "Derive the identity key of this node from a passphrase",
+	Long: `Derive the identity key of this node from a passphrase with argon2id,
+so that the node gets the same peer ID wherever the passphrase is used, e.g.
+to publish stable bootstrap addresses of heads. The passphrase is read from
+standard input. Keys derived for another --network.id differ.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := common.ValidateNetworkID(common.NetworkID()); err != nil {
+			return err
+		}
+		force, _ := cmd.Flags().GetBool("force")
+		passphrase, err := readPassphrase(cmd.InOrStdin())
+		if err != nil {
+			return err
+		}
+		priv, err := protocol.DeriveIdentityKey(passphrase, common.NetworkID())
+		if err != nil {
+			return err
+		}
+		return saveIdentityKey(priv, force)
+	},
+}
+
+// saveIdentityKey writes priv to the key file and prints the peer ID it
+// gives the node.
+func saveIdentityKey(priv crypto.PrivKey, force bool) error {
+	keyPath := protocol.IdentityKeyPath()
+	if err := protocol.SaveIdentityKey(keyPath, priv, force); err != nil {
+		return err
+	}
+	id, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Identity key written to %s (peer ID %s)\n", keyPath, id)
+	return nil
+}
+
+// readPassphrase reads the first line of in.
+func readPassphrase(in io.Reader) (string, error) {
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func init() {
+	keyCmd.PersistentFlags().String("network.id", "", "network the keys belong to")
+	keyCmd.PersistentFlags().String("key.path", "", "identity key file (default: $HOME/.ocfcore/keys[/<network.id>]/id)")
+	keyGenerateCmd.Flags().String("type", "ed25519", "key type (ed25519, rsa, secp256k1 or ecdsa)")
+	keyGenerateCmd.Flags().Bool("force", false, "replace an existing identity key")
+	keyExportCmd.Flags().String("format", protocol.KeyFormatProtobuf, "format of the exported key (protobuf or pem)")
+	keyExportCmd.Flags().String("out", "", "file to write the key to (default: standard output)")
+	keyImportCmd.Flags().Bool("force", false, "replace an existing identity key")
+	keyDeriveCmd.Flags().Bool("force", false, "replace an existing identity key")
+	keyCmd.AddCommand(keyGenerateCmd, keyShowCmd, keyExportCmd, keyImportCmd, keyDeriveCmd)
+	keySwarmCmd.Flags().String("out", "", "file to write the swarm key to (default: $HOME/.ocfcore/keys[/<network.id>]/swarm.key)")
+	keySwarmCmd.Flags().Bool("force", false, "replace an existing swarm key")
+	keyCmd.AddCommand(keySwarmCmd)
+}
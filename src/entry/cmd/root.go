@@ -7,6 +7,7 @@ import (
 	"path"
 	"strconv"
 	"strings"
+	"time"
 
 	homedir "github.com/mitchellh/go-homedir"
 	"github.com/spf13/cobra"
@@ -36,24 +37,63 @@ func init() {
 	startCmd.Flags().String("wallet.account", "", "wallet account")
 	startCmd.Flags().String("account.wallet", "", "path to wallet key file")
 	startCmd.Flags().String("bootstrap.addr", "http://152.67.71.5:8092/v1/dnt/bootstraps", "bootstrap address")
-	startCmd.Flags().StringSlice("bootstrap.source", nil, "bootstrap source (HTTP URL, dnsaddr://host, or multiaddr). Repeatable")
+	startCmd.Flags().StringSlice("bootstrap.source", nil, "bootstrap source (HTTP URL, dnsaddr://host, file://path, mdns://, rendezvous://namespace, or multiaddr). Repeatable")
 	startCmd.Flags().StringSlice("bootstrap.static", nil, "static bootstrap multiaddr (repeatable)")
-	startCmd.Flags().String("seed", "0", "Seed")
+	startCmd.Flags().Duration("bootstrap.refresh_interval", 2*time.Minute, "How often bootstrap sources are resolved again to find new bootstraps (0 disables it)")
+	startCmd.Flags().String("resources.max_memory", "", "Memory the p2p host may use, e.g. 2GiB (default: an eighth of the system memory)")
+	startCmd.Flags().Int("resources.max_fds", 0, "File descriptors the p2p host may use (default: half of the process limit)")
+	startCmd.Flags().Int("connmgr.low_water", 192, "Number of connections the connection manager trims down to")
+	startCmd.Flags().Int("connmgr.high_water", 256, "Number of connections above which the connection manager trims them (0 never trims)")
+	startCmd.Flags().Duration("connmgr.grace_period", time.Minute, "Time during which new connections are not trimmed")
+	startCmd.Flags().Duration("relay.max_duration", 30*time.Minute, "Maximum lifetime of a connection relayed for another peer")
+	startCmd.Flags().String("relay.max_data", "1GiB", "Maximum data relayed in each direction of a connection, e.g. 512MiB")
+	startCmd.Flags().Int("relay.max_reservations", 128, "Maximum number of peers relayed for")
+	startCmd.Flags().Int("relay.max_circuits", 16, "Maximum number of connections relayed for a single peer")
+	startCmd.Flags().String("seed", "0", "Seed the identity key is derived from (predictable, prefer otela key derive)")
+	startCmd.Flags().String("key.path", "", "Identity key file (default: $HOME/.ocfcore/keys[/<network.id>]/id)")
 	startCmd.Flags().String("mode", "node", "Mode (standalone, local, full)")
+	startCmd.Flags().String("role", "head", "Role of the node (head, worker, relay, observer)")
 	startCmd.Flags().String("tcpport", "43905", "TCP Port")
 	startCmd.Flags().String("udpport", "59820", "UDP Port")
 	startCmd.Flags().String("subprocess", "", "Subprocess to start")
 	startCmd.Flags().String("public-addr", "", "Public address if you have one (by setting this, you can be a bootstrap node)")
 	startCmd.Flags().String("service.name", "", "Service name")
 	startCmd.Flags().String("service.port", "", "Service port")
+	startCmd.Flags().Duration("service.models_refresh_interval", 30*time.Second, "Interval at which the models served by the local engine are re-discovered (0 disables)")
+	startCmd.Flags().String("health.path", "/health", "Default health check path of local services")
+	startCmd.Flags().Duration("health.interval", 10*time.Second, "Interval between health checks of local services")
+	startCmd.Flags().Duration("health.timeout", 5*time.Second, "Timeout of a single health check")
+	startCmd.Flags().Int("health.success_threshold", 1, "Consecutive successful checks before an unhealthy service is routed to again")
+	startCmd.Flags().Int("health.failure_threshold", 3, "Consecutive failed checks before a service is marked unhealthy")
+	startCmd.Flags().String("health.readiness_path", "", "Optional path that receives a warm-up POST before an unhealthy service is routed to again")
+	startCmd.Flags().String("health.readiness_body", "", "JSON body of the warm-up request")
+	startCmd.Flags().Duration("load.interval", 5*time.Second, "Interval at which the load of local engines is scraped (0 disables)")
+	startCmd.Flags().Duration("load.publish_interval", 15*time.Second, "Minimum time between two publications of the load to the network")
+	startCmd.Flags().String("load.metrics_path", "/metrics", "Prometheus endpoint of the local engines")
+	startCmd.Flags().Bool("security.require_signatures", true, "Reject node table entries that are not signed by the peer they belong to. Turning it off is a temporary compatibility option for networks with nodes predating signed entries, which are incompatible otherwise")
+	startCmd.Flags().String("network.id", "", "Network to join; nodes only talk to nodes of the same network (default: the public network)")
+	startCmd.Flags().Bool("network.private", false, "Only connect to peers sharing the swarm key (disables QUIC)")
+	startCmd.Flags().String("network.swarm_key", "", "Swarm key file for the private network (default: $HOME/.ocfcore/keys[/<network.id>]/swarm.key)")
+	startCmd.Flags().StringSlice("acl.allow_peers", nil, "Only connect to these peer IDs (repeatable)")
+	startCmd.Flags().StringSlice("acl.deny_peers", nil, "Never connect to these peer IDs (repeatable)")
+	startCmd.Flags().StringSlice("acl.allow_cidrs", nil, "Only accept peers connecting from these networks (repeatable)")
+	startCmd.Flags().StringSlice("acl.deny_cidrs", nil, "Reject peers connecting from these networks (repeatable)")
+	startCmd.Flags().StringSlice("acl.allow_owners", nil, "Only accept peers owned by these wallets, as proven by a signature of the wallet (repeatable); peers without a proven owner must then be allowed by ID")
+	startCmd.Flags().StringSlice("acl.deny_owners", nil, "Reject peers owned by these wallets (repeatable); peers without a proven owner must then be allowed by ID")
+	startCmd.Flags().Bool("acl.replicate", false, "Share access lists set at runtime with other nodes through the node table")
+	startCmd.Flags().StringSlice("acl.admins", nil, "Peer IDs whose replicated access lists are trusted (repeatable)")
 	startCmd.Flags().String("solana.rpc", defaultConfig.Solana.RPC, "Solana RPC endpoint")
 	startCmd.Flags().String("solana.mint", defaultConfig.Solana.Mint, "SPL token mint to verify ownership")
 	startCmd.Flags().Bool("solana.skip_verification", defaultConfig.Solana.SkipVerification, "Skip Solana token ownership verification (use for testing only)")
-	startCmd.Flags().Bool("cleanslate", true, "Clean slate")
+	startCmd.Flags().Bool("cleanslate", false, "Remove the persisted node table on startup and shutdown instead of warm restarting from it")
+	startCmd.Flags().Duration("shutdown.grace_period", 2*time.Minute, "Maximum time to wait for in-flight requests on shutdown")
+	startCmd.Flags().Duration("drain.timeout", 10*time.Minute, "Maximum time a drain waits for in-flight requests before leaving")
 	rootcmd.AddCommand(initCmd)
 	rootcmd.AddCommand(startCmd)
 	rootcmd.AddCommand(versionCmd)
 	rootcmd.AddCommand(updateCmd)
+	rootcmd.AddCommand(drainCmd)
+	rootcmd.AddCommand(keyCmd)
 }
 
 func initConfig(cmd *cobra.Command) error {
@@ -65,6 +105,9 @@ func initConfig(cmd *cobra.Command) error {
 	viper.SetDefault("crdt.tombstone_retention", "24h")
 	viper.SetDefault("crdt.tombstone_compaction_interval", "1h")
 	viper.SetDefault("crdt.tombstone_compaction_batch", 512)
+	viper.SetDefault("crdt.snapshot_interval", "10m")
+	viper.SetDefault("crdt.snapshot_min_height", 1000)
+	viper.SetDefault("crdt.snapshot_prune", false)
 	// Don't forget to read config either from cfgFile or from home directory!
 	if cfgFile != "" {
 		// Use config file from the flag.
@@ -128,6 +171,13 @@ func initConfig(cmd *cobra.Command) error {
 				} else {
 					viper.Set(flag.Name, value)
 				}
+			case "duration":
+				value, err := time.ParseDuration(flag.Value.String())
+				if err != nil {
+					viper.Set(flag.Name, flag.Value)
+				} else {
+					viper.Set(flag.Name, value)
+				}
 			case "stringSlice", "stringArray":
 				if sliceValue, ok := flag.Value.(pflag.SliceValue); ok {
 					viper.Set(flag.Name, sliceValue.GetSlice())
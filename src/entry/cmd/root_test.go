@@ -154,6 +154,8 @@ func TestInitConfigDefaults(t *testing.T) {
 	assert.Equal(t, "24h", viper.GetString("crdt.tombstone_retention"))
 	assert.Equal(t, "1h", viper.GetString("crdt.tombstone_compaction_interval"))
 	assert.Equal(t, 512, viper.GetInt("crdt.tombstone_compaction_batch"))
+	assert.Equal(t, "10m", viper.GetString("crdt.snapshot_interval"))
+	assert.False(t, viper.GetBool("crdt.snapshot_prune"))
 }
 
 func TestInitConfigFlagBinding(t *testing.T) {
@@ -4,6 +4,7 @@ import (
 	"opentela/internal/common"
 	"opentela/internal/protocol"
 	"opentela/internal/server"
+	"os"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -13,6 +14,14 @@ var startCmd = &cobra.Command{
 	Use:   "start",
 	Short: "Start listening for incoming connections",
 	Run: func(cmd *cobra.Command, args []string) {
+		if err := protocol.ValidateRole(protocol.NodeRole()); err != nil {
+			common.Logger.Error(err)
+			os.Exit(1)
+		}
+		if err := common.ValidateNetworkID(common.NetworkID()); err != nil {
+			common.Logger.Error(err)
+			os.Exit(1)
+		}
 		// check if cleanslate is set
 		if viper.GetBool("cleanslate") {
 			// clean slate, by removing the database
@@ -176,7 +176,7 @@ func TestStartCommandFlagDefaults(t *testing.T) {
 	assert.Equal(t, "node", flags.Lookup("mode").DefValue)
 	assert.Equal(t, "43905", flags.Lookup("tcpport").DefValue)
 	assert.Equal(t, "59820", flags.Lookup("udpport").DefValue)
-	assert.Equal(t, "true", flags.Lookup("cleanslate").DefValue)
+	assert.Equal(t, "false", flags.Lookup("cleanslate").DefValue)
 	assert.Equal(t, defaultConfig.Solana.RPC, flags.Lookup("solana.rpc").DefValue)
 	assert.Equal(t, defaultConfig.Solana.Mint, flags.Lookup("solana.mint").DefValue)
 	assert.Equal(t, "false", flags.Lookup("solana.skip_verification").DefValue) // Bool flags use "false" string representation
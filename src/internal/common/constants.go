@@ -24,6 +24,20 @@ func GetHomePath() string {
 	return ocfcorePath
 }
 
+// GetDBPath returns the database of the node, kept apart for every network
+// the node may join.
 func GetDBPath(nodeid string) string {
+	if network := NetworkID(); network != "" {
+		return path.Join(GetHomePath(), "ocfcore."+network+"."+nodeid+".db")
+	}
 	return path.Join(GetHomePath(), "ocfcore."+nodeid+".db")
 }
+
+// GetKeysPath returns the directory holding the keys of the node for the
+// current network.
+func GetKeysPath() string {
+	if network := NetworkID(); network != "" {
+		return path.Join(GetHomePath(), "keys", network)
+	}
+	return path.Join(GetHomePath(), "keys")
+}
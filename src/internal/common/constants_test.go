@@ -5,6 +5,8 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+
+	"github.com/spf13/viper"
 )
 
 func TestGetHomePathCreatesDir(t *testing.T) {
@@ -38,3 +40,35 @@ func TestGetDBPath(t *testing.T) {
 		t.Fatalf("unexpected db path: %s", db)
 	}
 }
+
+func TestPathsAreScopedByNetwork(t *testing.T) {
+	tmp, _ := os.MkdirTemp("", "ocf_home_test3")
+	old := os.Getenv("HOME")
+	t.Cleanup(func() { _ = os.Setenv("HOME", old) })
+	_ = os.Setenv("HOME", tmp)
+	t.Cleanup(func() { viper.Set("network.id", "") })
+
+	if keys := GetKeysPath(); !strings.HasSuffix(keys, filepath.Join(".ocfcore", "keys")) {
+		t.Fatalf("unexpected keys path on the default network: %s", keys)
+	}
+	viper.Set("network.id", "staging")
+	if db := GetDBPath("node123"); !strings.HasSuffix(db, filepath.Join(".ocfcore", "ocfcore.staging.node123.db")) {
+		t.Fatalf("unexpected db path: %s", db)
+	}
+	if keys := GetKeysPath(); !strings.HasSuffix(keys, filepath.Join(".ocfcore", "keys", "staging")) {
+		t.Fatalf("unexpected keys path: %s", keys)
+	}
+}
+
+func TestValidateNetworkID(t *testing.T) {
+	for _, id := range []string{"", "staging", "lab-2.eu_west"} {
+		if err := ValidateNetworkID(id); err != nil {
+			t.Fatalf("expected %q to be valid: %v", id, err)
+		}
+	}
+	for _, id := range []string{"-lead", "a/b", "with space", strings.Repeat("x", 65)} {
+		if err := ValidateNetworkID(id); err == nil {
+			t.Fatalf("expected %q to be rejected", id)
+		}
+	}
+}
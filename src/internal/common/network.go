@@ -0,0 +1,25 @@
+package common
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/spf13/viper"
+)
+
+var networkIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// NetworkID returns the network.id setting. Nodes only talk to nodes of the
+// same network; the empty ID is the default network.
+func NetworkID() string {
+	return viper.GetString("network.id")
+}
+
+// ValidateNetworkID checks that id can be used in topic names, protocol IDs
+// and file names.
+func ValidateNetworkID(id string) error {
+	if id != "" && !networkIDPattern.MatchString(id) {
+		return fmt.Errorf("invalid network id %q: use up to 64 letters, digits, '.', '_' or '-'", id)
+	}
+	return nil
+}
@@ -16,14 +16,39 @@ type LMAvailableModels struct {
 	Models []ModelData `json:"data"`
 }
 
+// GPUSpec describes a GPU. Memory is in MiB.
 type GPUSpec struct {
 	Name        string `json:"name"`
 	TotalMemory int64  `json:"total_memory"`
 	UsedMemory  int64  `json:"used_memory"`
+	// Vendor is "nvidia" or "amd"
+	Vendor string `json:"vendor,omitempty"`
+	UUID   string `json:"uuid,omitempty"`
+	// Utilization is in percent and Temperature in degrees Celsius
+	Utilization   int       `json:"utilization,omitempty"`
+	Temperature   int       `json:"temperature,omitempty"`
+	DriverVersion string    `json:"driver_version,omitempty"`
+	MIG           []MIGSpec `json:"mig,omitempty"`
 }
 
+// MIGSpec is a slice of an NVIDIA GPU partitioned with Multi-Instance GPU.
+type MIGSpec struct {
+	Profile string `json:"profile"`
+	UUID    string `json:"uuid"`
+}
+
+// CPUSpec describes the CPUs of the host.
+type CPUSpec struct {
+	Model string `json:"model"`
+	// Cores counts physical cores and Threads logical processors
+	Cores   int `json:"cores"`
+	Threads int `json:"threads"`
+}
+
+// HardwareSpec describes the hardware of a node. Host memory is in MiB.
 type HardwareSpec struct {
 	GPUs            []GPUSpec `json:"gpus"`
+	CPU             CPUSpec   `json:"cpu"`
 	Memory          int64     `json:"host_memory"`
 	MemoryBandwidth int64     `json:"host_memory_bandwidth"`
 	UsedMemory      int64     `json:"host_memory_used"`
@@ -1,33 +1,185 @@
 package platform
 
 import (
+	"encoding/json"
+	"fmt"
 	"opentela/internal/common"
 	"os/exec"
+	"sort"
 	"strconv"
 	"strings"
 )
 
+const nvidiaQuery = "--query-gpu=name,memory.total,memory.used,uuid,utilization.gpu,temperature.gpu,driver_version"
+
+// GetGPUInfo returns the NVIDIA and AMD GPUs of the host.
 func GetGPUInfo() []common.GPUSpec {
-	cmd := exec.Command("nvidia-smi", "--query-gpu=name,memory.total,memory.used", "--format=csv,noheader,nounits")
-	out, err := cmd.Output()
+	gpus := append(nvidiaGPUs(), amdGPUs()...)
+	if len(gpus) == 0 {
+		common.Logger.Info("No GPU found with nvidia-smi or rocm-smi - GPU info will be unavailable (this is expected if no GPU is present)")
+	}
+	return gpus
+}
+
+// GetGPUUtilization returns the average utilization of the GPUs in percent,
+// or false if it cannot be read.
+func GetGPUUtilization() (float64, bool) {
+	gpus := append(nvidiaGPUs(), amdGPUs()...)
+	if len(gpus) == 0 {
+		return 0, false
+	}
+	var total float64
+	for _, gpu := range gpus {
+		total += float64(gpu.Utilization)
+	}
+	return total / float64(len(gpus)), true
+}
+
+// parseInt reads a number printed by nvidia-smi or rocm-smi, which may be a
+// float or "[N/A]" (read as 0).
+func parseInt(value string) int64 {
+	value = strings.TrimSpace(value)
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return n
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0
+	}
+	return int64(f)
+}
+
+func nvidiaGPUs() []common.GPUSpec {
+	out, err := exec.Command("nvidia-smi", nvidiaQuery, "--format=csv,noheader,nounits").Output()
 	if err != nil {
-		common.Logger.Info("Error running nvidia-smi: ", err, " - GPU info will be unavailable (this is expected if no NVIDIA GPU is present)")
 		return []common.GPUSpec{}
 	}
-	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
-	var gpus []common.GPUSpec
-	for _, line := range lines {
+	gpus := parseNvidiaGPUs(string(out))
+	if list, err := exec.Command("nvidia-smi", "-L").Output(); err == nil {
+		slices := parseMIGSlices(string(list))
+		for i := range gpus {
+			gpus[i].MIG = slices[gpus[i].UUID]
+		}
+	}
+	return gpus
+}
+
+// parseNvidiaGPUs parses the CSV output of nvidiaQuery. Only name and memory
+// are required, so that older drivers still report their GPUs.
+func parseNvidiaGPUs(out string) []common.GPUSpec {
+	gpus := []common.GPUSpec{}
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
 		fields := strings.Split(line, ",")
 		if len(fields) < 3 {
 			continue
 		}
-		name := strings.TrimSpace(fields[0])
-		total, _ := strconv.ParseInt(strings.TrimSpace(fields[1]), 10, 64)
-		used, _ := strconv.ParseInt(strings.TrimSpace(fields[2]), 10, 64)
+		for len(fields) < 7 {
+			fields = append(fields, "")
+		}
+		gpus = append(gpus, common.GPUSpec{
+			Name:          strings.TrimSpace(fields[0]),
+			TotalMemory:   parseInt(fields[1]),
+			UsedMemory:    parseInt(fields[2]),
+			Vendor:        "nvidia",
+			UUID:          strings.TrimSpace(fields[3]),
+			Utilization:   int(parseInt(fields[4])),
+			Temperature:   int(parseInt(fields[5])),
+			DriverVersion: strings.TrimSpace(fields[6]),
+		})
+	}
+	return gpus
+}
+
+// parseMIGSlices parses `nvidia-smi -L` and returns the MIG slices of each
+// GPU by GPU UUID.
+func parseMIGSlices(out string) map[string][]common.MIGSpec {
+	slices := make(map[string][]common.MIGSpec)
+	var gpu string
+	for _, line := range strings.Split(out, "\n") {
+		trimmed := strings.TrimSpace(line)
+		uuid := ""
+		if i := strings.Index(trimmed, "(UUID: "); i >= 0 {
+			uuid = strings.TrimSuffix(trimmed[i+len("(UUID: "):], ")")
+		}
+		switch {
+		case strings.HasPrefix(trimmed, "GPU "):
+			gpu = uuid
+		case strings.HasPrefix(trimmed, "MIG ") && gpu != "":
+			fields := strings.Fields(trimmed)
+			slices[gpu] = append(slices[gpu], common.MIGSpec{Profile: fields[1], UUID: uuid})
+		}
+	}
+	return slices
+}
+
+func amdGPUs() []common.GPUSpec {
+	out, err := exec.Command("rocm-smi", "--showproductname", "--showuniqueid", "--showuse", "--showtemp", "--showmeminfo", "vram", "--showdriverversion", "--json").Output()
+	if err != nil {
+		return []common.GPUSpec{}
+	}
+	return parseRocmGPUs(out)
+}
+
+// rocmField returns the first value whose key starts with one of prefixes.
+// Key names differ slightly between rocm-smi releases.
+func rocmField(card map[string]string, prefixes ...string) string {
+	keys := make([]string, 0, len(card))
+	for key := range card {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, prefix := range prefixes {
+		for _, key := range keys {
+			if strings.HasPrefix(strings.ToLower(key), strings.ToLower(prefix)) {
+				return card[key]
+			}
+		}
+	}
+	return ""
+}
+
+// parseRocmGPUs parses the JSON output of rocm-smi, which holds one object
+// per card ("card0", "card1", ...) and a "system" object with the driver
+// version.
+func parseRocmGPUs(out []byte) []common.GPUSpec {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(out, &raw); err != nil {
+		return []common.GPUSpec{}
+	}
+	report := make(map[string]map[string]string, len(raw))
+	for name, value := range raw {
+		var fields map[string]any
+		if err := json.Unmarshal(value, &fields); err != nil {
+			continue
+		}
+		report[name] = make(map[string]string, len(fields))
+		for key, field := range fields {
+			report[name][key] = fmt.Sprint(field)
+		}
+	}
+	driver := rocmField(report["system"], "Driver version")
+	cards := make([]string, 0, len(report))
+	for name := range report {
+		if strings.HasPrefix(name, "card") {
+			cards = append(cards, name)
+		}
+	}
+	sort.Slice(cards, func(i, j int) bool {
+		return parseInt(strings.TrimPrefix(cards[i], "card")) < parseInt(strings.TrimPrefix(cards[j], "card"))
+	})
+	gpus := []common.GPUSpec{}
+	for _, name := range cards {
+		card := report[name]
+		const mib = 1 << 20
 		gpus = append(gpus, common.GPUSpec{
-			Name:        name,
-			TotalMemory: total,
-			UsedMemory:  used,
+			Name:          rocmField(card, "Card Series", "Card model", "Marketing Name"),
+			TotalMemory:   parseInt(rocmField(card, "VRAM Total Memory")) / mib,
+			UsedMemory:    parseInt(rocmField(card, "VRAM Total Used Memory")) / mib,
+			Vendor:        "amd",
+			UUID:          rocmField(card, "Unique ID"),
+			Utilization:   int(parseInt(rocmField(card, "GPU use"))),
+			Temperature:   int(parseInt(rocmField(card, "Temperature (Sensor edge)", "Temperature"))),
+			DriverVersion: driver,
 		})
 	}
 	return gpus
@@ -0,0 +1,92 @@
+package platform
+
+import (
+	"bufio"
+	"opentela/internal/common"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// procRoot is where the proc filesystem is mounted, replaced in tests.
+var procRoot = "/proc"
+
+// GetCPUInfo reads the CPU model, physical cores and logical processors of
+// the host from /proc/cpuinfo.
+func GetCPUInfo() common.CPUSpec {
+	f, err := os.Open(filepath.Join(procRoot, "cpuinfo"))
+	if err != nil {
+		return common.CPUSpec{}
+	}
+	defer f.Close()
+	var spec common.CPUSpec
+	cores := make(map[string]struct{})
+	physicalID := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		switch key {
+		case "processor":
+			spec.Threads++
+		case "model name":
+			if spec.Model == "" {
+				spec.Model = value
+			}
+		case "physical id":
+			physicalID = value
+		case "core id":
+			cores[physicalID+"/"+value] = struct{}{}
+		}
+	}
+	spec.Cores = len(cores)
+	if spec.Cores == 0 {
+		// no topology, e.g. in some VMs or on ARM
+		spec.Cores = spec.Threads
+	}
+	return spec
+}
+
+// GetHostMemory returns the total and used memory of the host in MiB, read
+// from /proc/meminfo. Used memory excludes caches that can be reclaimed.
+func GetHostMemory() (total, used int64) {
+	f, err := os.Open(filepath.Join(procRoot, "meminfo"))
+	if err != nil {
+		return 0, 0
+	}
+	defer f.Close()
+	var available int64
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		kib, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "MemTotal:":
+			total = kib / 1024
+		case "MemAvailable:":
+			available = kib / 1024
+		}
+	}
+	return total, total - available
+}
+
+// GetHardwareSpec returns the inventory of the host: CPUs, memory and GPUs.
+func GetHardwareSpec() common.HardwareSpec {
+	total, used := GetHostMemory()
+	return common.HardwareSpec{
+		GPUs:       GetGPUInfo(),
+		CPU:        GetCPUInfo(),
+		Memory:     total,
+		UsedMemory: used,
+	}
+}
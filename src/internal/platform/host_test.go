@@ -0,0 +1,79 @@
+package platform
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"opentela/internal/common"
+)
+
+func fakeProc(t *testing.T, files map[string]string) {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+	}
+	previous := procRoot
+	procRoot = dir
+	t.Cleanup(func() { procRoot = previous })
+}
+
+const cpuinfo = `processor	: 0
+model name	: AMD EPYC 7763 64-Core Processor
+physical id	: 0
+core id		: 0
+
+processor	: 1
+model name	: AMD EPYC 7763 64-Core Processor
+physical id	: 0
+core id		: 0
+
+processor	: 2
+model name	: AMD EPYC 7763 64-Core Processor
+physical id	: 1
+core id		: 0
+
+processor	: 3
+model name	: AMD EPYC 7763 64-Core Processor
+physical id	: 1
+core id		: 1
+`
+
+func TestGetCPUInfo(t *testing.T) {
+	fakeProc(t, map[string]string{"cpuinfo": cpuinfo})
+	want := common.CPUSpec{Model: "AMD EPYC 7763 64-Core Processor", Cores: 3, Threads: 4}
+	if got := GetCPUInfo(); got != want {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+
+	// without topology every processor counts as a core
+	fakeProc(t, map[string]string{"cpuinfo": "processor\t: 0\nprocessor\t: 1\n"})
+	if got := GetCPUInfo(); got.Cores != 2 || got.Threads != 2 {
+		t.Fatalf("unexpected CPU info: %+v", got)
+	}
+}
+
+func TestGetHostMemory(t *testing.T) {
+	fakeProc(t, map[string]string{"meminfo": "MemTotal:       16384000 kB\nMemFree:         1024000 kB\nMemAvailable:    4096000 kB\n"})
+	total, used := GetHostMemory()
+	if total != 16000 || used != 12000 {
+		t.Fatalf("expected 16000 MiB total and 12000 MiB used, got %d and %d", total, used)
+	}
+
+	fakeProc(t, nil)
+	if total, used := GetHostMemory(); total != 0 || used != 0 {
+		t.Fatalf("expected no memory without /proc, got %d and %d", total, used)
+	}
+}
+
+func TestGetHardwareSpec(t *testing.T) {
+	fakeProc(t, map[string]string{"cpuinfo": cpuinfo, "meminfo": "MemTotal: 2048 kB\nMemAvailable: 1024 kB\n"})
+	fakeBinaries(t, nil)
+	spec := GetHardwareSpec()
+	if spec.CPU.Threads != 4 || spec.Memory != 2 || spec.UsedMemory != 1 || len(spec.GPUs) != 0 {
+		t.Fatalf("unexpected hardware spec: %+v", spec)
+	}
+}
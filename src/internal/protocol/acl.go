@@ -0,0 +1,428 @@
+package protocol
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"opentela/internal/common"
+	"opentela/internal/wallet"
+	"slices"
+	"sync"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+	"github.com/spf13/viper"
+)
+
+// aclKey holds the access lists replicated through the CRDT.
+var aclKey = ds.NewKey("/_acl")
+
+var ErrInvalidACL = errors.New("invalid access list")
+
+// ACLRules lists peers by ID, by the networks they connect from and by the
+// wallet owning them.
+type ACLRules struct {
+	Peers  []string `json:"peers,omitempty"`
+	CIDRs  []string `json:"cidrs,omitempty"`
+	Owners []string `json:"owners,omitempty"`
+}
+
+// ACL decides which peers may connect and appear in the node table. Deny
+// rules always win. If any allow rule is set, peers must also match one of
+// them: by ID or owner, and by network if CIDRs are allowed.
+//
+// Owners are only matched when the peer proves, with a signature of its
+// wallet, that it belongs to the owner it announces. Once any owner rule is
+// set, peers that are not allowed by ID must have proven an owner to be
+// admitted, so that a denied owner cannot get through by announcing none.
+// Their owner is learnt from their metadata, which reaches the node through
+// the peers it is connected to: bootstraps should be allowed by ID.
+type ACL struct {
+	Allow ACLRules `json:"allow"`
+	Deny  ACLRules `json:"deny"`
+}
+
+// ACLState is the access list in effect: the static part from the config
+// and the part set at runtime, which may be replicated.
+type ACLState struct {
+	Static     ACL  `json:"static"`
+	Dynamic    ACL  `json:"dynamic"`
+	Replicated bool `json:"replicated"`
+}
+
+type compiledRules struct {
+	peers  map[string]struct{}
+	owners map[string]struct{}
+	nets   []*net.IPNet
+}
+
+func (r compiledRules) hasPeerRules() bool {
+	return len(r.peers) > 0 || len(r.owners) > 0
+}
+
+func (r compiledRules) matchesID(id string) bool {
+	_, ok := r.peers[id]
+	return ok
+}
+
+func (r compiledRules) matchesOwner(owner string) bool {
+	_, ok := r.owners[owner]
+	return owner != "" && ok
+}
+
+func (r compiledRules) matchesIP(ip net.IP) bool {
+	for _, n := range r.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func compileRules(rules ACLRules) (compiledRules, error) {
+	out := compiledRules{peers: make(map[string]struct{}), owners: make(map[string]struct{})}
+	for _, id := range rules.Peers {
+		if _, err := peer.Decode(id); err != nil {
+			return out, fmt.Errorf("%w: peer %q: %v", ErrInvalidACL, id, err)
+		}
+		out.peers[id] = struct{}{}
+	}
+	for _, owner := range rules.Owners {
+		out.owners[owner] = struct{}{}
+	}
+	for _, cidr := range rules.CIDRs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return out, fmt.Errorf("%w: %v", ErrInvalidACL, err)
+		}
+		out.nets = append(out.nets, n)
+	}
+	return out, nil
+}
+
+func mergeRules(a, b ACLRules) ACLRules {
+	return ACLRules{
+		Peers:  slices.Concat(a.Peers, b.Peers),
+		CIDRs:  slices.Concat(a.CIDRs, b.CIDRs),
+		Owners: slices.Concat(a.Owners, b.Owners),
+	}
+}
+
+// accessControl holds the access lists and the owners seen in the node table,
+// so that peers can be checked by owner before their entry is accepted.
+type accessControl struct {
+	mu      sync.RWMutex
+	static  ACL
+	dynamic ACL
+	allow   compiledRules
+	deny    compiledRules
+	owners  map[string]string
+}
+
+func newAccessControl() *accessControl {
+	a := &accessControl{owners: make(map[string]string)}
+	_ = a.compile(ACL{}, ACL{})
+	return a
+}
+
+func (a *accessControl) compile(static, dynamic ACL) error {
+	allow, err := compileRules(mergeRules(static.Allow, dynamic.Allow))
+	if err != nil {
+		return err
+	}
+	deny, err := compileRules(mergeRules(static.Deny, dynamic.Deny))
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.static, a.dynamic = static, dynamic
+	a.allow, a.deny = allow, deny
+	return nil
+}
+
+func (a *accessControl) setStatic(acl ACL) error {
+	a.mu.RLock()
+	dynamic := a.dynamic
+	a.mu.RUnlock()
+	return a.compile(acl, dynamic)
+}
+
+func (a *accessControl) setDynamic(acl ACL) error {
+	a.mu.RLock()
+	static := a.static
+	a.mu.RUnlock()
+	return a.compile(static, acl)
+}
+
+// recordOwner remembers the owner a peer proved in its metadata, empty if it
+// proved none.
+func (a *accessControl) recordOwner(id, owner string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.owners[id] = owner
+}
+
+// allowsPeer checks a peer by ID and by the owner it proved. With owner
+// rules set, a peer whose owner is unknown or unproven is only admitted if it
+// is allowed by ID.
+func (a *accessControl) allowsPeer(id string) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	owner := a.owners[id]
+	if a.deny.matchesID(id) || a.deny.matchesOwner(owner) {
+		return false
+	}
+	if a.allow.matchesID(id) {
+		return true
+	}
+	if owner == "" && len(a.allow.owners)+len(a.deny.owners) > 0 {
+		return false
+	}
+	return !a.allow.hasPeerRules() || a.allow.matchesOwner(owner)
+}
+
+// allowsAddr checks the network a peer connects from. Addresses without an
+// IP only pass when no network is allowlisted.
+func (a *accessControl) allowsAddr(addr ma.Multiaddr) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	ip, err := manet.ToIP(addr)
+	if err != nil {
+		return len(a.allow.nets) == 0
+	}
+	if a.deny.matchesIP(ip) {
+		return false
+	}
+	return len(a.allow.nets) == 0 || a.allow.matchesIP(ip)
+}
+
+func (a *accessControl) state() ACLState {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return ACLState{Static: a.static, Dynamic: a.dynamic}
+}
+
+// aclFromViper reads the static access lists from the acl.* settings.
+func aclFromViper() ACL {
+	return ACL{
+		Allow: ACLRules{
+			Peers:  viper.GetStringSlice("acl.allow_peers"),
+			CIDRs:  viper.GetStringSlice("acl.allow_cidrs"),
+			Owners: viper.GetStringSlice("acl.allow_owners"),
+		},
+		Deny: ACLRules{
+			Peers:  viper.GetStringSlice("acl.deny_peers"),
+			CIDRs:  viper.GetStringSlice("acl.deny_cidrs"),
+			Owners: viper.GetStringSlice("acl.deny_owners"),
+		},
+	}
+}
+
+// GetACL returns the access lists in effect on the default node.
+func GetACL() ACLState {
+	return defaultNode().GetACL()
+}
+
+// GetACL returns the access lists in effect.
+func (n *Node) GetACL() ACLState {
+	state := n.acl.state()
+	state.Replicated = n.settings().ACLReplicate
+	return state
+}
+
+// SetACL replaces the runtime access lists of the default node.
+func SetACL(ctx context.Context, acl ACL) error {
+	return defaultNode().SetACL(ctx, acl)
+}
+
+// SetACL replaces the runtime access lists, purges the peers they deny and,
+// with acl.replicate set, publishes them to the other nodes.
+func (n *Node) SetACL(ctx context.Context, acl ACL) error {
+	if err := n.acl.setDynamic(acl); err != nil {
+		return err
+	}
+	n.enforceACL()
+	if !n.settings().ACLReplicate {
+		return nil
+	}
+	value, err := json.Marshal(acl)
+	if err != nil {
+		return err
+	}
+	store, err := n.storeOrStart()
+	if err != nil {
+		return err
+	}
+	sealed, err := sealEntry(n.signingKey, aclKey, value)
+	if err != nil {
+		return err
+	}
+	return store.Put(ctx, aclKey, sealed)
+}
+
+// applyReplicatedACL applies access lists received through the CRDT, if this
+// node takes part in replication. They are only trusted if signed by this node
+// or one of acl.admins.
+func (n *Node) applyReplicatedACL(value []byte) {
+	cfg := n.settings()
+	if !cfg.ACLReplicate {
+		return
+	}
+	env, signer, err := openSignedValue(aclKey, value)
+	if err != nil {
+		n.quarantineEntry(aclKey, err)
+		return
+	}
+	self := n.host != nil && signer == n.host.ID()
+	if !self && !slices.Contains(cfg.ACLAdmins, signer.String()) {
+		n.quarantineEntry(aclKey, fmt.Errorf("access list signed by %s, who is not an admin", signer))
+		return
+	}
+	if err := n.entrySeqs.admit(aclKey, env.Seq); err != nil {
+		n.quarantineEntry(aclKey, err)
+		return
+	}
+	var acl ACL
+	if err := json.Unmarshal(env.Payload, &acl); err != nil {
+		n.quarantineEntry(aclKey, err)
+		return
+	}
+	if err := n.acl.setDynamic(acl); err != nil {
+		n.quarantineEntry(aclKey, err)
+		return
+	}
+	common.Logger.Infof("Applied access list replicated by %s", signer)
+	n.enforceACL()
+}
+
+// loadReplicatedACL applies the access lists already in the store, which the
+// put hook does not replay on restart.
+func (n *Node) loadReplicatedACL(ctx context.Context) {
+	value, err := n.store.Get(ctx, aclKey)
+	if err != nil {
+		return
+	}
+	n.applyReplicatedACL(value)
+}
+
+// ownerProofMessage is what the wallet of a peer's owner signs to prove the
+// peer belongs to it.
+func ownerProofMessage(peerID string) []byte {
+	return []byte("opentela-owner:" + peerID)
+}
+
+// proveOwner signs the peer ID with the managed wallet account of owner. It
+// returns nil if this node does not hold the keys of that account.
+func proveOwner(peerID, owner string) []byte {
+	if owner == "" {
+		return nil
+	}
+	wm, err := wallet.InitializeWallet()
+	if err != nil {
+		return nil
+	}
+	proof, err := wm.Sign(owner, ownerProofMessage(peerID))
+	if err != nil {
+		common.Logger.Debugf("Cannot prove ownership by %s: %v", owner, err)
+		return nil
+	}
+	return proof
+}
+
+// provenOwner returns the owner of the peer if its proof is valid, or an
+// empty string.
+func provenOwner(p Peer) string {
+	if p.Owner == "" || !wallet.Verify(p.Owner, ownerProofMessage(p.ID), p.OwnerProof) {
+		return ""
+	}
+	return p.Owner
+}
+
+// aclAdmits reports whether an entry of the node table may be accepted. The
+// proven owner of a peer is recorded from its metadata, so that the peer is
+// purged if the owner is denied, and its services, ignored until then, are
+// applied if it is allowed.
+func (n *Node) aclAdmits(entry entryKey, value []byte) bool {
+	if entry.kind != serviceEntry {
+		var p Peer
+		if err := json.Unmarshal(value, &p); err == nil {
+			p.ID = entry.peerID
+			admitted := n.acl.allowsPeer(entry.peerID)
+			n.acl.recordOwner(entry.peerID, provenOwner(p))
+			if !admitted && n.acl.allowsPeer(entry.peerID) {
+				n.replayServices(entry.peerID)
+			}
+		}
+	}
+	if n.acl.allowsPeer(entry.peerID) {
+		return true
+	}
+	common.Logger.Debugf("Ignoring entry [%s] of denied peer", entry.peerID)
+	n.purgePeer(entry.peerID)
+	return false
+}
+
+// enforceACL purges the denied peers from the node table of the node and
+// disconnects from them.
+func (n *Node) enforceACL() {
+	for key, p := range n.table.snapshot(nil) {
+		if owner := provenOwner(p); owner != "" {
+			n.acl.recordOwner(p.ID, owner)
+		}
+		id := key[1:]
+		if !n.acl.allowsPeer(id) {
+			n.purgePeer(id)
+		}
+	}
+	if n.host == nil {
+		return
+	}
+	for _, conn := range n.host.Network().Conns() {
+		remote := conn.RemotePeer()
+		if !n.acl.allowsPeer(remote.String()) || !n.acl.allowsAddr(conn.RemoteMultiaddr()) {
+			n.purgePeer(remote.String())
+		}
+	}
+}
+
+// replayServices applies the service entries of a peer held in the store to
+// the node table.
+func (n *Node) replayServices(peerID string) {
+	if n.store == nil {
+		return
+	}
+	ctx := context.Background()
+	keys, err := peerEntryKeys(ctx, n.store, peerID)
+	if err != nil {
+		return
+	}
+	for _, key := range keys {
+		if entry, _ := parseEntryKey(key); entry.kind != serviceEntry {
+			continue
+		}
+		value, err := n.store.Get(ctx, key)
+		if err != nil {
+			continue
+		}
+		if env, ok := n.acceptEntry(key, value); ok && !env.Removed {
+			n.UpdateNodeTableHook(key, env.Payload)
+		}
+	}
+}
+
+func (n *Node) purgePeer(id string) {
+	if _, ok := n.table.remove("/" + id); ok {
+		common.Logger.Infof("Removed denied peer [%s] from the node table", id)
+	}
+	if n.host == nil {
+		return
+	}
+	if pid, err := peer.Decode(id); err == nil {
+		_ = n.host.Network().ClosePeer(pid)
+	}
+}
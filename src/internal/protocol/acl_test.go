@@ -0,0 +1,214 @@
+package protocol
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/mr-tron/base58"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+const (
+	aclPeerA = "12D3KooWJ7BrgG4dF1u9wB3XAGKTd7Lw1R6CQqp38zdc6PGBHFcM"
+	aclPeerB = "QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN"
+)
+
+func TestACLRules(t *testing.T) {
+	a := newAccessControl()
+	if err := a.setStatic(ACL{Deny: ACLRules{CIDRs: []string{"not-a-cidr"}}}); err == nil {
+		t.Fatal("expected an invalid CIDR to be rejected")
+	}
+	if err := a.setStatic(ACL{Deny: ACLRules{Peers: []string{"not-a-peer"}}}); err == nil {
+		t.Fatal("expected an invalid peer ID to be rejected")
+	}
+
+	_ = a.setStatic(ACL{Deny: ACLRules{Peers: []string{aclPeerB}, CIDRs: []string{"10.0.0.0/8"}}})
+	if a.allowsPeer(aclPeerB) || !a.allowsPeer(aclPeerA) {
+		t.Fatal("expected only the denied peer to be rejected")
+	}
+	if a.allowsAddr(ma.StringCast("/ip4/10.1.2.3/tcp/4001")) || !a.allowsAddr(ma.StringCast("/ip4/192.168.1.1/tcp/4001")) {
+		t.Fatal("expected only the denied network to be rejected")
+	}
+
+	// an allowlist admits only what it lists, and deny rules still win
+	_ = a.setDynamic(ACL{Allow: ACLRules{Peers: []string{aclPeerA, aclPeerB}, CIDRs: []string{"192.168.0.0/16"}}})
+	if !a.allowsPeer(aclPeerA) || a.allowsPeer(aclPeerB) {
+		t.Fatal("expected deny rules to win over allow rules")
+	}
+	if a.allowsAddr(ma.StringCast("/ip4/172.16.0.1/tcp/4001")) || a.allowsAddr(ma.StringCast("/dns4/example.com/tcp/4001")) {
+		t.Fatal("expected addresses outside the allowed networks to be rejected")
+	}
+}
+
+func TestACLOwners(t *testing.T) {
+	a := newAccessControl()
+	_ = a.setStatic(ACL{Allow: ACLRules{Owners: []string{"good-wallet"}, Peers: []string{aclPeerB}}})
+	if a.allowsPeer(aclPeerA) {
+		t.Fatal("expected a peer of unknown owner to be rejected")
+	}
+	if !a.allowsPeer(aclPeerB) {
+		t.Fatal("expected a peer allowed by ID to be accepted without an owner")
+	}
+	a.recordOwner(aclPeerA, "other-wallet")
+	if a.allowsPeer(aclPeerA) {
+		t.Fatal("expected a peer of another owner to be rejected")
+	}
+	a.recordOwner(aclPeerA, "good-wallet")
+	if !a.allowsPeer(aclPeerA) {
+		t.Fatal("expected a peer of an allowed owner to be accepted")
+	}
+
+	a = newAccessControl()
+	_ = a.setStatic(ACL{Deny: ACLRules{Owners: []string{"bad-wallet"}}})
+	a.recordOwner(aclPeerA, "")
+	if a.allowsPeer(aclPeerA) || a.allowsPeer(aclPeerB) {
+		t.Fatal("expected peers without a proven owner to be rejected once owners are denied")
+	}
+	a.recordOwner(aclPeerA, "good-wallet")
+	if !a.allowsPeer(aclPeerA) {
+		t.Fatal("expected a peer of another proven owner to be accepted")
+	}
+}
+
+// ownedPeer returns the metadata of peer id owned by a fresh wallet, with a
+// valid ownership proof, and the owner.
+func ownedPeer(t *testing.T, id string) (Peer, string) {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner := base58.Encode(public)
+	return Peer{ID: id, Owner: owner, OwnerProof: ed25519.Sign(private, ownerProofMessage(id))}, owner
+}
+
+func TestACLAdmitsPurgesDeniedOwners(t *testing.T) {
+	table := cleanNodeTable()
+	n := defaultNode()
+	previous := n.acl
+	n.acl = newAccessControl()
+	defer func() { n.acl = previous }()
+	rogue, owner := ownedPeer(t, aclPeerA)
+	_ = n.acl.setStatic(ACL{Deny: ACLRules{Owners: []string{owner}}})
+
+	llm := Service{Name: "llm", Port: "8080"}
+	service, _ := json.Marshal(llm)
+	entry, _ := parseEntryKey(serviceKey(aclPeerA, llm))
+	if n.aclAdmits(entry, service) {
+		t.Fatal("expected services of a peer of unknown owner to be ignored")
+	}
+	// a denied owner does not get through by leaving out its proof
+	unproven := rogue
+	unproven.OwnerProof = nil
+	value, _ := json.Marshal(unproven)
+	entry, _ = parseEntryKey(metaKey(aclPeerA))
+	if n.aclAdmits(entry, value) {
+		t.Fatal("expected the metadata of a peer without a proven owner to be rejected")
+	}
+
+	UpdateNodeTableHook(serviceKey(aclPeerA, llm), service)
+	meta, _ := json.Marshal(rogue)
+	if n.aclAdmits(entry, meta) {
+		t.Fatal("expected the metadata of a denied owner to be rejected")
+	}
+	if _, ok := table.get("/" + aclPeerA); ok {
+		t.Fatal("expected the denied peer to be purged from the table")
+	}
+	entry, _ = parseEntryKey(serviceKey(aclPeerA, llm))
+	if n.aclAdmits(entry, service) {
+		t.Fatal("expected later entries of the denied peer to be ignored")
+	}
+}
+
+func TestACLIgnoresUnprovenOwners(t *testing.T) {
+	cleanNodeTable()
+	n := defaultNode()
+	previous := n.acl
+	n.acl = newAccessControl()
+	defer func() { n.acl = previous }()
+	_, owner := ownedPeer(t, aclPeerA)
+	_ = n.acl.setStatic(ACL{Allow: ACLRules{Owners: []string{owner}}})
+
+	// a peer claiming an allowed owner without its wallet's signature
+	claimed, _ := json.Marshal(Peer{ID: aclPeerB, Owner: owner})
+	entry, _ := parseEntryKey(metaKey(aclPeerB))
+	if n.aclAdmits(entry, claimed) {
+		t.Fatal("expected an unproven owner not to match owner rules")
+	}
+	// nor with the proof of another peer
+	stolen, _ := ownedPeer(t, aclPeerA)
+	stolen.ID = aclPeerB
+	value, _ := json.Marshal(stolen)
+	if n.aclAdmits(entry, value) {
+		t.Fatal("expected a proof for another peer to be rejected")
+	}
+	proven, _ := ownedPeer(t, aclPeerA)
+	_ = n.acl.setStatic(ACL{Allow: ACLRules{Owners: []string{proven.Owner}}})
+	value, _ = json.Marshal(proven)
+	entry, _ = parseEntryKey(metaKey(aclPeerA))
+	if !n.aclAdmits(entry, value) {
+		t.Fatal("expected a proven owner to match owner rules")
+	}
+}
+
+func TestACLAppliesServicesOnceOwnerIsProven(t *testing.T) {
+	n := newNode()
+	n.store = newTestCRDTStore(t, "/test-acl-replay")
+	ctx := context.Background()
+	priv, _, _ := crypto.GenerateEd25519Key(rand.Reader)
+	pid, _ := peer.IDFromPrivateKey(priv)
+	id := pid.String()
+	owned, owner := ownedPeer(t, id)
+	_ = n.acl.setStatic(ACL{Allow: ACLRules{Owners: []string{owner}}})
+
+	// the service arrives before the metadata proving the owner
+	llm := Service{Name: "llm", Port: "8080"}
+	value, _ := json.Marshal(llm)
+	sealed, _ := sealEntry(priv, serviceKey(id, llm), value)
+	_ = n.store.Put(ctx, serviceKey(id, llm), sealed)
+	entry, _ := parseEntryKey(serviceKey(id, llm))
+	if n.aclAdmits(entry, value) {
+		t.Fatal("expected the service of a peer of unknown owner to be ignored")
+	}
+
+	meta, _ := json.Marshal(owned)
+	entry, _ = parseEntryKey(metaKey(id))
+	if !n.aclAdmits(entry, meta) {
+		t.Fatal("expected the metadata of an allowed owner to be accepted")
+	}
+	if p, err := n.GetPeerFromTable(id); err != nil || len(p.Service) != 1 {
+		t.Fatalf("expected the ignored service to be applied, got %+v (%v)", p, err)
+	}
+}
+
+func TestACLKeyIsNotAPeerEntry(t *testing.T) {
+	if _, ok := parseEntryKey(aclKey); ok {
+		t.Fatal("expected the access list key not to parse as a peer entry")
+	}
+}
+
+func TestApplyReplicatedACL(t *testing.T) {
+	n := NewNode(NodeConfig{ACLReplicate: true})
+
+	priv, admin := testSigningKey(t)
+	value, _ := json.Marshal(ACL{Deny: ACLRules{Peers: []string{aclPeerB}}})
+	sealed, _ := sealEntry(priv, aclKey, value)
+
+	n.applyReplicatedACL(sealed)
+	if !n.acl.allowsPeer(aclPeerB) {
+		t.Fatal("expected lists signed by a non-admin to be ignored")
+	}
+	n.cfg.ACLAdmins = []string{admin}
+	n.applyReplicatedACL(sealed)
+	if n.acl.allowsPeer(aclPeerB) {
+		t.Fatal("expected lists signed by an admin to be applied")
+	}
+	if got := n.GetACL().Dynamic.Deny.Peers; len(got) != 1 || got[0] != aclPeerB {
+		t.Fatalf("unexpected dynamic lists: %+v", got)
+	}
+}
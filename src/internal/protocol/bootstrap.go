@@ -6,36 +6,29 @@ import (
 	"fmt"
 	"net"
 	"opentela/internal/common"
+	"os"
 	"strings"
 
+	"github.com/mitchellh/go-homedir"
 	"github.com/multiformats/go-multiaddr"
 	"github.com/spf13/viper"
 )
 
 var lookupTXT = net.LookupTXT
 
-func getDefaultBootstrapPeers(bootstrapAddrs []string, mode string) []multiaddr.Multiaddr {
+func getDefaultBootstrapPeers(bootstrapAddrs []string, mode string, d *bootstrapDiscovery) []multiaddr.Multiaddr {
 	if mode == "standalone" {
 		common.Logger.Info("Bootstrap: []")
 		return []multiaddr.Multiaddr{}
 	}
 
-	var sources []string
-	switch {
-	case bootstrapAddrs != nil:
-		sources = append(sources, bootstrapAddrs...)
-	case mode == "local":
-		sources = []string{"/ip4/127.0.0.1/tcp/43905"}
-	default:
-		sources = collectBootstrapSources()
-	}
-
+	sources := bootstrapSources(bootstrapAddrs, mode)
 	if len(sources) == 0 {
 		common.Logger.Warn("No bootstrap sources configured")
 		return []multiaddr.Multiaddr{}
 	}
 
-	resolved := resolveBootstrapSources(sources)
+	resolved := resolveBootstrapSources(sources, d)
 	peers := parseBootstrapMultiaddrs(resolved)
 	if len(peers) == 0 {
 		common.Logger.Warn("No bootstrap addresses discovered from configured sources")
@@ -46,6 +39,22 @@ func getDefaultBootstrapPeers(bootstrapAddrs []string, mode string) []multiaddr.
 	return peers
 }
 
+// bootstrapSources returns the sources bootstraps are resolved from: the
+// explicit addresses if any, the local node in local mode, and the configured
+// sources otherwise.
+func bootstrapSources(bootstrapAddrs []string, mode string) []string {
+	switch {
+	case mode == "standalone":
+		return nil
+	case bootstrapAddrs != nil:
+		return append([]string(nil), bootstrapAddrs...)
+	case mode == "local":
+		return []string{"/ip4/127.0.0.1/tcp/43905"}
+	default:
+		return collectBootstrapSources()
+	}
+}
+
 func collectBootstrapSources() []string {
 	var combined []string
 	appendAll := func(values []string) {
@@ -68,10 +77,10 @@ func collectBootstrapSources() []string {
 	return combined
 }
 
-func resolveBootstrapSources(sources []string) []string {
+func resolveBootstrapSources(sources []string, d *bootstrapDiscovery) []string {
 	var resolved []string
 	for _, source := range sources {
-		entries, err := resolveBootstrapSource(strings.TrimSpace(source))
+		entries, err := resolveBootstrapSource(strings.TrimSpace(source), d)
 		if err != nil {
 			common.Logger.With("source", source).Warnf("Bootstrap source failed: %v", err)
 			continue
@@ -85,7 +94,13 @@ func resolveBootstrapSources(sources []string) []string {
 	return common.DeduplicateStrings(resolved)
 }
 
-func resolveBootstrapSource(source string) ([]string, error) {
+// resolveBootstrapSource returns the bootstrap addresses of a source: an
+// HTTP(S) URL serving a JSON list, dnsaddr://<host>, file://<path> of a list
+// maintained locally, mdns:// for peers on the local network,
+// rendezvous://<namespace> for bootstraps advertising the namespace in the
+// DHT, or literal multiaddrs. The last two schemes need the discovery of a
+// running node.
+func resolveBootstrapSource(source string, d *bootstrapDiscovery) ([]string, error) {
 	if source == "" {
 		return nil, nil
 	}
@@ -96,11 +111,48 @@ func resolveBootstrapSource(source string) ([]string, error) {
 	case strings.HasPrefix(strings.ToLower(source), "dnsaddr://"):
 		host := source[len("dnsaddr://"):]
 		return fetchDNSAddrBootstraps(host)
+	case strings.HasPrefix(strings.ToLower(source), "file://"):
+		path, _ := cutSourcePrefix(source, "file://")
+		return readFileBootstraps(path)
+	case strings.HasPrefix(strings.ToLower(source), mdnsSourcePrefix):
+		return d.lanPeers()
+	case strings.HasPrefix(strings.ToLower(source), rendezvousSourcePrefix):
+		namespace, _ := cutSourcePrefix(source, rendezvousSourcePrefix)
+		if namespace == "" {
+			return nil, errors.New("empty rendezvous namespace")
+		}
+		return d.rendezvousPeers(namespace)
 	default:
 		return expandBootstrapValue(source), nil
 	}
 }
 
+// readFileBootstraps reads a list of bootstrap addresses from a file, either
+// a JSON list or one address per line. Text after a '#' is a comment.
+func readFileBootstraps(path string) ([]string, error) {
+	if path == "" {
+		return nil, errors.New("empty file path")
+	}
+	path, err := homedir.Expand(path)
+	if err != nil {
+		return nil, err
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	trimmed := strings.TrimSpace(string(content))
+	if strings.HasPrefix(trimmed, "[") {
+		return expandBootstrapValue(trimmed), nil
+	}
+	var addrs []string
+	for _, line := range strings.Split(trimmed, "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		addrs = append(addrs, expandBootstrapValue(line)...)
+	}
+	return addrs, nil
+}
+
 func fetchHTTPBootstraps(url string) ([]string, error) {
 	common.Logger.With("source", url).Info("Fetching bootstrap list")
 	body, err := common.RemoteGET(url)
@@ -0,0 +1,176 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"opentela/internal/common"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	dualdht "github.com/libp2p/go-libp2p-kad-dht/dual"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/discovery/mdns"
+	"github.com/multiformats/go-multihash"
+)
+
+const (
+	mdnsSourcePrefix       = "mdns://"
+	rendezvousSourcePrefix = "rendezvous://"
+	// mdnsServiceName is announced on the local network. Peers of other
+	// networks are found too, and dropped once identify tells their network.
+	mdnsServiceName = "_opentela._udp"
+	// rendezvousLookupTimeout bounds a provider lookup in the DHT
+	rendezvousLookupTimeout = 10 * time.Second
+	// rendezvousMaxPeers is the number of bootstraps a lookup returns at most
+	rendezvousMaxPeers = 20
+)
+
+var errNoDiscovery = errors.New("source needs a running node")
+
+// bootstrapDiscovery finds bootstraps through the host of the node: on the
+// local network with mDNS, and in the DHT through provider records of a
+// rendezvous namespace, under which the bootstraps advertise themselves.
+type bootstrapDiscovery struct {
+	host host.Host
+	dht  *dualdht.DHT
+	// network scopes the rendezvous namespaces
+	network string
+
+	mu   sync.Mutex
+	mdns mdns.Service
+	lan  map[peer.ID]peer.AddrInfo
+}
+
+func newBootstrapDiscovery(h host.Host, dht *dualdht.DHT, network string) *bootstrapDiscovery {
+	return &bootstrapDiscovery{host: h, dht: dht, network: network, lan: make(map[peer.ID]peer.AddrInfo)}
+}
+
+// lanPeers returns the peers found on the local network so far. mDNS is
+// started on first use, so the first resolution usually finds nobody; peers
+// are dialed as soon as they are found.
+func (d *bootstrapDiscovery) lanPeers() ([]string, error) {
+	if d == nil {
+		return nil, errNoDiscovery
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.mdns == nil {
+		d.mdns = mdns.NewMdnsService(d.host, mdnsServiceName, d)
+		if err := d.mdns.Start(); err != nil {
+			d.mdns = nil
+			return nil, err
+		}
+		common.Logger.Info("Discovering bootstraps on the local network with mDNS")
+	}
+	var addrs []string
+	for _, info := range d.lan {
+		addrs = append(addrs, p2pAddrs(info)...)
+	}
+	return addrs, nil
+}
+
+// HandlePeerFound records and dials a peer found with mDNS.
+func (d *bootstrapDiscovery) HandlePeerFound(info peer.AddrInfo) {
+	if info.ID == d.host.ID() {
+		return
+	}
+	d.mu.Lock()
+	d.lan[info.ID] = info
+	d.mu.Unlock()
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := d.host.Connect(ctx, info); err != nil {
+			common.Logger.With("peer", info.ID).Debugf("Failed to connect to peer found with mDNS: %v", err)
+		}
+	}()
+}
+
+// rendezvousKey is the DHT key bootstraps of the namespace in network
+// provide.
+func rendezvousKey(network, namespace string) (cid.Cid, error) {
+	hash, err := multihash.Sum([]byte(networkScoped(network, "opentela/rendezvous/"+namespace)), multihash.SHA2_256, -1)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return cid.NewCidV1(cid.Raw, hash), nil
+}
+
+// rendezvousPeers looks up the bootstraps advertising the namespace. The
+// node must already be in the DHT, through another source or a previous
+// lookup.
+func (d *bootstrapDiscovery) rendezvousPeers(namespace string) ([]string, error) {
+	if d == nil || d.dht == nil {
+		return nil, errNoDiscovery
+	}
+	key, err := rendezvousKey(d.network, namespace)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), rendezvousLookupTimeout)
+	defer cancel()
+	var addrs []string
+	for info := range d.dht.FindProvidersAsync(ctx, key, rendezvousMaxPeers) {
+		if info.ID == d.host.ID() {
+			continue
+		}
+		addrs = append(addrs, p2pAddrs(info)...)
+	}
+	return addrs, nil
+}
+
+// advertise provides the rendezvous namespaces of sources, so that nodes
+// looking them up find this one.
+func (d *bootstrapDiscovery) advertise(ctx context.Context, sources []string) {
+	if d == nil || d.dht == nil {
+		return
+	}
+	for _, source := range sources {
+		namespace, ok := cutSourcePrefix(source, rendezvousSourcePrefix)
+		if !ok || namespace == "" {
+			continue
+		}
+		key, err := rendezvousKey(d.network, namespace)
+		if err != nil {
+			continue
+		}
+		if err := d.dht.Provide(ctx, key, true); err != nil {
+			common.Logger.With("namespace", namespace).Debugf("Failed to advertise as bootstrap: %v", err)
+		}
+	}
+}
+
+func (d *bootstrapDiscovery) close() {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.mdns != nil {
+		_ = d.mdns.Close()
+		d.mdns = nil
+	}
+}
+
+// cutSourcePrefix strips the case-insensitive scheme prefix of a source.
+func cutSourcePrefix(source, prefix string) (string, bool) {
+	if len(source) < len(prefix) || !strings.EqualFold(source[:len(prefix)], prefix) {
+		return "", false
+	}
+	return strings.TrimSpace(source[len(prefix):]), true
+}
+
+func p2pAddrs(info peer.AddrInfo) []string {
+	addrs, err := peer.AddrInfoToP2pAddrs(&info)
+	if err != nil {
+		return nil
+	}
+	out := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		out = append(out, addr.String())
+	}
+	return out
+}
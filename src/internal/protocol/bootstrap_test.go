@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/multiformats/go-multiaddr"
@@ -14,7 +16,7 @@ const testPeerID = "12D3KooWJ7BrgG4dF1u9wB3XAGKTd7Lw1R6CQqp38zdc6PGBHFcM"
 
 func TestGetDefaultBootstrapPeersStandalone(t *testing.T) {
 	viper.Reset()
-	res := getDefaultBootstrapPeers(nil, "standalone")
+	res := getDefaultBootstrapPeers(nil, "standalone", nil)
 	if len(res) != 0 {
 		t.Fatalf("expected 0 peers, got %d", len(res))
 	}
@@ -22,7 +24,7 @@ func TestGetDefaultBootstrapPeersStandalone(t *testing.T) {
 
 func TestGetDefaultBootstrapPeersLocal(t *testing.T) {
 	viper.Reset()
-	res := getDefaultBootstrapPeers(nil, "local")
+	res := getDefaultBootstrapPeers(nil, "local", nil)
 	if len(res) != 1 {
 		t.Fatalf("expected 1 local peer, got %d", len(res))
 	}
@@ -33,7 +35,7 @@ func TestGetDefaultBootstrapPeersLocal(t *testing.T) {
 
 func TestGetDefaultBootstrapPeersExplicit(t *testing.T) {
 	viper.Reset()
-	res := getDefaultBootstrapPeers([]string{"/ip4/127.0.0.1/tcp/1234/p2p/" + testPeerID}, "any")
+	res := getDefaultBootstrapPeers([]string{"/ip4/127.0.0.1/tcp/1234/p2p/" + testPeerID}, "any", nil)
 	if len(res) != 1 {
 		t.Fatalf("expected 1 explicit peer, got %d", len(res))
 	}
@@ -48,7 +50,7 @@ func TestBootstrapSourcesHTTP(t *testing.T) {
 	defer ts.Close()
 
 	viper.Set("bootstrap.sources", []string{ts.URL})
-	res := getDefaultBootstrapPeers(nil, "node")
+	res := getDefaultBootstrapPeers(nil, "node", nil)
 	if len(res) != 1 {
 		t.Fatalf("expected 1 peer from HTTP source, got %d", len(res))
 	}
@@ -62,7 +64,7 @@ func TestBootstrapSourcesFallback(t *testing.T) {
 	defer failing.Close()
 
 	viper.Set("bootstrap.sources", []string{failing.URL, "/ip4/10.0.0.1/tcp/4001/p2p/" + testPeerID})
-	res := getDefaultBootstrapPeers(nil, "node")
+	res := getDefaultBootstrapPeers(nil, "node", nil)
 	if len(res) != 1 {
 		t.Fatalf("expected 1 fallback peer, got %d", len(res))
 	}
@@ -80,8 +82,35 @@ func TestBootstrapSourcesDNSAddr(t *testing.T) {
 	defer func() { lookupTXT = originalLookup }()
 
 	viper.Set("bootstrap.sources", []string{"dnsaddr://bootstrap.example.com"})
-	res := getDefaultBootstrapPeers(nil, "node")
+	res := getDefaultBootstrapPeers(nil, "node", nil)
 	if len(res) != 1 {
 		t.Fatalf("expected 1 peer from dnsaddr, got %d", len(res))
 	}
 }
+
+func TestBootstrapSourcesFile(t *testing.T) {
+	viper.Reset()
+	path := filepath.Join(t.TempDir(), "bootstraps")
+	list := "# heads of the cluster\n/ip4/10.0.0.3/tcp/4001/p2p/" + testPeerID + "  # head-1\n\n/ip4/10.0.0.4/tcp/4001/p2p/" + testPeerID + "\n"
+	if err := os.WriteFile(path, []byte(list), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	viper.Set("bootstrap.sources", []string{"file://" + path})
+	res := getDefaultBootstrapPeers(nil, "node", nil)
+	if len(res) != 2 {
+		t.Fatalf("expected 2 peers from the file, got %v", res)
+	}
+}
+
+func TestBootstrapSourcesNeedingANode(t *testing.T) {
+	viper.Reset()
+	for _, source := range []string{"mdns://", "rendezvous://cluster"} {
+		if _, err := resolveBootstrapSource(source, nil); err == nil {
+			t.Fatalf("expected %s to fail without a running node", source)
+		}
+	}
+	if _, err := resolveBootstrapSource("rendezvous://", nil); err == nil {
+		t.Fatal("expected an empty rendezvous namespace to be rejected")
+	}
+}
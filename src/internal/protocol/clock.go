@@ -46,7 +46,7 @@ func StartTicker() {
 						p.Connected = false
 						disconnected++
 					} else if err := host.Connect(ctx, addrInfo); err != nil {
-						common.Logger.With("err", err).Warnf("Failed to dial peer %s; marking disconnected", peer_id)
+						common.Logger.With("err", defaultNode().explainDialError(err)).Warnf("Failed to dial peer %s; marking disconnected", peer_id)
 						p.Connected = false
 						disconnected++
 					} else {
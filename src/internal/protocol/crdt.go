@@ -6,17 +6,15 @@ import (
 	"fmt"
 	"opentela/internal/common"
 	"strings"
-	"sync"
 	"time"
 
 	crdt "opentela/internal/protocol/go-ds-crdt"
 
 	ipfslite "github.com/hsanjuan/ipfs-lite"
 	ds "github.com/ipfs/go-datastore"
-	badger "github.com/ipfs/go-ds-badger"
+	dssync "github.com/ipfs/go-datastore/sync"
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
 	"github.com/libp2p/go-libp2p/core/peer"
-	"github.com/spf13/viper"
 )
 
 var (
@@ -24,143 +22,300 @@ var (
 	pubsubKey   = "ocf-crdt"
 	pubsubNet   = "ocf-crdt-net"
 )
-var ipfs *ipfslite.Peer
-var crdtStore *crdt.Datastore
-var once sync.Once
-var cancelSubscriptions context.CancelFunc
 
+// GetCRDTStore returns the CRDT store of the default node, starting the node
+// on first use, and the function cancelling the replication of the table.
 func GetCRDTStore() (*crdt.Datastore, context.CancelFunc) {
-	once.Do(func() {
-		mode := viper.GetString("mode")
-		host, dht := GetP2PNode(nil)
-		ctx := context.Background()
-		common.Logger.Info("Creating CRDT store, using dbpath: " + common.GetDBPath(host.ID().String()))
-		store, err := badger.NewDatastore(common.GetDBPath(host.ID().String()), &badger.DefaultOptions)
-		common.ReportError(err, "Error while creating datastore")
-
-		ipfs, err = ipfslite.New(ctx, store, nil, host, &dht, nil)
-		common.ReportError(err, "Error while creating ipfs lite node")
-		pubsubParams := pubsub.DefaultGossipSubParams()
-		pubsubParams.D = 128
-		pubsubParams.Dlo = 16
-		pubsubParams.Dhi = 256
-		psub, err := pubsub.NewGossipSub(ctx, host, pubsub.WithGossipSubParams(pubsubParams))
-		common.ReportError(err, "Error while creating pubsub")
-
-		topic, err := psub.Join(pubsubNet)
-		common.ReportError(err, "Error while joining pubsub topic")
-
-		netSubs, err := topic.Subscribe()
-		common.ReportError(err, "Error while subscribing to pubsub topic")
-
-		go func() {
-			for {
-				msg, err := netSubs.Next(ctx)
-				if err != nil {
-					fmt.Println(err)
-					break
-				}
-				host.ConnManager().TagPeer(msg.ReceivedFrom, "keep", 100)
-				// Update LastSeen when we receive a message from a peer
-				p, gerr := GetPeerFromTable(msg.ReceivedFrom.String())
-				if gerr != nil {
-					p = Peer{ID: msg.ReceivedFrom.String()}
-					common.Logger.Debugf("Adding peer: [%s] triggered by msg received", msg.ReceivedFrom.String())
-				} else {
-					common.Logger.Debugf("Updating peer: [%s] triggered by msg received", msg.ReceivedFrom.String())
-				}
-				p.LastSeen = time.Now().Unix()
-				p.Connected = true
-				if b, merr := json.Marshal(p); merr == nil {
-					UpdateNodeTableHook(ds.NewKey(msg.ReceivedFrom.String()), b)
-				}
-			}
-		}()
-
-		go func() {
-			for {
-				select {
-				case <-ctx.Done():
-					return
-				default:
-					if err := topic.Publish(ctx, []byte("ping")); err != nil {
-						common.Logger.Warn("Error while publishing ping: ", err)
-					}
-					time.Sleep(20 * time.Second)
-				}
-			}
-		}()
-		psubCtx, pcancel := context.WithCancel(ctx)
-		cancelSubscriptions = pcancel
-		pubsubBC, err := crdt.NewPubSubBroadcaster(psubCtx, psub, pubsubTopic)
-		common.ReportError(err, "Error while creating pubsub broadcaster")
-		opts := crdt.DefaultOptions()
-		opts.Logger = common.Logger
-		opts.RebroadcastInterval = 5 * time.Second
-		opts.PutHook = func(k ds.Key, v []byte) {
-			var peer Peer
-			err := json.Unmarshal(v, &peer)
-			common.ReportError(err, "Error while unmarshalling peer")
-			// When a new peer is added to the table it is marked as diconnected by default.
-			// Doing so allows to intercept ghost peers by the verification procedure.
-
-			// Do not update itself
-			host, _ := GetP2PNode(nil)
-			if strings.Trim(k.String(), "/") == host.ID().String() {
-				return
-			}
-			p, err := GetPeerFromTable(strings.Trim(k.String(), "/"))
+	n := defaultNode()
+	n.mustStart()
+	return n.store, n.cancel
+}
+
+// openStore opens the CRDT store of the node and starts replicating the node
+// table with the network.
+func (n *Node) openStore(ctx context.Context) error {
+	cfg := *n.cfg
+	host := n.host
+	var store ds.Batching
+	if cfg.InMemory {
+		store = dssync.MutexWrap(ds.NewMapDatastore())
+	} else {
+		dbPath := cfg.DBPath
+		if dbPath == "" {
+			dbPath = common.GetDBPath(host.ID().String())
+		}
+		common.Logger.Info("Creating CRDT store, using dbpath: " + dbPath)
+		badgerStore, err := openPersistedStore(ctx, dbPath)
+		if err != nil {
+			return fmt.Errorf("error while creating datastore: %w", err)
+		}
+		store = badgerStore
+	}
+	n.backend = store
+	n.entrySeqs.persistIn(store)
+
+	var err error
+	n.ipfs, err = ipfslite.New(ctx, store, nil, host, n.dht, nil)
+	if err != nil {
+		return fmt.Errorf("error while creating ipfs lite node: %w", err)
+	}
+	pubsubParams := pubsub.DefaultGossipSubParams()
+	pubsubParams.D = 128
+	pubsubParams.Dlo = 16
+	pubsubParams.Dhi = 256
+	psub, err := pubsub.NewGossipSub(ctx, host, pubsub.WithGossipSubParams(pubsubParams))
+	if err != nil {
+		return fmt.Errorf("error while creating pubsub: %w", err)
+	}
+
+	topic, err := psub.Join(networkScoped(cfg.NetworkID, pubsubNet))
+	if err != nil {
+		return fmt.Errorf("error while joining pubsub topic: %w", err)
+	}
+
+	netSubs, err := topic.Subscribe()
+	if err != nil {
+		return fmt.Errorf("error while subscribing to pubsub topic: %w", err)
+	}
+
+	go func() {
+		for {
+			msg, err := netSubs.Next(ctx)
 			if err != nil {
-				peer.Connected = false
-				common.Logger.Debugf("Adding peer: [%s] triggered by p2p hook", strings.Trim(k.String(), "/"))
-			} else {
-				peer.Connected = p.Connected
-				common.Logger.Debugf("Updating peer: [%s] triggered by p2p hook", strings.Trim(k.String(), "/"))
+				fmt.Println(err)
+				break
 			}
-			value, err := json.Marshal(peer)
-			if err == nil {
-				UpdateNodeTableHook(k, value)
+			host.ConnManager().TagPeer(msg.ReceivedFrom, "keep", 100)
+			// Update LastSeen when we receive a message from a peer
+			p, gerr := n.GetPeerFromTable(msg.ReceivedFrom.String())
+			if gerr != nil {
+				p = Peer{ID: msg.ReceivedFrom.String()}
+				common.Logger.Debugf("Adding peer: [%s] triggered by msg received", msg.ReceivedFrom.String())
 			} else {
-				common.Logger.Error("Error while marshalling peer", err)
+				common.Logger.Debugf("Updating peer: [%s] triggered by msg received", msg.ReceivedFrom.String())
+			}
+			p.LastSeen = time.Now().Unix()
+			p.Connected = true
+			if b, merr := json.Marshal(p); merr == nil {
+				n.UpdateNodeTableHook(ds.NewKey(msg.ReceivedFrom.String()), b)
 			}
 		}
-		opts.DeleteHook = func(k ds.Key) {
-			common.Logger.Debugf("Removed: [%s] triggered by p2p hook", strings.Trim(k.String(), "/"))
-			DeleteNodeTableHook(k)
+	}()
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+				if err := topic.Publish(ctx, []byte("ping")); err != nil {
+					common.Logger.Warn("Error while publishing ping: ", err)
+				}
+				time.Sleep(20 * time.Second)
+			}
 		}
+	}()
+	psubCtx, pcancel := context.WithCancel(ctx)
+	n.cancel = pcancel
+	pubsubBC, err := crdt.NewPubSubBroadcaster(psubCtx, psub, networkScoped(cfg.NetworkID, pubsubTopic))
+	if err != nil {
+		return fmt.Errorf("error while creating pubsub broadcaster: %w", err)
+	}
+	opts := crdt.DefaultOptions()
+	opts.Logger = common.Logger
+	opts.RebroadcastInterval = 5 * time.Second
+	opts.PutHook = n.putHook
+	opts.DeleteHook = n.deleteHook
+	opts.SnapshotInterval = cfg.SnapshotInterval
+	if cfg.SnapshotMinHeight > 0 {
+		opts.SnapshotMinHeight = cfg.SnapshotMinHeight
+	}
+	opts.SnapshotPrune = cfg.SnapshotPrune
+	opts.SnapshotPruneGate = n.peersReadSnapshots
 
-		crdtStore, err = crdt.New(store, ds.NewKey(pubsubKey), ipfs, pubsubBC, opts)
-		common.ReportError(err, "Error while creating crdt store")
-		addsInfo, err := peer.AddrInfosFromP2pAddrs(getDefaultBootstrapPeers(nil, mode)...)
-		common.ReportError(err, "Error while getting bootstrap peers")
-		ipfs.Bootstrap(addsInfo)
-		common.ReportError(err, "Error while starting ticker")
-		// h.ConnManager().TagPeer(inf.ID, "keep", 100)
-		common.Logger.Info("Mode: ", mode)
-		common.Logger.Info("Peer ID: ", host.ID().String())
-		common.Logger.Info("Listen Addr: ", host.Addrs())
-
-		startTombstoneCompactor(crdtStore)
-	})
-	return crdtStore, cancelSubscriptions
+	n.signingKey = host.Peerstore().PrivKey(host.ID())
+	n.store, err = crdt.New(store, ds.NewKey(networkScoped(cfg.NetworkID, pubsubKey)), n.ipfs, pubsubBC, opts)
+	if err != nil {
+		return fmt.Errorf("error while creating crdt store: %w", err)
+	}
+	if _, err := n.store.MigrateKeys(ctx, legacyEntryMigration(host.ID().String(), n.signingKey)); err != nil {
+		common.Logger.Error("Error while migrating node table keys: ", err)
+	}
+	n.loadReplicatedACL(ctx)
+	if err := n.restoreTable(ctx); err != nil {
+		common.Logger.Error("Error while restoring the persisted node table: ", err)
+	}
+	n.bootstrapIPFS()
+	common.Logger.Info("Mode: ", cfg.Mode)
+	common.Logger.Info("Peer ID: ", host.ID().String())
+	common.Logger.Info("Listen Addr: ", host.Addrs())
+
+	// compaction is process-wide and follows the default node
+	if n == theDefaultNode {
+		startTombstoneCompactor(n.store)
+	}
+	return nil
 }
 
+// putHook applies entries received from the network to the node table.
+func (n *Node) putHook(k ds.Key, v []byte) {
+	if k == aclKey {
+		n.applyReplicatedACL(v)
+		return
+	}
+	entry, ok := parseEntryKey(k)
+	if !ok {
+		common.Logger.Debugf("Ignoring unknown key: [%s] triggered by p2p hook", k)
+		return
+	}
+	// Do not update itself
+	if entry.peerID == n.host.ID().String() {
+		return
+	}
+	// only the peer owning the key may write it
+	env, ok := n.acceptEntry(k, v)
+	if !ok {
+		return
+	}
+	if env.Removed {
+		common.Logger.Debugf("Removed: [%s] by its owner", strings.Trim(k.String(), "/"))
+		n.DeleteNodeTableHook(k)
+		n.protectRoutingTarget(entry.peerID)
+		return
+	}
+	v = env.Payload
+	if !n.aclAdmits(entry, v) {
+		return
+	}
+	if entry.kind == serviceEntry {
+		common.Logger.Debugf("Updating service [%s] of peer: [%s] triggered by p2p hook", entry.service, entry.peerID)
+		n.UpdateNodeTableHook(k, v)
+		return
+	}
+	var peer Peer
+	err := json.Unmarshal(v, &peer)
+	common.ReportError(err, "Error while unmarshalling peer")
+	// When a new peer is added to the table it is marked as diconnected by default.
+	// Doing so allows to intercept ghost peers by the verification procedure.
+	p, err := n.GetPeerFromTable(entry.peerID)
+	if connected, ok := n.legacyRemoved.LoadAndDelete(entry.peerID); ok {
+		peer.Connected = connected.(bool)
+		common.Logger.Debugf("Migrating peer: [%s] triggered by p2p hook", entry.peerID)
+	} else if err != nil {
+		peer.Connected = false
+		common.Logger.Debugf("Adding peer: [%s] triggered by p2p hook", entry.peerID)
+	} else {
+		peer.Connected = p.Connected
+		common.Logger.Debugf("Updating peer: [%s] triggered by p2p hook", entry.peerID)
+	}
+	value, err := json.Marshal(peer)
+	if err == nil {
+		n.UpdateNodeTableHook(k, value)
+		n.protectRoutingTarget(entry.peerID)
+	} else {
+		common.Logger.Error("Error while marshalling peer", err)
+	}
+}
+
+func (n *Node) deleteHook(k ds.Key) {
+	if k == aclKey {
+		// deletes are not signed; admins clear the list by replacing it
+		common.Logger.Warn("Ignoring deletion of the replicated access list")
+		return
+	}
+	entry, ok := parseEntryKey(k)
+	if ok && !n.deletionAllowed(entry) {
+		common.Logger.Debugf("Ignoring unsigned deletion of [%s]", strings.Trim(k.String(), "/"))
+		return
+	}
+	if ok && entry.kind == legacyEntry {
+		if n.hasEntries(entry.peerID) {
+			common.Logger.Debugf("Ignoring deletion of the migrated legacy entry of [%s]", entry.peerID)
+			return
+		}
+		// A peer migrating its legacy entry removes it in the same delta as
+		// it adds the new keys, and tombstones are merged first: the meta
+		// entry re-adds the peer right after.
+		if p, err := n.GetPeerFromTable(entry.peerID); err == nil {
+			n.legacyRemoved.Store(entry.peerID, p.Connected)
+		}
+	}
+	common.Logger.Debugf("Removed: [%s] triggered by p2p hook", strings.Trim(k.String(), "/"))
+	n.DeleteNodeTableHook(k)
+	if ok {
+		n.protectRoutingTarget(entry.peerID)
+	}
+}
+
+// hasEntries reports whether the CRDT holds meta or service entries of the
+// peer.
+func (n *Node) hasEntries(peerID string) bool {
+	if n.store == nil {
+		return false
+	}
+	keys, err := peerEntryKeys(context.Background(), n.store, peerID)
+	if err != nil {
+		return false
+	}
+	for _, key := range keys {
+		if entry, _ := parseEntryKey(key); entry.kind != legacyEntry {
+			return true
+		}
+	}
+	return false
+}
+
+// deletionAllowed reports whether a CRDT deletion of the entry may be applied
+// to the node table. Deletions are not signed, so any peer could issue them;
+// peers remove their own entries with signed removals instead. Deletions are
+// only applied to peers that left, whose entries the tombstone manager cleans
+// up, or when unsigned entries are accepted anyway.
+func (n *Node) deletionAllowed(entry entryKey) bool {
+	if !n.requireSignatures() {
+		return true
+	}
+	if entry.peerID == n.host.ID().String() {
+		return false
+	}
+	p, err := n.GetPeerFromTable(entry.peerID)
+	return err != nil || p.Status == LEFT
+}
+
+func (n *Node) bootstrapIPFS() {
+	addsInfo, err := peer.AddrInfosFromP2pAddrs(n.bootstrapPeers()...)
+	common.ReportError(err, "Error while getting bootstrap peers")
+	for _, info := range addsInfo {
+		n.host.ConnManager().Protect(info.ID, connTagBootstrap)
+	}
+	n.ipfs.Bootstrap(addsInfo)
+}
+
+// Reconnect bootstraps the default node again.
 func Reconnect() {
-	mode := viper.GetString("mode")
-	if ipfs == nil {
+	defaultNode().Reconnect()
+}
+
+// Reconnect connects the node to its bootstrap peers again.
+func (n *Node) Reconnect() {
+	if n.ipfs == nil {
 		common.Logger.Warn("Reconnect requested but CRDT/IPFS not initialized yet; skipping")
 		return
 	}
-	addsInfo, err := peer.AddrInfosFromP2pAddrs(getDefaultBootstrapPeers(nil, mode)...)
-	common.ReportError(err, "Error while getting bootstrap peers")
-	ipfs.Bootstrap(addsInfo)
+	n.bootstrapIPFS()
 }
 
+// ClearCRDTStore removes the database of the default node.
 func ClearCRDTStore() {
-	// remove ~/.ocfcore directory
-	host, _ := GetP2PNode(nil)
-	err := common.RemoveDir(common.GetDBPath(host.ID().String()))
+	n := defaultNode()
+	host, err := n.hostOrStart()
 	if err != nil {
+		return
+	}
+	dbPath := n.cfg.DBPath
+	if dbPath == "" {
+		dbPath = common.GetDBPath(host.ID().String())
+	}
+	if err := common.RemoveDir(dbPath); err != nil {
 		common.Logger.Error("Error while removing directory: ", err)
 	}
 }
@@ -0,0 +1,149 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"io"
+	"opentela/internal/common"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// ErrRepairRunning is returned when a repair is requested while one runs.
+var ErrRepairRunning = errors.New("a DAG repair is already running")
+
+// CRDTStats is the state of the CRDT store of a node: the heads of its DAG,
+// the jobs processing incoming DAG nodes, and whether it needs repair.
+type CRDTStats struct {
+	Heads      []string `json:"heads"`
+	MaxHeight  uint64   `json:"max_height"`
+	QueuedJobs int      `json:"queued_jobs"`
+	// Dirty is set when processing a DAG node failed; the store repairs
+	// itself periodically until it is clean again
+	Dirty bool `json:"dirty"`
+	// Repairing is set while a repair requested with RepairCRDT runs
+	Repairing bool `json:"repairing"`
+	// Snapshot is the latest snapshot of the table the node took or
+	// received, and SnapshotHeight its height in the DAG
+	Snapshot       string `json:"snapshot,omitempty"`
+	SnapshotHeight uint64 `json:"snapshot_height,omitempty"`
+}
+
+// CRDTStats returns the state of the CRDT store of the node.
+func (n *Node) CRDTStats(ctx context.Context) (CRDTStats, error) {
+	store, err := n.storeOrStart()
+	if err != nil {
+		return CRDTStats{}, err
+	}
+	internal := store.InternalStats(ctx)
+	stats := CRDTStats{
+		Heads:      make([]string, 0, len(internal.Heads)),
+		MaxHeight:  internal.MaxHeight,
+		QueuedJobs: internal.QueuedJobs,
+		Dirty:      store.IsDirty(ctx),
+		Repairing:  n.repairing.Load(),
+	}
+	for _, head := range internal.Heads {
+		stats.Heads = append(stats.Heads, head.String())
+	}
+	if internal.Snapshot.Defined() {
+		stats.Snapshot = internal.Snapshot.String()
+		stats.SnapshotHeight = internal.SnapshotHeight
+	}
+	return stats, nil
+}
+
+// WriteDAG writes the DAG of the CRDT store of the node to w as a Graphviz
+// DOT graph.
+func (n *Node) WriteDAG(ctx context.Context, w io.Writer) error {
+	store, err := n.storeOrStart()
+	if err != nil {
+		return err
+	}
+	return store.DotDAG(ctx, w)
+}
+
+// RepairCRDT starts walking the whole DAG of the node again from its heads,
+// processing the branches that were missed, and marks the store clean once
+// done. The repair runs in the background, as it can take long on large
+// DAGs; ErrRepairRunning is returned if one is already running.
+func (n *Node) RepairCRDT() error {
+	store, err := n.storeOrStart()
+	if err != nil {
+		return err
+	}
+	if !n.repairing.CompareAndSwap(false, true) {
+		return ErrRepairRunning
+	}
+	go func() {
+		defer n.repairing.Store(false)
+		if err := store.Repair(store.Context()); err != nil {
+			common.Logger.Errorf("DAG repair failed: %v", err)
+		}
+	}()
+	return nil
+}
+
+// SnapshotCRDT takes a snapshot of the table at the current heads of the DAG
+// and broadcasts it, so that nodes joining later start from it rather than
+// from the first entries. crdt.ErrSnapshotBusy is returned while DAG nodes
+// are being processed.
+func (n *Node) SnapshotCRDT(ctx context.Context) (string, error) {
+	store, err := n.storeOrStart()
+	if err != nil {
+		return "", err
+	}
+	c, err := store.Snapshot(ctx)
+	if err != nil {
+		return "", err
+	}
+	return c.String(), nil
+}
+
+// CompactionResult is what a compaction removed.
+type CompactionResult struct {
+	// LeftPeers are the peers removed from the table after they left
+	LeftPeers int `json:"left_peers"`
+	// Tombstones are the CRDT tombstones removed from the store
+	Tombstones int `json:"tombstones"`
+}
+
+// CompactCRDT runs a compaction now rather than at the next compaction
+// interval: LEFT peers past the retention period are removed, then up to
+// limit tombstones older than olderThan. Zero values use the
+// crdt.tombstone_retention and crdt.tombstone_compaction_batch settings.
+func (n *Node) CompactCRDT(ctx context.Context, olderThan time.Duration, limit int) (CompactionResult, error) {
+	store, err := n.storeOrStart()
+	if err != nil {
+		return CompactionResult{}, err
+	}
+	if olderThan <= 0 {
+		olderThan = readDurationSetting("crdt.tombstone_retention", defaultTombstoneRetention)
+	}
+	if limit <= 0 {
+		if limit = viper.GetInt("crdt.tombstone_compaction_batch"); limit <= 0 {
+			limit = defaultTombstoneCompactionBatch
+		}
+	}
+	var result CompactionResult
+	if result.LeftPeers, err = n.tombstones(olderThan).CleanupLeftNodes(ctx); err != nil {
+		return result, err
+	}
+	result.Tombstones, err = store.CompactTombstones(ctx, olderThan, limit)
+	return result, err
+}
+
+// PendingTombstones lists the LEFT peers the next compaction removes once
+// they are past the retention period.
+func (n *Node) PendingTombstones() ([]PendingTombstone, error) {
+	if _, err := n.storeOrStart(); err != nil {
+		return nil, err
+	}
+	retention := readDurationSetting("crdt.tombstone_retention", defaultTombstoneRetention)
+	return n.tombstones(retention).Pending(), nil
+}
+
+func (n *Node) tombstones(retention time.Duration) *TombstoneManager {
+	return &TombstoneManager{store: n.store, retention: retention, node: n}
+}
@@ -0,0 +1,157 @@
+package protocol
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	crdt "opentela/internal/protocol/go-ds-crdt"
+
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	dssync "github.com/ipfs/go-datastore/sync"
+	pb "github.com/ipfs/go-ds-crdt/pb"
+	"google.golang.org/protobuf/proto"
+)
+
+// headsBroadcaster hands the heads announced by the test to a replica.
+type headsBroadcaster chan []byte
+
+func (b headsBroadcaster) Broadcast(ctx context.Context, data []byte) error { return nil }
+
+func (b headsBroadcaster) Next(ctx context.Context) ([]byte, error) {
+	select {
+	case data := <-b:
+		return data, nil
+	case <-ctx.Done():
+		return nil, crdt.ErrNoMoreBroadcast
+	}
+}
+
+func (b headsBroadcaster) announce(t *testing.T, heads []cid.Cid) {
+	t.Helper()
+	msg := &pb.CRDTBroadcast{}
+	for _, h := range heads {
+		msg.Heads = append(msg.Heads, &pb.Head{Cid: h.Bytes()})
+	}
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b <- data
+}
+
+func TestCRDTSnapshotBootstrapsNewReplica(t *testing.T) {
+	ctx := context.Background()
+	dag := NewMockDAGService()
+	opts := crdt.DefaultOptions()
+	// small blocks, so that the snapshot is split into parts
+	opts.MaxBatchDeltaSize = 256
+	namespace := ds.NewKey("/snapshot")
+
+	first, err := crdt.New(dssync.MutexWrap(ds.NewMapDatastore()), namespace, dag, nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	key := func(i int) ds.Key { return ds.NewKey(fmt.Sprintf("/peer-%d", i)) }
+	for i := 0; i < 20; i++ {
+		if err := first.Put(ctx, key(i), []byte(fmt.Sprintf("v%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldest := first.InternalStats(ctx).Heads[0]
+	if err := first.Put(ctx, key(3), []byte("updated")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := first.Delete(ctx, key(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	snapshot, err := first.Snapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := first.InternalStats(ctx)
+	if len(stats.Heads) != 1 || stats.Heads[0] != snapshot || stats.Snapshot != snapshot {
+		t.Fatalf("expected the snapshot to replace the heads, got %v", stats)
+	}
+	if err := first.Put(ctx, key(20), []byte("v20")); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := first.PruneSnapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 20 additions, an update and 5 deletions
+	if removed != 26 {
+		t.Fatalf("expected the 26 blocks below the snapshot to be pruned, removed %d", removed)
+	}
+	if _, err := dag.Get(ctx, oldest); err == nil {
+		t.Fatal("expected the oldest block to be pruned")
+	}
+	// the values of the pruned elements are kept
+	if err := first.Put(ctx, key(6), []byte("v6-bis")); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.Repair(ctx); err != nil {
+		t.Fatalf("expected the repair to stop at pruned blocks: %v", err)
+	}
+
+	// a new replica only walks down to the snapshot
+	bcast := make(headsBroadcaster, 1)
+	second, err := crdt.New(dssync.MutexWrap(ds.NewMapDatastore()), namespace, dag, bcast, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	bcast.announce(t, first.InternalStats(ctx).Heads)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if v, err := second.Get(ctx, key(6)); err == nil && string(v) == "v6-bis" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the new replica to sync")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	want := map[string]string{"/peer-3": "", "/peer-5": "v5", "/peer-19": "v19", "/peer-20": "v20"}
+	for k, v := range want {
+		got, err := second.Get(ctx, ds.NewKey(k))
+		if v == "" {
+			if err != ds.ErrNotFound {
+				t.Fatalf("expected %s to be deleted, got %q", k, got)
+			}
+			continue
+		}
+		if err != nil || string(got) != v {
+			t.Fatalf("expected %s=%s, got %q (%v)", k, v, got, err)
+		}
+	}
+	results, err := second.Query(ctx, query.Query{KeysOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := results.Rest()
+	if len(entries) != 16 {
+		t.Fatalf("expected 16 keys, got %d", len(entries))
+	}
+	if second.IsDirty(ctx) {
+		t.Fatal("expected the new replica not to have needed the pruned blocks")
+	}
+
+	// elements from the snapshot keep the id of the block adding them
+	if err := second.Delete(ctx, key(5)); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := second.Has(ctx, key(5)); ok {
+		t.Fatal("expected the element from the snapshot to be deleted")
+	}
+}
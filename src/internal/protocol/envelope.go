@@ -0,0 +1,297 @@
+package protocol
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"opentela/internal/common"
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	// envelopeVersion 2 adds the sequence number and the removal flag to the
+	// signed bytes. Version 1 envelopes are still verified, with sequence 0.
+	envelopeVersion = 2
+	// quarantined entries kept for inspection
+	quarantineSize = 256
+)
+
+var (
+	errUnsignedEntry = errors.New("entry is not signed")
+	errNoSigningKey  = errors.New("no key to sign node table entries")
+)
+
+// signedEntry wraps a node table value. The signature covers the CRDT key,
+// the sequence number and the removal flag as well as the payload, so a
+// signed value can neither be replayed under another key nor in place of a
+// newer one.
+type signedEntry struct {
+	Version int `json:"envelope"`
+	// Seq increases with every value the signer writes, see nextEntrySeq.
+	Seq uint64 `json:"seq,omitempty"`
+	// Removed marks the key as deleted by its owner. CRDT deletions are not
+	// signed, so peers remove their entries by writing a signed removal.
+	Removed   bool   `json:"removed,omitempty"`
+	Payload   []byte `json:"payload"`
+	PublicKey []byte `json:"public_key"`
+	Signature []byte `json:"signature"`
+}
+
+func (env signedEntry) signedBytes(key ds.Key) []byte {
+	out := make([]byte, 0, len(key.String())+11+len(env.Payload))
+	out = append(out, key.String()...)
+	out = append(out, 0)
+	if env.Version >= 2 {
+		out = binary.BigEndian.AppendUint64(out, env.Seq)
+		if env.Removed {
+			out = append(out, 1)
+		} else {
+			out = append(out, 0)
+		}
+		out = append(out, 0)
+	}
+	return append(out, env.Payload...)
+}
+
+var (
+	entrySeqMu sync.Mutex
+	entrySeq   uint64
+)
+
+// nextEntrySeq returns the sequence number of the next value written by this
+// process. It follows the clock so that it keeps increasing across restarts.
+func nextEntrySeq() uint64 {
+	entrySeqMu.Lock()
+	defer entrySeqMu.Unlock()
+	entrySeq = max(entrySeq+1, uint64(time.Now().UnixNano()))
+	return entrySeq
+}
+
+// sealEntry signs value for key with priv.
+func sealEntry(priv crypto.PrivKey, key ds.Key, value []byte) ([]byte, error) {
+	return seal(priv, key, signedEntry{Payload: value})
+}
+
+// sealRemoval signs the removal of key with priv.
+func sealRemoval(priv crypto.PrivKey, key ds.Key) ([]byte, error) {
+	return seal(priv, key, signedEntry{Removed: true})
+}
+
+func seal(priv crypto.PrivKey, key ds.Key, env signedEntry) ([]byte, error) {
+	if priv == nil {
+		return nil, errNoSigningKey
+	}
+	pub, err := crypto.MarshalPublicKey(priv.GetPublic())
+	if err != nil {
+		return nil, err
+	}
+	env.Version = envelopeVersion
+	env.Seq = nextEntrySeq()
+	env.PublicKey = pub
+	if env.Signature, err = priv.Sign(env.signedBytes(key)); err != nil {
+		return nil, err
+	}
+	return json.Marshal(env)
+}
+
+// decodeEnvelope returns the envelope of value, or false if value is a plain,
+// unsigned entry as written by older releases.
+func decodeEnvelope(value []byte) (signedEntry, bool) {
+	var env signedEntry
+	if err := json.Unmarshal(value, &env); err != nil || env.Version == 0 {
+		return signedEntry{}, false
+	}
+	return env, true
+}
+
+// openEntry verifies the signature of a node table value and returns its
+// envelope. The signer must be the peer the key belongs to. Unsigned entries
+// are returned as the payload of an empty envelope with errUnsignedEntry, so
+// that callers can decide whether to accept them.
+func openEntry(key ds.Key, value []byte) (signedEntry, error) {
+	entry, ok := parseEntryKey(key)
+	if !ok {
+		return signedEntry{}, fmt.Errorf("unknown key %s", key)
+	}
+	env, signer, err := openSignedValue(key, value)
+	if err != nil {
+		return env, err
+	}
+	if signer.String() != entry.peerID {
+		return signedEntry{}, fmt.Errorf("entry for %s signed by %s", entry.peerID, signer)
+	}
+	return env, nil
+}
+
+// openSignedValue verifies the signature of value for key and returns its
+// envelope and signer, whoever that is.
+func openSignedValue(key ds.Key, value []byte) (signedEntry, peer.ID, error) {
+	env, ok := decodeEnvelope(value)
+	if !ok {
+		return signedEntry{Payload: value}, "", errUnsignedEntry
+	}
+	pub, err := crypto.UnmarshalPublicKey(env.PublicKey)
+	if err != nil {
+		return signedEntry{}, "", fmt.Errorf("invalid public key: %w", err)
+	}
+	signer, err := peer.IDFromPublicKey(pub)
+	if err != nil {
+		return signedEntry{}, "", fmt.Errorf("invalid public key: %w", err)
+	}
+	valid, err := pub.Verify(env.signedBytes(key), env.Signature)
+	if err != nil || !valid {
+		return signedEntry{}, "", fmt.Errorf("invalid signature from %s", signer)
+	}
+	return env, signer, nil
+}
+
+// requireSignatures reports whether unsigned entries are rejected. They are
+// unless AllowUnsigned is set, from security.require_signatures turned off,
+// which is only meant to keep networks with nodes predating signed entries
+// working while they are upgraded.
+func (n *Node) requireSignatures() bool {
+	return !n.settings().AllowUnsigned
+}
+
+// acceptEntry opens a value received from the network. Entries that fail
+// verification, that are older than the value already accepted for their key,
+// and unsigned entries unless signatures are not required, are quarantined
+// and false is returned.
+func (n *Node) acceptEntry(key ds.Key, value []byte) (signedEntry, bool) {
+	env, err := openEntry(key, value)
+	switch {
+	case err == nil:
+		err = n.entrySeqs.admit(key, env.Seq)
+	case errors.Is(err, errUnsignedEntry) && !n.requireSignatures():
+		return env, true
+	}
+	if err != nil {
+		n.quarantineEntry(key, err)
+		return signedEntry{}, false
+	}
+	return env, true
+}
+
+// entrySeqPrefix is where the sequence numbers of accepted entries are kept
+// in the backend of the store, next to but outside of the replicated keys.
+var entrySeqPrefix = ds.NewKey("/entry-seqs")
+
+// seqTracker remembers the sequence number of the last value accepted for
+// every key, so that older signed values cannot be replayed. Once the store
+// is opened they are persisted in its backend, so that they survive restarts
+// and bootstraps from a snapshot.
+type seqTracker struct {
+	mu    sync.Mutex
+	last  map[ds.Key]uint64
+	store ds.Datastore
+}
+
+// persistIn makes the tracker read and write the sequence numbers in store.
+func (t *seqTracker) persistIn(store ds.Datastore) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.store = store
+}
+
+// lastSeq returns the sequence number of the last value accepted for key.
+func (t *seqTracker) lastSeq(key ds.Key) uint64 {
+	if seq, ok := t.last[key]; ok || t.store == nil {
+		return seq
+	}
+	value, err := t.store.Get(context.Background(), entrySeqPrefix.Child(key))
+	if err != nil || len(value) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(value)
+}
+
+// admit records seq for key, or fails if a newer value was accepted already.
+// The same value may be seen several times, e.g. on restart.
+func (t *seqTracker) admit(key ds.Key, seq uint64) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	last := t.lastSeq(key)
+	if seq < last {
+		return fmt.Errorf("replayed entry: sequence %d is older than %d", seq, last)
+	}
+	if t.last == nil {
+		t.last = make(map[ds.Key]uint64)
+	}
+	t.last[key] = seq
+	if t.store != nil && seq != last {
+		if err := t.store.Put(context.Background(), entrySeqPrefix.Child(key), binary.BigEndian.AppendUint64(nil, seq)); err != nil {
+			common.Logger.Warnf("Error while persisting the sequence number of [%s]: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// isRemoval reports whether value is a signed removal marker, without
+// verifying it.
+func isRemoval(value []byte) bool {
+	env, ok := decodeEnvelope(value)
+	return ok && env.Removed
+}
+
+// payloadOf returns the payload of value without verifying it. It is only
+// meant for reading entries this node wrote itself.
+func payloadOf(value []byte) []byte {
+	if env, ok := decodeEnvelope(value); ok {
+		return env.Payload
+	}
+	return value
+}
+
+// QuarantinedEntry is a node table entry that was rejected because it was not
+// signed by the peer it belongs to.
+type QuarantinedEntry struct {
+	Key    string `json:"key"`
+	Reason string `json:"reason"`
+	Time   int64  `json:"time"`
+}
+
+// quarantineLog keeps the most recently rejected entries of a node.
+type quarantineLog struct {
+	mu      sync.Mutex
+	entries []QuarantinedEntry
+}
+
+func (q *quarantineLog) add(entry QuarantinedEntry) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.entries) >= quarantineSize {
+		q.entries = q.entries[1:]
+	}
+	q.entries = append(q.entries, entry)
+}
+
+func (q *quarantineLog) list() []QuarantinedEntry {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	out := make([]QuarantinedEntry, len(q.entries))
+	copy(out, q.entries)
+	return out
+}
+
+func (n *Node) quarantineEntry(key ds.Key, reason error) {
+	common.Logger.Warnf("Rejected node table entry [%s]: %v", key, reason)
+	n.quarantine.add(QuarantinedEntry{Key: key.String(), Reason: reason.Error(), Time: time.Now().Unix()})
+}
+
+// QuarantinedEntries returns the entries most recently rejected by the
+// default node, oldest first.
+func QuarantinedEntries() []QuarantinedEntry {
+	return defaultNode().QuarantinedEntries()
+}
+
+// QuarantinedEntries returns the most recently rejected entries, oldest first.
+func (n *Node) QuarantinedEntries() []QuarantinedEntry {
+	return n.quarantine.list()
+}
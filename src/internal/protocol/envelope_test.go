@@ -0,0 +1,165 @@
+package protocol
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestSealAndOpenEntry(t *testing.T) {
+	priv, self := testSigningKey(t)
+	key := metaKey(self)
+	value := []byte(`{"id":"` + self + `"}`)
+
+	sealed, err := sealEntry(priv, key, value)
+	if err != nil {
+		t.Fatalf("sealEntry failed: %v", err)
+	}
+	opened, err := openEntry(key, sealed)
+	if err != nil || string(opened.Payload) != string(value) {
+		t.Fatalf("expected the payload back, got %q (%v)", opened.Payload, err)
+	}
+
+	// a valid signature replayed under another key of the same peer
+	if _, err := openEntry(serviceKey(self, Service{Name: "llm", Port: "1"}), sealed); err == nil {
+		t.Fatal("expected a signature bound to another key to be rejected")
+	}
+
+	// a tampered payload
+	var env signedEntry
+	_ = json.Unmarshal(sealed, &env)
+	env.Payload = []byte(`{"id":"` + self + `","owner":"attacker"}`)
+	tampered, _ := json.Marshal(env)
+	if _, err := openEntry(key, tampered); err == nil {
+		t.Fatal("expected a tampered payload to be rejected")
+	}
+}
+
+func TestOpenEntryRejectsImpersonation(t *testing.T) {
+	attacker, _ := testSigningKey(t)
+	_, victim := testSigningKey(t)
+	key := serviceKey(victim, Service{Name: "llm", Port: "8080"})
+	sealed, _ := sealEntry(attacker, key, []byte(`{"name":"llm","port":"8080"}`))
+	if _, err := openEntry(key, sealed); err == nil {
+		t.Fatal("expected an entry signed by another peer to be rejected")
+	}
+}
+
+func TestAcceptEntryUnsigned(t *testing.T) {
+	n := NewNode(NodeConfig{})
+	key := ds.NewKey("legacy-peer")
+	value := []byte(`{"id":"legacy-peer"}`)
+
+	if _, ok := n.acceptEntry(key, value); ok {
+		t.Fatal("expected unsigned entries to be rejected by default")
+	}
+	entries := n.QuarantinedEntries()
+	if len(entries) != 1 || entries[0].Key != "/legacy-peer" {
+		t.Fatalf("expected the entry to be quarantined, got %+v", entries)
+	}
+
+	n.cfg.AllowUnsigned = true
+	if env, ok := n.acceptEntry(key, value); !ok || string(env.Payload) != string(value) {
+		t.Fatal("unsigned entries are accepted when signatures are not required")
+	}
+}
+
+func TestAcceptEntryRejectsReplay(t *testing.T) {
+	n := newNode()
+	priv, self := testSigningKey(t)
+	key := serviceKey(self, Service{Name: "llm", Port: "8080"})
+
+	old, _ := sealEntry(priv, key, []byte(`{"name":"llm","port":"8080","status":"connected"}`))
+	removed, _ := sealRemoval(priv, key)
+	if _, ok := n.acceptEntry(key, old); !ok {
+		t.Fatal("expected the first value to be accepted")
+	}
+	env, ok := n.acceptEntry(key, removed)
+	if !ok || !env.Removed {
+		t.Fatal("expected the newer removal to be accepted")
+	}
+	if _, ok := n.acceptEntry(key, old); ok {
+		t.Fatal("expected an older value to be rejected")
+	}
+	if _, ok := n.acceptEntry(key, removed); !ok {
+		t.Fatal("expected the same value to be accepted again")
+	}
+
+	// the sequence number is signed
+	var tampered signedEntry
+	_ = json.Unmarshal(old, &tampered)
+	tampered.Seq = env.Seq + 1
+	value, _ := json.Marshal(tampered)
+	if _, ok := n.acceptEntry(key, value); ok {
+		t.Fatal("expected a tampered sequence number to be rejected")
+	}
+}
+
+func TestAcceptedSequencesArePersisted(t *testing.T) {
+	backend := dssync.MutexWrap(ds.NewMapDatastore())
+	n := newNode()
+	n.entrySeqs.persistIn(backend)
+	priv, self := testSigningKey(t)
+	key := metaKey(self)
+
+	old, _ := sealEntry(priv, key, []byte(`{"id":"`+self+`"}`))
+	newer, _ := sealEntry(priv, key, []byte(`{"id":"`+self+`","version":"v2"}`))
+	if _, ok := n.acceptEntry(key, newer); !ok {
+		t.Fatal("expected the value to be accepted")
+	}
+
+	// a restarted node, or one bootstrapped from a snapshot, still knows
+	// the last value it accepted
+	restarted := newNode()
+	restarted.entrySeqs.persistIn(backend)
+	if _, ok := restarted.acceptEntry(key, old); ok {
+		t.Fatal("expected an older value to be rejected after a restart")
+	}
+	if _, ok := restarted.acceptEntry(key, newer); !ok {
+		t.Fatal("expected the same value to be accepted after a restart")
+	}
+}
+
+func TestDeleteHookVerifiesDeletions(t *testing.T) {
+	n := startTestNode(t, "standalone", nil)
+	priv, _, _ := crypto.GenerateEd25519Key(rand.Reader)
+	id, _ := peer.IDFromPrivateKey(priv)
+	other := id.String()
+	llm := Service{Name: "llm", Port: "8080"}
+	put := func(key ds.Key, v any) {
+		value, _ := json.Marshal(v)
+		sealed, err := sealEntry(priv, key, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.putHook(key, sealed)
+	}
+	put(metaKey(other), Peer{ID: other, Status: CONNECTED})
+	put(serviceKey(other, llm), llm)
+
+	// anyone may issue a deletion
+	n.deleteHook(serviceKey(other, llm))
+	n.deleteHook(metaKey(other))
+	if p, err := n.GetPeerFromTable(other); err != nil || len(p.Service) != 1 {
+		t.Fatalf("expected unsigned deletions to be ignored, got %+v (%v)", p, err)
+	}
+
+	// the owner removes its service with a signed removal
+	removed, _ := sealRemoval(priv, serviceKey(other, llm))
+	n.putHook(serviceKey(other, llm), removed)
+	if p, err := n.GetPeerFromTable(other); err != nil || len(p.Service) != 0 {
+		t.Fatalf("expected the service to be removed, got %+v (%v)", p, err)
+	}
+
+	// the entries of peers that left are cleaned up with deletions
+	put(metaKey(other), Peer{ID: other, Status: LEFT})
+	n.deleteHook(metaKey(other))
+	if _, err := n.GetPeerFromTable(other); err == nil {
+		t.Fatal("expected the peer that left to be removed")
+	}
+}
@@ -0,0 +1,45 @@
+package protocol
+
+import (
+	"github.com/libp2p/go-libp2p/core/control"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// aclGater is the libp2p ConnectionGater enforcing the access lists on every
+// inbound and outbound connection. It also refuses peers found to belong to
+// another network. As the ACLFilter of the relay service, it only relays
+// between peers the access lists admit.
+type aclGater struct {
+	acl     *accessControl
+	foreign *foreignPeers
+}
+
+func (g *aclGater) InterceptPeerDial(p peer.ID) bool {
+	return !g.foreign.has(p) && g.acl.allowsPeer(p.String())
+}
+
+func (g *aclGater) InterceptAddrDial(p peer.ID, addr ma.Multiaddr) bool {
+	return g.acl.allowsPeer(p.String()) && g.acl.allowsAddr(addr)
+}
+
+func (g *aclGater) InterceptAccept(addrs network.ConnMultiaddrs) bool {
+	return g.acl.allowsAddr(addrs.RemoteMultiaddr())
+}
+
+func (g *aclGater) InterceptSecured(_ network.Direction, p peer.ID, addrs network.ConnMultiaddrs) bool {
+	return !g.foreign.has(p) && g.acl.allowsPeer(p.String()) && g.acl.allowsAddr(addrs.RemoteMultiaddr())
+}
+
+func (g *aclGater) InterceptUpgraded(network.Conn) (bool, control.DisconnectReason) {
+	return true, 0
+}
+
+func (g *aclGater) AllowReserve(p peer.ID, addr ma.Multiaddr) bool {
+	return g.InterceptPeerDial(p) && g.acl.allowsAddr(addr)
+}
+
+func (g *aclGater) AllowConnect(src peer.ID, srcAddr ma.Multiaddr, dest peer.ID) bool {
+	return g.AllowReserve(src, srcAddr) && g.InterceptPeerDial(dest)
+}
@@ -12,6 +12,10 @@
 // Note that, in the absence of compaction (which must be performed manually),
 // a crdt.Datastore will only grow in size even when keys are deleted.
 //
+// Snapshots of the state (see Options.SnapshotInterval) let new replicas start
+// from them instead of replaying the whole DAG, and the blocks below them to
+// be pruned.
+//
 // The time to be fully synced for new Datastore replicas will depend on how
 // fast they can retrieve the DAGs announced by the other replicas, but newer
 // values will be available before older ones.
@@ -49,6 +53,7 @@ const (
 	setNs             = "s" // set
 	processedBlocksNs = "b" // blocks
 	dirtyBitKey       = "d" // dirty
+	snapshotKey       = "n" // latest snapshot
 	versionKey        = "crdt_version"
 )
 
@@ -109,6 +114,24 @@ type Options struct {
 	// branching is not necessarily a bad thing and may improve
 	// throughput, but everything depends on usage.
 	MultiHeadProcessing bool
+	// SnapshotInterval specifies how often to take a snapshot of the
+	// state, when the DAG grew by SnapshotMinHeight since the latest one,
+	// and to prune the blocks below the latest snapshot if SnapshotPrune
+	// is set. 0 to disable. Snapshots from other replicas are merged
+	// regardless.
+	SnapshotInterval time.Duration
+	// SnapshotMinHeight is how much the DAG must grow between two
+	// snapshots.
+	SnapshotMinHeight uint64
+	// SnapshotPrune removes the blocks covered by the latest snapshot
+	// from the DAGService once every head descends from it, including
+	// the heads other replicas broadcast.
+	SnapshotPrune bool
+	// SnapshotPruneGate, when set, is asked before every pruning, which
+	// only happens while it returns true: e.g. once every replica is known
+	// to understand snapshots, since others cannot walk past pruned
+	// blocks.
+	SnapshotPruneGate func() bool
 }
 
 func (opts *Options) verify() error {
@@ -140,6 +163,10 @@ func (opts *Options) verify() error {
 		return errors.New("invalid RepairInterval")
 	}
 
+	if opts.SnapshotInterval < 0 {
+		return errors.New("invalid SnapshotInterval")
+	}
+
 	return nil
 }
 
@@ -158,6 +185,10 @@ func DefaultOptions() *Options {
 		MaxBatchDeltaSize:   1 * 1024 * 1024, // 1MB,
 		RepairInterval:      time.Hour,
 		MultiHeadProcessing: false,
+		SnapshotInterval:    0,
+		SnapshotMinHeight:   1000,
+		SnapshotPrune:       false,
+		SnapshotPruneGate:   nil,
 	}
 }
 
@@ -182,9 +213,18 @@ type Datastore struct {
 	seenHeadsMux sync.RWMutex
 	seenHeads    map[cid.Cid]struct{}
 
+	// peerHeads are the heads other replicas broadcast, with when they
+	// were last received, see recordPeerHeads
+	peerHeadsMux sync.Mutex
+	peerHeads    map[cid.Cid]time.Time
+
 	curDeltaMux sync.Mutex
 	curDelta    *pb.Delta // current, unpublished delta
 
+	// snapshotMux serializes taking and pruning snapshots
+	snapshotMux       sync.Mutex
+	latestSnapshotMux sync.Mutex
+
 	wg sync.WaitGroup
 
 	jobQueue chan *dagJob
@@ -283,6 +323,7 @@ func New(
 		dagService:     dagSyncer,
 		broadcaster:    bcast,
 		seenHeads:      make(map[cid.Cid]struct{}),
+		peerHeads:      make(map[cid.Cid]time.Time),
 		jobQueue:       make(chan *dagJob, opts.NumWorkers),
 		sendJobs:       make(chan *dagJob),
 		queuedChildren: newCidSafeSet(),
@@ -318,7 +359,7 @@ func New(
 			dstore.dagWorker()
 		}()
 	}
-	dstore.wg.Add(4)
+	dstore.wg.Add(5)
 	go func() {
 		defer dstore.wg.Done()
 		dstore.handleNext(ctx)
@@ -338,6 +379,11 @@ func New(
 		dstore.logStats(ctx)
 	}()
 
+	go func() {
+		defer dstore.wg.Done()
+		dstore.snapshots(ctx)
+	}()
+
 	return dstore, nil
 }
 
@@ -366,6 +412,7 @@ func (store *Datastore) handleNext(ctx context.Context) {
 			store.logger.Error(err)
 			continue
 		}
+		store.recordPeerHeads(bCastHeads)
 
 		processHead := func(ctx context.Context, c cid.Cid) {
 			err = store.handleBlock(ctx, c) //handleBlock blocks
@@ -791,7 +838,17 @@ func (store *Datastore) processNode(ctx context.Context, ng *crdtNodeGetter, roo
 	// First,  merge the delta in this node.
 	current := node.Cid()
 	blockKey := dshelp.MultihashToDsKey(current.Hash()).String()
-	err := store.set.Merge(ctx, delta, blockKey)
+	snap, err := extractSnapshot(delta)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding snapshot from %s: %w", current, err)
+	}
+	if snap != nil {
+		err = store.mergeSnapshot(ctx, ng, snap)
+		if err != nil {
+			return nil, fmt.Errorf("error merging snapshot from %s: %w", current, err)
+		}
+	}
+	err = store.set.Merge(ctx, delta, blockKey)
 	if err != nil {
 		return nil, fmt.Errorf("error merging delta from %s: %w", current, err)
 	}
@@ -807,6 +864,15 @@ func (store *Datastore) processNode(ctx context.Context, ng *crdtNodeGetter, roo
 	// processing.
 	store.queuedChildren.Remove(node.Cid())
 
+	if snap != nil {
+		if err := store.coverHeads(ctx, snap, root, rootPrio); err != nil {
+			return nil, err
+		}
+		if err := store.recordSnapshot(ctx, current, delta.GetPriority()); err != nil {
+			return nil, fmt.Errorf("error recording snapshot %s: %w", current, err)
+		}
+	}
+
 	// Some informative logging
 	if prio := delta.GetPriority(); prio%50 == 0 {
 		common.Logger.Infof("merged delta from node %s (priority: %d)", current, prio)
@@ -964,6 +1030,16 @@ func (store *Datastore) repairDAG(ctx context.Context) error {
 		cur := nh.node
 		head := nh.head
 
+		// pruned blocks are covered by a snapshot, there is
+		// nothing to repair below them.
+		pruned, err := store.isPruned(ctx, cur)
+		if err != nil {
+			return fmt.Errorf("error checking for pruned block %s: %w", cur, err)
+		}
+		if pruned {
+			continue
+		}
+
 		cctx, cancel := context.WithTimeout(ctx, store.opts.DAGSyncerTimeout)
 		n, delta, err := getter.GetDelta(cctx, cur)
 		if err != nil {
@@ -1383,6 +1459,17 @@ func (store *Datastore) printDAGRec(ctx context.Context, from cid.Cid, depth uin
 		return nil
 	}
 
+	pruned, err := store.isPruned(ctx, from)
+	if err != nil {
+		return err
+	}
+	if pruned {
+		cidStr := from.String()
+		line += fmt.Sprintf("- %s: Pruned", cidStr[len(cidStr)-4:])
+		fmt.Println(line)
+		return nil
+	}
+
 	cctx, cancel := context.WithTimeout(ctx, store.opts.DAGSyncerTimeout)
 	defer cancel()
 	nd, delta, err := ng.GetDelta(cctx, from)
@@ -1468,6 +1555,15 @@ func (store *Datastore) dotDAGRec(ctx context.Context, w io.Writer, from cid.Cid
 		return nil
 	}
 
+	pruned, err := store.isPruned(ctx, from)
+	if err != nil {
+		return err
+	}
+	if pruned {
+		fmt.Fprintf(w, "%s [label=\"%s: pruned\"]\n", cidLong, cidShort)
+		return nil
+	}
+
 	cctx, cancel := context.WithTimeout(ctx, store.opts.DAGSyncerTimeout)
 	defer cancel()
 	nd, delta, err := ng.GetDelta(cctx, from)
@@ -1508,17 +1604,23 @@ type Stats struct {
 	Heads      []cid.Cid
 	MaxHeight  uint64
 	QueuedJobs int
+	// Snapshot is the latest snapshot, undefined if there is none
+	Snapshot       cid.Cid
+	SnapshotHeight uint64
 }
 
 // InternalStats returns internal datastore information like the current heads
 // and max height.
 func (store *Datastore) InternalStats(ctx context.Context) Stats {
 	heads, height, _ := store.heads.List(ctx)
+	snapshot, snapshotHeight, _ := store.LatestSnapshot(ctx)
 
 	return Stats{
-		Heads:      heads,
-		MaxHeight:  height,
-		QueuedJobs: len(store.jobQueue),
+		Heads:          heads,
+		MaxHeight:      height,
+		QueuedJobs:     len(store.jobQueue),
+		Snapshot:       snapshot,
+		SnapshotHeight: snapshotHeight,
 	}
 }
 
@@ -1562,3 +1664,12 @@ func (s *cidSafeSet) Has(c cid.Cid) (ok bool) {
 	s.mux.RUnlock()
 	return
 }
+
+func (s *cidSafeSet) Len() (n int) {
+	s.mux.RLock()
+	{
+		n = len(s.set)
+	}
+	s.mux.RUnlock()
+	return
+}
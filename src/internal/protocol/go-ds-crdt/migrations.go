@@ -165,3 +165,56 @@ func (store *Datastore) migrate0to1(ctx context.Context) error {
 	s.logger.Infof("Migration v0 to v1 finished (%d elements affected)", total)
 	return nil
 }
+
+// KeyMigration maps an element stored under an outdated key layout to the
+// elements that replace it. It returns false for elements that must be left
+// untouched.
+type KeyMigration func(key ds.Key, value []byte) (replacements map[ds.Key][]byte, ok bool)
+
+// MigrateKeys rewrites every element selected by m. Unlike the format
+// migrations above, which only touch the local datastore, this is a regular
+// CRDT update: the replacements are added and the original elements removed
+// in a single delta that is broadcast to the other replicas. It returns the
+// number of migrated elements.
+func (store *Datastore) MigrateKeys(ctx context.Context, m KeyMigration) (int, error) {
+	results, err := store.Query(ctx, query.Query{})
+	if err != nil {
+		return 0, err
+	}
+	entries, err := results.Rest()
+	if err != nil {
+		return 0, err
+	}
+
+	b, err := store.Batch(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var total int
+	for _, e := range entries {
+		key := ds.NewKey(e.Key)
+		replacements, ok := m(key, e.Value)
+		if !ok {
+			continue
+		}
+		for k, v := range replacements {
+			if err := b.Put(ctx, k, v); err != nil {
+				return total, err
+			}
+		}
+		if _, kept := replacements[key]; !kept {
+			if err := b.Delete(ctx, key); err != nil {
+				return total, err
+			}
+		}
+		total++
+	}
+	if total == 0 {
+		return 0, nil
+	}
+	if err := b.Commit(ctx); err != nil {
+		return total, err
+	}
+	store.logger.Infof("Key migration finished (%d elements affected)", total)
+	return total, nil
+}
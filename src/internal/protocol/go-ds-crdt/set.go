@@ -361,7 +361,7 @@ func (s *set) findBestValue(ctx context.Context, key string, pendingTombIDs []st
 	prefix := s.elemsPrefix(key)
 	q := query.Query{
 		Prefix:   prefix.String(),
-		KeysOnly: true,
+		KeysOnly: false,
 	}
 
 	results, err := s.store.Query(ctx, q)
@@ -372,8 +372,7 @@ func (s *set) findBestValue(ctx context.Context, key string, pendingTombIDs []st
 
 	var bestValue []byte
 	var bestPriority uint64
-	var deltaCid cid.Cid
-	ng := crdtNodeGetter{NodeGetter: s.dagService}
+	ng := &crdtNodeGetter{NodeGetter: s.dagService}
 
 	// range all the /namespace/elems/<key>/<block_cid>.
 NEXT:
@@ -407,51 +406,86 @@ NEXT:
 			continue
 		}
 
-		// get the block
-		mhash, err := dshelp.DsKeyToMultihash(ds.NewKey(id))
-		if err != nil {
-			return nil, 0, err
-		}
-		deltaCid = cid.NewCidV1(cid.DagProtobuf, mhash)
-		_, delta, err := ng.GetDelta(ctx, deltaCid)
+		value, prio, err := s.elemValue(ctx, ng, key, id, r.Value)
 		if err != nil {
 			return nil, 0, err
 		}
 
-		// discard this delta.
-		if delta.Priority < bestPriority {
+		// discard this element.
+		if prio < bestPriority {
 			continue
 		}
 
-		// When equal priority, choose the greatest among values in
-		// the delta and current. When higher priority, choose the
-		// greatest only among those in the delta.
-		var greatestValueInDelta []byte
-		for _, elem := range delta.GetElements() {
-			if elem.GetKey() != key {
-				continue
-			}
-			v := elem.GetValue()
-			if bytes.Compare(greatestValueInDelta, v) < 0 {
-				greatestValueInDelta = v
-			}
-		}
-
-		if delta.Priority > bestPriority {
-			bestValue = greatestValueInDelta
-			bestPriority = delta.Priority
+		if prio > bestPriority {
+			bestValue = value
+			bestPriority = prio
 			continue
 		}
 
 		// equal priority
-		if bytes.Compare(bestValue, greatestValueInDelta) < 0 {
-			bestValue = greatestValueInDelta
+		if bytes.Compare(bestValue, value) < 0 {
+			bestValue = value
 		}
 	}
 
 	return bestValue, bestPriority, nil
 }
 
+// elemValue returns the value and priority of the element of key added by
+// the block id. They are read from the element entry, or from the block for
+// entries written before elements carried them.
+func (s *set) elemValue(ctx context.Context, ng *crdtNodeGetter, key, id string, entry []byte) ([]byte, uint64, error) {
+	if value, prio, ok := decodeElem(entry); ok {
+		return value, prio, nil
+	}
+
+	// get the block
+	mhash, err := dshelp.DsKeyToMultihash(ds.NewKey(id))
+	if err != nil {
+		return nil, 0, err
+	}
+	deltaCid := cid.NewCidV1(cid.DagProtobuf, mhash)
+	_, delta, err := ng.GetDelta(ctx, deltaCid)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// choose the greatest among the values in the delta.
+	var greatestValueInDelta []byte
+	for _, elem := range delta.GetElements() {
+		if elem.GetKey() != key {
+			continue
+		}
+		v := elem.GetValue()
+		if bytes.Compare(greatestValueInDelta, v) < 0 {
+			greatestValueInDelta = v
+		}
+	}
+	return greatestValueInDelta, delta.Priority, nil
+}
+
+// encodeElem encodes the entry of an element: its priority (a Uvarint) and
+// its value. Keeping them with the element lets findBestValue work after the
+// block that added the element has been pruned.
+func encodeElem(value []byte, prio uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(value))
+	n := binary.PutUvarint(buf, prio+1)
+	return append(buf[:n], value...)
+}
+
+// decodeElem decodes an element entry. ok is false for the empty entries of
+// elements written before they carried their value.
+func decodeElem(entry []byte) (value []byte, prio uint64, ok bool) {
+	if len(entry) == 0 {
+		return nil, 0, false
+	}
+	prio, n := binary.Uvarint(entry)
+	if n <= 0 || prio == 0 {
+		return nil, 0, false
+	}
+	return entry[n:], prio - 1, true
+}
+
 // putElems adds items to the "elems" set. It will also set current
 // values and priorities for each element. This needs to run in a lock,
 // as otherwise races may occur when reading/writing the priorities, resulting
@@ -462,6 +496,15 @@ NEXT:
 // the batch is written), and one lock per key might be way worse than a single
 // global lock in the end.
 func (s *set) putElems(ctx context.Context, elems []*pb.Element, id string, prio uint64) error {
+	for _, e := range elems {
+		e.Id = id // overwrite the identifier as it would come unset
+	}
+	return s.putElemsWithIDs(ctx, elems, prio)
+}
+
+// putElemsWithIDs is putElems for elements that keep their own identifiers,
+// as those in snapshots, which come from many blocks.
+func (s *set) putElemsWithIDs(ctx context.Context, elems []*pb.Element, prio uint64) error {
 	s.putElemsMux.Lock()
 	defer s.putElemsMux.Unlock()
 
@@ -479,14 +522,20 @@ func (s *set) putElems(ctx context.Context, elems []*pb.Element, id string, prio
 		}
 	}
 
+	// a delta may carry several values for the same key and id. The entry
+	// keeps the greatest, which is the one findBestValue would choose.
+	written := make(map[ds.Key][]byte)
 	for _, e := range elems {
-		e.Id = id // overwrite the identifier as it would come unset
+		id := e.GetId()
 		key := e.GetKey()
 		// /namespace/elems/<key>/<id>
 		k := s.elemsPrefix(key).ChildString(id)
-		err := store.Put(ctx, k, nil)
-		if err != nil {
-			return err
+		if v, ok := written[k]; !ok || bytes.Compare(v, e.GetValue()) < 0 {
+			err := store.Put(ctx, k, encodeElem(e.GetValue(), prio))
+			if err != nil {
+				return err
+			}
+			written[k] = e.GetValue()
 		}
 
 		// update the value if applicable:
@@ -0,0 +1,73 @@
+package crdt
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"testing"
+
+	dshelp "github.com/ipfs/boxo/datastore/dshelp"
+	pb "github.com/ipfs/go-ds-crdt/pb"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestEncodeElem(t *testing.T) {
+	cases := []struct {
+		value []byte
+		prio  uint64
+	}{
+		{[]byte("value"), 0},
+		{nil, 7},
+		{[]byte("value"), math.MaxUint64 - 1},
+	}
+	for _, c := range cases {
+		value, prio, ok := decodeElem(encodeElem(c.value, c.prio))
+		if !ok || prio != c.prio || !bytes.Equal(value, c.value) {
+			t.Errorf("decodeElem(encodeElem(%q, %d)) = %q, %d, %v", c.value, c.prio, value, prio, ok)
+		}
+	}
+	if _, _, ok := decodeElem(nil); ok {
+		t.Fatal("expected empty entries to be told apart")
+	}
+}
+
+func TestFindBestValue(t *testing.T) {
+	ctx := context.Background()
+	dags := newMapDAGService()
+	s := newTestStore(t, dags).set
+	best := func(pending ...string) (string, uint64) {
+		t.Helper()
+		value, prio, err := s.findBestValue(ctx, "/k", pending)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(value), prio
+	}
+
+	_ = s.putElemsWithIDs(ctx, []*pb.Element{{Key: "/k", Id: "/a", Value: []byte("low")}}, 1)
+	_ = s.putElemsWithIDs(ctx, []*pb.Element{{Key: "/k", Id: "/b", Value: []byte("high")}, {Key: "/k", Id: "/c", Value: []byte("higher")}}, 2)
+	// the elements of another key sharing the prefix
+	_ = s.putElemsWithIDs(ctx, []*pb.Element{{Key: "/k/sub", Id: "/d", Value: []byte("other")}}, 9)
+
+	if value, prio := best(); value != "higher" || prio != 2 {
+		t.Fatalf("expected the greatest value of the highest priority, got %q at %d", value, prio)
+	}
+	if value, _ := best("/c"); value != "high" {
+		t.Fatalf("expected pending tombstones to be skipped, got %q", value)
+	}
+	_ = s.putTombs(ctx, []*pb.Element{{Key: "/k", Id: "/b"}, {Key: "/k", Id: "/c"}})
+	if value, prio := best(); value != "low" || prio != 1 {
+		t.Fatalf("expected tombstoned elements to be skipped, got %q at %d", value, prio)
+	}
+
+	// entries written before elements carried their value are read from
+	// their block
+	data, _ := proto.Marshal(&pb.Delta{Priority: 5, Elements: []*pb.Element{{Key: "/k", Value: []byte("legacy")}}})
+	nd, _ := makeDataNode(data)
+	_ = dags.Add(ctx, nd)
+	id := dshelp.MultihashToDsKey(nd.Cid().Hash()).String()
+	_ = s.store.Put(ctx, s.elemsPrefix("/k").ChildString(id), nil)
+	if value, prio := best(); value != "legacy" || prio != 5 {
+		t.Fatalf("expected the value of the block, got %q at %d", value, prio)
+	}
+}
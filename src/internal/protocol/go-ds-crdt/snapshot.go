@@ -0,0 +1,872 @@
+package crdt
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	dag "github.com/ipfs/boxo/ipld/merkledag"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	query "github.com/ipfs/go-datastore/query"
+	pb "github.com/ipfs/go-ds-crdt/pb"
+	ipld "github.com/ipfs/go-ipld-format"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// Snapshots let new replicas start from a recent state instead of replaying
+// the whole DAG.
+//
+// A snapshot block is a regular DAG block without links whose delta has no
+// elements. It carries the full state of the set, encoded as a message in
+// an extra field of the delta, at the heads the snapshot was taken at:
+//
+//	message Snapshot {
+//	  repeated bytes heads = 1;  // CIDs of the heads the snapshot covers
+//	  repeated Delta deltas = 2; // tombstones, and elements by priority
+//	  repeated bytes parts = 3;  // CIDs of blocks with more deltas
+//	}
+//
+// Elements keep the id of the block which added them, so that tombstones
+// issued later still apply to them. Replicas unaware of snapshots see an
+// empty delta. Since the block has no links, branches are walked down to it
+// only. When the state is larger than MaxBatchDeltaSize, the deltas go into
+// part blocks which are referenced by CID rather than linked, so that they
+// are never walked as branches.
+//
+// Merging a snapshot is merging all its deltas, which is idempotent. A
+// snapshot supersedes the heads it covers: they are replaced as heads and
+// walks stop at them. Once every head descends from the latest snapshot, no
+// replica starting from the heads walks below it, and the blocks it covers
+// can be removed from the DAGService.
+
+// snapshotField is the field of the delta of a snapshot block holding the
+// snapshot.
+const snapshotField protowire.Number = 15
+
+const (
+	snapshotHeadsField  protowire.Number = 1
+	snapshotDeltasField protowire.Number = 2
+	snapshotPartsField  protowire.Number = 3
+)
+
+// prunedMarker is the value of the processed-block entry of blocks that are
+// not kept anymore as a snapshot covers them.
+var prunedMarker = []byte{1}
+
+// peerHeadsRebroadcasts is for how many rebroadcast intervals the heads a
+// replica broadcast are taken as its heads. Replicas broadcast their heads
+// again every interval, so heads not received meanwhile were replaced.
+const peerHeadsRebroadcasts = 3
+
+// ErrSnapshotBusy is returned when a snapshot is requested while DAG blocks
+// are being processed, since it would not hold their state.
+var ErrSnapshotBusy = errors.New("cannot snapshot while DAG blocks are being processed")
+
+type snapshot struct {
+	heads  []cid.Cid
+	deltas []*pb.Delta
+	parts  []cid.Cid
+}
+
+func (snap *snapshot) marshal() ([]byte, error) {
+	var data []byte
+	for _, h := range snap.heads {
+		data = protowire.AppendTag(data, snapshotHeadsField, protowire.BytesType)
+		data = protowire.AppendBytes(data, h.Bytes())
+	}
+	for _, d := range snap.deltas {
+		b, err := proto.Marshal(d)
+		if err != nil {
+			return nil, err
+		}
+		data = protowire.AppendTag(data, snapshotDeltasField, protowire.BytesType)
+		data = protowire.AppendBytes(data, b)
+	}
+	for _, p := range snap.parts {
+		data = protowire.AppendTag(data, snapshotPartsField, protowire.BytesType)
+		data = protowire.AppendBytes(data, p.Bytes())
+	}
+	return data, nil
+}
+
+func unmarshalSnapshot(data []byte) (*snapshot, error) {
+	snap := &snapshot{}
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		data = data[n:]
+		if typ != protowire.BytesType {
+			// unknown field
+			n = protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			data = data[n:]
+			continue
+		}
+		v, n := protowire.ConsumeBytes(data)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		switch num {
+		case snapshotHeadsField:
+			c, err := cid.Cast(v)
+			if err != nil {
+				return nil, err
+			}
+			snap.heads = append(snap.heads, c)
+		case snapshotDeltasField:
+			d := &pb.Delta{}
+			if err := proto.Unmarshal(v, d); err != nil {
+				return nil, err
+			}
+			snap.deltas = append(snap.deltas, d)
+		case snapshotPartsField:
+			c, err := cid.Cast(v)
+			if err != nil {
+				return nil, err
+			}
+			snap.parts = append(snap.parts, c)
+		}
+	}
+	return snap, nil
+}
+
+// extractSnapshot returns the snapshot carried by a delta, or nil for regular
+// deltas.
+func extractSnapshot(delta *pb.Delta) (*snapshot, error) {
+	unknown := delta.ProtoReflect().GetUnknown()
+	for len(unknown) > 0 {
+		num, typ, n := protowire.ConsumeTag(unknown)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		unknown = unknown[n:]
+		if num == snapshotField && typ == protowire.BytesType {
+			v, n := protowire.ConsumeBytes(unknown)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			return unmarshalSnapshot(v)
+		}
+		n = protowire.ConsumeFieldValue(num, typ, unknown)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		unknown = unknown[n:]
+	}
+	return nil, nil
+}
+
+func makeSnapshotNode(snap *snapshot, height uint64) (ipld.Node, error) {
+	data, err := proto.Marshal(&pb.Delta{Priority: height})
+	if err != nil {
+		return nil, err
+	}
+	snapData, err := snap.marshal()
+	if err != nil {
+		return nil, err
+	}
+	data = protowire.AppendTag(data, snapshotField, protowire.BytesType)
+	data = protowire.AppendBytes(data, snapData)
+	return makeDataNode(data)
+}
+
+func makeDataNode(data []byte) (ipld.Node, error) {
+	nd := dag.NodeWithData(data)
+	// Ensure we work with CIDv1
+	if err := nd.SetCidBuilder(dag.V1CidPrefix()); err != nil {
+		return nil, err
+	}
+	return nd, nil
+}
+
+// deltaChunker groups elements into deltas of the same priority and of up to
+// maxSize bytes. Tombstones are added with priority 0, which no element has.
+type deltaChunker struct {
+	maxSize int
+	size    int
+	deltas  []*pb.Delta
+}
+
+func (c *deltaChunker) add(e *pb.Element, prio uint64, tomb bool) {
+	// the element plus its tag and length
+	size := proto.Size(e) + 2*binary.MaxVarintLen32
+	var last *pb.Delta
+	if len(c.deltas) > 0 {
+		last = c.deltas[len(c.deltas)-1]
+	}
+	if last == nil || last.Priority != prio || c.size+size > c.maxSize {
+		last = &pb.Delta{Priority: prio}
+		c.deltas = append(c.deltas, last)
+		c.size = 0
+	}
+	if tomb {
+		last.Tombstones = append(last.Tombstones, e)
+	} else {
+		last.Elements = append(last.Elements, e)
+	}
+	c.size += size
+}
+
+// rangeEntries calls fn with the key, id and value of every entry in the
+// given namespace of the set (elements or tombstones).
+func (s *set) rangeEntries(ctx context.Context, ns string, fn func(key, id string, value []byte) error) error {
+	prefix := s.keyPrefix(ns)
+	results, err := s.store.Query(ctx, query.Query{Prefix: prefix.String()})
+	if err != nil {
+		return err
+	}
+	defer results.Close()
+
+	for r := range results.Next() {
+		if r.Error != nil {
+			return r.Error
+		}
+		// Switch from /ns/<elems|tombs>/key/block to /key/block
+		k := ds.NewKey(strings.TrimPrefix(r.Key, prefix.String()))
+		if err := fn(k.Parent().String(), k.BaseNamespace(), r.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// snapshot returns the state of the set as deltas of up to maxSize bytes:
+// the tombstones, then the elements that are not tombstoned, by decreasing
+// priority so that replicas loading them set each value once.
+func (s *set) snapshot(ctx context.Context, maxSize int) ([]*pb.Delta, error) {
+	chunker := &deltaChunker{maxSize: maxSize}
+	tombs := make(map[string]struct{})
+	err := s.rangeEntries(ctx, tombsNs, func(key, id string, _ []byte) error {
+		tombs[key+"/"+id] = struct{}{}
+		chunker.add(&pb.Element{Key: key, Id: id}, 0, true)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ng := &crdtNodeGetter{NodeGetter: s.dagService}
+	byPrio := make(map[uint64][]*pb.Element)
+	err = s.rangeEntries(ctx, elemsNs, func(key, id string, entry []byte) error {
+		if _, ok := tombs[key+"/"+id]; ok {
+			return nil
+		}
+		value, prio, err := s.elemValue(ctx, ng, key, id, entry)
+		if err != nil {
+			return fmt.Errorf("error getting value of %s from %s: %w", key, id, err)
+		}
+		byPrio[prio] = append(byPrio[prio], &pb.Element{Key: key, Id: id, Value: value})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	prios := make([]uint64, 0, len(byPrio))
+	for prio := range byPrio {
+		prios = append(prios, prio)
+	}
+	sort.Slice(prios, func(i, j int) bool { return prios[i] > prios[j] })
+	for _, prio := range prios {
+		for _, e := range byPrio[prio] {
+			chunker.add(e, prio, false)
+		}
+	}
+	return chunker.deltas, nil
+}
+
+// inlineElems rewrites the entries of elements written before they carried
+// their value, which is read from their block. The blocks can be pruned
+// afterwards.
+func (s *set) inlineElems(ctx context.Context) (int, error) {
+	type elem struct {
+		key, id string
+	}
+	var legacy []elem
+	err := s.rangeEntries(ctx, elemsNs, func(key, id string, entry []byte) error {
+		if len(entry) == 0 {
+			legacy = append(legacy, elem{key, id})
+		}
+		return nil
+	})
+	if err != nil || len(legacy) == 0 {
+		return 0, err
+	}
+
+	ng := &crdtNodeGetter{NodeGetter: s.dagService}
+	var rewritten int
+	for _, e := range legacy {
+		// tombstoned elements do not need their value
+		deleted, err := s.inTombsKeyID(ctx, e.key, e.id)
+		if err != nil {
+			return rewritten, err
+		}
+		if deleted {
+			continue
+		}
+		value, prio, err := s.elemValue(ctx, ng, e.key, e.id, nil)
+		if err != nil {
+			return rewritten, fmt.Errorf("error getting value of %s from %s: %w", e.key, e.id, err)
+		}
+		if err := s.store.Put(ctx, s.elemsPrefix(e.key).ChildString(e.id), encodeElem(value, prio)); err != nil {
+			return rewritten, err
+		}
+		rewritten++
+	}
+	return rewritten, nil
+}
+
+// mergeSnapshot merges the state in a snapshot into the set. Tombstones are
+// merged first, so that tombstoned elements never become the value of their
+// key.
+func (store *Datastore) mergeSnapshot(ctx context.Context, ng *crdtNodeGetter, snap *snapshot) error {
+	deltas := snap.deltas
+	if len(snap.parts) > 0 {
+		cctx, cancel := context.WithTimeout(ctx, store.opts.DAGSyncerTimeout)
+		defer cancel()
+		var got int
+		for opt := range ng.GetMany(cctx, snap.parts) {
+			if opt.Err != nil {
+				return fmt.Errorf("error getting snapshot part: %w", opt.Err)
+			}
+			protonode, ok := opt.Node.(*dag.ProtoNode)
+			if !ok {
+				return errors.New("snapshot part is not a ProtoNode")
+			}
+			part, err := unmarshalSnapshot(protonode.Data())
+			if err != nil {
+				return fmt.Errorf("error decoding snapshot part %s: %w", opt.Node.Cid(), err)
+			}
+			deltas = append(deltas, part.deltas...)
+			got++
+		}
+		if got != len(snap.parts) {
+			return fmt.Errorf("got %d of the %d snapshot parts", got, len(snap.parts))
+		}
+	}
+
+	for _, d := range deltas {
+		// tombstones known already are skipped to keep their timestamp
+		var tombs []*pb.Element
+		for _, t := range d.GetTombstones() {
+			deleted, err := store.set.inTombsKeyID(ctx, t.GetKey(), t.GetId())
+			if err != nil {
+				return err
+			}
+			if !deleted {
+				tombs = append(tombs, t)
+			}
+		}
+		if err := store.set.putTombs(ctx, tombs); err != nil {
+			return err
+		}
+	}
+	for _, d := range deltas {
+		if err := store.set.putElemsWithIDs(ctx, d.GetElements(), d.GetPriority()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// coverHeads makes the branch of a snapshot replace the heads the snapshot
+// covers. Those never processed here are marked pruned: the snapshot holds
+// their state and walks must stop at them.
+func (store *Datastore) coverHeads(ctx context.Context, snap *snapshot, root cid.Cid, rootPrio uint64) error {
+	for _, h := range snap.heads {
+		isHead, _, err := store.heads.IsHead(ctx, h)
+		if err != nil {
+			return fmt.Errorf("error checking if %s is head: %w", h, err)
+		}
+		if isHead && h != root {
+			if err := store.heads.Replace(ctx, h, root, rootPrio); err != nil {
+				return fmt.Errorf("error replacing head: %s->%s: %w", h, root, err)
+			}
+		}
+		isProcessed, err := store.isProcessed(ctx, h)
+		if err != nil {
+			return fmt.Errorf("error checking for known block %s: %w", h, err)
+		}
+		if !isProcessed {
+			if err := store.markPruned(ctx, h); err != nil {
+				return fmt.Errorf("error recording %s as pruned: %w", h, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (store *Datastore) isPruned(ctx context.Context, c cid.Cid) (bool, error) {
+	v, err := store.store.Get(ctx, store.processedBlockKey(c))
+	if err == ds.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return len(v) == len(prunedMarker) && v[0] == prunedMarker[0], nil
+}
+
+func (store *Datastore) markPruned(ctx context.Context, c cid.Cid) error {
+	return store.store.Put(ctx, store.processedBlockKey(c), prunedMarker)
+}
+
+func (store *Datastore) latestSnapshotKey() ds.Key {
+	return store.namespace.ChildString(snapshotKey)
+}
+
+// LatestSnapshot returns the snapshot with the highest priority this replica
+// has taken or merged, and its priority. The CID is undefined when there is
+// none.
+func (store *Datastore) LatestSnapshot(ctx context.Context) (cid.Cid, uint64, error) {
+	data, err := store.store.Get(ctx, store.latestSnapshotKey())
+	if err == ds.ErrNotFound {
+		return cid.Undef, 0, nil
+	}
+	if err != nil {
+		return cid.Undef, 0, err
+	}
+	prio, n := binary.Uvarint(data)
+	if n <= 0 {
+		return cid.Undef, 0, errors.New("error decoding snapshot priority")
+	}
+	c, err := cid.Cast(data[n:])
+	return c, prio, err
+}
+
+// recordSnapshot records c as the latest snapshot unless a snapshot with a
+// higher priority is known. Between snapshots of the same priority, the
+// greatest CID wins, so that replicas agree.
+func (store *Datastore) recordSnapshot(ctx context.Context, c cid.Cid, prio uint64) error {
+	store.latestSnapshotMux.Lock()
+	defer store.latestSnapshotMux.Unlock()
+
+	latest, latestPrio, err := store.LatestSnapshot(ctx)
+	if err != nil {
+		return err
+	}
+	if latest.Defined() && (prio < latestPrio || prio == latestPrio && c.KeyString() <= latest.KeyString()) {
+		return nil
+	}
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, prio)
+	return store.store.Put(ctx, store.latestSnapshotKey(), append(buf[:n], c.Bytes()...))
+}
+
+// checkIdle returns ErrSnapshotBusy unless all the blocks below the given
+// heads have been processed.
+func (store *Datastore) checkIdle(ctx context.Context, heads []cid.Cid) error {
+	if store.IsDirty(ctx) {
+		return fmt.Errorf("%w: the store is dirty", ErrSnapshotBusy)
+	}
+	if len(store.jobQueue) > 0 || store.queuedChildren.Len() > 0 {
+		return ErrSnapshotBusy
+	}
+	for _, h := range heads {
+		isProcessed, err := store.isProcessed(ctx, h)
+		if err != nil {
+			return fmt.Errorf("error checking for known block %s: %w", h, err)
+		}
+		if !isProcessed {
+			return ErrSnapshotBusy
+		}
+	}
+	return nil
+}
+
+// Snapshot takes a snapshot of the state of the store at its current heads,
+// adds it to the DAG on top of them and broadcasts it. ErrSnapshotBusy is
+// returned while blocks are being processed.
+func (store *Datastore) Snapshot(ctx context.Context) (cid.Cid, error) {
+	store.snapshotMux.Lock()
+	defer store.snapshotMux.Unlock()
+
+	heads, height, err := store.heads.List(ctx)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("error listing heads: %w", err)
+	}
+	if len(heads) == 0 {
+		return cid.Undef, errors.New("there are no heads to snapshot")
+	}
+	if err := store.checkIdle(ctx, heads); err != nil {
+		return cid.Undef, err
+	}
+
+	deltas, err := store.set.snapshot(ctx, store.opts.MaxBatchDeltaSize)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("error reading the state: %w", err)
+	}
+	height++
+
+	nd, err := store.putSnapshot(ctx, heads, deltas, height)
+	if err != nil {
+		return cid.Undef, err
+	}
+	delta, err := extractDelta(nd)
+	if err != nil {
+		return cid.Undef, err
+	}
+	_, err = store.processNode(ctx, &crdtNodeGetter{store.dagService}, nd.Cid(), height, delta, nd)
+	if err != nil {
+		store.MarkDirty(ctx)
+		return cid.Undef, fmt.Errorf("error processing snapshot: %w", err)
+	}
+	store.logger.Infof("took snapshot %s at height %d (%d heads, %d deltas)", nd.Cid(), height, len(heads), len(deltas))
+	return nd.Cid(), store.broadcast(ctx, []cid.Cid{nd.Cid()})
+}
+
+// putSnapshot adds the snapshot block to the DAGService, with its deltas in
+// part blocks when they do not fit in MaxBatchDeltaSize.
+func (store *Datastore) putSnapshot(ctx context.Context, heads []cid.Cid, deltas []*pb.Delta, height uint64) (ipld.Node, error) {
+	cctx, cancel := context.WithTimeout(ctx, store.opts.DAGSyncerTimeout)
+	defer cancel()
+
+	maxSize := store.opts.MaxBatchDeltaSize
+	snap := &snapshot{heads: heads}
+	var total int
+	for _, d := range deltas {
+		total += proto.Size(d)
+	}
+	if total <= maxSize {
+		snap.deltas = deltas
+	} else {
+		var part []*pb.Delta
+		var partSize int
+		flush := func() error {
+			data, err := (&snapshot{deltas: part}).marshal()
+			if err != nil {
+				return err
+			}
+			nd, err := makeDataNode(data)
+			if err != nil {
+				return err
+			}
+			if err := store.dagService.Add(cctx, nd); err != nil {
+				return fmt.Errorf("error writing snapshot part %s: %w", nd.Cid(), err)
+			}
+			snap.parts = append(snap.parts, nd.Cid())
+			part, partSize = nil, 0
+			return nil
+		}
+		for _, d := range deltas {
+			size := proto.Size(d)
+			if len(part) > 0 && partSize+size > maxSize {
+				if err := flush(); err != nil {
+					return nil, err
+				}
+			}
+			part = append(part, d)
+			partSize += size
+		}
+		if err := flush(); err != nil {
+			return nil, err
+		}
+	}
+
+	nd, err := makeSnapshotNode(snap, height)
+	if err != nil {
+		return nil, fmt.Errorf("error creating snapshot block: %w", err)
+	}
+	if err := store.dagService.Add(cctx, nd); err != nil {
+		return nil, fmt.Errorf("error writing snapshot block %s: %w", nd.Cid(), err)
+	}
+	return nd, nil
+}
+
+// getSnapshot returns the snapshot in block c.
+func (store *Datastore) getSnapshot(ctx context.Context, ng *crdtNodeGetter, c cid.Cid) (*snapshot, error) {
+	cctx, cancel := context.WithTimeout(ctx, store.opts.DAGSyncerTimeout)
+	defer cancel()
+	_, delta, err := ng.GetDelta(cctx, c)
+	if err != nil {
+		return nil, err
+	}
+	snap, err := extractSnapshot(delta)
+	if err == nil && snap == nil {
+		err = fmt.Errorf("%s is not a snapshot", c)
+	}
+	return snap, err
+}
+
+// PruneSnapshot removes from the DAGService the blocks covered by the latest
+// snapshot once it is agreed, that is, when every head, of this replica or
+// broadcast by others, descends from it: no replica starting from the
+// current heads needs the blocks below it anymore.
+// It returns the number of removed blocks, which is 0 while the snapshot is
+// not agreed.
+func (store *Datastore) PruneSnapshot(ctx context.Context) (int, error) {
+	store.snapshotMux.Lock()
+	defer store.snapshotMux.Unlock()
+
+	latest, prio, err := store.LatestSnapshot(ctx)
+	if err != nil || !latest.Defined() {
+		return 0, err
+	}
+	ng := &crdtNodeGetter{NodeGetter: store.dagService}
+	snap, err := store.getSnapshot(ctx, ng, latest)
+	if err != nil {
+		return 0, fmt.Errorf("error getting snapshot %s: %w", latest, err)
+	}
+
+	agreed, err := store.snapshotAgreed(ctx, ng, latest, prio, snap)
+	if err != nil || !agreed {
+		return 0, err
+	}
+
+	// the values of the elements added by the pruned blocks are needed to
+	// find the value of their keys when other elements are tombstoned
+	if _, err := store.set.inlineElems(ctx); err != nil {
+		return 0, err
+	}
+
+	blocks, err := store.coveredBlocks(ctx, ng, snap)
+	if err != nil {
+		return 0, err
+	}
+	// Remove the deepest blocks first, so that an interrupted pruning
+	// resumes from the covered heads.
+	var removed int
+	for i := len(blocks) - 1; i >= 0; i-- {
+		c := blocks[i]
+		if err := store.dagService.Remove(ctx, c); err != nil {
+			return removed, fmt.Errorf("error removing %s: %w", c, err)
+		}
+		if err := store.markPruned(ctx, c); err != nil {
+			return removed, fmt.Errorf("error recording %s as pruned: %w", c, err)
+		}
+		removed++
+	}
+	if removed > 0 {
+		store.logger.Infof("pruned %d blocks below snapshot %s", removed, latest)
+	}
+	return removed, nil
+}
+
+// recordPeerHeads remembers heads broadcast by other replicas, which may not
+// have merged the latest snapshot yet.
+func (store *Datastore) recordPeerHeads(heads []cid.Cid) {
+	now := time.Now()
+	store.peerHeadsMux.Lock()
+	defer store.peerHeadsMux.Unlock()
+	for _, h := range heads {
+		store.peerHeads[h] = now
+	}
+}
+
+// recentPeerHeads returns the heads other replicas broadcast lately and
+// forgets the older ones.
+func (store *Datastore) recentPeerHeads() []cid.Cid {
+	since := time.Now().Add(-peerHeadsRebroadcasts * store.opts.RebroadcastInterval)
+	store.peerHeadsMux.Lock()
+	defer store.peerHeadsMux.Unlock()
+	heads := make([]cid.Cid, 0, len(store.peerHeads))
+	for h, seen := range store.peerHeads {
+		if seen.Before(since) {
+			delete(store.peerHeads, h)
+			continue
+		}
+		heads = append(heads, h)
+	}
+	return heads
+}
+
+// snapshotAgreed tells whether the heads of this replica, and those other
+// replicas broadcast lately, all descend from the latest snapshot. Heads
+// covered by the snapshot, pruned or not processed here yet are those of
+// replicas that have not merged it, which may still walk down to the blocks
+// it covers. From the other heads, every branch must reach the snapshot, or
+// the heads it covers, before any block with its priority or lower, which
+// would be concurrent to it.
+func (store *Datastore) snapshotAgreed(ctx context.Context, ng *crdtNodeGetter, latest cid.Cid, prio uint64, snap *snapshot) (bool, error) {
+	heads, _, err := store.heads.List(ctx)
+	if err != nil {
+		return false, fmt.Errorf("error listing heads: %w", err)
+	}
+	heads = append(heads, store.recentPeerHeads()...)
+
+	visited := cid.NewSet()
+	visited.Add(latest)
+	for _, h := range snap.heads {
+		visited.Add(h)
+	}
+	var queue []cid.Cid
+	for _, h := range heads {
+		if h == latest {
+			continue
+		}
+		if !visited.Visit(h) {
+			if slices.Contains(snap.heads, h) {
+				return false, nil
+			}
+			continue
+		}
+		processed, err := store.isProcessed(ctx, h)
+		if err != nil {
+			return false, fmt.Errorf("error checking for known block %s: %w", h, err)
+		}
+		pruned, err := store.isPruned(ctx, h)
+		if err != nil {
+			return false, err
+		}
+		if !processed || pruned {
+			return false, nil
+		}
+		queue = append(queue, h)
+	}
+
+	for len(queue) > 0 {
+		c := queue[0]
+		queue = queue[1:]
+
+		pruned, err := store.isPruned(ctx, c)
+		if err != nil {
+			return false, err
+		}
+		if pruned {
+			continue
+		}
+		cctx, cancel := context.WithTimeout(ctx, store.opts.DAGSyncerTimeout)
+		nd, delta, err := ng.GetDelta(cctx, c)
+		cancel()
+		if err != nil {
+			return false, fmt.Errorf("error getting %s: %w", c, err)
+		}
+		other, err := extractSnapshot(delta)
+		if err != nil {
+			return false, err
+		}
+		if other != nil {
+			// an older or concurrent snapshot, nothing below
+			continue
+		}
+		if delta.GetPriority() <= prio {
+			return false, nil
+		}
+		for _, l := range nd.Links() {
+			if visited.Visit(l.Cid) {
+				queue = append(queue, l.Cid)
+			}
+		}
+	}
+	return true, nil
+}
+
+// coveredBlocks returns the blocks reachable from the heads covered by a
+// snapshot, with the parts of the snapshots among them, that have not been
+// pruned yet. Blocks come before their children.
+func (store *Datastore) coveredBlocks(ctx context.Context, ng *crdtNodeGetter, snap *snapshot) ([]cid.Cid, error) {
+	visited := cid.NewSet()
+	var queue, blocks []cid.Cid
+	for _, h := range snap.heads {
+		if visited.Visit(h) {
+			queue = append(queue, h)
+		}
+	}
+
+	for len(queue) > 0 {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+		c := queue[0]
+		queue = queue[1:]
+
+		pruned, err := store.isPruned(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		if pruned {
+			continue
+		}
+		cctx, cancel := context.WithTimeout(ctx, store.opts.DAGSyncerTimeout)
+		nd, delta, err := ng.GetDelta(cctx, c)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("error getting %s: %w", c, err)
+		}
+		blocks = append(blocks, c)
+
+		other, err := extractSnapshot(delta)
+		if err != nil {
+			return nil, err
+		}
+		if other != nil {
+			for _, p := range other.parts {
+				pruned, err := store.isPruned(ctx, p)
+				if err != nil {
+					return nil, err
+				}
+				if !pruned {
+					blocks = append(blocks, p)
+				}
+			}
+		}
+		for _, l := range nd.Links() {
+			if visited.Visit(l.Cid) {
+				queue = append(queue, l.Cid)
+			}
+		}
+	}
+	return blocks, nil
+}
+
+// snapshotDue tells whether the DAG grew by SnapshotMinHeight since the
+// latest snapshot.
+func (store *Datastore) snapshotDue(ctx context.Context) (bool, error) {
+	_, height, err := store.heads.List(ctx)
+	if err != nil {
+		return false, err
+	}
+	_, prio, err := store.LatestSnapshot(ctx)
+	if err != nil {
+		return false, err
+	}
+	return height > prio && height-prio >= store.opts.SnapshotMinHeight, nil
+}
+
+func (store *Datastore) snapshots(ctx context.Context) {
+	if store.opts.SnapshotInterval == 0 {
+		return
+	}
+	// replicas snapshot at different times, so that one usually takes the
+	// snapshot the others then find
+	timer := time.NewTimer(randomizeInterval(store.opts.SnapshotInterval))
+	for {
+		select {
+		case <-ctx.Done():
+			if !timer.Stop() {
+				<-timer.C
+			}
+			return
+		case <-timer.C:
+			if store.opts.SnapshotPrune && (store.opts.SnapshotPruneGate == nil || store.opts.SnapshotPruneGate()) {
+				if _, err := store.PruneSnapshot(ctx); err != nil && ctx.Err() == nil {
+					store.logger.Errorf("error pruning snapshot: %s", err)
+				}
+			}
+			due, err := store.snapshotDue(ctx)
+			if err != nil {
+				store.logger.Error(err)
+			} else if due {
+				if _, err := store.Snapshot(ctx); err != nil && !errors.Is(err, ErrSnapshotBusy) && ctx.Err() == nil {
+					store.logger.Errorf("error taking snapshot: %s", err)
+				}
+			}
+			timer.Reset(randomizeInterval(store.opts.SnapshotInterval))
+		}
+	}
+}
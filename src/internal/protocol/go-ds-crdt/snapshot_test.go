@@ -0,0 +1,185 @@
+package crdt
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// mapDAGService is an in-memory DAGService.
+type mapDAGService struct {
+	mu    sync.RWMutex
+	nodes map[cid.Cid]ipld.Node
+}
+
+func newMapDAGService() *mapDAGService {
+	return &mapDAGService{nodes: make(map[cid.Cid]ipld.Node)}
+}
+
+func (m *mapDAGService) Get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if nd, ok := m.nodes[c]; ok {
+		return nd, nil
+	}
+	return nil, ipld.ErrNotFound{Cid: c}
+}
+
+func (m *mapDAGService) GetMany(ctx context.Context, cids []cid.Cid) <-chan *ipld.NodeOption {
+	out := make(chan *ipld.NodeOption, len(cids))
+	for _, c := range cids {
+		nd, err := m.Get(ctx, c)
+		out <- &ipld.NodeOption{Node: nd, Err: err}
+	}
+	close(out)
+	return out
+}
+
+func (m *mapDAGService) Add(ctx context.Context, nd ipld.Node) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nodes[nd.Cid()] = nd
+	return nil
+}
+
+func (m *mapDAGService) AddMany(ctx context.Context, nds []ipld.Node) error {
+	for _, nd := range nds {
+		_ = m.Add(ctx, nd)
+	}
+	return nil
+}
+
+func (m *mapDAGService) Remove(ctx context.Context, c cid.Cid) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.nodes, c)
+	return nil
+}
+
+func (m *mapDAGService) RemoveMany(ctx context.Context, cids []cid.Cid) error {
+	for _, c := range cids {
+		_ = m.Remove(ctx, c)
+	}
+	return nil
+}
+
+// newTestStore returns an offline replica keeping its blocks in dags.
+func newTestStore(t *testing.T, dags ipld.DAGService) *Datastore {
+	t.Helper()
+	store, err := New(dssync.MutexWrap(ds.NewMapDatastore()), ds.NewKey("/test"), dags, nil, DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+	return store
+}
+
+func testBlock(t *testing.T, data string) cid.Cid {
+	t.Helper()
+	nd, err := makeDataNode([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nd.Cid()
+}
+
+func TestCoverHeads(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t, newMapDAGService())
+	covered := testBlock(t, "covered")
+	unknown := testBlock(t, "unknown")
+	other := testBlock(t, "other")
+	root := testBlock(t, "root")
+	_ = store.heads.Add(ctx, covered, 1)
+	_ = store.heads.Add(ctx, other, 2)
+	_ = store.markProcessed(ctx, covered)
+
+	if err := store.coverHeads(ctx, &snapshot{heads: []cid.Cid{covered, unknown}}, root, 3); err != nil {
+		t.Fatal(err)
+	}
+	heads, height, _ := store.heads.List(ctx)
+	if len(heads) != 2 || height != 3 {
+		t.Fatalf("unexpected heads %v at height %d", heads, height)
+	}
+	for _, h := range heads {
+		if h == covered {
+			t.Fatal("expected the covered head to be replaced")
+		}
+	}
+	if pruned, _ := store.isPruned(ctx, covered); pruned {
+		t.Fatal("expected a block processed here not to be marked pruned")
+	}
+	if pruned, _ := store.isPruned(ctx, unknown); !pruned {
+		t.Fatal("expected a covered block never processed here to be marked pruned")
+	}
+}
+
+func TestPruneSnapshotWaitsForPeers(t *testing.T) {
+	ctx := context.Background()
+	dags := newMapDAGService()
+	store := newTestStore(t, dags)
+	for _, key := range []string{"/a", "/b", "/c"} {
+		if err := store.Put(ctx, ds.NewKey(key), []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Delete(ctx, ds.NewKey("/b")); err != nil {
+		t.Fatal(err)
+	}
+	old, _, _ := store.heads.List(ctx)
+	latest, err := store.Snapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prune := func() int {
+		t.Helper()
+		removed, err := store.PruneSnapshot(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return removed
+	}
+	forgetPeerHeads := func() {
+		store.peerHeadsMux.Lock()
+		defer store.peerHeadsMux.Unlock()
+		for h := range store.peerHeads {
+			store.peerHeads[h] = time.Now().Add(-peerHeadsRebroadcasts*store.opts.RebroadcastInterval - time.Second)
+		}
+	}
+
+	// a replica still at the heads the snapshot covers
+	store.recordPeerHeads(old)
+	if prune() != 0 {
+		t.Fatal("expected nothing to be pruned while a peer has not merged the snapshot")
+	}
+	// a replica with a branch not received here yet
+	forgetPeerHeads()
+	store.recordPeerHeads([]cid.Cid{testBlock(t, "concurrent")})
+	if prune() != 0 {
+		t.Fatal("expected nothing to be pruned while a peer has unknown heads")
+	}
+
+	forgetPeerHeads()
+	store.recordPeerHeads([]cid.Cid{latest})
+	if removed := prune(); removed != 4 {
+		t.Fatalf("expected the 4 covered blocks to be pruned, got %d", removed)
+	}
+	if _, err := dags.Get(ctx, old[0]); err == nil {
+		t.Fatal("expected the covered head to be removed from the DAG")
+	}
+	if v, err := store.Get(ctx, ds.NewKey("/a")); err != nil || string(v) != "/a" {
+		t.Fatalf("expected values to survive pruning, got %q (%v)", v, err)
+	}
+	if ok, _ := store.Has(ctx, ds.NewKey("/b")); ok {
+		t.Fatal("expected deleted keys to stay deleted")
+	}
+	if prune() != 0 {
+		t.Fatal("expected pruned blocks not to be pruned again")
+	}
+}
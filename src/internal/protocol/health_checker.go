@@ -0,0 +1,318 @@
+package protocol
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"opentela/internal/common"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultHealthPath             = "/health"
+	defaultHealthInterval         = 10 * time.Second
+	defaultHealthTimeout          = 5 * time.Second
+	defaultHealthSuccessThreshold = 1
+	defaultHealthFailureThreshold = 3
+)
+
+// HealthCheck holds the health check settings of a single service. Unset
+// fields fall back to the health.* settings of the node.
+type HealthCheck struct {
+	// Interval and Timeout are durations such as "30s"
+	Interval         string `json:"interval,omitempty"`
+	Timeout          string `json:"timeout,omitempty"`
+	SuccessThreshold int    `json:"success_threshold,omitempty"`
+	FailureThreshold int    `json:"failure_threshold,omitempty"`
+}
+
+func (c HealthCheck) validate() error {
+	for name, value := range map[string]string{"interval": c.Interval, "timeout": c.Timeout} {
+		if value == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+			return fmt.Errorf("%w: invalid health check %s %q", ErrInvalidService, name, value)
+		}
+	}
+	if c.SuccessThreshold < 0 || c.FailureThreshold < 0 {
+		return fmt.Errorf("%w: health check thresholds must not be negative", ErrInvalidService)
+	}
+	return nil
+}
+
+// healthConfig controls how local services are health checked.
+type healthConfig struct {
+	// path is probed on services that do not set their own HealthPath
+	path     string
+	interval time.Duration
+	timeout  time.Duration
+	// consecutive successes needed to become healthy again, and consecutive
+	// failures needed to become unhealthy
+	successThreshold int
+	failureThreshold int
+	// readinessPath, if set, receives readinessBody as a POST (e.g. a tiny
+	// completion) before an unhealthy service is considered healthy again, so
+	// that traffic only arrives once the engine actually serves requests
+	readinessPath string
+	readinessBody string
+}
+
+// healthConfigOf returns the health check settings of a node, with the
+// defaults in place of the unset ones.
+func healthConfigOf(node NodeConfig) healthConfig {
+	cfg := healthConfig{
+		path:             node.HealthPath,
+		interval:         node.HealthInterval,
+		timeout:          node.HealthTimeout,
+		successThreshold: node.HealthSuccessThreshold,
+		failureThreshold: node.HealthFailureThreshold,
+		readinessPath:    node.HealthReadinessPath,
+		readinessBody:    node.HealthReadinessBody,
+	}
+	if cfg.path == "" {
+		cfg.path = defaultHealthPath
+	}
+	if cfg.interval <= 0 {
+		cfg.interval = defaultHealthInterval
+	}
+	if cfg.timeout <= 0 {
+		cfg.timeout = defaultHealthTimeout
+	}
+	if cfg.successThreshold <= 0 {
+		cfg.successThreshold = defaultHealthSuccessThreshold
+	}
+	if cfg.failureThreshold <= 0 {
+		cfg.failureThreshold = defaultHealthFailureThreshold
+	}
+	return cfg
+}
+
+// forService returns the settings that apply to service, with its own
+// health path and health check settings taking precedence.
+func (cfg healthConfig) forService(service Service) healthConfig {
+	if service.HealthPath != "" {
+		cfg.path = service.HealthPath
+	}
+	check := service.HealthCheck
+	if check == nil {
+		return cfg
+	}
+	if d, err := time.ParseDuration(check.Interval); err == nil && d > 0 {
+		cfg.interval = d
+	}
+	if d, err := time.ParseDuration(check.Timeout); err == nil && d > 0 {
+		cfg.timeout = d
+	}
+	if check.SuccessThreshold > 0 {
+		cfg.successThreshold = check.SuccessThreshold
+	}
+	if check.FailureThreshold > 0 {
+		cfg.failureThreshold = check.FailureThreshold
+	}
+	return cfg
+}
+
+// serviceBaseURL is the URL the service is reached at from this node.
+func serviceBaseURL(service Service) string {
+	if service.Upstream != "" {
+		return strings.TrimSuffix(service.Upstream, "/")
+	}
+	host := service.Host
+	if host == "" {
+		host = "localhost"
+	}
+	return "http://" + host + ":" + service.Port
+}
+
+// serviceHealth tracks consecutive probe results of a service.
+type serviceHealth struct {
+	unhealthy bool
+	successes int
+	failures  int
+	// next is when the service is due to be probed again
+	next time.Time
+}
+
+// healthChecker periodically probes the local services and marks them
+// UNHEALTHY or healthy again once their thresholds are reached.
+type healthChecker struct {
+	mu     sync.Mutex
+	cfg    healthConfig
+	client *http.Client
+	states map[string]*serviceHealth
+}
+
+func newHealthChecker(cfg healthConfig) *healthChecker {
+	return &healthChecker{
+		cfg:    cfg,
+		client: &http.Client{},
+		states: make(map[string]*serviceHealth),
+	}
+}
+
+func (h *healthChecker) probe(ctx context.Context, cfg healthConfig, service Service) error {
+	return h.request(ctx, cfg.timeout, http.MethodGet, serviceBaseURL(service)+cfg.path, "")
+}
+
+// ready sends the readiness request, if one is configured.
+func (h *healthChecker) ready(ctx context.Context, cfg healthConfig, service Service) error {
+	if cfg.readinessPath == "" {
+		return nil
+	}
+	return h.request(ctx, cfg.timeout, http.MethodPost, serviceBaseURL(service)+cfg.readinessPath, cfg.readinessBody)
+}
+
+func (h *healthChecker) request(ctx context.Context, timeout time.Duration, method, url, body string) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// checkAll probes the local services of the node that are due, concurrently,
+// and applies the resulting status changes. It reports whether any service
+// changed status.
+func (h *healthChecker) checkAll(ctx context.Context, n *Node) bool {
+	type check struct {
+		cfg     healthConfig
+		service Service
+		state   *serviceHealth
+	}
+	now := time.Now()
+	var due []check
+	h.mu.Lock()
+	seen := make(map[string]struct{})
+	for _, service := range n.snapshotLocalServices() {
+		id := service.Name + "|" + service.Port
+		seen[id] = struct{}{}
+		state, ok := h.states[id]
+		if !ok {
+			state = &serviceHealth{unhealthy: service.Status == UNHEALTHY}
+			h.states[id] = state
+		}
+		if now.Before(state.next) {
+			continue
+		}
+		cfg := h.cfg.forService(service)
+		state.next = now.Add(cfg.interval)
+		due = append(due, check{cfg: cfg, service: service, state: state})
+	}
+	// forget services that were deregistered
+	for id := range h.states {
+		if _, ok := seen[id]; !ok {
+			delete(h.states, id)
+		}
+	}
+	h.mu.Unlock()
+
+	// each state is only updated by the goroutine probing its service
+	var wg sync.WaitGroup
+	var changed atomic.Bool
+	for _, c := range due {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if h.check(ctx, n, c.cfg, c.service, c.state) {
+				changed.Store(true)
+			}
+		}()
+	}
+	wg.Wait()
+	return changed.Load()
+}
+
+// check probes a single service and reports whether it changed status.
+func (h *healthChecker) check(ctx context.Context, n *Node, cfg healthConfig, service Service, state *serviceHealth) bool {
+	if err := h.probe(ctx, cfg, service); err != nil {
+		state.successes = 0
+		state.failures++
+		if state.unhealthy || state.failures < cfg.failureThreshold {
+			return false
+		}
+		common.Logger.Warnf("Service %s on port %s is unhealthy after %d failed checks: %v", service.Name, service.Port, state.failures, err)
+		state.unhealthy = true
+		return n.setServiceHealth(service, false)
+	}
+	state.failures = 0
+	state.successes++
+	if !state.unhealthy || state.successes < cfg.successThreshold {
+		return false
+	}
+	if err := h.ready(ctx, cfg, service); err != nil {
+		common.Logger.Warnf("Service %s on port %s passed health checks but is not ready: %v", service.Name, service.Port, err)
+		state.successes = 0
+		return false
+	}
+	common.Logger.Infof("Service %s on port %s is healthy again", service.Name, service.Port)
+	state.unhealthy = false
+	return n.setServiceHealth(service, true)
+}
+
+// setServiceHealth updates the status of the local service. Draining services
+// keep their status, as they are out of rotation anyway.
+func (n *Node) setServiceHealth(service Service, healthy bool) bool {
+	status := UNHEALTHY
+	if healthy {
+		status = CONNECTED
+	}
+	n.servicesLock.Lock()
+	defer n.servicesLock.Unlock()
+	for i := range n.services {
+		svc := &n.services[i]
+		if !sameService(*svc, service) || svc.Status == DRAINING || svc.Status == status {
+			continue
+		}
+		svc.Status = status
+		return true
+	}
+	return false
+}
+
+// StartHealthChecks probes the local services of the default node until ctx
+// is done.
+func StartHealthChecks(ctx context.Context) {
+	defaultNode().StartHealthChecks(ctx)
+}
+
+// StartHealthChecks probes the local services until ctx is done and
+// republishes them whenever one of them changes health.
+func (n *Node) StartHealthChecks(ctx context.Context) {
+	h := newHealthChecker(healthConfigOf(n.settings()))
+	// services are probed once due, at their own interval
+	ticker := time.NewTicker(min(h.cfg.interval, time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !h.checkAll(ctx, n) {
+				continue
+			}
+			if err := n.publishLocalServices(); err != nil {
+				common.Logger.Warn("Failed to publish service health: ", err)
+			}
+		}
+	}
+}
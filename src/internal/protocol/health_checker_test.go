@@ -0,0 +1,161 @@
+package protocol
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeEngine serves /health with a status that can be flipped, and counts the
+// readiness requests it receives.
+type fakeEngine struct {
+	healthy   atomic.Bool
+	readiness atomic.Int32
+	ready     atomic.Bool
+}
+
+func (e *fakeEngine) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/health":
+		if !e.healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	case "/v1/completions":
+		e.readiness.Add(1)
+		if !e.ready.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func localServiceStatus(t *testing.T, n *Node) string {
+	t.Helper()
+	snap := n.snapshotLocalServices()
+	if len(snap) != 1 {
+		t.Fatalf("expected one local service, got %+v", snap)
+	}
+	return snap[0].Status
+}
+
+func TestHealthCheckerThresholds(t *testing.T) {
+	engine := &fakeEngine{}
+	engine.healthy.Store(true)
+	srv := httptest.NewServer(engine)
+	defer srv.Close()
+
+	n := newNode()
+	n.addLocalService(Service{Name: "llm", Upstream: srv.URL, Status: CONNECTED})
+	h := newHealthChecker(healthConfig{path: "/health", timeout: time.Second, successThreshold: 2, failureThreshold: 2})
+	ctx := context.Background()
+
+	if h.checkAll(ctx, n) || localServiceStatus(t, n) != CONNECTED {
+		t.Fatal("a healthy service must stay connected")
+	}
+
+	engine.healthy.Store(false)
+	if h.checkAll(ctx, n) {
+		t.Fatal("a single failure must not change the status")
+	}
+	if !h.checkAll(ctx, n) || localServiceStatus(t, n) != UNHEALTHY {
+		t.Fatal("expected the service to be unhealthy after two failures")
+	}
+	if _, ok := n.lookupLocalService("llm"); !ok {
+		t.Fatal("an unhealthy service is still served locally")
+	}
+
+	engine.healthy.Store(true)
+	if h.checkAll(ctx, n) {
+		t.Fatal("a single success must not change the status")
+	}
+	if !h.checkAll(ctx, n) || localServiceStatus(t, n) != CONNECTED {
+		t.Fatal("expected the service to be healthy after two successes")
+	}
+}
+
+func TestHealthCheckerReadiness(t *testing.T) {
+	engine := &fakeEngine{}
+	srv := httptest.NewServer(engine)
+	defer srv.Close()
+
+	n := newNode()
+	n.addLocalService(Service{Name: "llm", Upstream: srv.URL, Status: UNHEALTHY})
+	h := newHealthChecker(healthConfig{
+		path: "/health", timeout: time.Second, successThreshold: 1, failureThreshold: 1,
+		readinessPath: "/v1/completions", readinessBody: `{"prompt":"hi","max_tokens":1}`,
+	})
+	ctx := context.Background()
+
+	engine.healthy.Store(true)
+	if h.checkAll(ctx, n) || localServiceStatus(t, n) != UNHEALTHY {
+		t.Fatal("the service must stay unhealthy until the readiness request succeeds")
+	}
+	engine.ready.Store(true)
+	if !h.checkAll(ctx, n) || localServiceStatus(t, n) != CONNECTED {
+		t.Fatal("expected the service to be healthy once ready")
+	}
+	if got := engine.readiness.Load(); got != 2 {
+		t.Fatalf("expected 2 readiness requests, got %d", got)
+	}
+}
+
+func TestHealthCheckerKeepsDrainingStatus(t *testing.T) {
+	srv := httptest.NewServer(&fakeEngine{})
+	defer srv.Close()
+
+	n := newNode()
+	n.addLocalService(Service{Name: "llm", Upstream: srv.URL, Status: DRAINING})
+	h := newHealthChecker(healthConfig{path: "/health", timeout: time.Second, successThreshold: 1, failureThreshold: 1})
+	if h.checkAll(context.Background(), n) || localServiceStatus(t, n) != DRAINING {
+		t.Fatal("health checks must not override a draining service")
+	}
+}
+
+func TestHealthCheckerPerServiceSettings(t *testing.T) {
+	engine := &fakeEngine{}
+	srv := httptest.NewServer(engine)
+	defer srv.Close()
+
+	n := newNode()
+	n.addLocalService(Service{Name: "llm", Upstream: srv.URL, Status: CONNECTED, HealthCheck: &HealthCheck{FailureThreshold: 1}})
+	n.addLocalService(Service{Name: "vision", Upstream: srv.URL, Status: CONNECTED, HealthCheck: &HealthCheck{Interval: "1h"}})
+	h := newHealthChecker(healthConfig{path: "/health", timeout: time.Second, successThreshold: 1, failureThreshold: 2})
+	ctx := context.Background()
+
+	if !h.checkAll(ctx, n) {
+		t.Fatal("expected the service with a failure threshold of 1 to become unhealthy")
+	}
+	// vision is not due for another hour, llm falls back to the node interval
+	h.checkAll(ctx, n)
+	for _, s := range n.snapshotLocalServices() {
+		want := CONNECTED
+		if s.Name == "llm" {
+			want = UNHEALTHY
+		}
+		if s.Status != want {
+			t.Fatalf("expected %s to be %s, got %s", s.Name, want, s.Status)
+		}
+	}
+}
+
+func TestHealthCheckerProbesConcurrently(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+	}))
+	defer slow.Close()
+
+	n := newNode()
+	for _, port := range []string{"1", "2", "3"} {
+		n.addLocalService(Service{Name: "llm", Port: port, Upstream: slow.URL, Status: CONNECTED})
+	}
+	h := newHealthChecker(healthConfig{path: "/health", timeout: time.Second, successThreshold: 1, failureThreshold: 1})
+	start := time.Now()
+	h.checkAll(context.Background(), n)
+	if elapsed := time.Since(start); elapsed >= 600*time.Millisecond {
+		t.Fatalf("expected the services to be probed concurrently, took %s", elapsed)
+	}
+}
@@ -1,19 +1,13 @@
 package protocol
 
 import (
-	"bytes"
 	"context"
-	"crypto/rand"
-	"crypto/sha256"
-	"encoding/hex"
 	"encoding/json"
 	"errors"
 	mrand "math/rand"
 	"net"
 	"opentela/internal/common"
 	"os"
-	"strconv"
-	"sync"
 	"time"
 
 	"github.com/ipfs/boxo/ipns"
@@ -27,124 +21,113 @@ import (
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/routing"
-	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
+	relayv2 "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
 	"github.com/libp2p/go-libp2p/p2p/security/noise"
 	libp2ptls "github.com/libp2p/go-libp2p/p2p/security/tls"
-	"github.com/spf13/viper"
+	"github.com/multiformats/go-multiaddr"
 )
 
+// P2PNode and MyID are the host and peer ID of the default node, set when it
+// starts.
 var P2PNode *host.Host
-var ddht *dualdht.DHT
-var hostOnce sync.Once
 var MyID string
 
-const (
-	Version = "0.0.0-dev.0"
-)
-
+// GetP2PNode returns the host and DHT of the default node, creating them on
+// first use. ds backs the DHT records if the host is not created yet.
 func GetP2PNode(ds datastore.Batching) (host.Host, dualdht.DHT) {
-	hostOnce.Do(func() {
-		ctx := context.Background()
-		var err error
-		seed := viper.GetString("seed")
-		// try to parse the seed as int64
-		seedInt, err := strconv.ParseInt(seed, 10, 64)
-		if err != nil {
-			common.Logger.Error("Seed is not a valid int64 value: ", seed, " parse error: ", err)
-			os.Exit(1)
-		}
-		host, err := newHost(ctx, seedInt, ds)
-		if err != nil {
-			common.Logger.Error("Error while creating P2P node: ", err)
-			os.Exit(1)
+	n := defaultNode()
+	if ds != nil && n.cfg == nil {
+		if cfg, err := n.config(); err == nil {
+			cfg.DHTDatastore = ds
+			n.cfg = &cfg
 		}
-		MyID = host.ID().String()
-		P2PNode = &host
-	})
-	return *P2PNode, *ddht
+	}
+	h, err := n.hostOrStart()
+	if err != nil {
+		common.Logger.Error("Error while creating P2P node: ", err)
+		os.Exit(1)
+	}
+	return h, *n.dht
 }
 
-func newHost(ctx context.Context, seed int64, ds datastore.Batching) (host.Host, error) {
-	var err error
-	if err != nil {
-		common.Logger.Error("Error while creating connection manager: ", err)
-	}
-	var priv crypto.PrivKey
-	// try to load the private key from file
-	if seed == 0 {
-		// try to load from the file
-		priv = loadKeyFromFile()
-		if priv == nil {
-			common.Logger.Info("No existing private key found, generating a new one...")
-			r := rand.Reader
-			priv, _, err = crypto.GenerateKeyPairWithReader(crypto.RSA, 2048, r)
-			if err != nil {
-				return nil, err
-			}
-			writeKeyToFile(priv)
-		}
-	} else {
-		r := mrand.New(mrand.NewSource(seed))
-		priv, _, err = crypto.GenerateKeyPairWithReader(crypto.RSA, 2048, r)
-		if err != nil {
-			return nil, err
-		}
-		writeKeyToFile(priv)
+// nodeKey returns the private key of the node: the configured identity, one
+// derived from the seed, or the one in the key file, generated on first run.
+func nodeKey(cfg NodeConfig) (crypto.PrivKey, error) {
+	if cfg.Identity != nil {
+		return cfg.Identity, nil
 	}
-	if err != nil {
+	if cfg.Seed != 0 {
+		// kept so that seeded nodes keep their peer ID; the key is not
+		// written to the key file anymore
+		common.Logger.Warn("Deriving the identity from --seed, which is predictable; use `otela key derive` instead")
+		r := mrand.New(mrand.NewSource(cfg.Seed))
+		priv, _, err := crypto.GenerateKeyPairWithReader(crypto.RSA, 2048, r)
+		return priv, err
+	}
+	keyPath := cfg.KeyPath
+	if keyPath == "" {
+		keyPath = IdentityKeyPath()
+	}
+	common.Logger.Info("Looking for keys under: ", keyPath)
+	priv, err := LoadIdentityKey(keyPath)
+	if err == nil {
+		return priv, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
 		return nil, err
 	}
+	common.Logger.Info("No existing private key found, generating a new one...")
+	if priv, err = GenerateIdentityKey("ed25519"); err != nil {
+		return nil, err
+	}
+	if err := SaveIdentityKey(keyPath, priv, false); err != nil {
+		return nil, err
+	}
+	return priv, nil
+}
 
-	hash := sha256.Sum256([]byte(Version))
-	keyHex := hex.EncodeToString(hash[:])
-
-	var buf bytes.Buffer
-	buf.WriteString("/key/swarm/psk/1.0.0/\n")
-	buf.WriteString("/base16/\n")
-	buf.WriteString(keyHex + "\n")
-
-	// psk, err := pnet.DecodeV1PSK(bytes.NewReader(buf.Bytes()))
-	// if err != nil {
-	// 	panic(err)
-	// }
+func (n *Node) newHost(ctx context.Context, cfg NodeConfig) (host.Host, *dualdht.DHT, error) {
+	if cfg.Role == "" {
+		cfg.Role = defaultRole
+	}
+	if err := ValidateRole(cfg.Role); err != nil {
+		return nil, nil, err
+	}
+	if err := common.ValidateNetworkID(cfg.NetworkID); err != nil {
+		return nil, nil, err
+	}
+	behavior := roleBehaviors[cfg.Role]
+	if err := n.acl.setStatic(cfg.ACL); err != nil {
+		return nil, nil, err
+	}
 
-	opts := []libp2p.Option{
-		libp2p.DefaultTransports,
-		libp2p.Identity(priv),
-		// libp2p.PrivateNetwork(psk),
-		libp2p.ResourceManager(&network.NullResourceManager{}),
-		// libp2p.ConnectionManager(connmgr),
-		libp2p.NATPortMap(),
-		libp2p.ListenAddrStrings(
-			"/ip4/0.0.0.0/tcp/"+viper.GetString("tcpport"),
-			"/ip4/0.0.0.0/tcp/"+viper.GetString("tcpport")+"/ws",
-			"/ip4/0.0.0.0/udp/"+viper.GetString("udpport")+"/quic",
-		),
-		libp2p.Security(libp2ptls.ID, libp2ptls.New),
-		libp2p.Security(noise.ID, noise.New),
-		libp2p.EnableNATService(),
-		libp2p.EnableRelay(),
-		libp2p.EnableHolePunching(),
-		libp2p.EnableAutoNATv2(),
-		libp2p.EnableRelayService(),
-		libp2p.ForceReachabilityPublic(),
-		libp2p.Routing(func(h host.Host) (routing.PeerRouting, error) {
-			ddht, err = newDHT(ctx, h, ds)
-			return ddht, err
-		}),
+	var host host.Host
+	var ddht *dualdht.DHT
+	var err error
+	if cfg.Host != nil {
+		host = cfg.Host
+		if ddht, err = newDHT(ctx, host, cfg.DHTDatastore, behavior.dhtClient); err != nil {
+			return nil, nil, err
+		}
+	} else if host, ddht, err = n.newLibp2pHost(ctx, cfg, behavior); err != nil {
+		return nil, nil, err
 	}
 
-	host, err := libp2p.New(opts...)
-	if err != nil {
-		return nil, err
+	if cfg.NetworkID != "" {
+		common.Logger.Infof("Joining network %q", cfg.NetworkID)
 	}
+	if err := n.watchIdentify(ctx, host); err != nil {
+		_ = host.Close()
+		return nil, nil, err
+	}
+	advertiseProtocols(host, n.localProtocols())
 
 	// Log connection events for debugging
 	host.Network().Notify(&network.NotifyBundle{
-		ConnectedF: func(n network.Network, c network.Conn) {
-			common.Logger.Info("Connected to peer: ", c.RemotePeer(), " Total connections: ", len(n.Conns()))
+		ConnectedF: func(net network.Network, c network.Conn) {
+			common.Logger.Info("Connected to peer: ", c.RemotePeer(), " Total connections: ", len(net.Conns()))
 			// On (re)connections, re-announce local services
-			go ReannounceLocalServices()
+			go n.ReannounceLocalServices()
 
 			// Mark peer as connected in node table immediately
 			go func(pid peer.ID) {
@@ -152,7 +135,7 @@ func newHost(ctx context.Context, seed int64, ds datastore.Batching) (host.Host,
 				if pid == host.ID() {
 					return
 				}
-				p, err := GetPeerFromTable(pid.String())
+				p, err := n.GetPeerFromTable(pid.String())
 				if err != nil {
 					p = Peer{ID: pid.String()}
 					common.Logger.Infof("Adding peer: [%s] triggered by new connection", pid.String())
@@ -162,20 +145,24 @@ func newHost(ctx context.Context, seed int64, ds datastore.Batching) (host.Host,
 				p.Connected = true
 				p.LastSeen = time.Now().Unix()
 				if b, e := json.Marshal(p); e == nil {
-					UpdateNodeTableHook(datastore.NewKey(pid.String()), b)
+					n.UpdateNodeTableHook(datastore.NewKey(pid.String()), b)
 				} else {
 					common.Logger.Error("Failed to marshal peer on connect: ", e)
 				}
 			}(c.RemotePeer())
 		},
-		DisconnectedF: func(n network.Network, c network.Conn) {
-			common.Logger.Info("Disconnected from peer: ", c.RemotePeer(), " Total connections: ", len(n.Conns()))
+		DisconnectedF: func(net network.Network, c network.Conn) {
+			common.Logger.Info("Disconnected from peer: ", c.RemotePeer(), " Total connections: ", len(net.Conns()))
 			// Mark peer as disconnected in node table immediately
 			go func(pid peer.ID) {
 				if pid == host.ID() {
 					return
 				}
-				p, err := GetPeerFromTable(pid.String())
+				// the peer may run another version when it reconnects
+				if net.Connectedness(pid) != network.Connected {
+					n.protocols.forget(pid.String())
+				}
+				p, err := n.GetPeerFromTable(pid.String())
 				if err != nil {
 					p = Peer{ID: pid.String()}
 				}
@@ -183,7 +170,7 @@ func newHost(ctx context.Context, seed int64, ds datastore.Batching) (host.Host,
 				common.Logger.Infof("Removing peer: [%s] triggered by disconnection", pid.String())
 				// keep LastSeen as last known good; do not bump here
 				if b, e := json.Marshal(p); e == nil {
-					UpdateNodeTableHook(datastore.NewKey(pid.String()), b)
+					n.UpdateNodeTableHook(datastore.NewKey(pid.String()), b)
 				} else {
 					common.Logger.Error("Failed to marshal peer on disconnect: ", e)
 				}
@@ -191,14 +178,81 @@ func newHost(ctx context.Context, seed int64, ds datastore.Batching) (host.Host,
 		},
 	})
 
+	n.discovery = newBootstrapDiscovery(host, ddht, cfg.NetworkID)
 	// Start a background auto-reconnector that watches connectivity
-	go startAutoReconnect(ctx, host)
+	go n.startAutoReconnect(ctx, host)
+	if cfg.BootstrapRefresh > 0 && cfg.Mode != "standalone" {
+		go n.refreshBootstraps(ctx, host, cfg.BootstrapRefresh, behavior.bootstrap)
+	}
+
+	return host, ddht, nil
+}
+
+// newLibp2pHost creates the libp2p host of the node and its DHT.
+func (n *Node) newLibp2pHost(ctx context.Context, cfg NodeConfig, behavior roleBehavior) (host.Host, *dualdht.DHT, error) {
+	priv, err := nodeKey(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	transports, err := n.transportOptions(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	if n.privateNetwork != "" {
+		common.Logger.Infof("Private network mode enabled, swarm key fingerprint %s", n.privateNetwork)
+	}
+
+	resources, limits, err := resourceOptions(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	n.limits = limits
+
+	var ddht *dualdht.DHT
+	gater := &aclGater{acl: n.acl, foreign: &n.foreign}
+	opts := append(transports, resources...)
+	opts = append(opts,
+		libp2p.Identity(priv),
+		libp2p.UserAgent(userAgent(cfg.NetworkID)),
+		libp2p.ConnectionGater(gater),
+		libp2p.NATPortMap(),
+		libp2p.Security(libp2ptls.ID, libp2ptls.New),
+		libp2p.Security(noise.ID, noise.New),
+		libp2p.EnableRelay(),
+		libp2p.EnableHolePunching(),
+		libp2p.EnableAutoNATv2(),
+		libp2p.Routing(func(h host.Host) (routing.PeerRouting, error) {
+			var err error
+			ddht, err = newDHT(ctx, h, cfg.DHTDatastore, behavior.dhtClient)
+			return ddht, err
+		}),
+	)
+	if behavior.natService {
+		opts = append(opts, libp2p.EnableNATService())
+	}
+	if behavior.relayService {
+		opts = append(opts, libp2p.EnableRelayService(
+			relayv2.WithResources(relayResources(cfg)),
+			relayv2.WithACL(gater),
+		))
+	}
+	if cfg.PublicAddr != "" {
+		opts = append(opts, libp2p.ForceReachabilityPublic())
+	} else {
+		// AutoNAT tells whether the node is reachable; if it is not, slots
+		// are reserved on relays and the relayed addresses advertised
+		opts = append(opts, libp2p.EnableAutoRelayWithPeerSource(n.relayPeers(cfg.TCPPort)))
+	}
 
-	return host, nil
+	host, err := libp2p.New(opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return host, ddht, nil
 }
 
 // startAutoReconnect periodically checks if we lost connectivity and attempts to reconnect to bootstraps with backoff.
-func startAutoReconnect(ctx context.Context, h host.Host) {
+func (n *Node) startAutoReconnect(ctx context.Context, h host.Host) {
 	const (
 		healthCheckInterval = 30 * time.Second
 		minBackoff          = 5 * time.Second
@@ -225,7 +279,7 @@ func startAutoReconnect(ctx context.Context, h host.Host) {
 				}
 			}
 
-			if tryReconnectToBootstraps(ctx, h, dialTimeout) {
+			if n.tryReconnectToBootstraps(ctx, h, dialTimeout) {
 				if attempt > 1 {
 					common.Logger.Infof("P2P connectivity restored after %d attempts; resetting backoff", attempt)
 				}
@@ -251,18 +305,34 @@ func startAutoReconnect(ctx context.Context, h host.Host) {
 	}
 }
 
-func tryReconnectToBootstraps(ctx context.Context, h host.Host, dialTimeout time.Duration) bool {
-	mode := viper.GetString("mode")
-	addrs := getDefaultBootstrapPeers(nil, mode)
+func (n *Node) tryReconnectToBootstraps(ctx context.Context, h host.Host, dialTimeout time.Duration) bool {
+	addrs := n.bootstrapPeers()
 	if len(addrs) == 0 {
 		common.Logger.Warn("Reconnect attempt skipped: no bootstrap addresses configured")
 		return false
 	}
 
+	if n.dialBootstraps(ctx, h, addrs, dialTimeout) > 0 {
+		go n.Reconnect()
+		return true
+	}
+
+	common.Logger.Warn("Reconnect attempt failed; no bootstrap peers reachable")
+	return false
+}
+
+// bootstrapPeers resolves the bootstrap sources of the node.
+func (n *Node) bootstrapPeers() []multiaddr.Multiaddr {
+	return getDefaultBootstrapPeers(n.cfg.Bootstraps, n.cfg.Mode, n.discovery)
+}
+
+// dialBootstraps connects to the bootstraps the host is not connected to yet
+// and returns how many of them it is connected to.
+func (n *Node) dialBootstraps(ctx context.Context, h host.Host, addrs []multiaddr.Multiaddr, dialTimeout time.Duration) int {
 	peerInfos, err := peer.AddrInfosFromP2pAddrs(addrs...)
 	if err != nil {
 		common.Logger.Error("Failed to parse bootstrap peers during reconnect: ", err)
-		return false
+		return 0
 	}
 
 	successes := 0
@@ -272,6 +342,7 @@ func tryReconnectToBootstraps(ctx context.Context, h host.Host, dialTimeout time
 		}
 
 		if h.Network().Connectedness(info.ID) == network.Connected {
+			h.ConnManager().Protect(info.ID, connTagBootstrap)
 			successes++
 			continue
 		}
@@ -286,6 +357,7 @@ func tryReconnectToBootstraps(ctx context.Context, h host.Host, dialTimeout time
 		cancel()
 
 		if err != nil {
+			err = n.explainDialError(err)
 			if isTransientNetworkError(err) {
 				common.Logger.With("peer", info.ID).Debugf("Transient error connecting to bootstrap: %v", err)
 			} else {
@@ -295,16 +367,29 @@ func tryReconnectToBootstraps(ctx context.Context, h host.Host, dialTimeout time
 		}
 
 		common.Logger.Infof("Connected to bootstrap peer %s", info.ID)
+		h.ConnManager().Protect(info.ID, connTagBootstrap)
 		successes++
 	}
+	return successes
+}
 
-	if successes > 0 {
-		go Reconnect()
-		return true
+// refreshBootstraps resolves the bootstrap sources every interval, so that
+// bootstraps appearing in them are dialed without waiting for the node to
+// lose all its connections. Nodes able to serve as bootstraps also advertise
+// themselves under the rendezvous namespaces of their sources.
+func (n *Node) refreshBootstraps(ctx context.Context, h host.Host, interval time.Duration, advertise bool) {
+	const dialTimeout = 10 * time.Second
+	for {
+		if advertise {
+			n.discovery.advertise(ctx, bootstrapSources(n.cfg.Bootstraps, n.cfg.Mode))
+		}
+		if !waitFor(ctx, interval) {
+			return
+		}
+		if addrs := n.bootstrapPeers(); len(addrs) > 0 {
+			n.dialBootstraps(ctx, h, addrs, dialTimeout)
+		}
 	}
-
-	common.Logger.Warn("Reconnect attempt failed; no bootstrap peers reachable")
-	return false
 }
 
 func waitFor(ctx context.Context, d time.Duration) bool {
@@ -376,12 +461,16 @@ func isTransientNetworkError(err error) bool {
 	return false
 }
 
-func newDHT(ctx context.Context, h host.Host, ds datastore.Batching) (*dualdht.DHT, error) {
+func newDHT(ctx context.Context, h host.Host, ds datastore.Batching, client bool) (*dualdht.DHT, error) {
+	mode := dht.ModeAuto
+	if client {
+		mode = dht.ModeClient
+	}
 	dhtOpts := []dualdht.Option{
 		dualdht.DHTOption(dht.NamespacedValidator("pk", record.PublicKeyValidator{})),
 		dualdht.DHTOption(dht.NamespacedValidator("ipns", ipns.Validator{KeyBook: h.Peerstore()})),
 		dualdht.DHTOption(dht.Concurrency(512)),
-		dualdht.DHTOption(dht.Mode(dht.ModeAuto)),
+		dualdht.DHTOption(dht.Mode(mode)),
 	}
 	if ds != nil {
 		dhtOpts = append(dhtOpts, dualdht.DHTOption(dht.Datastore(ds)))
@@ -389,10 +478,18 @@ func newDHT(ctx context.Context, h host.Host, ds datastore.Batching) (*dualdht.D
 	return dualdht.New(ctx, h, dhtOpts...)
 }
 
-// GetConnectedPeers returns the list of connected peers
+// ConnectedPeers returns the peers the default node is connected to.
 func ConnectedPeers() []*peer.AddrInfo {
+	return defaultNode().ConnectedPeers()
+}
+
+// ConnectedPeers returns the peers the node is connected to.
+func (n *Node) ConnectedPeers() []*peer.AddrInfo {
 	var pinfos = []*peer.AddrInfo{}
-	host, _ := GetP2PNode(nil)
+	host, err := n.hostOrStart()
+	if err != nil {
+		return pinfos
+	}
 	for _, p := range host.Peerstore().Peers() {
 		// check if the peer is connected
 		if host.Network().Connectedness(p) == network.Connected {
@@ -406,8 +503,17 @@ func ConnectedPeers() []*peer.AddrInfo {
 }
 
 func AllPeers() []*PeerWithStatus {
+	return defaultNode().AllPeers()
+}
+
+// AllPeers returns the peers known to the host of the node, connected or
+// not.
+func (n *Node) AllPeers() []*PeerWithStatus {
 	var pinfos = []*PeerWithStatus{}
-	host, _ := GetP2PNode(nil)
+	host, err := n.hostOrStart()
+	if err != nil {
+		return pinfos
+	}
 	for _, p := range host.Peerstore().Peers() {
 		pinfos = append(pinfos, &PeerWithStatus{
 			ID:            p.String(),
@@ -418,14 +524,22 @@ func AllPeers() []*PeerWithStatus {
 }
 
 func ConnectedBootstraps() []string {
+	return defaultNode().ConnectedBootstraps()
+}
+
+// ConnectedBootstraps returns the addresses of the bootstrap candidates the
+// node is connected to, itself included.
+func (n *Node) ConnectedBootstraps() []string {
 	var bootstraps = []string{}
-	dnt := GetAllPeers()
-	host, _ := GetP2PNode(nil)
-	for _, p := range *dnt {
-		if p.PublicAddress != "" {
+	host, err := n.hostOrStart()
+	if err != nil {
+		return bootstraps
+	}
+	for _, p := range *n.GetAllPeers() {
+		if isBootstrapCandidate(p) {
 			common.Logger.Info("Peer: ", p.ID, " Public Address: ", p.PublicAddress, " Connectedness: ", host.Network().Connectedness(peer.ID(p.ID)), " Host ID: ", host.ID())
 			if host.Network().Connectedness(peer.ID(p.ID)) == network.Connected || host.ID().String() == p.ID {
-				bootstrapAddr := "/ip4/" + p.PublicAddress + "/tcp/" + viper.GetString("tcpport") + "/p2p/" + p.ID
+				bootstrapAddr := "/ip4/" + p.PublicAddress + "/tcp/" + n.cfg.TCPPort + "/p2p/" + p.ID
 				bootstraps = append(bootstraps, bootstrapAddr)
 			}
 		}
@@ -433,29 +547,3 @@ func ConnectedBootstraps() []string {
 	bootstraps = common.DeduplicateStrings(bootstraps)
 	return bootstraps
 }
-
-// GetResourceManagerStats returns current resource usage statistics
-func GetResourceManagerStats() {
-	host, _ := GetP2PNode(nil)
-	if rm := host.Network().ResourceManager(); rm != nil {
-		// Try to get stats if available
-		if statsGetter, ok := rm.(interface {
-			Stat() rcmgr.ResourceManagerStat
-		}); ok {
-			stats := statsGetter.Stat()
-			common.Logger.Infof("Resource Manager Stats - System: Conns=%d (in:%d out:%d), Streams=%d (in:%d out:%d), Memory=%d",
-				stats.System.NumConnsInbound+stats.System.NumConnsOutbound,
-				stats.System.NumConnsInbound,
-				stats.System.NumConnsOutbound,
-				stats.System.NumStreamsInbound+stats.System.NumStreamsOutbound,
-				stats.System.NumStreamsInbound,
-				stats.System.NumStreamsOutbound,
-				stats.System.Memory,
-			)
-		} else {
-			common.Logger.Info("Resource Manager present but stats not available")
-		}
-	} else {
-		common.Logger.Info("No Resource Manager configured")
-	}
-}
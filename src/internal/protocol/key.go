@@ -1,55 +1,166 @@
 package protocol
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"opentela/internal/common"
 	"os"
 	"path"
+	"strings"
 
 	"github.com/libp2p/go-libp2p/core/crypto"
-	"github.com/mitchellh/go-homedir"
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/argon2"
 )
 
-func writeKeyToFile(priv crypto.PrivKey) {
-	keyData, err := crypto.MarshalPrivateKey(priv)
-	if err != nil {
-		common.Logger.Error("Error while marshalling private key: ", err)
+// Formats identity keys are imported from and exported to.
+const (
+	// KeyFormatProtobuf is the libp2p protobuf encoding, which the key file
+	// of the node is stored in
+	KeyFormatProtobuf = "protobuf"
+	// KeyFormatPEM is a PKCS #8 "PRIVATE KEY" block
+	KeyFormatPEM = "pem"
+)
+
+const pemKeyType = "PRIVATE KEY"
+
+// Cost of the key derivation, argon2id with the parameters recommended by
+// RFC 9106 for memory-constrained environments.
+const (
+	deriveTime    = 3
+	deriveMemory  = 64 * 1024
+	deriveThreads = 4
+)
+
+var keyTypes = map[string]int{
+	"ed25519":   crypto.Ed25519,
+	"rsa":       crypto.RSA,
+	"secp256k1": crypto.Secp256k1,
+	"ecdsa":     crypto.ECDSA,
+}
+
+// IdentityKeyPath returns the file holding the identity of the node: the
+// key.path setting, or id in the keys directory.
+func IdentityKeyPath() string {
+	if p := viper.GetString("key.path"); p != "" {
+		if expanded, err := homedir.Expand(p); err == nil {
+			return expanded
+		}
+		return p
 	}
-	home, err := homedir.Dir()
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+	return path.Join(common.GetKeysPath(), "id")
+}
+
+// GenerateIdentityKey returns a new key of keyType: ed25519, rsa (2048 bits),
+// secp256k1 or ecdsa.
+func GenerateIdentityKey(keyType string) (crypto.PrivKey, error) {
+	typ, ok := keyTypes[strings.ToLower(keyType)]
+	if !ok {
+		return nil, fmt.Errorf("unknown key type %q, expected one of ed25519, rsa, secp256k1 or ecdsa", keyType)
 	}
-	keyPath := path.Join(home, ".ocfcore", "keys", "id")
-	err = os.MkdirAll(path.Dir(keyPath), os.ModePerm)
-	if err != nil {
-		common.Logger.Error("Could not create keys directory", "error", err)
-		os.Exit(1)
+	priv, _, err := crypto.GenerateKeyPairWithReader(typ, 2048, rand.Reader)
+	return priv, err
+}
+
+// DeriveIdentityKey derives an Ed25519 key from passphrase with argon2id, so
+// that a node can be given the same peer ID wherever it runs. The salt is
+// scoped to network: a passphrase gives another key in another network.
+func DeriveIdentityKey(passphrase, network string) (crypto.PrivKey, error) {
+	if passphrase == "" {
+		return nil, errors.New("passphrase is empty")
 	}
-	err = os.WriteFile(keyPath, keyData, 0600)
+	salt := []byte(networkScoped(network, "opentela/identity"))
+	seed := argon2.IDKey([]byte(passphrase), salt, deriveTime, deriveMemory, deriveThreads, ed25519.SeedSize)
+	return crypto.UnmarshalEd25519PrivateKey(ed25519.NewKeyFromSeed(seed))
+}
+
+// MarshalIdentityKey encodes priv in format.
+func MarshalIdentityKey(priv crypto.PrivKey, format string) ([]byte, error) {
+	switch strings.ToLower(format) {
+	case KeyFormatProtobuf:
+		return crypto.MarshalPrivateKey(priv)
+	case KeyFormatPEM:
+		std, err := crypto.PrivKeyToStdKey(priv)
+		if err != nil {
+			return nil, err
+		}
+		// ed25519 keys are values in the standard library
+		if k, ok := std.(*ed25519.PrivateKey); ok {
+			std = *k
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(std)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: pemKeyType, Bytes: der}), nil
+	default:
+		return nil, fmt.Errorf("unknown key format %q, expected protobuf or pem", format)
+	}
+}
+
+// UnmarshalIdentityKey decodes a key in either format, telling them apart by
+// the PEM header.
+func UnmarshalIdentityKey(data []byte) (crypto.PrivKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return crypto.UnmarshalPrivateKey(data)
+	}
+	if block.Type != pemKeyType {
+		return nil, fmt.Errorf("unsupported PEM block %q, expected %q", block.Type, pemKeyType)
+	}
+	std, err := x509.ParsePKCS8PrivateKey(block.Bytes)
 	if err != nil {
-		common.Logger.Error("Could not write key to file", err)
-		os.Exit(1)
+		return nil, err
+	}
+	// crypto.KeyPairFromStdKey expects pointers to ed25519 keys
+	if k, ok := std.(ed25519.PrivateKey); ok {
+		std = &k
 	}
+	priv, _, err := crypto.KeyPairFromStdKey(std)
+	return priv, err
 }
 
-func loadKeyFromFile() crypto.PrivKey {
-	home, err := homedir.Dir()
+// SaveIdentityKey writes priv to keyPath. An existing key is only replaced if
+// force is set, since replacing it changes the peer ID of the node.
+func SaveIdentityKey(keyPath string, priv crypto.PrivKey, force bool) error {
+	if _, err := os.Stat(keyPath); err == nil && !force {
+		return fmt.Errorf("identity key %s already exists", keyPath)
+	}
+	data, err := crypto.MarshalPrivateKey(priv)
 	if err != nil {
-		fmt.Println(err)
-		return nil
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(keyPath), 0700); err != nil {
+		return err
 	}
-	keyPath := path.Join(home, ".ocfcore", "keys", "id")
-	common.Logger.Info("Looking for keys under: ", keyPath)
-	keyData, err := os.ReadFile(keyPath)
+	return os.WriteFile(keyPath, data, 0600)
+}
+
+// LoadIdentityKey reads the key at keyPath.
+func LoadIdentityKey(keyPath string) (crypto.PrivKey, error) {
+	data, err := os.ReadFile(keyPath)
 	if err != nil {
-		common.Logger.Error("Error while reading private key file: ", err)
-		return nil
+		return nil, err
 	}
-	priv, err := crypto.UnmarshalPrivateKey(keyData)
+	priv, err := UnmarshalIdentityKey(data)
 	if err != nil {
-		common.Logger.Error("Error while unmarshalling private key: ", err)
-		return nil
+		return nil, fmt.Errorf("invalid identity key %s: %w", keyPath, err)
+	}
+	return priv, nil
+}
+
+// KeyTypeName is the name of the type of key, as accepted by
+// GenerateIdentityKey.
+func KeyTypeName(key crypto.Key) string {
+	for name, typ := range keyTypes {
+		if int(key.Type()) == typ {
+			return name
+		}
 	}
-	return priv
+	return key.Type().String()
 }
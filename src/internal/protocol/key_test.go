@@ -0,0 +1,87 @@
+package protocol
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+)
+
+func TestIdentityKeyFormats(t *testing.T) {
+	for _, keyType := range []string{"ed25519", "rsa", "ecdsa", "secp256k1"} {
+		priv, err := GenerateIdentityKey(keyType)
+		if err != nil {
+			t.Fatalf("%s: %v", keyType, err)
+		}
+		if KeyTypeName(priv) != keyType {
+			t.Fatalf("expected a %s key, got %s", keyType, KeyTypeName(priv))
+		}
+		for _, format := range []string{KeyFormatProtobuf, KeyFormatPEM} {
+			data, err := MarshalIdentityKey(priv, format)
+			if keyType == "secp256k1" && format == KeyFormatPEM {
+				if err == nil {
+					t.Fatal("expected secp256k1 keys not to be exported to PEM")
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("%s to %s: %v", keyType, format, err)
+			}
+			decoded, err := UnmarshalIdentityKey(data)
+			if err != nil || !decoded.Equals(priv) {
+				t.Fatalf("%s key did not survive %s: %v", keyType, format, err)
+			}
+		}
+	}
+	if _, err := GenerateIdentityKey("dsa"); err == nil {
+		t.Fatal("expected an unknown key type to be rejected")
+	}
+}
+
+func TestDeriveIdentityKey(t *testing.T) {
+	first, err := DeriveIdentityKey("correct horse battery staple", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := DeriveIdentityKey("correct horse battery staple", "")
+	other, _ := DeriveIdentityKey("another passphrase", "")
+	if !first.Equals(again) || first.Equals(other) {
+		t.Fatal("expected the key to depend on the passphrase only")
+	}
+	if first.Type() != crypto.Ed25519 {
+		t.Fatalf("expected an ed25519 key, got %v", first.Type())
+	}
+	if scoped, _ := DeriveIdentityKey("correct horse battery staple", "lab"); scoped.Equals(first) {
+		t.Fatal("expected another key in another network")
+	}
+	if _, err := DeriveIdentityKey("", ""); err == nil {
+		t.Fatal("expected an empty passphrase to be rejected")
+	}
+}
+
+func TestNodeKeyFromKeyPath(t *testing.T) {
+	keyPath := filepath.Join(t.TempDir(), "node-1", "id")
+	generated, err := nodeKey(NodeConfig{KeyPath: keyPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if generated.Type() != crypto.Ed25519 {
+		t.Fatalf("expected new nodes to get an ed25519 key, got %v", generated.Type())
+	}
+	loaded, err := nodeKey(NodeConfig{KeyPath: keyPath})
+	if err != nil || !loaded.Equals(generated) {
+		t.Fatalf("expected the key file to be reused: %v", err)
+	}
+	if err := SaveIdentityKey(keyPath, loaded, false); err == nil {
+		t.Fatal("expected an existing key not to be replaced")
+	}
+
+	seededPath := filepath.Join(t.TempDir(), "id")
+	if _, err := nodeKey(NodeConfig{Seed: 42, KeyPath: seededPath}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(seededPath); !os.IsNotExist(err) {
+		t.Fatal("expected a seeded key not to be written to the key file")
+	}
+}
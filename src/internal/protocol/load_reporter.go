@@ -0,0 +1,266 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"opentela/internal/common"
+	"opentela/internal/platform"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultLoadPublishInterval = 15 * time.Second
+	defaultLoadMetricsPath     = "/metrics"
+	// changes of utilization smaller than this are not worth a CRDT write
+	loadUtilizationThreshold = 0.05
+	// loads older than this are ignored by routing
+	loadStaleAfter = 2 * time.Minute
+	// unchanged loads are published again after this long so that they do
+	// not go stale
+	loadHeartbeatInterval = loadStaleAfter / 2
+)
+
+// ServiceLoad is the load of the engine behind a service, as scraped from its
+// Prometheus endpoint.
+type ServiceLoad struct {
+	RequestsRunning int `json:"requests_running"`
+	RequestsWaiting int `json:"requests_waiting"`
+	// KVCacheUsage is the fraction of the KV cache in use, from 0 to 1
+	KVCacheUsage float64 `json:"kv_cache_usage"`
+	// GPUUtilization is the average utilization of the node's GPUs, from 0
+	// to 1
+	GPUUtilization float64 `json:"gpu_utilization"`
+	UpdatedAt      int64   `json:"updated_at"`
+}
+
+// Score orders services by load, lower is less loaded. Waiting requests
+// weigh more than running ones since they are already queued.
+func (l ServiceLoad) Score() float64 {
+	return float64(l.RequestsRunning) + 2*float64(l.RequestsWaiting) + 10*l.KVCacheUsage + 5*l.GPUUtilization
+}
+
+// IsStale reports whether the load is too old to be relied upon.
+func (l ServiceLoad) IsStale(now time.Time) bool {
+	return now.Sub(time.Unix(l.UpdatedAt, 0)) > loadStaleAfter
+}
+
+// Prometheus metrics of the supported engines. Counts are summed over every
+// label set (e.g. data-parallel engines), fractions are averaged.
+var (
+	runningMetrics = []string{"vllm:num_requests_running", "sglang:num_running_reqs"}
+	waitingMetrics = []string{"vllm:num_requests_waiting", "sglang:num_queue_reqs"}
+	kvCacheMetrics = []string{"vllm:gpu_cache_usage_perc", "vllm:kv_cache_usage_perc", "sglang:token_usage"}
+)
+
+// parseEngineMetrics extracts the load from a Prometheus text exposition. It
+// returns false if none of the known metrics is present.
+func parseEngineMetrics(r io.Reader) (ServiceLoad, bool) {
+	sums := make(map[string]float64)
+	counts := make(map[string]int)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		name, rest := line, ""
+		if i := strings.IndexAny(line, "{ "); i >= 0 {
+			name, rest = line[:i], line[i:]
+		}
+		if j := strings.LastIndexByte(rest, '}'); j >= 0 {
+			rest = rest[j+1:]
+		}
+		// the value may be followed by a timestamp
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			continue
+		}
+		value, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil || math.IsNaN(value) {
+			continue
+		}
+		sums[name] += value
+		counts[name]++
+	}
+	first := func(names []string) (string, bool) {
+		for _, name := range names {
+			if counts[name] > 0 {
+				return name, true
+			}
+		}
+		return "", false
+	}
+	var load ServiceLoad
+	found := false
+	if name, ok := first(runningMetrics); ok {
+		load.RequestsRunning = int(sums[name])
+		found = true
+	}
+	if name, ok := first(waitingMetrics); ok {
+		load.RequestsWaiting = int(sums[name])
+		found = true
+	}
+	if name, ok := first(kvCacheMetrics); ok {
+		load.KVCacheUsage = sums[name] / float64(counts[name])
+		found = true
+	}
+	return load, found
+}
+
+// loadChanged reports whether next differs enough from prev to be published.
+func loadChanged(prev, next *ServiceLoad) bool {
+	if prev == nil || next == nil {
+		return prev != next
+	}
+	return prev.RequestsRunning != next.RequestsRunning ||
+		prev.RequestsWaiting != next.RequestsWaiting ||
+		math.Abs(prev.KVCacheUsage-next.KVCacheUsage) >= loadUtilizationThreshold ||
+		math.Abs(prev.GPUUtilization-next.GPUUtilization) >= loadUtilizationThreshold
+}
+
+// heartbeatDue reports whether next must be published even though it did not
+// change, because prev was published too long ago.
+func heartbeatDue(prev, next *ServiceLoad) bool {
+	if prev == nil || next == nil {
+		return false
+	}
+	return next.UpdatedAt-prev.UpdatedAt >= int64(loadHeartbeatInterval/time.Second)
+}
+
+// loadReporter scrapes the engines behind the local services and publishes
+// their load, at most once per publishInterval.
+type loadReporter struct {
+	metricsPath     string
+	publishInterval time.Duration
+	client          *http.Client
+	gpuUtilization  func() (float64, bool)
+	lastPublish     time.Time
+}
+
+func newLoadReporter(cfg NodeConfig) *loadReporter {
+	path := cfg.LoadMetricsPath
+	if path == "" {
+		path = defaultLoadMetricsPath
+	}
+	publishInterval := cfg.LoadPublishInterval
+	if publishInterval <= 0 {
+		publishInterval = defaultLoadPublishInterval
+	}
+	return &loadReporter{
+		metricsPath:     path,
+		publishInterval: publishInterval,
+		client:          &http.Client{Timeout: 5 * time.Second},
+		gpuUtilization:  platform.GetGPUUtilization,
+	}
+}
+
+func (r *loadReporter) scrape(ctx context.Context, service Service) (ServiceLoad, bool) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, serviceBaseURL(service)+r.metricsPath, nil)
+	if err != nil {
+		return ServiceLoad{}, false
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return ServiceLoad{}, false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ServiceLoad{}, false
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 8<<20))
+	if err != nil {
+		return ServiceLoad{}, false
+	}
+	return parseEngineMetrics(bytes.NewReader(body))
+}
+
+// collect scrapes every local service of the node exposing engine metrics.
+func (r *loadReporter) collect(ctx context.Context, n *Node, now time.Time) []Service {
+	gpu, hasGPU := r.gpuUtilization()
+	var out []Service
+	for _, service := range n.snapshotLocalServices() {
+		load, ok := r.scrape(ctx, service)
+		if !ok {
+			continue
+		}
+		if hasGPU {
+			load.GPUUtilization = gpu / 100
+		}
+		load.UpdatedAt = now.Unix()
+		service.Load = &load
+		out = append(out, service)
+	}
+	return out
+}
+
+// update collects the loads and, unless the last publication was too recent,
+// stores those that changed enough or are due for a heartbeat. It reports
+// whether the local services need to be published.
+func (r *loadReporter) update(ctx context.Context, n *Node, now time.Time) bool {
+	if now.Sub(r.lastPublish) < r.publishInterval {
+		return false
+	}
+	changed := false
+	for _, service := range r.collect(ctx, n, now) {
+		changed = n.setServiceLoad(service, service.Load) || changed
+	}
+	if changed {
+		r.lastPublish = now
+	}
+	return changed
+}
+
+// setServiceLoad stores the load of the local service if it changed enough
+// since it was last published, or if the published one is about to go stale.
+func (n *Node) setServiceLoad(service Service, load *ServiceLoad) bool {
+	n.servicesLock.Lock()
+	defer n.servicesLock.Unlock()
+	for i := range n.services {
+		svc := &n.services[i]
+		if !sameService(*svc, service) || !(loadChanged(svc.Load, load) || heartbeatDue(svc.Load, load)) {
+			continue
+		}
+		svc.Load = load
+		return true
+	}
+	return false
+}
+
+// StartLoadReporter reports the load of the local services of the default
+// node until ctx is done.
+func StartLoadReporter(ctx context.Context) {
+	defaultNode().StartLoadReporter(ctx)
+}
+
+// StartLoadReporter scrapes the load of the local services every
+// LoadInterval until ctx is done. A zero interval disables it.
+func (n *Node) StartLoadReporter(ctx context.Context) {
+	cfg := n.settings()
+	if cfg.LoadInterval <= 0 {
+		common.Logger.Info("Load reporting disabled")
+		return
+	}
+	r := newLoadReporter(cfg)
+	ticker := time.NewTicker(cfg.LoadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if !r.update(ctx, n, now) {
+				continue
+			}
+			if err := n.publishLocalServices(); err != nil {
+				common.Logger.Warn("Failed to publish service load: ", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package protocol
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const vllmMetrics = `# HELP vllm:num_requests_running Number of requests in model execution batches.
+# TYPE vllm:num_requests_running gauge
+vllm:num_requests_running{engine="0",model_name="m"} 3.0
+vllm:num_requests_running{engine="1",model_name="m"} 2.0
+vllm:num_requests_waiting{engine="0",model_name="m"} 4.0
+vllm:num_requests_waiting{engine="1",model_name="m"} 0.0
+vllm:gpu_cache_usage_perc{engine="0",model_name="m"} 0.5
+vllm:gpu_cache_usage_perc{engine="1",model_name="m"} 0.25 1700000000000
+process_cpu_seconds_total 12.5
+`
+
+func TestParseEngineMetrics(t *testing.T) {
+	load, ok := parseEngineMetrics(strings.NewReader(vllmMetrics))
+	if !ok {
+		t.Fatal("expected vLLM metrics to be recognized")
+	}
+	if load.RequestsRunning != 5 || load.RequestsWaiting != 4 || load.KVCacheUsage != 0.375 {
+		t.Fatalf("unexpected load: %+v", load)
+	}
+
+	load, ok = parseEngineMetrics(strings.NewReader("sglang:num_running_reqs{tp_rank=\"0\"} 7\nsglang:num_queue_reqs 1\nsglang:token_usage 0.9\n"))
+	if !ok || load.RequestsRunning != 7 || load.RequestsWaiting != 1 || load.KVCacheUsage != 0.9 {
+		t.Fatalf("unexpected SGLang load: %+v (%v)", load, ok)
+	}
+
+	if _, ok := parseEngineMetrics(strings.NewReader("process_cpu_seconds_total 12.5\n")); ok {
+		t.Fatal("expected metrics of unknown engines to be ignored")
+	}
+}
+
+func TestLoadChanged(t *testing.T) {
+	base := &ServiceLoad{RequestsRunning: 1, KVCacheUsage: 0.5}
+	if loadChanged(base, &ServiceLoad{RequestsRunning: 1, KVCacheUsage: 0.52, UpdatedAt: 10}) {
+		t.Fatal("expected small utilization changes to be ignored")
+	}
+	if !loadChanged(base, &ServiceLoad{RequestsRunning: 2, KVCacheUsage: 0.5}) {
+		t.Fatal("expected a change of running requests to be published")
+	}
+	if !loadChanged(nil, base) || loadChanged(nil, nil) {
+		t.Fatal("expected a first load to be published")
+	}
+}
+
+func TestLoadReporterThrottlesUpdates(t *testing.T) {
+	var running atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/metrics" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte("vllm:num_requests_running " + strconv.Itoa(int(running.Load())) + "\n"))
+	}))
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	n := newNode()
+	n.addLocalService(Service{Name: "llm", Port: port})
+	n.addLocalService(Service{Name: "no-metrics", Port: "1"})
+
+	r := &loadReporter{
+		metricsPath:     "/metrics",
+		publishInterval: 30 * time.Second,
+		client:          srv.Client(),
+		gpuUtilization:  func() (float64, bool) { return 50, true },
+	}
+	ctx := context.Background()
+	now := time.Unix(1000, 0)
+	if !r.update(ctx, n, now) {
+		t.Fatal("expected the first load to be stored")
+	}
+	snap := n.snapshotLocalServices()
+	if snap[0].Load == nil || snap[0].Load.GPUUtilization != 0.5 || snap[0].Load.UpdatedAt != 1000 {
+		t.Fatalf("unexpected load: %+v", snap[0].Load)
+	}
+	if snap[1].Load != nil {
+		t.Fatal("services without metrics must not report a load")
+	}
+
+	running.Store(3)
+	if r.update(ctx, n, now.Add(10*time.Second)) {
+		t.Fatal("expected updates within the publish interval to be throttled")
+	}
+	if !r.update(ctx, n, now.Add(time.Minute)) {
+		t.Fatal("expected the changed load to be stored after the publish interval")
+	}
+	if snap := n.snapshotLocalServices(); snap[0].Load.RequestsRunning != 3 {
+		t.Fatalf("unexpected load: %+v", snap[0].Load)
+	}
+	if r.update(ctx, n, now.Add(90*time.Second)) {
+		t.Fatal("expected an unchanged load not to be published again")
+	}
+	// unless it would go stale
+	if !r.update(ctx, n, now.Add(2*time.Minute)) {
+		t.Fatal("expected an unchanged load to be published as a heartbeat")
+	}
+	if snap := n.snapshotLocalServices(); snap[0].Load.UpdatedAt != now.Add(2*time.Minute).Unix() {
+		t.Fatalf("expected the heartbeat to refresh the load, got %+v", snap[0].Load)
+	}
+}
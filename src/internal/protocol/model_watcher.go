@@ -0,0 +1,122 @@
+package protocol
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"opentela/internal/common"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+const modelIdentityPrefix = "model="
+
+// fetchModelIdentityGroups asks the engine listening on port for the models it
+// serves and returns them as sorted "model=<id>" identity groups.
+func fetchModelIdentityGroups(port string) ([]string, error) {
+	modelsBytes, err := common.RemoteGET("http://localhost:" + port + "/v1/models")
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch models from LLM service: %w", err)
+	}
+	var availableModels common.LMAvailableModels
+	if err := json.Unmarshal(modelsBytes, &availableModels); err != nil {
+		return nil, fmt.Errorf("could not unmarshal models from LLM service: %w", err)
+	}
+	var identityGroup []string
+	for _, model := range availableModels.Models {
+		identityGroup = append(identityGroup, modelIdentityPrefix+model.Id)
+	}
+	sort.Strings(identityGroup)
+	return slices.Compact(identityGroup), nil
+}
+
+// setServiceModels replaces the model identity groups of the local llm
+// service on port with models, keeping any other identity groups it has. It
+// reports whether anything changed.
+func (n *Node) setServiceModels(port string, models []string) bool {
+	n.servicesLock.Lock()
+	defer n.servicesLock.Unlock()
+	for i := range n.services {
+		svc := &n.services[i]
+		if svc.Name != "llm" || svc.Port != port {
+			continue
+		}
+		var current, others []string
+		for _, group := range svc.IdentityGroup {
+			if strings.HasPrefix(group, modelIdentityPrefix) {
+				current = append(current, group)
+			} else {
+				others = append(others, group)
+			}
+		}
+		sort.Strings(current)
+		if slices.Equal(slices.Compact(current), models) {
+			return false
+		}
+		added, removed := diffGroups(current, models)
+		common.Logger.Infof("Models served on port %s changed: added %v, removed %v", port, added, removed)
+		svc.IdentityGroup = append(others, models...)
+		return true
+	}
+	return false
+}
+
+// diffGroups returns the entries of next that are not in prev, and those of
+// prev that are not in next.
+func diffGroups(prev, next []string) (added, removed []string) {
+	for _, group := range next {
+		if !slices.Contains(prev, group) {
+			added = append(added, group)
+		}
+	}
+	for _, group := range prev {
+		if !slices.Contains(next, group) {
+			removed = append(removed, group)
+		}
+	}
+	return added, removed
+}
+
+// watchModels re-discovers the models served by the engine on port every
+// interval and republishes the llm service when they change, so that adapters
+// or models loaded at runtime become routable and unloaded ones stop being
+// advertised. A failed poll leaves the advertised models untouched.
+func (n *Node) watchModels(ctx context.Context, port string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			models, err := fetchModelIdentityGroups(port)
+			if err != nil {
+				common.Logger.Warn("Model re-discovery failed: ", err)
+				continue
+			}
+			if !n.setServiceModels(port, models) {
+				continue
+			}
+			if err := n.publishLocalServices(); err != nil {
+				common.Logger.Warn("Failed to publish updated models: ", err)
+			}
+		}
+	}
+}
+
+// startModelWatcher watches the models of the engine on port until ctx is
+// done or the node is closed, unless ModelsRefresh is zero.
+func (n *Node) startModelWatcher(ctx context.Context, port string) {
+	interval := n.settings().ModelsRefresh
+	if interval <= 0 {
+		common.Logger.Info("Model re-discovery disabled")
+		return
+	}
+	ctx, cancel := n.untilClosed(ctx)
+	go func() {
+		defer cancel()
+		n.watchModels(ctx, port, interval)
+	}()
+}
@@ -0,0 +1,84 @@
+package protocol
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFetchModelIdentityGroups(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/models" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(`{"object":"list","data":[{"id":"base"},{"id":"lora-b"},{"id":"base"}]}`))
+	}))
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+
+	groups, err := fetchModelIdentityGroups(port)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := []string{"model=base", "model=lora-b"}; !slices.Equal(groups, want) {
+		t.Fatalf("expected %v, got %v", want, groups)
+	}
+}
+
+func TestSetServiceModels(t *testing.T) {
+	n := newNode()
+	n.addLocalService(Service{Name: "llm", Port: "8000", IdentityGroup: []string{"model=a", "all", "model=b"}})
+	n.addLocalService(Service{Name: "llm", Port: "9000", IdentityGroup: []string{"model=z"}})
+
+	if n.setServiceModels("8000", []string{"model=a", "model=b"}) {
+		t.Fatal("expected no change when the same models are served")
+	}
+	if !n.setServiceModels("8000", []string{"model=b", "model=c"}) {
+		t.Fatal("expected a change when models are swapped")
+	}
+	snap := n.snapshotLocalServices()
+	if want := []string{"all", "model=b", "model=c"}; !slices.Equal(snap[0].IdentityGroup, want) {
+		t.Fatalf("expected %v, got %v", want, snap[0].IdentityGroup)
+	}
+	if !slices.Equal(snap[1].IdentityGroup, []string{"model=z"}) {
+		t.Fatalf("service on another port must not change, got %v", snap[1].IdentityGroup)
+	}
+
+	// every model unloaded
+	if !n.setServiceModels("8000", nil) {
+		t.Fatal("expected a change when all models are removed")
+	}
+	if snap := n.snapshotLocalServices(); !slices.Equal(snap[0].IdentityGroup, []string{"all"}) {
+		t.Fatalf("expected only non-model groups to remain, got %v", snap[0].IdentityGroup)
+	}
+	if n.setServiceModels("7000", []string{"model=a"}) {
+		t.Fatal("expected no change for an unknown port")
+	}
+}
+
+func TestModelWatcherStopsWithNode(t *testing.T) {
+	var polls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		polls.Add(1)
+		_, _ = w.Write([]byte(`{"object":"list","data":[]}`))
+	}))
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	n := NewNode(NodeConfig{ModelsRefresh: 10 * time.Millisecond})
+	n.startModelWatcher(context.Background(), port)
+	eventually(t, func() bool { return polls.Load() > 0 })
+	_ = n.Close()
+	// a poll may be in flight when the node closes
+	time.Sleep(50 * time.Millisecond)
+	stopped := polls.Load()
+	time.Sleep(50 * time.Millisecond)
+	if polls.Load() != stopped {
+		t.Fatal("expected the model watcher to stop when the node is closed")
+	}
+}
@@ -0,0 +1,147 @@
+package protocol
+
+import (
+	"context"
+	"opentela/internal/common"
+	"strings"
+	"sync"
+	"time"
+
+	p2phttp "github.com/libp2p/go-libp2p-http"
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// agentNetworkPrefix marks the network of a node in its libp2p user agent.
+const agentNetworkPrefix = "network/"
+
+// networkScoped suffixes name with the network ID, so that nodes of different
+// networks use different pubsub topics, CRDT namespaces and protocols. Names
+// of the default network are unchanged.
+func networkScoped(network, name string) string {
+	if network != "" {
+		return name + "/" + network
+	}
+	return name
+}
+
+// P2PHTTPProtocol is the protocol HTTP is served over between the nodes of
+// the network of this node.
+func (n *Node) P2PHTTPProtocol() protocol.ID {
+	return protocol.ID(networkScoped(n.settings().NetworkID, string(p2phttp.DefaultP2PProtocol)))
+}
+
+// userAgent identifies the node and the network it belongs to.
+func userAgent(network string) string {
+	agent := "opentela/" + BuildVersion()
+	if network != "" {
+		agent += " " + agentNetworkPrefix + network
+	}
+	return agent
+}
+
+// networkOfAgent returns the network announced in a user agent, empty for the
+// default network.
+func networkOfAgent(agent string) string {
+	for _, field := range strings.Fields(agent) {
+		if id, ok := strings.CutPrefix(field, agentNetworkPrefix); ok {
+			return id
+		}
+	}
+	return ""
+}
+
+// foreignPeerTTL is how long a peer of another network is refused. It may
+// restart in the right network meanwhile, and is checked again once it
+// reconnects.
+const foreignPeerTTL = 10 * time.Minute
+
+// foreignPeers are the peers found to belong to another network, with when
+// they were found. They are refused by the connection gater until their entry
+// expires.
+type foreignPeers struct {
+	mu    sync.Mutex
+	until map[peer.ID]time.Time
+}
+
+func (f *foreignPeers) mark(id peer.ID) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	if f.until == nil {
+		f.until = make(map[peer.ID]time.Time)
+	}
+	// expired entries are dropped here so that the set stays bounded
+	for other, until := range f.until {
+		if now.After(until) {
+			delete(f.until, other)
+		}
+	}
+	f.until[id] = now.Add(foreignPeerTTL)
+}
+
+// forget drops a peer found to belong to our network after all.
+func (f *foreignPeers) forget(id peer.ID) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.until, id)
+}
+
+func (f *foreignPeers) has(id peer.ID) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	until, ok := f.until[id]
+	if ok && time.Now().After(until) {
+		delete(f.until, id)
+		return false
+	}
+	return ok
+}
+
+// checkPeerNetwork compares the network a peer announced with ours and
+// reports whether it may stay connected.
+func (n *Node) checkPeerNetwork(id peer.ID, agent string) bool {
+	network := networkOfAgent(agent)
+	own := n.settings().NetworkID
+	if network == own {
+		n.foreign.forget(id)
+		return true
+	}
+	n.foreign.mark(id)
+	if network == "" {
+		network = "the default network"
+	}
+	common.Logger.Warnf("Disconnecting from peer [%s] of %s, this node is in network %q", id, network, own)
+	return false
+}
+
+// watchIdentify checks the network and the protocol versions of peers once
+// identify completes, and disconnects from peers of other networks.
+func (n *Node) watchIdentify(ctx context.Context, h host.Host) error {
+	sub, err := h.EventBus().Subscribe(new(event.EvtPeerIdentificationCompleted))
+	if err != nil {
+		return err
+	}
+	go func() {
+		defer sub.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case e, ok := <-sub.Out():
+				if !ok {
+					return
+				}
+				evt := e.(event.EvtPeerIdentificationCompleted)
+				if !n.checkPeerNetwork(evt.Peer, evt.AgentVersion) {
+					_ = h.Network().ClosePeer(evt.Peer)
+					continue
+				}
+				n.checkPeerProtocols(evt.Peer, evt.Protocols)
+			}
+		}
+	}()
+	return nil
+}
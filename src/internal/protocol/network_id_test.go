@@ -0,0 +1,61 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestNetworkScopedNames(t *testing.T) {
+	if networkScoped("", pubsubTopic) != pubsubTopic || NewNode(NodeConfig{}).P2PHTTPProtocol() != "/libp2p-http" {
+		t.Fatal("expected names of the default network to be unchanged")
+	}
+	if networkOfAgent(userAgent("")) != "" {
+		t.Fatalf("expected no network in %q", userAgent(""))
+	}
+	if got := networkScoped("staging", pubsubTopic); got != pubsubTopic+"/staging" {
+		t.Fatalf("unexpected topic %q", got)
+	}
+	if got := NewNode(NodeConfig{NetworkID: "staging"}).P2PHTTPProtocol(); got != "/libp2p-http/staging" {
+		t.Fatalf("unexpected protocol %q", got)
+	}
+	if got := networkOfAgent(userAgent("staging")); got != "staging" {
+		t.Fatalf("expected staging in %q, got %q", userAgent("staging"), got)
+	}
+}
+
+func TestForeignPeersAreGated(t *testing.T) {
+	n := NewNode(NodeConfig{NetworkID: "staging"})
+	gater := &aclGater{acl: n.acl, foreign: &n.foreign}
+	_, same := testSigningKey(t)
+	_, other := testSigningKey(t)
+	sameID, _ := peer.Decode(same)
+	otherID, _ := peer.Decode(other)
+
+	if !n.checkPeerNetwork(sameID, "opentela/1.0.0 network/staging") {
+		t.Fatal("expected a peer of the same network to be kept")
+	}
+	if n.checkPeerNetwork(otherID, "opentela/1.0.0") {
+		t.Fatal("expected a peer of the default network to be dropped")
+	}
+	if !gater.InterceptPeerDial(sameID) {
+		t.Fatal("expected the peer of the same network to be dialed")
+	}
+	if gater.InterceptPeerDial(otherID) || gater.InterceptSecured(0, otherID, nil) {
+		t.Fatal("expected the foreign peer to be refused")
+	}
+
+	// the peer is checked again once its entry expires, and kept if it
+	// restarted in our network
+	n.foreign.mu.Lock()
+	n.foreign.until[otherID] = time.Now().Add(-time.Second)
+	n.foreign.mu.Unlock()
+	if !gater.InterceptPeerDial(otherID) {
+		t.Fatal("expected the foreign peer to be dialed again once expired")
+	}
+	n.foreign.mark(otherID)
+	if !n.checkPeerNetwork(otherID, "opentela/1.0.0 network/staging") || !gater.InterceptPeerDial(otherID) {
+		t.Fatal("expected a peer back in our network to be accepted")
+	}
+}
@@ -0,0 +1,439 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"opentela/internal/common"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	crdt "opentela/internal/protocol/go-ds-crdt"
+
+	"github.com/dustin/go-humanize"
+	ipfslite "github.com/hsanjuan/ipfs-lite"
+	"github.com/ipfs/go-datastore"
+	dualdht "github.com/libp2p/go-libp2p-kad-dht/dual"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
+	"github.com/spf13/viper"
+)
+
+// NodeConfig is what a Node is built from. ConfigFromViper reads it from the
+// settings of the process; tests build it directly.
+type NodeConfig struct {
+	// Identity is the private key of the node. If it is nil, the key is
+	// derived from Seed, or loaded from (and saved to) KeyPath when Seed is
+	// 0.
+	Identity crypto.PrivKey
+	Seed     int64
+	// KeyPath is the key file of the node, IdentityKeyPath if empty.
+	KeyPath string
+	// Mode is standalone, local or node, see getDefaultBootstrapPeers.
+	Mode string
+	Role string
+	// TCPPort and UDPPort are the ports libp2p listens on, "0" picks any.
+	TCPPort string
+	UDPPort string
+	// PublicAddr makes the node a bootstrap candidate.
+	PublicAddr string
+	// Bootstraps replaces the configured bootstrap sources when not nil.
+	Bootstraps []string
+	// BootstrapRefresh is how often the bootstrap sources are resolved
+	// again and new bootstraps dialed, never if zero.
+	BootstrapRefresh time.Duration
+	// MaxMemory and MaxFDs bound the memory and file descriptors of the
+	// libp2p host; limits are scaled from the system when they are zero.
+	MaxMemory int64
+	MaxFDs    int
+	// ConnLowWater and ConnHighWater are the watermarks of the connection
+	// manager, which trims connections down to the low watermark once there
+	// are more than the high one, sparing those younger than
+	// ConnGracePeriod. Connections are never trimmed if ConnHighWater is 0.
+	ConnLowWater    int
+	ConnHighWater   int
+	ConnGracePeriod time.Duration
+	// RelayDuration and RelayData bound each connection relayed for other
+	// peers, RelayReservations the peers relayed for and RelayCircuits the
+	// connections relayed per peer. Zero picks the defaults of relay.go.
+	RelayDuration     time.Duration
+	RelayData         int64
+	RelayReservations int
+	RelayCircuits     int
+	// DBPath is the badger directory of the CRDT store, derived from the
+	// peer ID if empty. With InMemory set the store is not persisted.
+	DBPath   string
+	InMemory bool
+	// DHTDatastore backs the DHT records, kept in memory if nil.
+	DHTDatastore datastore.Batching
+	// Host replaces the libp2p host the node would create, e.g. with one
+	// of an in-memory mocknet. Identity, the ports and the transport
+	// settings are then ignored, and the node closes it on Close.
+	Host host.Host
+
+	// NetworkID scopes the topics, CRDT namespace and protocols of the
+	// node, see networkScoped. Empty is the default network.
+	NetworkID string
+	// PrivateNetwork only lets the node connect to peers sharing the swarm
+	// key at SwarmKeyPath, DefaultSwarmKeyPath if empty.
+	PrivateNetwork bool
+	SwarmKeyPath   string
+	// ACL is the static access list. With ACLReplicate set, the runtime
+	// lists are published to the other nodes, and those published by
+	// ACLAdmins are applied.
+	ACL          ACL
+	ACLReplicate bool
+	ACLAdmins    []string
+	// AllowUnsigned accepts node table entries that are not signed, see
+	// requireSignatures.
+	AllowUnsigned bool
+	// HealthPath, HealthInterval, HealthTimeout and the thresholds
+	// configure the health checks of local services, see healthConfig.
+	// Zero values pick the defaults.
+	HealthPath             string
+	HealthInterval         time.Duration
+	HealthTimeout          time.Duration
+	HealthSuccessThreshold int
+	HealthFailureThreshold int
+	HealthReadinessPath    string
+	HealthReadinessBody    string
+	// LoadInterval is how often the load of local services is scraped from
+	// LoadMetricsPath, never if zero, and LoadPublishInterval how often it
+	// is published at most.
+	LoadInterval        time.Duration
+	LoadMetricsPath     string
+	LoadPublishInterval time.Duration
+	// ModelsRefresh is how often the models of an llm service are listed
+	// again, never if zero.
+	ModelsRefresh time.Duration
+	// SnapshotInterval, SnapshotMinHeight and SnapshotPrune configure the
+	// snapshots of the CRDT store, see crdt.Options.
+	SnapshotInterval  time.Duration
+	SnapshotMinHeight uint64
+	SnapshotPrune     bool
+}
+
+// ConfigFromViper reads the node configuration from the settings.
+func ConfigFromViper() (NodeConfig, error) {
+	var seed int64
+	var err error
+	if v := viper.GetString("seed"); v != "" {
+		if seed, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return NodeConfig{}, fmt.Errorf("seed %q is not a valid int64 value: %w", v, err)
+		}
+	}
+	var maxMemory, relayData uint64
+	if v := viper.GetString("resources.max_memory"); v != "" {
+		if maxMemory, err = humanize.ParseBytes(v); err != nil {
+			return NodeConfig{}, fmt.Errorf("resources.max_memory %q is not a valid size: %w", v, err)
+		}
+	}
+	if v := viper.GetString("relay.max_data"); v != "" {
+		if relayData, err = humanize.ParseBytes(v); err != nil {
+			return NodeConfig{}, fmt.Errorf("relay.max_data %q is not a valid size: %w", v, err)
+		}
+	}
+	return NodeConfig{
+		Seed:             seed,
+		KeyPath:          IdentityKeyPath(),
+		Mode:             viper.GetString("mode"),
+		Role:             NodeRole(),
+		TCPPort:          viper.GetString("tcpport"),
+		UDPPort:          viper.GetString("udpport"),
+		PublicAddr:       viper.GetString("public-addr"),
+		BootstrapRefresh: viper.GetDuration("bootstrap.refresh_interval"),
+		MaxMemory:        int64(maxMemory),
+		MaxFDs:           viper.GetInt("resources.max_fds"),
+		ConnLowWater:     viper.GetInt("connmgr.low_water"),
+		ConnHighWater:    viper.GetInt("connmgr.high_water"),
+		ConnGracePeriod:  viper.GetDuration("connmgr.grace_period"),
+
+		RelayDuration:     viper.GetDuration("relay.max_duration"),
+		RelayData:         int64(relayData),
+		RelayReservations: viper.GetInt("relay.max_reservations"),
+		RelayCircuits:     viper.GetInt("relay.max_circuits"),
+
+		NetworkID:      common.NetworkID(),
+		PrivateNetwork: viper.GetBool("network.private"),
+		SwarmKeyPath:   viper.GetString("network.swarm_key"),
+		ACL:            aclFromViper(),
+		ACLReplicate:   viper.GetBool("acl.replicate"),
+		ACLAdmins:      viper.GetStringSlice("acl.admins"),
+		AllowUnsigned:  viper.IsSet("security.require_signatures") && !viper.GetBool("security.require_signatures"),
+
+		HealthPath:             viper.GetString("health.path"),
+		HealthInterval:         viper.GetDuration("health.interval"),
+		HealthTimeout:          viper.GetDuration("health.timeout"),
+		HealthSuccessThreshold: viper.GetInt("health.success_threshold"),
+		HealthFailureThreshold: viper.GetInt("health.failure_threshold"),
+		HealthReadinessPath:    viper.GetString("health.readiness_path"),
+		HealthReadinessBody:    viper.GetString("health.readiness_body"),
+		LoadInterval:           viper.GetDuration("load.interval"),
+		LoadMetricsPath:        viper.GetString("load.metrics_path"),
+		LoadPublishInterval:    viper.GetDuration("load.publish_interval"),
+		ModelsRefresh:          viper.GetDuration("service.models_refresh_interval"),
+
+		SnapshotInterval:  viper.GetDuration("crdt.snapshot_interval"),
+		SnapshotMinHeight: viper.GetUint64("crdt.snapshot_min_height"),
+		SnapshotPrune:     viper.GetBool("crdt.snapshot_prune"),
+	}, nil
+}
+
+// Node is a member of the network: its libp2p host and DHT, the CRDT store
+// replicating the node table, the in-memory node table and the services it
+// provides. Several nodes can run in one process.
+//
+// The package-level functions operate on the default node, which is
+// configured from the settings when it is first started.
+type Node struct {
+	// cfg is nil on the default node until it starts, or until its
+	// settings are first read, see config
+	cfgMu sync.Mutex
+	cfg   *NodeConfig
+
+	hostOnce sync.Once
+	hostErr  error
+	host     host.Host
+	dht      *dualdht.DHT
+	// limits are the limits of the resource manager of the host
+	limits rcmgr.ConcreteLimitConfig
+	// privateNetwork is the swarm key fingerprint when the node runs in
+	// private network mode, empty otherwise
+	privateNetwork string
+	// acl holds the access lists of the node, enforced by the connection
+	// gater of its host and on the entries of its table
+	acl *accessControl
+	// foreign are the peers found to belong to another network
+	foreign foreignPeers
+	// protocols are the protocol ranges peers advertised over identify
+	protocols peerProtocols
+	// discovery resolves the mdns:// and rendezvous:// bootstrap sources
+	discovery *bootstrapDiscovery
+
+	storeOnce sync.Once
+	storeErr  error
+	// backend holds the CRDT store and the blocks of the DAG
+	backend datastore.Batching
+	ipfs    *ipfslite.Peer
+	store   *crdt.Datastore
+	cancel  context.CancelFunc
+	// repairing is set while a repair requested through RepairCRDT runs
+	repairing atomic.Bool
+	// signingKey is the libp2p private key of the node. Every value it
+	// writes to the node table is signed with it so that other peers can
+	// check it was written by the peer owning the key.
+	signingKey crypto.PrivKey
+	// entrySeqs holds the sequence numbers of the entries accepted from the
+	// network
+	entrySeqs seqTracker
+	// quarantine holds the entries rejected from the network
+	quarantine quarantineLog
+	// legacyRemoved holds whether the peers whose legacy entry was deleted
+	// were connected, until their migrated metadata re-adds them
+	legacyRemoved sync.Map
+
+	table *peerTable
+	// self is this node's own entry in the node table. selfLock is held
+	// while it is updated and published, see publishSelf.
+	selfLock sync.Mutex
+	self     Peer
+
+	servicesLock sync.RWMutex
+	services     []Service
+
+	// closed is cancelled by Close, stopping the background tasks of the
+	// node, see untilClosed
+	closed context.Context
+	close  context.CancelFunc
+}
+
+// NewNode returns a node configured with cfg. Nothing is started until Start
+// is called.
+func NewNode(cfg NodeConfig) *Node {
+	n := newNode()
+	n.cfg = &cfg
+	return n
+}
+
+func newNode() *Node {
+	closed, close := context.WithCancel(context.Background())
+	return &Node{table: newPeerTable(), acl: newAccessControl(), closed: closed, close: close}
+}
+
+var (
+	defaultNodeOnce sync.Once
+	theDefaultNode  *Node
+)
+
+// DefaultNode returns the node the package-level functions operate on.
+func DefaultNode() *Node {
+	defaultNodeOnce.Do(func() {
+		theDefaultNode = newNode()
+	})
+	return theDefaultNode
+}
+
+func defaultNode() *Node {
+	return DefaultNode()
+}
+
+// Start creates the host and opens the CRDT store of the node.
+func (n *Node) Start(ctx context.Context) error {
+	if err := n.startHost(ctx); err != nil {
+		return err
+	}
+	return n.startStore(ctx)
+}
+
+// Close stops the background tasks of the node and the replication of the
+// node table, closes the CRDT store and its datastore, and shuts the host
+// down.
+func (n *Node) Close() error {
+	n.close()
+	if n.cancel != nil {
+		n.cancel()
+	}
+	var err error
+	if n.store != nil {
+		err = n.store.Close()
+	}
+	if n.backend != nil {
+		if cerr := n.backend.Close(); err == nil {
+			err = cerr
+		}
+	}
+	n.discovery.close()
+	if n.dht != nil {
+		_ = n.dht.Close()
+	}
+	if n.host != nil {
+		if cerr := n.host.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// untilClosed returns a context that is also cancelled when the node is
+// closed, for background tasks the node owns.
+func (n *Node) untilClosed(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(n.closed, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// config returns the configuration of the node, reading it from the settings
+// for the default node.
+func (n *Node) config() (NodeConfig, error) {
+	n.cfgMu.Lock()
+	defer n.cfgMu.Unlock()
+	if n.cfg != nil {
+		return *n.cfg, nil
+	}
+	cfg, err := ConfigFromViper()
+	if err != nil {
+		return cfg, err
+	}
+	n.cfg = &cfg
+	return cfg, nil
+}
+
+// settings returns the configuration of the node for the code running once
+// it is configured. Invalid settings, which keep the node from starting, read
+// as the zero configuration.
+func (n *Node) settings() NodeConfig {
+	cfg, err := n.config()
+	if err != nil {
+		return NodeConfig{}
+	}
+	return cfg
+}
+
+func (n *Node) startHost(ctx context.Context) error {
+	n.hostOnce.Do(func() {
+		cfg, err := n.config()
+		if err != nil {
+			n.hostErr = err
+			return
+		}
+		n.host, n.dht, n.hostErr = n.newHost(ctx, cfg)
+		if n.hostErr == nil && n == theDefaultNode {
+			MyID = n.host.ID().String()
+			P2PNode = &n.host
+		}
+	})
+	return n.hostErr
+}
+
+func (n *Node) startStore(ctx context.Context) error {
+	if err := n.startHost(ctx); err != nil {
+		return err
+	}
+	n.storeOnce.Do(func() {
+		n.storeErr = n.openStore(ctx)
+	})
+	return n.storeErr
+}
+
+// Host returns the libp2p host of the node, nil before Start.
+func (n *Node) Host() host.Host {
+	return n.host
+}
+
+// ID returns the peer ID of the node, empty before Start.
+func (n *Node) ID() string {
+	if n.host == nil {
+		return ""
+	}
+	return n.host.ID().String()
+}
+
+// Store returns the CRDT store of the node, nil before Start.
+func (n *Node) Store() *crdt.Datastore {
+	return n.store
+}
+
+var errNodeNotStarted = errors.New("node is not started")
+
+// storeOrStart returns the CRDT store of the node. The default node is
+// started on first use, as the package-level functions always did; other
+// nodes must be started explicitly.
+func (n *Node) storeOrStart() (*crdt.Datastore, error) {
+	if n == theDefaultNode {
+		n.mustStart()
+	}
+	if n.store == nil {
+		return nil, errNodeNotStarted
+	}
+	return n.store, nil
+}
+
+// hostOrStart is storeOrStart for the host.
+func (n *Node) hostOrStart() (host.Host, error) {
+	if n == theDefaultNode {
+		if err := n.startHost(context.Background()); err != nil {
+			common.Logger.Error("Error while creating P2P node: ", err)
+			os.Exit(1)
+		}
+	}
+	if n.host == nil {
+		return nil, errNodeNotStarted
+	}
+	return n.host, nil
+}
+
+// mustStart starts the default node, exiting if it cannot, as the
+// package-level functions have no way to report the error.
+func (n *Node) mustStart() {
+	if err := n.Start(context.Background()); err != nil {
+		common.Logger.Error("Error while starting the node: ", err)
+		os.Exit(1)
+	}
+}
@@ -7,20 +7,22 @@ import (
 	"opentela/internal/common"
 	"opentela/internal/platform"
 	"opentela/internal/wallet"
-	"sync"
+	"slices"
 	"time"
 
+	crdt "opentela/internal/protocol/go-ds-crdt"
+
 	ds "github.com/ipfs/go-datastore"
 	"github.com/spf13/viper"
 )
 
-var dntOnce sync.Once
-var myself Peer
-
 const (
 	CONNECTED    string = "connected"
 	DISCONNECTED string = "disconnected"
 	LEFT         string = "left"
+	DRAINING     string = "draining"
+	// UNHEALTHY is only used for services that fail their health checks
+	UNHEALTHY string = "unhealthy"
 )
 
 type Service struct {
@@ -29,6 +31,15 @@ type Service struct {
 	Status   string              `json:"status"`
 	Host     string              `json:"host"`
 	Port     string              `json:"port"`
+	// Upstream is the base URL requests are forwarded to, for services that
+	// are not served on Host:Port
+	Upstream string `json:"upstream,omitempty"`
+	// HealthPath is polled to check that the service is up
+	HealthPath string `json:"health_path,omitempty"`
+	// HealthCheck overrides the health.* settings for this service
+	HealthCheck *HealthCheck `json:"health_check,omitempty"`
+	// Load is the latest load reported by the engine behind the service
+	Load *ServiceLoad `json:"load,omitempty"`
 	// IdentityGroup is a list of identities that can access this service
 	// Format: <identity_group_name>=<identity_name>
 	// e.g., "model=resnet50"
@@ -37,21 +48,31 @@ type Service struct {
 
 // Peer is a single node in the network, as can be seen by the current node.
 type Peer struct {
-	ID                string              `json:"id"`
-	Latency           int                 `json:"latency"` // in ms
-	Privileged        bool                `json:"privileged"`
-	Owner             string              `json:"owner"`
-	CurrentOffering   []string            `json:"current_offering"`
-	Role              []string            `json:"role"`
-	Status            string              `json:"status"`
-	AvailableOffering []string            `json:"available_offering"`
-	Service           []Service           `json:"service"`
-	LastSeen          int64               `json:"last_seen"`
-	Version           string              `json:"version"`
-	PublicAddress     string              `json:"public_address"`
-	Hardware          common.HardwareSpec `json:"hardware"`
-	Connected         bool                `json:"connected"`
-	Load              []int               `json:"load"`
+	ID         string `json:"id"`
+	Latency    int    `json:"latency"` // in ms
+	Privileged bool   `json:"privileged"`
+	Owner      string `json:"owner"`
+	// OwnerProof is a signature of the peer ID by the wallet of Owner, see
+	// proveOwner. Owner rules of the access lists only match proven owners.
+	OwnerProof        []byte         `json:"owner_proof,omitempty"`
+	CurrentOffering   []string       `json:"current_offering"`
+	Role              []string       `json:"role"`
+	Status            string         `json:"status"`
+	AvailableOffering []string       `json:"available_offering"`
+	Service           []Service      `json:"service"`
+	LastSeen          int64          `json:"last_seen"`
+	Version           string         `json:"version"`
+	Protocol          *ProtocolRange `json:"protocol,omitempty"`
+	// Incompatible is set locally on peers sharing no protocol version with
+	// this node, which are not routed to
+	Incompatible  bool                `json:"incompatible,omitempty"`
+	PublicAddress string              `json:"public_address"`
+	Hardware      common.HardwareSpec `json:"hardware"`
+	Connected     bool                `json:"connected"`
+	// Connection is set locally on connected peers to ConnectionDirect or
+	// ConnectionRelayed, depending on how traffic to them flows
+	Connection string `json:"connection,omitempty"`
+	Load       []int  `json:"load"`
 }
 
 type PeerWithStatus struct {
@@ -59,140 +80,252 @@ type PeerWithStatus struct {
 	Connectedness string `json:"connectedness"` // "connected" or "disconnected"
 }
 
-// Node table tracks the nodes and their status in the network.
+// NodeTable is a point-in-time copy of the node table, keyed by "/<peerID>".
 type NodeTable map[string]Peer
 
-var dnt *NodeTable
-var tableUpdateSem = make(chan struct{}, 1) // capacity 1 → max 1 goroutine at a time
-
-func getNodeTable() *NodeTable {
-	dntOnce.Do(func() {
-		dnt = &NodeTable{}
-	})
-	return dnt
+// getNodeTable returns the node table of the default node.
+func getNodeTable() *peerTable {
+	return defaultNode().table
 }
 
 func UpdateNodeTable(peer Peer) {
+	defaultNode().UpdateNodeTable(peer)
+}
+
+// UpdateNodeTable publishes peer as the entry of the node, merging its
+// services with the published ones.
+func (n *Node) UpdateNodeTable(peer Peer) {
 	ctx := context.Background()
-	host, _ := GetP2PNode(nil)
 	// broadcast the peer to the network
-	store, _ := GetCRDTStore()
-	key := ds.NewKey(host.ID().String())
-	peer.ID = host.ID().String()
+	store, err := n.storeOrStart()
+	if err != nil {
+		common.Logger.Error("Error while updating node table: ", err)
+		return
+	}
+	peer.ID = n.ID()
 	// merge services instead of overwriting
 	// first find the peer in the table if it exists
-	existingPeer, err := GetPeerFromTable(peer.ID)
+	existingPeer, err := n.GetPeerFromTable(peer.ID)
 	if err == nil {
-		peer.Service = append(peer.Service, existingPeer.Service...)
+		services := existingPeer.Service
+		for _, service := range peer.Service {
+			services = upsertService(services, service)
+		}
+		peer.Service = services
 		// Preserve existing provider if not set in the update
 		if peer.Owner == "" && existingPeer.Owner != "" {
 			peer.Owner = existingPeer.Owner
+			peer.OwnerProof = existingPeer.OwnerProof
 		}
 	}
-	if viper.GetString("public-addr") != "" {
-		peer.PublicAddress = viper.GetString("public-addr")
+	if n.cfg.PublicAddr != "" {
+		peer.PublicAddress = n.cfg.PublicAddr
 	}
-	value, err := json.Marshal(peer)
-	common.ReportError(err, "Error while marshalling peer")
-	if err := store.Put(ctx, key, value); err != nil {
+	if err := n.publishPeer(ctx, store, peer); err != nil {
 		common.Logger.Error("Error while updating node table: ", err)
 	}
 }
 
 func MarkSelfAsBootstrap() {
-	if viper.GetString("public-addr") != "" {
+	defaultNode().MarkSelfAsBootstrap()
+}
+
+// MarkSelfAsBootstrap publishes the public address of the node, if it has
+// one, so that other nodes can bootstrap from it.
+func (n *Node) MarkSelfAsBootstrap() {
+	store, err := n.storeOrStart()
+	if err != nil {
+		common.Logger.Error("Error while registering bootstrap: ", err)
+		return
+	}
+	if n.cfg.PublicAddr != "" {
 		common.Logger.Info("Registering myself as a bootstrap node")
 		ctx := context.Background()
-		store, _ := GetCRDTStore()
-		host, _ := GetP2PNode(nil)
-		key := ds.NewKey(host.ID().String())
+		protocols := n.localProtocols()
 		peer := Peer{
-			ID:            host.ID().String(),
-			PublicAddress: viper.GetString("public-addr"),
+			ID:            n.ID(),
+			PublicAddress: n.cfg.PublicAddr,
+			Role:          []string{n.cfg.Role},
+			Version:       BuildVersion(),
+			Protocol:      &protocols,
 			Connected:     true,
 		}
-		value, err := json.Marshal(peer)
-		UpdateNodeTableHook(key, value)
-		common.ReportError(err, "Error while marshalling peer")
-		if err := store.Put(ctx, key, value); err != nil {
+		if err := n.putPeerMeta(ctx, store, peer); err != nil {
 			common.Logger.Error("Error while registering bootstrap: ", err)
 		}
 	}
 }
 
 func AnnounceLeave() {
-	ctx := context.Background()
-	host, _ := GetP2PNode(nil)
-	// broadcast the peer to the network
-	store, _ := GetCRDTStore()
-	key := ds.NewKey(host.ID().String())
-	common.Logger.Info("Announcing myself as LEFT from the network")
+	defaultNode().AnnounceLeave()
+}
 
-	// Update self status to LEFT
-	myself.Status = LEFT
-	myself.Connected = false
-	myself.LastSeen = time.Now().Unix()
+// AnnounceLeave marks the node as LEFT in the node table.
+func (n *Node) AnnounceLeave() {
+	common.Logger.Info("Announcing myself as LEFT from the network")
+	// services stay published until the tombstone manager removes the
+	// whole entry; a LEFT peer is never routed to
+	err := n.publishSelf(func(self *Peer) {
+		self.Status = LEFT
+		self.Connected = false
+		self.LastSeen = time.Now().Unix()
+	}, n.putPeerMeta)
+	if err != nil {
+		common.Logger.Error("Error while announcing leave: ", err)
+	}
+}
 
-	value, err := json.Marshal(myself)
+// publishSelf applies update to the entry of the node and publishes a copy
+// of the result with publish. Both happen under selfLock, so that concurrent
+// updates are neither lost nor published out of order.
+func (n *Node) publishSelf(update func(self *Peer), publish func(context.Context, *crdt.Datastore, Peer) error) error {
+	store, err := n.storeOrStart()
 	if err != nil {
-		common.Logger.Error("Error while marshalling peer for leave: ", err)
-		return
+		return err
 	}
+	n.selfLock.Lock()
+	defer n.selfLock.Unlock()
+	update(&n.self)
+	self := n.self
+	self.Service = slices.Clone(n.self.Service)
+	self.Role = slices.Clone(n.self.Role)
+	return publish(context.Background(), store, self)
+}
 
-	if err := store.Put(ctx, key, value); err != nil {
-		common.Logger.Error("Error while announcing leave: ", err)
+// AnnounceDraining marks this node and all of its services as DRAINING so that
+// heads stop routing new requests to it, while requests that are already in
+// flight keep being served.
+func AnnounceDraining() {
+	defaultNode().AnnounceDraining()
+}
+
+// AnnounceDraining marks the node and its services as DRAINING.
+func (n *Node) AnnounceDraining() {
+	common.Logger.Info("Announcing myself as DRAINING")
+	n.setLocalServicesStatus(DRAINING)
+	err := n.publishSelf(func(self *Peer) {
+		self.Status = DRAINING
+		self.Service = n.snapshotLocalServices()
+		self.LastSeen = time.Now().Unix()
+	}, n.publishPeer)
+	if err != nil {
+		common.Logger.Error("Error while announcing drain: ", err)
 	}
 }
 
+// IsDraining reports whether this node has announced itself as DRAINING.
+func IsDraining() bool {
+	return defaultNode().IsDraining()
+}
+
+// IsDraining reports whether the node has announced itself as DRAINING.
+func (n *Node) IsDraining() bool {
+	n.selfLock.Lock()
+	defer n.selfLock.Unlock()
+	return n.self.Status == DRAINING
+}
+
+// UpdateNodeTableHook applies a CRDT entry to the in-memory table. Legacy
+// /<peerID> entries replace the whole peer, meta entries update the peer but
+// keep its services, and service entries add or replace a single service.
 func UpdateNodeTableHook(key ds.Key, value []byte) {
-	table := *getNodeTable()
+	defaultNode().UpdateNodeTableHook(key, value)
+}
+
+// UpdateNodeTableHook applies a CRDT entry to the node table of the node.
+func (n *Node) UpdateNodeTableHook(key ds.Key, value []byte) {
+	entry, ok := parseEntryKey(key)
+	if !ok {
+		common.Logger.Debugf("Ignoring unknown node table key [%s]", key)
+		return
+	}
+	if entry.kind == serviceEntry {
+		var service Service
+		if err := json.Unmarshal(value, &service); err != nil {
+			common.ReportError(err, "Error while unmarshalling service")
+			return
+		}
+		n.table.update(entry.tableKey(), func(existing Peer, ok bool) Peer {
+			if !ok {
+				// services may arrive before the peer's metadata
+				existing = Peer{ID: entry.peerID}
+			}
+			existing.Service = upsertService(existing.Service, service)
+			if existing.Status != LEFT {
+				existing.LastSeen = time.Now().Unix()
+			}
+			existing.Incompatible = !n.isCompatible(existing)
+			return existing
+		})
+		return
+	}
+
 	var peer Peer
 	err := json.Unmarshal(value, &peer)
 	common.ReportError(err, "Error while unmarshalling peer")
-
-	// Check for Left status — keep the peer in the table marked as LEFT
-	// so TombstoneManager.collectCandidates can find it for deferred cleanup.
 	if peer.Status == LEFT {
-		common.Logger.Debugf("Peer [%s] has left, marking as LEFT in table", peer.ID)
-		tableUpdateSem <- struct{}{}
-		defer func() { <-tableUpdateSem }() // Release on exit
-		peer.Connected = false
-		if peer.LastSeen == 0 {
-			peer.LastSeen = time.Now().Unix()
-		}
-		table[key.String()] = peer
-		return
+		n.protocols.forget(entry.peerID)
 	}
 
-	// A non-LEFT update: if this peer was previously LEFT, it has rejoined.
-	tableUpdateSem <- struct{}{}
-	defer func() { <-tableUpdateSem }() // Release on exit
-	if existing, ok := table[key.String()]; ok {
-		if existing.Status == LEFT {
-			common.Logger.Infof("Peer [%s] rejoined the network (was LEFT)", peer.ID)
+	n.table.update(entry.tableKey(), func(existing Peer, ok bool) Peer {
+		if entry.kind == metaEntry {
+			peer.Service = nil
+			if ok {
+				peer.Service = existing.Service
+			}
+		}
+		// Check for Left status — keep the peer in the table marked as LEFT
+		// so TombstoneManager.collectCandidates can find it for deferred cleanup.
+		if peer.Status == LEFT {
+			common.Logger.Debugf("Peer [%s] has left, marking as LEFT in table", peer.ID)
+			peer.Connected = false
+			if peer.LastSeen == 0 {
+				peer.LastSeen = time.Now().Unix()
+			}
+			return peer
 		}
-		// If LastSeen is missing in the update, keep the existing one
-		if peer.LastSeen == 0 {
-			peer.LastSeen = existing.LastSeen
+		// A non-LEFT update: if this peer was previously LEFT, it has rejoined.
+		if ok && existing.Status == LEFT {
+			common.Logger.Infof("Peer [%s] rejoined the network (was LEFT)", peer.ID)
 		}
-	}
-	// Always update LastSeen on any CRDT update we receive for that peer
-	peer.LastSeen = time.Now().Unix()
-	table[key.String()] = peer
+		// Always update LastSeen on any CRDT update we receive for that peer
+		peer.LastSeen = time.Now().Unix()
+		peer.Incompatible = !n.isCompatible(peer)
+		return peer
+	})
 }
 
+// DeleteNodeTableHook removes a CRDT entry from the in-memory table. Removing
+// a legacy or meta entry removes the peer, removing a service entry only
+// drops that service.
 func DeleteNodeTableHook(key ds.Key) {
-	table := *getNodeTable()
-	tableUpdateSem <- struct{}{}
-	defer func() { <-tableUpdateSem }() // Release on exit
-	delete(table, key.String())
+	defaultNode().DeleteNodeTableHook(key)
+}
+
+// DeleteNodeTableHook removes a CRDT entry from the node table of the node.
+func (n *Node) DeleteNodeTableHook(key ds.Key) {
+	entry, ok := parseEntryKey(key)
+	if !ok {
+		return
+	}
+	if entry.kind == serviceEntry {
+		n.table.patch(entry.tableKey(), func(peer Peer) Peer {
+			peer.Service = removeService(peer.Service, entry.service, entry.port)
+			return peer
+		})
+		return
+	}
+	n.protocols.forget(entry.peerID)
+	n.table.remove(entry.tableKey())
 }
 
 func GetPeerFromTable(peerId string) (Peer, error) {
-	table := *getNodeTable()
-	tableUpdateSem <- struct{}{}
-	defer func() { <-tableUpdateSem }() // Release on exit
-	peer, ok := table["/"+peerId]
+	return defaultNode().GetPeerFromTable(peerId)
+}
+
+// GetPeerFromTable returns the peer from the node table of the node.
+func (n *Node) GetPeerFromTable(peerId string) (Peer, error) {
+	peer, ok := n.table.get("/" + peerId)
 	if !ok {
 		return Peer{}, errors.New("peer not found")
 	}
@@ -200,94 +333,145 @@ func GetPeerFromTable(peerId string) (Peer, error) {
 }
 
 func GetConnectedPeers() *NodeTable {
-	var connected = NodeTable{}
-	tableUpdateSem <- struct{}{}
-	defer func() { <-tableUpdateSem }() // Release on exit
-	for id, p := range *getNodeTable() {
-		if p.Connected {
-			connected[id] = p
-		}
-	}
+	return defaultNode().GetConnectedPeers()
+}
+
+// GetConnectedPeers returns the connected peers of the node table of the
+// node.
+func (n *Node) GetConnectedPeers() *NodeTable {
+	connected := n.table.snapshot(func(p Peer) bool { return p.Connected })
+	n.annotateConnections(connected)
 	return &connected
 }
 
 func GetAllPeers() *NodeTable {
-	var peers = NodeTable{}
-	tableUpdateSem <- struct{}{}
-	defer func() { <-tableUpdateSem }() // Release on exit
-	for id, p := range *getNodeTable() {
-		peers[id] = p
-	}
+	return defaultNode().GetAllPeers()
+}
+
+// GetAllPeers returns a copy of the node table of the node.
+func (n *Node) GetAllPeers() *NodeTable {
+	peers := n.table.snapshot(nil)
 	return &peers
 }
 
+// WatchNodeTable subscribes to changes of the node table. A client that
+// reconnects passes the ID of the last event it saw to receive only what it
+// missed; otherwise the watch starts with a snapshot. The returned function
+// must be called to release the subscription.
+func WatchNodeTable(lastEventID string) (*TableWatch, func()) {
+	return defaultNode().WatchNodeTable(lastEventID)
+}
+
+// WatchNodeTable subscribes to changes of the node table of the node.
+func (n *Node) WatchNodeTable(lastEventID string) (*TableWatch, func()) {
+	return n.table.watch(lastEventID)
+}
+
+// GetService returns the local service with the given name. It is served from
+// the in-memory registry of local services rather than the CRDT.
 func GetService(name string) (Service, error) {
-	host, _ := GetP2PNode(nil)
-	store, _ := GetCRDTStore()
-	key := ds.NewKey(host.ID().String())
-	value, err := store.Get(context.Background(), key)
-	common.ReportError(err, "Error while getting peer")
-	var peer Peer
-	err = json.Unmarshal(value, &peer)
-	common.ReportError(err, "Error while unmarshalling peer")
-	for _, service := range peer.Service {
-		if service.Name == name {
-			return service, nil
-		}
+	return defaultNode().GetService(name)
+}
+
+// GetService returns the local service of the node with the given name.
+func (n *Node) GetService(name string) (Service, error) {
+	if service, ok := n.lookupLocalService(name); ok {
+		return service, nil
 	}
 	return Service{}, errors.New("Service not found")
 }
 
+// isRoutable reports whether new requests may be sent to the peer.
+func (n *Node) isRoutable(peer Peer) bool {
+	// draining peers keep serving what they have but take no new work
+	return peer.Connected && peer.Status != DRAINING && isRoutingTarget(peer) && n.isCompatible(peer)
+}
+
+// IsServiceRoutable reports whether new requests may be sent to the service.
+func IsServiceRoutable(service Service) bool {
+	return service.Status != UNHEALTHY && service.Status != DRAINING
+}
+
 func GetAllProviders(serviceName string) ([]Peer, error) {
-	var providers []Peer
-	table := *getNodeTable()
-	tableUpdateSem <- struct{}{}
-	defer func() { <-tableUpdateSem }() // Release on exit
-	for _, peer := range table {
-		if peer.Connected {
-			for _, service := range peer.Service {
-				if service.Name == serviceName {
-					providers = append(providers, peer)
-				}
-			}
-		}
+	return defaultNode().GetAllProviders(serviceName)
+}
+
+// GetAllProviders returns the routable peers of the node table of the node
+// that provide the service.
+func (n *Node) GetAllProviders(serviceName string) ([]Peer, error) {
+	providers := n.table.providers(serviceName, n.isRoutable)
+	if len(providers) == 0 {
+		return providers, errors.New("no providers found")
 	}
+	return providers, nil
+}
+
+// GetProvidersWithIdentity returns the routable peers that advertise the given
+// identity group (e.g. "model=Qwen/Qwen3-8B") for the named service.
+func GetProvidersWithIdentity(serviceName, identityGroup string) ([]Peer, error) {
+	return defaultNode().GetProvidersWithIdentity(serviceName, identityGroup)
+}
+
+// GetProvidersWithIdentity is GetAllProviders restricted to the peers
+// advertising identityGroup.
+func (n *Node) GetProvidersWithIdentity(serviceName, identityGroup string) ([]Peer, error) {
+	providers := n.table.providersWithIdentity(serviceName, identityGroup, n.isRoutable)
 	if len(providers) == 0 {
 		return providers, errors.New("no providers found")
 	}
 	return providers, nil
 }
 
+// IdentityGroups returns the identity groups advertised for the named service
+// by the peers of the node table.
+func (n *Node) IdentityGroups(serviceName string) []string {
+	return n.table.identityGroups(serviceName)
+}
+
 func InitializeMyself(ownerOverride string) {
-	host, _ := GetP2PNode(nil)
-	ctx := context.Background()
-	store, _ := GetCRDTStore()
-	key := ds.NewKey(host.ID().String())
-	myself = Peer{
-		ID:            host.ID().String(),
-		PublicAddress: viper.GetString("public-addr"),
+	defaultNode().InitializeMyself(ownerOverride)
+}
+
+// InitializeMyself publishes the entry of the node, owned by ownerOverride
+// or by the configured wallet. The default node is started first.
+func (n *Node) InitializeMyself(ownerOverride string) {
+	if _, err := n.storeOrStart(); err != nil {
+		common.Logger.Error("Error while initializing myself in the node table: ", err)
+		return
+	}
+	protocols := n.localProtocols()
+	self := Peer{
+		ID:            n.ID(),
+		PublicAddress: n.cfg.PublicAddr,
+		Role:          []string{n.cfg.Role},
+		Version:       BuildVersion(),
+		Protocol:      &protocols,
 		LastSeen:      time.Now().Unix(),
 		Connected:     true,
 	}
 
 	// Add wallet address as provider if available
 	if ownerOverride != "" {
-		myself.Owner = ownerOverride
-		common.Logger.Infof("Using verified wallet account for provider: %s", myself.Owner)
+		self.Owner = ownerOverride
+		common.Logger.Infof("Using verified wallet account for provider: %s", self.Owner)
 	} else if account := viper.GetString("wallet.account"); account != "" {
-		myself.Owner = account
-		common.Logger.Infof("Using configured wallet account for provider: %s", myself.Owner)
+		self.Owner = account
+		common.Logger.Infof("Using configured wallet account for provider: %s", self.Owner)
 	} else if wm, err := wallet.InitializeWallet(); err == nil && wm.WalletExists() {
-		myself.Owner = wm.GetPublicKey()
-		if myself.Owner != "" {
-			common.Logger.Infof("Added wallet address as provider: %s", myself.Owner)
+		self.Owner = wm.GetPublicKey()
+		if self.Owner != "" {
+			common.Logger.Infof("Added wallet address as provider: %s", self.Owner)
 		}
 	}
+	self.OwnerProof = proveOwner(n.ID(), self.Owner)
 
-	myself.Hardware.GPUs = platform.GetGPUInfo()
-	value, err := json.Marshal(myself)
-	common.ReportError(err, "Error while marshalling peer")
-	err = store.Put(ctx, key, value)
+	self.Hardware = platform.GetHardwareSpec()
+	err := n.publishSelf(func(s *Peer) {
+		*s = self
+		// services restored from a previous run stay published, others
+		// are withdrawn until they register again
+		s.Service = n.snapshotLocalServices()
+	}, n.publishPeer)
 	if err != nil {
 		common.Logger.Error("Error while initializing myself in the node table: ", err)
 	}
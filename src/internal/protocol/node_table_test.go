@@ -23,11 +23,11 @@ func TestUpdateNodeTableHookAndGetPeer(t *testing.T) {
 }
 
 func TestDeleteNodeTableHook(t *testing.T) {
-	table := GetAllPeers()
 	p := Peer{ID: "peer2", PublicAddress: "5.6.7.8"}
 	b, _ := json.Marshal(p)
 	UpdateNodeTableHook(ds.NewKey("peer2"), b)
 	DeleteNodeTableHook(ds.NewKey("peer2"))
+	table := GetAllPeers()
 	if _, ok := (*table)["/peer2"]; ok {
 		t.Fatalf("expected peer2 deleted")
 	}
@@ -116,3 +116,27 @@ func TestNodeLeaveAndRejoin(t *testing.T) {
 		t.Fatalf("expected updated public address 10.0.0.3, got %s", got.PublicAddress)
 	}
 }
+
+func TestGetAllProvidersSkipsDrainingPeers(t *testing.T) {
+	cleanNodeTable()
+	serving := routablePeer("peer-serving", Service{Name: "llm"})
+	draining := routablePeer("peer-draining", Service{Name: "llm"})
+	draining.Status = DRAINING
+	for _, p := range []Peer{serving, draining} {
+		b, _ := json.Marshal(p)
+		UpdateNodeTableHook(ds.NewKey(p.ID), b)
+	}
+
+	providers, err := GetAllProviders("llm")
+	if err != nil {
+		t.Fatalf("unexpected: %v", err)
+	}
+	if len(providers) != 1 || providers[0].ID != "peer-serving" {
+		t.Fatalf("expected only the serving peer, got %+v", providers)
+	}
+
+	// the draining peer stays in the table so in-flight streams can finish
+	if got, err := GetPeerFromTable("peer-draining"); err != nil || got.Status != DRAINING {
+		t.Fatalf("expected draining peer to remain in table, got %+v (%v)", got, err)
+	}
+}
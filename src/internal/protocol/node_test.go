@@ -0,0 +1,161 @@
+package protocol
+
+import (
+	"context"
+	"crypto/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/mitchellh/go-homedir"
+	"github.com/spf13/viper"
+)
+
+// startTestNode starts an in-memory node listening on random ports.
+func startTestNode(t *testing.T, mode string, bootstraps []string) *Node {
+	t.Helper()
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	n := NewNode(NodeConfig{
+		Identity:   priv,
+		Mode:       mode,
+		Role:       RoleWorker,
+		TCPPort:    "0",
+		UDPPort:    "0",
+		Bootstraps: bootstraps,
+		InMemory:   true,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		_ = n.Close()
+	})
+	if err := n.Start(ctx); err != nil {
+		t.Fatalf("failed to start node: %v", err)
+	}
+	n.InitializeMyself("owner")
+	return n
+}
+
+// p2pAddr returns the loopback TCP address of the node.
+func p2pAddr(t *testing.T, n *Node) string {
+	t.Helper()
+	addrs, err := peer.AddrInfoToP2pAddrs(&peer.AddrInfo{ID: n.Host().ID(), Addrs: n.Host().Addrs()})
+	if err != nil {
+		t.Fatalf("failed to build p2p addrs: %v", err)
+	}
+	for _, addr := range addrs {
+		if s := addr.String(); strings.HasPrefix(s, "/ip4/127.0.0.1/tcp/") && !strings.Contains(s, "/ws") {
+			return s
+		}
+	}
+	t.Fatalf("no loopback address in %v", addrs)
+	return ""
+}
+
+func TestNodesReplicateInProcess(t *testing.T) {
+	a := startTestNode(t, "standalone", nil)
+	b := startTestNode(t, "node", []string{p2pAddr(t, a)})
+	if a.ID() == b.ID() {
+		t.Fatal("expected distinct peer IDs")
+	}
+
+	if _, err := a.RegisterService(Service{Name: "llm", Port: "8000", IdentityGroup: []string{"all"}}); err != nil {
+		t.Fatalf("failed to register service: %v", err)
+	}
+	if len(b.LocalServices()) != 0 {
+		t.Fatal("local services must not be shared between nodes")
+	}
+
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		if p, err := b.GetPeerFromTable(a.ID()); err == nil && len(p.Service) == 1 && p.Service[0].Name == "llm" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the service of the first node did not reach the table of the second")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if _, ok := getNodeTable().get("/" + a.ID()); ok {
+		t.Fatal("the default node table must not see in-process nodes")
+	}
+}
+
+func TestRendezvousFindsAdvertisedBootstraps(t *testing.T) {
+	a := startTestNode(t, "standalone", nil)
+	b := startTestNode(t, "node", []string{p2pAddr(t, a)})
+	// b may take a moment to enter a's routing table
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		a.discovery.advertise(context.Background(), []string{"rendezvous://cluster"})
+		addrs, err := b.discovery.rendezvousPeers("cluster")
+		if err != nil {
+			t.Fatalf("lookup failed: %v", err)
+		}
+		if len(addrs) > 0 && strings.HasSuffix(addrs[0], "/p2p/"+a.ID()) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the advertised bootstrap to be found, got %v", addrs)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+func TestInitializeMyselfStartsTheDefaultNode(t *testing.T) {
+	homedir.DisableCache = true
+	t.Cleanup(func() { homedir.DisableCache = false })
+	t.Setenv("HOME", t.TempDir())
+	// a fresh default node, configured from the settings as by otela start
+	previous := DefaultNode()
+	theDefaultNode = newNode()
+	previousID, previousHost := MyID, P2PNode
+	t.Cleanup(func() {
+		_ = theDefaultNode.Close()
+		theDefaultNode = previous
+		MyID, P2PNode = previousID, previousHost
+	})
+	for key, value := range map[string]any{"seed": "0", "mode": "standalone", "role": RoleWorker, "tcpport": "0", "udpport": "0"} {
+		viper.Set(key, value)
+		t.Cleanup(func() { viper.Set(key, nil) })
+	}
+
+	n := defaultNode()
+	n.InitializeMyself("owner")
+	if n.ID() == "" {
+		t.Fatal("expected the node to be started")
+	}
+	self, err := n.GetPeerFromTable(n.ID())
+	if err != nil || self.ID != n.ID() || self.Owner != "owner" {
+		t.Fatalf("expected the node to publish its own entry, got %+v (%v)", self, err)
+	}
+}
+
+func TestConfigFromViperReadsNodeSettings(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+	viper.Set("network.id", "staging")
+	viper.Set("acl.deny_peers", []string{aclPeerB})
+	viper.Set("acl.replicate", true)
+	viper.Set("health.interval", "2s")
+	viper.Set("crdt.snapshot_prune", true)
+	cfg, err := ConfigFromViper()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.NetworkID != "staging" || !cfg.ACLReplicate || len(cfg.ACL.Deny.Peers) != 1 || cfg.HealthInterval != 2*time.Second || !cfg.SnapshotPrune {
+		t.Fatalf("unexpected settings: %+v", cfg)
+	}
+	if cfg.AllowUnsigned {
+		t.Fatal("expected signatures to be required by default")
+	}
+	viper.Set("security.require_signatures", false)
+	if cfg, _ := ConfigFromViper(); !cfg.AllowUnsigned {
+		t.Fatal("expected unsigned entries to be allowed once signatures are not required")
+	}
+}
@@ -0,0 +1,291 @@
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+
+	crdt "opentela/internal/protocol/go-ds-crdt"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p/core/crypto"
+)
+
+// A peer's entry in the CRDT is split over several keys so that its services
+// can be added, updated and removed independently of each other:
+//
+//	/<peerID>/meta                    the Peer, without its services
+//	/<peerID>/service/<name>/<port>   one Service
+//
+// Releases before this layout stored the whole Peer, services included, under
+// /<peerID>. Such legacy entries are still understood so that mixed networks
+// keep working while nodes are upgraded.
+const (
+	metaKeyName    = "meta"
+	serviceKeyName = "service"
+)
+
+type entryKind int
+
+const (
+	legacyEntry entryKind = iota
+	metaEntry
+	serviceEntry
+)
+
+// entryKey is a parsed CRDT key of a peer's entry.
+type entryKey struct {
+	peerID  string
+	kind    entryKind
+	service string
+	port    string
+}
+
+// parseEntryKey parses the key of a peer's entry. Keys starting with an
+// underscore, such as the access lists, are not peer entries.
+func parseEntryKey(key ds.Key) (entryKey, bool) {
+	parts := key.List()
+	if len(parts) == 0 || strings.HasPrefix(parts[0], "_") {
+		return entryKey{}, false
+	}
+	switch {
+	case len(parts) == 1:
+		return entryKey{peerID: parts[0], kind: legacyEntry}, true
+	case len(parts) == 2 && parts[1] == metaKeyName:
+		return entryKey{peerID: parts[0], kind: metaEntry}, true
+	case len(parts) == 3 && parts[1] == serviceKeyName:
+		// a service without a port
+		return entryKey{peerID: parts[0], kind: serviceEntry, service: parts[2]}, true
+	case len(parts) == 4 && parts[1] == serviceKeyName:
+		return entryKey{peerID: parts[0], kind: serviceEntry, service: parts[2], port: parts[3]}, true
+	}
+	return entryKey{}, false
+}
+
+// tableKey is the key of the peer in the in-memory node table.
+func (e entryKey) tableKey() string {
+	return "/" + e.peerID
+}
+
+func metaKey(peerID string) ds.Key {
+	return ds.KeyWithNamespaces([]string{peerID, metaKeyName})
+}
+
+func serviceKey(peerID string, service Service) ds.Key {
+	return ds.KeyWithNamespaces([]string{peerID, serviceKeyName, service.Name, service.Port})
+}
+
+// sameService reports whether a and b are the same service of a peer, i.e.
+// are stored under the same key.
+func sameService(a, b Service) bool {
+	return a.Name == b.Name && a.Port == b.Port
+}
+
+// upsertService replaces the service with the same name and port as service,
+// or appends it if there is none.
+func upsertService(services []Service, service Service) []Service {
+	out := make([]Service, 0, len(services)+1)
+	replaced := false
+	for _, existing := range services {
+		if sameService(existing, service) {
+			if !replaced {
+				out = append(out, service)
+				replaced = true
+			}
+			continue
+		}
+		out = append(out, existing)
+	}
+	if !replaced {
+		out = append(out, service)
+	}
+	return out
+}
+
+func removeService(services []Service, name, port string) []Service {
+	out := make([]Service, 0, len(services))
+	for _, existing := range services {
+		if existing.Name == name && existing.Port == port {
+			continue
+		}
+		out = append(out, existing)
+	}
+	return out
+}
+
+// putEntry applies an entry of the node to its table and writes it, signed, to
+// the CRDT. Updates to our own keys are ignored by the put hook, so the table
+// is updated here.
+func (n *Node) putEntry(ctx context.Context, store *crdt.Datastore, key ds.Key, value []byte) error {
+	sealed, err := sealEntry(n.signingKey, key, value)
+	if err != nil {
+		return err
+	}
+	n.UpdateNodeTableHook(key, value)
+	return store.Put(ctx, key, sealed)
+}
+
+// deleteEntry removes an entry of the node from its table and replaces it in
+// the CRDT with a signed removal, which other peers can verify unlike a
+// deletion.
+func (n *Node) deleteEntry(ctx context.Context, store *crdt.Datastore, key ds.Key) error {
+	sealed, err := sealRemoval(n.signingKey, key)
+	if err != nil {
+		return err
+	}
+	n.DeleteNodeTableHook(key)
+	return store.Put(ctx, key, sealed)
+}
+
+// putPeerMeta publishes the metadata of the peer and leaves its services as
+// they are.
+func (n *Node) putPeerMeta(ctx context.Context, store *crdt.Datastore, peer Peer) error {
+	value, err := peerMeta(peer)
+	if err != nil {
+		return err
+	}
+	return n.putEntry(ctx, store, metaKey(peer.ID), value)
+}
+
+func peerMeta(peer Peer) ([]byte, error) {
+	peer.Service = nil
+	return json.Marshal(peer)
+}
+
+// publishPeer publishes the metadata of the peer along with its services.
+// Entries whose value did not change are not rewritten, and the services the
+// peer no longer provides are removed.
+func (n *Node) publishPeer(ctx context.Context, store *crdt.Datastore, peer Peer) error {
+	meta, err := peerMeta(peer)
+	if err != nil {
+		return err
+	}
+	if old, err := store.Get(ctx, metaKey(peer.ID)); err != nil || !bytes.Equal(payloadOf(old), meta) {
+		if err := n.putEntry(ctx, store, metaKey(peer.ID), meta); err != nil {
+			return err
+		}
+	}
+	current := make(map[ds.Key]struct{}, len(peer.Service))
+	for _, service := range peer.Service {
+		key := serviceKey(peer.ID, service)
+		current[key] = struct{}{}
+		value, err := json.Marshal(service)
+		if err != nil {
+			return err
+		}
+		if old, err := store.Get(ctx, key); err == nil && bytes.Equal(payloadOf(old), value) {
+			continue
+		}
+		if err := n.putEntry(ctx, store, key, value); err != nil {
+			return err
+		}
+	}
+
+	keys, err := peerEntryKeys(ctx, store, peer.ID)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		entry, _ := parseEntryKey(key)
+		if _, ok := current[key]; ok || entry.kind != serviceEntry {
+			continue
+		}
+		if old, err := store.Get(ctx, key); err == nil && isRemoval(old) {
+			continue
+		}
+		if err := n.deleteEntry(ctx, store, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// peerEntryKeys lists the keys of every entry, legacy ones included, that the
+// CRDT holds for the peer.
+func peerEntryKeys(ctx context.Context, store *crdt.Datastore, peerID string) ([]ds.Key, error) {
+	results, err := store.Query(ctx, query.Query{Prefix: ds.NewKey(peerID).String(), KeysOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	entries, err := results.Rest()
+	if err != nil {
+		return nil, err
+	}
+	var keys []ds.Key
+	// the query only returns the children of /<peerID>
+	legacy := ds.NewKey(peerID)
+	if ok, err := store.Has(ctx, legacy); err != nil {
+		return nil, err
+	} else if ok {
+		keys = append(keys, legacy)
+	}
+	for _, e := range entries {
+		key := ds.NewKey(e.Key)
+		// the prefix also matches peer IDs that merely start with this one
+		if entry, ok := parseEntryKey(key); ok && entry.peerID == peerID {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// deletePeerEntries removes every key of the peer from the CRDT in a single
+// delta.
+func deletePeerEntries(ctx context.Context, store *crdt.Datastore, peerID string) error {
+	keys, err := peerEntryKeys(ctx, store, peerID)
+	if err != nil {
+		return err
+	}
+	batch, err := store.Batch(ctx)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := batch.Delete(ctx, key); err != nil {
+			return err
+		}
+	}
+	return batch.Commit(ctx)
+}
+
+// legacyEntryMigration converts this node's own legacy /<peerID> entry into
+// signed meta and service keys. Entries of other peers are left to them: they
+// are read through the compatibility path until those peers upgrade and
+// migrate their entries themselves.
+func legacyEntryMigration(self string, priv crypto.PrivKey) crdt.KeyMigration {
+	return func(key ds.Key, value []byte) (map[ds.Key][]byte, bool) {
+		entry, ok := parseEntryKey(key)
+		if !ok || entry.kind != legacyEntry || entry.peerID != self {
+			return nil, false
+		}
+		var peer Peer
+		if err := json.Unmarshal(payloadOf(value), &peer); err != nil {
+			return nil, false
+		}
+		peer.ID = self
+		values := make(map[ds.Key][]byte, len(peer.Service)+1)
+		for _, service := range peer.Service {
+			if value, err := json.Marshal(service); err == nil {
+				values[serviceKey(self, service)] = value
+			}
+		}
+		peer.Service = nil
+		meta, err := json.Marshal(peer)
+		if err != nil {
+			return nil, false
+		}
+		values[metaKey(self)] = meta
+
+		replacements := make(map[ds.Key][]byte, len(values))
+		for k, v := range values {
+			sealed, err := sealEntry(priv, k, v)
+			if err != nil {
+				return nil, false
+			}
+			replacements[k] = sealed
+		}
+		return replacements, true
+	}
+}
@@ -0,0 +1,284 @@
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+	"time"
+
+	crdt "opentela/internal/protocol/go-ds-crdt"
+
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func newTestCRDTStore(t *testing.T, namespace string) *crdt.Datastore {
+	t.Helper()
+	store := dssync.MutexWrap(ds.NewMapDatastore())
+	crdtStore, err := crdt.New(store, ds.NewKey(namespace), NewMockDAGService(), nil, crdt.DefaultOptions())
+	if err != nil {
+		t.Fatalf("failed to create crdt store: %v", err)
+	}
+	return crdtStore
+}
+
+// testSigningKey installs a fresh signing key and returns it with its peer ID.
+func testSigningKey(t *testing.T) (crypto.PrivKey, string) {
+	t.Helper()
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	id, _ := peer.IDFromPrivateKey(priv)
+	n := defaultNode()
+	previous := n.signingKey
+	n.signingKey = priv
+	t.Cleanup(func() { n.signingKey = previous })
+	return priv, id.String()
+}
+
+func TestParseEntryKey(t *testing.T) {
+	llm := Service{Name: "llm", Port: "8080"}
+	cases := []struct {
+		key  ds.Key
+		want entryKey
+	}{
+		{ds.NewKey("peer"), entryKey{peerID: "peer", kind: legacyEntry}},
+		{metaKey("peer"), entryKey{peerID: "peer", kind: metaEntry}},
+		{serviceKey("peer", llm), entryKey{peerID: "peer", kind: serviceEntry, service: "llm", port: "8080"}},
+		{serviceKey("peer", Service{Name: "llm"}), entryKey{peerID: "peer", kind: serviceEntry, service: "llm"}},
+	}
+	for _, c := range cases {
+		got, ok := parseEntryKey(c.key)
+		if !ok || got != c.want {
+			t.Fatalf("parseEntryKey(%s) = %+v, %v; want %+v", c.key, got, ok, c.want)
+		}
+	}
+	for _, key := range []string{"/peer/other", "/peer/service/a/b/c", "/peer/meta/x"} {
+		if _, ok := parseEntryKey(ds.NewKey(key)); ok {
+			t.Fatalf("expected %s to be rejected", key)
+		}
+	}
+}
+
+func TestHooksBuildPeerFromEntries(t *testing.T) {
+	table := cleanNodeTable()
+	llm := Service{Name: "llm", Port: "8080", IdentityGroup: []string{"model=x"}}
+	value, _ := json.Marshal(llm)
+
+	// the service may arrive before the metadata
+	UpdateNodeTableHook(serviceKey("split", llm), value)
+	meta, _ := json.Marshal(Peer{ID: "split", Connected: true, Owner: "wallet"})
+	UpdateNodeTableHook(metaKey("split"), meta)
+
+	peer, ok := table.get("/split")
+	if !ok || peer.Owner != "wallet" || len(peer.Service) != 1 {
+		t.Fatalf("expected metadata and service to be merged, got %+v", peer)
+	}
+
+	// rewriting the same service replaces it instead of duplicating it
+	llm.IdentityGroup = []string{"model=y"}
+	value, _ = json.Marshal(llm)
+	UpdateNodeTableHook(serviceKey("split", llm), value)
+	peer, _ = table.get("/split")
+	if len(peer.Service) != 1 || peer.Service[0].IdentityGroup[0] != "model=y" {
+		t.Fatalf("expected the service to be replaced, got %+v", peer.Service)
+	}
+
+	DeleteNodeTableHook(serviceKey("split", llm))
+	peer, ok = table.get("/split")
+	if !ok || len(peer.Service) != 0 {
+		t.Fatalf("expected only the service to be removed, got %+v", peer)
+	}
+
+	DeleteNodeTableHook(metaKey("split"))
+	if _, ok := table.get("/split"); ok {
+		t.Fatal("expected the peer to be removed with its metadata")
+	}
+	// a late service deletion must not bring the peer back
+	DeleteNodeTableHook(serviceKey("split", llm))
+	if _, ok := table.get("/split"); ok {
+		t.Fatal("expected the peer to stay removed")
+	}
+}
+
+func TestPublishPeerWritesServicesIndependently(t *testing.T) {
+	cleanNodeTable()
+	testSigningKey(t)
+	store := newTestCRDTStore(t, "/test-publish")
+	ctx := context.Background()
+	llm := Service{Name: "llm", Port: "8080", IdentityGroup: []string{"model=x"}}
+	vision := Service{Name: "vision", Port: "9090"}
+
+	peer := Peer{ID: "publisher", Connected: true, Service: []Service{llm, vision}}
+	if err := defaultNode().publishPeer(ctx, store, peer); err != nil {
+		t.Fatalf("publishPeer failed: %v", err)
+	}
+	meta, err := store.Get(ctx, metaKey("publisher"))
+	if err != nil {
+		t.Fatalf("expected meta entry: %v", err)
+	}
+	var stored Peer
+	_ = json.Unmarshal(payloadOf(meta), &stored)
+	if len(stored.Service) != 0 {
+		t.Fatalf("meta entry must not carry services, got %+v", stored.Service)
+	}
+	for _, s := range peer.Service {
+		if ok, _ := store.Has(ctx, serviceKey("publisher", s)); !ok {
+			t.Fatalf("expected entry for service %s", s.Name)
+		}
+	}
+
+	// dropping a service replaces its key only, with a signed removal
+	peer.Service = []Service{llm}
+	if err := defaultNode().publishPeer(ctx, store, peer); err != nil {
+		t.Fatalf("publishPeer failed: %v", err)
+	}
+	if again, _ := store.Get(ctx, metaKey("publisher")); !bytes.Equal(again, meta) {
+		t.Fatal("expected the unchanged meta entry not to be rewritten")
+	}
+	if removed, err := store.Get(ctx, serviceKey("publisher", vision)); err != nil || !isRemoval(removed) {
+		t.Fatal("expected the vision service to be removed")
+	}
+	if ok, _ := store.Has(ctx, serviceKey("publisher", llm)); !ok {
+		t.Fatal("expected the llm service to be kept")
+	}
+	got, err := GetPeerFromTable("publisher")
+	if err != nil || len(got.Service) != 1 || got.Service[0].Name != "llm" {
+		t.Fatalf("expected the local table to follow, got %+v (%v)", got, err)
+	}
+
+	if err := deletePeerEntries(ctx, store, "publisher"); err != nil {
+		t.Fatalf("deletePeerEntries failed: %v", err)
+	}
+	keys, _ := peerEntryKeys(ctx, store, "publisher")
+	if len(keys) != 0 {
+		t.Fatalf("expected no entries left, got %v", keys)
+	}
+}
+
+func TestLegacyEntryMigration(t *testing.T) {
+	store := newTestCRDTStore(t, "/test-migration")
+	ctx := context.Background()
+	priv, self := testSigningKey(t)
+	legacy := Peer{ID: self, Owner: "wallet", Service: []Service{{Name: "llm", Port: "8080"}}}
+	value, _ := json.Marshal(legacy)
+	other, _ := json.Marshal(Peer{ID: "other"})
+	_ = store.Put(ctx, ds.NewKey(self), value)
+	_ = store.Put(ctx, ds.NewKey("other"), other)
+
+	n, err := store.MigrateKeys(ctx, legacyEntryMigration(self, priv))
+	if err != nil || n != 1 {
+		t.Fatalf("expected 1 migrated entry, got %d (%v)", n, err)
+	}
+	if ok, _ := store.Has(ctx, ds.NewKey(self)); ok {
+		t.Fatal("expected the legacy entry to be removed")
+	}
+	if ok, _ := store.Has(ctx, serviceKey(self, legacy.Service[0])); !ok {
+		t.Fatal("expected the service entry to be created")
+	}
+	sealed, err := store.Get(ctx, metaKey(self))
+	if err != nil {
+		t.Fatalf("expected the meta entry to be created: %v", err)
+	}
+	meta, err := openEntry(metaKey(self), sealed)
+	if err != nil {
+		t.Fatalf("expected a valid signature on the migrated entry: %v", err)
+	}
+	var migrated Peer
+	_ = json.Unmarshal(meta.Payload, &migrated)
+	if migrated.Owner != "wallet" || len(migrated.Service) != 0 {
+		t.Fatalf("unexpected migrated meta: %+v", migrated)
+	}
+	if ok, _ := store.Has(ctx, ds.NewKey("other")); !ok {
+		t.Fatal("entries of other peers must be left alone")
+	}
+
+	// running it again is a no-op
+	if n, err := store.MigrateKeys(ctx, legacyEntryMigration(self, priv)); err != nil || n != 0 {
+		t.Fatalf("expected nothing left to migrate, got %d (%v)", n, err)
+	}
+}
+
+func TestLegacyEntryMigrationReplicates(t *testing.T) {
+	ctx := context.Background()
+	dag := NewMockDAGService()
+	namespace := ds.NewKey("/test-migration-replicas")
+	first, err := crdt.New(dssync.MutexWrap(ds.NewMapDatastore()), namespace, dag, nil, crdt.DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+
+	// the second replica applies what it receives to the table of a node
+	h, err := libp2p.New(libp2p.NoListenAddrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	// legacy entries are unsigned
+	n := NewNode(NodeConfig{AllowUnsigned: true})
+	n.host = h
+	bcast := make(headsBroadcaster, 1)
+	opts := crdt.DefaultOptions()
+	opts.PutHook = n.putHook
+	opts.DeleteHook = n.deleteHook
+	if n.store, err = crdt.New(dssync.MutexWrap(ds.NewMapDatastore()), namespace, dag, bcast, opts); err != nil {
+		t.Fatal(err)
+	}
+	defer n.store.Close()
+
+	priv, _, _ := crypto.GenerateEd25519Key(rand.Reader)
+	id, _ := peer.IDFromPrivateKey(priv)
+	self := id.String()
+	llm := Service{Name: "llm", Port: "8080"}
+	value, _ := json.Marshal(Peer{ID: self, Service: []Service{llm}})
+	if err := first.Put(ctx, ds.NewKey(self), value); err != nil {
+		t.Fatal(err)
+	}
+	bcast.announce(t, first.InternalStats(ctx).Heads)
+	eventually(t, func() bool {
+		_, err := n.GetPeerFromTable(self)
+		return err == nil
+	})
+	// verified by the node in the meantime
+	n.table.patch("/"+self, func(p Peer) Peer {
+		p.Connected = true
+		return p
+	})
+
+	if _, err := first.MigrateKeys(ctx, legacyEntryMigration(self, priv)); err != nil {
+		t.Fatal(err)
+	}
+	bcast.announce(t, first.InternalStats(ctx).Heads)
+	eventually(t, func() bool {
+		ok, _ := n.store.Has(ctx, metaKey(self))
+		return ok
+	})
+	p, err := n.GetPeerFromTable(self)
+	if err != nil || !p.Connected || len(p.Service) != 1 {
+		t.Fatalf("expected the migrated peer to stay connected with its service, got %+v (%v)", p, err)
+	}
+
+	// a late deletion of the legacy entry is ignored once it migrated
+	n.deleteHook(ds.NewKey(self))
+	if _, err := n.GetPeerFromTable(self); err != nil {
+		t.Fatal("expected the migrated peer to stay in the table")
+	}
+}
+
+func eventually(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
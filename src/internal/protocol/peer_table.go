@@ -0,0 +1,225 @@
+package protocol
+
+import "sync"
+
+// peerTable is the concurrency-safe, in-memory view of the node table.
+//
+// Readers share an RWMutex and never block each other. Every write keeps two
+// secondary indexes in sync, from service name and from (service name,
+// identity group) to the keys of the peers providing them, so that routing
+// lookups only touch the peers that can actually serve a request instead of
+// scanning the whole table. Changes are diffed into TableEvents and published
+// to the table's event log while the write lock is held.
+type peerTable struct {
+	mu    sync.RWMutex
+	peers map[string]Peer
+	// service name -> peer keys
+	byService map[string]map[string]struct{}
+	// service name -> identity group -> peer keys
+	byIdentity map[string]map[string]map[string]struct{}
+	events     *eventLog
+}
+
+func newPeerTable() *peerTable {
+	return &peerTable{
+		peers:      make(map[string]Peer),
+		byService:  make(map[string]map[string]struct{}),
+		byIdentity: make(map[string]map[string]map[string]struct{}),
+		events:     newEventLog(tableEventHistory),
+	}
+}
+
+func (t *peerTable) get(key string) (Peer, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	peer, ok := t.peers[key]
+	return peer, ok
+}
+
+func (t *peerTable) len() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return len(t.peers)
+}
+
+// set stores peer under key, replacing any previous entry.
+func (t *peerTable) set(key string, peer Peer) {
+	t.update(key, func(Peer, bool) Peer { return peer })
+}
+
+// update atomically replaces the entry under key with the result of fn, which
+// receives the current entry (if any). It returns the previous entry.
+func (t *peerTable) update(key string, fn func(existing Peer, ok bool) Peer) (Peer, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	existing, ok := t.peers[key]
+	peer := fn(existing, ok)
+	if ok {
+		t.unindex(key, existing)
+	}
+	t.peers[key] = peer
+	t.index(key, peer)
+	t.events.publish(diffPeer(key, existing, ok, peer, true))
+	return existing, ok
+}
+
+// patch replaces the entry under key with the result of fn if there is one.
+func (t *peerTable) patch(key string, fn func(Peer) Peer) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	existing, ok := t.peers[key]
+	if !ok {
+		return false
+	}
+	peer := fn(existing)
+	t.unindex(key, existing)
+	t.peers[key] = peer
+	t.index(key, peer)
+	t.events.publish(diffPeer(key, existing, true, peer, true))
+	return true
+}
+
+// remove deletes the entry under key and returns it.
+func (t *peerTable) remove(key string) (Peer, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	existing, ok := t.peers[key]
+	if !ok {
+		return Peer{}, false
+	}
+	t.unindex(key, existing)
+	delete(t.peers, key)
+	t.events.publish(diffPeer(key, existing, true, Peer{}, false))
+	return existing, true
+}
+
+// reset empties the table without emitting events.
+func (t *peerTable) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.peers = make(map[string]Peer)
+	t.byService = make(map[string]map[string]struct{})
+	t.byIdentity = make(map[string]map[string]map[string]struct{})
+}
+
+// snapshot returns a copy of the entries for which keep returns true, or of
+// every entry if keep is nil.
+func (t *peerTable) snapshot(keep func(Peer) bool) NodeTable {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	out := make(NodeTable, len(t.peers))
+	for key, peer := range t.peers {
+		if keep == nil || keep(peer) {
+			out[key] = peer
+		}
+	}
+	return out
+}
+
+// watch subscribes to the table's events. Resuming from lastEventID is
+// attempted first; when that is not possible the watch starts with a snapshot
+// that is consistent with the first event delivered on it.
+func (t *peerTable) watch(lastEventID string) (*TableWatch, func()) {
+	// holding the read lock keeps writers, and with them publish, out until
+	// the subscriber is registered and the snapshot taken
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	backlog, cursor, ch, resumed := t.events.subscribe(lastEventID)
+	watch := &TableWatch{Cursor: cursor, Backlog: backlog, Events: ch}
+	if !resumed {
+		watch.Snapshot = make(NodeTable, len(t.peers))
+		for key, peer := range t.peers {
+			watch.Snapshot[key] = peer
+		}
+	}
+	return watch, func() { t.events.unsubscribe(ch) }
+}
+
+// providers returns the peers that advertise serviceName and satisfy keep.
+func (t *peerTable) providers(serviceName string, keep func(Peer) bool) []Peer {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.collect(t.byService[serviceName], keep)
+}
+
+// providersWithIdentity returns the peers that advertise serviceName with the
+// given identity group (e.g. "model=Qwen/Qwen3-8B") and satisfy keep.
+func (t *peerTable) providersWithIdentity(serviceName, identityGroup string, keep func(Peer) bool) []Peer {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.collect(t.byIdentity[serviceName][identityGroup], keep)
+}
+
+// identityGroups returns the identity groups advertised for serviceName.
+func (t *peerTable) identityGroups(serviceName string) []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	groups := make([]string, 0, len(t.byIdentity[serviceName]))
+	for group := range t.byIdentity[serviceName] {
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+func (t *peerTable) collect(keys map[string]struct{}, keep func(Peer) bool) []Peer {
+	if len(keys) == 0 {
+		return nil
+	}
+	out := make([]Peer, 0, len(keys))
+	for key := range keys {
+		peer := t.peers[key]
+		if keep == nil || keep(peer) {
+			out = append(out, peer)
+		}
+	}
+	return out
+}
+
+// index and unindex must be called with the write lock held.
+func (t *peerTable) index(key string, peer Peer) {
+	for _, service := range peer.Service {
+		addToIndex(t.byService, service.Name, key)
+		groups, ok := t.byIdentity[service.Name]
+		if !ok {
+			groups = make(map[string]map[string]struct{})
+			t.byIdentity[service.Name] = groups
+		}
+		for _, group := range service.IdentityGroup {
+			addToIndex(groups, group, key)
+		}
+	}
+}
+
+func (t *peerTable) unindex(key string, peer Peer) {
+	for _, service := range peer.Service {
+		removeFromIndex(t.byService, service.Name, key)
+		if groups, ok := t.byIdentity[service.Name]; ok {
+			for _, group := range service.IdentityGroup {
+				removeFromIndex(groups, group, key)
+			}
+			if len(groups) == 0 {
+				delete(t.byIdentity, service.Name)
+			}
+		}
+	}
+}
+
+func addToIndex(index map[string]map[string]struct{}, name, key string) {
+	keys, ok := index[name]
+	if !ok {
+		keys = make(map[string]struct{})
+		index[name] = keys
+	}
+	keys[key] = struct{}{}
+}
+
+func removeFromIndex(index map[string]map[string]struct{}, name, key string) {
+	keys, ok := index[name]
+	if !ok {
+		return
+	}
+	delete(keys, key)
+	if len(keys) == 0 {
+		delete(index, name)
+	}
+}
@@ -0,0 +1,173 @@
+package protocol
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// currentProtocols is the protocol range published by peers of this release.
+var currentProtocols = ProtocolRange{Min: ProtocolVersion, Max: ProtocolVersion}
+
+func routablePeer(id string, services ...Service) Peer {
+	return Peer{ID: id, Connected: true, Status: CONNECTED, Protocol: &currentProtocols, Service: services}
+}
+
+func TestPeerTableServiceIndex(t *testing.T) {
+	table := newPeerTable()
+	table.set("/a", routablePeer("a", Service{Name: "llm", IdentityGroup: []string{"model=x"}}))
+	table.set("/b", routablePeer("b", Service{Name: "vision"}))
+
+	if got := table.providers("llm", nil); len(got) != 1 || got[0].ID != "a" {
+		t.Fatalf("expected peer a for llm, got %+v", got)
+	}
+
+	// replacing the entry must drop the stale index entries
+	table.set("/a", routablePeer("a", Service{Name: "vision"}))
+	if got := table.providers("llm", nil); len(got) != 0 {
+		t.Fatalf("expected no llm providers after update, got %+v", got)
+	}
+	if got := table.providers("vision", nil); len(got) != 2 {
+		t.Fatalf("expected 2 vision providers, got %+v", got)
+	}
+
+	table.remove("/b")
+	if got := table.providers("vision", nil); len(got) != 1 || got[0].ID != "a" {
+		t.Fatalf("expected only peer a after removal, got %+v", got)
+	}
+	if len(table.byIdentity) != 0 {
+		t.Fatalf("expected identity index to be empty, got %v", table.byIdentity)
+	}
+}
+
+func TestPeerTableIdentityIndex(t *testing.T) {
+	table := newPeerTable()
+	isRoutable := newNode().isRoutable
+	table.set("/a", routablePeer("a", Service{Name: "llm", IdentityGroup: []string{"model=x", "model=y"}}))
+	table.set("/b", routablePeer("b", Service{Name: "llm", IdentityGroup: []string{"model=y"}}))
+	table.set("/c", Peer{ID: "c", Protocol: &currentProtocols, Service: []Service{{Name: "llm", IdentityGroup: []string{"model=y"}}}})
+
+	if got := table.providersWithIdentity("llm", "model=x", nil); len(got) != 1 || got[0].ID != "a" {
+		t.Fatalf("expected peer a for model=x, got %+v", got)
+	}
+	if got := table.providersWithIdentity("llm", "model=y", isRoutable); len(got) != 2 {
+		t.Fatalf("expected 2 routable peers for model=y, got %+v", got)
+	}
+	if got := table.providersWithIdentity("vision", "model=y", nil); len(got) != 0 {
+		t.Fatalf("expected no providers for another service, got %+v", got)
+	}
+}
+
+func TestPeerTableUpdateSeesExisting(t *testing.T) {
+	table := newPeerTable()
+	table.set("/a", Peer{ID: "a", Owner: "wallet"})
+	previous, ok := table.update("/a", func(existing Peer, ok bool) Peer {
+		if !ok {
+			t.Fatal("expected existing entry")
+		}
+		existing.Connected = true
+		return existing
+	})
+	if !ok || previous.Connected {
+		t.Fatalf("expected previous disconnected entry, got %+v", previous)
+	}
+	got, _ := table.get("/a")
+	if !got.Connected || got.Owner != "wallet" {
+		t.Fatalf("unexpected entry after update: %+v", got)
+	}
+}
+
+func TestPeerTableSnapshotIsACopy(t *testing.T) {
+	table := newPeerTable()
+	table.set("/a", routablePeer("a"))
+	snap := table.snapshot(nil)
+	delete(snap, "/a")
+	if table.len() != 1 {
+		t.Fatal("mutating a snapshot must not affect the table")
+	}
+}
+
+func TestPeerTableConcurrentAccess(t *testing.T) {
+	table := newPeerTable()
+	isRoutable := newNode().isRoutable
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				key := fmt.Sprintf("/peer-%d-%d", w, i%10)
+				table.set(key, routablePeer(key, Service{Name: "llm", IdentityGroup: []string{"model=x"}}))
+				if i%3 == 0 {
+					table.remove(key)
+				}
+			}
+		}(w)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				_ = table.providers("llm", isRoutable)
+				_ = table.providersWithIdentity("llm", "model=x", isRoutable)
+				_ = table.snapshot(nil)
+			}
+		}()
+	}
+	wg.Wait()
+	for _, p := range table.providers("llm", nil) {
+		// peers in this test use their table key as ID
+		if _, ok := table.get(p.ID); !ok {
+			t.Fatalf("index references missing peer %s", p.ID)
+		}
+	}
+}
+
+// populatedTable builds a table of n peers spread over 50 models, of which
+// every tenth is disconnected and every other one also runs a second service.
+func populatedTable(n int) *peerTable {
+	table := newPeerTable()
+	for i := 0; i < n; i++ {
+		id := fmt.Sprintf("peer-%d", i)
+		p := routablePeer(id, Service{Name: "llm", IdentityGroup: []string{fmt.Sprintf("model=m%d", i%50)}})
+		if i%2 == 0 {
+			p.Service = append(p.Service, Service{Name: "embedding", IdentityGroup: []string{"all"}})
+		}
+		if i%10 == 0 {
+			p.Connected = false
+		}
+		table.set("/"+id, p)
+	}
+	return table
+}
+
+func BenchmarkPeerTableProviders(b *testing.B) {
+	isRoutable := newNode().isRoutable
+	for _, n := range []int{1000, 5000} {
+		table := populatedTable(n)
+		b.Run(fmt.Sprintf("service/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_ = table.providers("embedding", isRoutable)
+			}
+		})
+		b.Run(fmt.Sprintf("identity/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_ = table.providersWithIdentity("llm", "model=m7", isRoutable)
+			}
+		})
+		b.Run(fmt.Sprintf("parallel/%d", n), func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					_ = table.providersWithIdentity("llm", "model=m7", isRoutable)
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkPeerTableUpdate(b *testing.B) {
+	table := populatedTable(1000)
+	p := routablePeer("peer-7", Service{Name: "llm", IdentityGroup: []string{"model=m7"}})
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		table.set("/peer-7", p)
+	}
+}
@@ -2,42 +2,42 @@ package protocol
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
+	"fmt"
+	"net/url"
 	"opentela/internal/common"
 	"opentela/internal/platform"
-	"sync"
+	"strconv"
+	"strings"
 	"time"
 
-	ds "github.com/ipfs/go-datastore"
 	"github.com/spf13/viper"
 )
 
-// localServices keeps a thread-safe copy of services this node provides
-// so we can re-announce them on reconnects
 var (
-	localServices     []Service
-	localServicesLock = &sync.RWMutex{}
+	ErrInvalidService  = errors.New("invalid service")
+	ErrServiceExists   = errors.New("service already registered")
+	ErrServiceNotFound = errors.New("service not found")
 )
 
-// addLocalService appends (deduped) to localServices
-func addLocalService(svc Service) {
-	localServicesLock.Lock()
-	defer localServicesLock.Unlock()
+// addLocalService appends (deduped) to the local services
+func (n *Node) addLocalService(svc Service) {
+	n.servicesLock.Lock()
+	defer n.servicesLock.Unlock()
 	// simple dedupe on Name|Host|Port
 	key := svc.Name + "|" + svc.Host + "|" + svc.Port
 	exists := false
-	for i := range localServices {
-		k := localServices[i].Name + "|" + localServices[i].Host + "|" + localServices[i].Port
+	for i := range n.services {
+		k := n.services[i].Name + "|" + n.services[i].Host + "|" + n.services[i].Port
 		if k == key {
 			// merge identity groups (dedupe)
 			existing := make(map[string]struct{})
-			for _, id := range localServices[i].IdentityGroup {
+			for _, id := range n.services[i].IdentityGroup {
 				existing[id] = struct{}{}
 			}
 			for _, id := range svc.IdentityGroup {
 				if _, ok := existing[id]; !ok {
-					localServices[i].IdentityGroup = append(localServices[i].IdentityGroup, id)
+					n.services[i].IdentityGroup = append(n.services[i].IdentityGroup, id)
 				}
 			}
 			exists = true
@@ -45,69 +45,151 @@ func addLocalService(svc Service) {
 		}
 	}
 	if !exists {
-		localServices = append(localServices, svc)
+		n.services = append(n.services, svc)
+	}
+}
+
+// replaceLocalService stores svc in place of the local service with the same
+// name and port, or appends it. It reports whether the service is new.
+func (n *Node) replaceLocalService(svc Service) bool {
+	n.servicesLock.Lock()
+	defer n.servicesLock.Unlock()
+	for i := range n.services {
+		if sameService(n.services[i], svc) {
+			n.services[i] = svc
+			return false
+		}
+	}
+	n.services = append(n.services, svc)
+	return true
+}
+
+// removeLocalServices removes the local services with the given name, and
+// port if it is not empty, and returns them.
+func (n *Node) removeLocalServices(name, port string) []Service {
+	n.servicesLock.Lock()
+	defer n.servicesLock.Unlock()
+	var removed []Service
+	kept := n.services[:0]
+	for _, svc := range n.services {
+		if svc.Name == name && (port == "" || svc.Port == port) {
+			removed = append(removed, svc)
+			continue
+		}
+		kept = append(kept, svc)
+	}
+	n.services = kept
+	return removed
+}
+
+// hasLocalService reports whether a service with the same name and port as
+// svc is registered.
+func (n *Node) hasLocalService(svc Service) bool {
+	n.servicesLock.RLock()
+	defer n.servicesLock.RUnlock()
+	for _, existing := range n.services {
+		if sameService(existing, svc) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupLocalService returns the first routable local service with the given
+// name, or the first one with that name if none is routable
+func (n *Node) lookupLocalService(name string) (Service, bool) {
+	n.servicesLock.RLock()
+	defer n.servicesLock.RUnlock()
+	var fallback *Service
+	for i, service := range n.services {
+		if service.Name != name {
+			continue
+		}
+		if IsServiceRoutable(service) {
+			return service, true
+		}
+		if fallback == nil {
+			fallback = &n.services[i]
+		}
+	}
+	if fallback != nil {
+		return *fallback, true
+	}
+	return Service{}, false
+}
+
+// setLocalServicesStatus updates the status of every local service
+func (n *Node) setLocalServicesStatus(status string) {
+	n.servicesLock.Lock()
+	defer n.servicesLock.Unlock()
+	for i := range n.services {
+		n.services[i].Status = status
 	}
 }
 
 // snapshotLocalServices returns a copy of current local services
-func snapshotLocalServices() []Service {
-	localServicesLock.RLock()
-	defer localServicesLock.RUnlock()
-	out := make([]Service, len(localServices))
-	copy(out, localServices)
+func (n *Node) snapshotLocalServices() []Service {
+	n.servicesLock.RLock()
+	defer n.servicesLock.RUnlock()
+	out := make([]Service, len(n.services))
+	copy(out, n.services)
 	return out
 }
 
-func RegisterLocalServices() {
+// RegisterLocalServices registers the service configured by service.name and
+// service.port on the default node. The models of an llm service are watched
+// until ctx is done.
+func RegisterLocalServices(ctx context.Context) {
+	n := defaultNode()
 	serviceName := viper.GetString("service.name")
 	servicePort := viper.GetString("service.port")
+	if serviceName != "" && !nodeBehavior().routingTarget {
+		common.Logger.Warnf("Service %s is registered but no request will be routed to it: role %s does not serve requests", serviceName, NodeRole())
+	}
 	if serviceName == "llm" && servicePort != "" {
 		// register the service by first fetch available models on the port
-		err := healthCheckRemote(servicePort, 6000)
+		err := healthCheckRemote(ctx, healthConfigOf(n.settings()), servicePort, 6000)
 		if err != nil {
 			common.Logger.Error("could not health check LLM service: ", err)
 			return
 		}
 		common.Logger.Info("LLM service is healthy")
-		registerLLMService(servicePort)
+		n.registerLLMService(servicePort)
+		n.startModelWatcher(ctx, servicePort)
+	} else if serviceName != "" && servicePort != "" {
+		// the service may have been restored from a previous run
+		if _, _, err := n.PutService(Service{Name: serviceName, Port: servicePort}); err != nil {
+			common.Logger.Error("could not register service: ", err)
+		}
 	}
 }
 
-func healthCheckRemote(port string, maxTries int) error {
-	err := errors.New("initial error")
-	tries := 0
-	for err != nil {
-		_, err := common.RemoteGET("http://localhost:" + port + "/health")
-		if err != nil {
-			common.Logger.Info("could not health check LLM service: ", err, " retrying in 10 seconds...")
-			time.Sleep(10 * time.Second)
-			tries++
+// healthCheckRemote waits for the service on port to pass its health check,
+// probing it every interval of cfg up to maxTries times or until ctx is done.
+func healthCheckRemote(ctx context.Context, cfg healthConfig, port string, maxTries int) error {
+	h := newHealthChecker(cfg)
+	service := Service{Host: "localhost", Port: port}
+	var err error
+	for tries := 0; tries <= maxTries; tries++ {
+		if err = h.probe(ctx, h.cfg, service); err == nil {
+			return nil
 		}
-		if tries > maxTries {
-			return err
-		}
-		if err == nil {
-			break
+		common.Logger.Info("could not health check LLM service: ", err, " retrying in ", h.cfg.interval, "...")
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(h.cfg.interval):
 		}
 	}
-	return nil
+	return err
 }
 
-func registerLLMService(port string) {
-	modelsBytes, err := common.RemoteGET("http://localhost:" + port + "/v1/models")
-	if err != nil {
-		common.Logger.Error("could not fetch models from LLM service: ", err)
-	}
-	common.Logger.Info("Fetched models from LLM service: ", string(modelsBytes))
-	var availableModels common.LMAvailableModels
-	err = json.Unmarshal(modelsBytes, &availableModels)
+func (n *Node) registerLLMService(port string) {
+	identityGroup, err := fetchModelIdentityGroups(port)
 	if err != nil {
-		common.Logger.Error("could not unmarshal models from LLM service: ", err)
-	}
-	var identityGroup []string
-	for _, model := range availableModels.Models {
-		identityGroup = append(identityGroup, "model="+model.Id)
+		common.Logger.Error(err)
 	}
+	common.Logger.Info("Fetched models from LLM service: ", identityGroup)
 
 	// register the models
 	service := Service{
@@ -117,49 +199,164 @@ func registerLLMService(port string) {
 		Port:          port,
 		IdentityGroup: identityGroup,
 	}
-	provideService(service)
-}
-
-func provideService(service Service) {
-	host, _ := GetP2PNode(nil)
-	ctx := context.Background()
-	store, _ := GetCRDTStore()
-	key := ds.NewKey(host.ID().String())
-	// track locally and publish full set (deduped)
-	addLocalService(service)
-	myself.Service = snapshotLocalServices()
-	if viper.GetString("public-addr") != "" {
-		myself.PublicAddress = viper.GetString("public-addr")
-	}
-	common.Logger.Info("Registering LLM service: ", myself)
-	value, err := json.Marshal(myself)
-	UpdateNodeTableHook(key, value)
-	common.ReportError(err, "Error while marshalling peer")
-	err = store.Put(ctx, key, value)
-	if err != nil {
+	n.provideService(service)
+}
+
+func (n *Node) provideService(service Service) {
+	// a draining node keeps its services out of rotation
+	if n.IsDraining() {
+		service.Status = DRAINING
+	}
+	// track locally, superseding a service restored from a previous run,
+	// and publish the full set
+	n.replaceLocalService(service)
+	common.Logger.Info("Registering LLM service: ", service)
+	if err := n.publishLocalServices(); err != nil {
 		common.Logger.Debug("Error while providing service: ", err)
 	}
 }
 
+// publishLocalServices publishes this node along with its current set of
+// local services. Services that were removed locally are withdrawn from the
+// network.
+func (n *Node) publishLocalServices() error {
+	return n.publishSelf(n.withLocalServices, n.publishPeer)
+}
+
+// withLocalServices sets the current local services of the node on self.
+func (n *Node) withLocalServices(self *Peer) {
+	self.Service = n.snapshotLocalServices()
+	if n.cfg.PublicAddr != "" {
+		self.PublicAddress = n.cfg.PublicAddr
+	}
+}
+
+// ValidateService checks that a service can be registered. Errors wrap
+// ErrInvalidService.
+func ValidateService(service Service) error {
+	if service.Name == "" {
+		return fmt.Errorf("%w: name is required", ErrInvalidService)
+	}
+	// name and port are part of the service's CRDT key
+	if strings.Contains(service.Name, "/") || strings.Contains(service.Port, "/") {
+		return fmt.Errorf("%w: name and port must not contain '/'", ErrInvalidService)
+	}
+	if service.Port == "" && service.Upstream == "" {
+		return fmt.Errorf("%w: either a port or an upstream is required", ErrInvalidService)
+	}
+	if service.Port != "" {
+		if port, err := strconv.Atoi(service.Port); err != nil || port < 1 || port > 65535 {
+			return fmt.Errorf("%w: invalid port %q", ErrInvalidService, service.Port)
+		}
+	}
+	if service.Upstream != "" {
+		u, err := url.Parse(service.Upstream)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%w: invalid upstream %q, expected an http(s) URL", ErrInvalidService, service.Upstream)
+		}
+	}
+	if service.HealthPath != "" && !strings.HasPrefix(service.HealthPath, "/") {
+		return fmt.Errorf("%w: health path must start with '/'", ErrInvalidService)
+	}
+	if service.HealthCheck != nil {
+		return service.HealthCheck.validate()
+	}
+	return nil
+}
+
+// withRegistrationDefaults fills in the fields a registered service is
+// published with.
+func (n *Node) withRegistrationDefaults(service Service) Service {
+	if service.Host == "" && service.Upstream == "" {
+		service.Host = "localhost"
+	}
+	service.Status = CONNECTED
+	// a draining node keeps its services out of rotation
+	if n.IsDraining() {
+		service.Status = DRAINING
+	}
+	return service
+}
+
+// RegisterService starts providing a new service. It fails with
+// ErrServiceExists if a service with the same name and port is registered.
+func RegisterService(service Service) (Service, error) {
+	return defaultNode().RegisterService(service)
+}
+
+// RegisterService starts providing a new service on the node.
+func (n *Node) RegisterService(service Service) (Service, error) {
+	if err := ValidateService(service); err != nil {
+		return Service{}, err
+	}
+	service = n.withRegistrationDefaults(service)
+	if n.hasLocalService(service) {
+		return Service{}, ErrServiceExists
+	}
+	n.addLocalService(service)
+	common.Logger.Infof("Registering service %s", service.Name)
+	return service, n.publishLocalServices()
+}
+
+// PutService registers the service, replacing any service with the same name
+// and port. It reports whether the service is new.
+func PutService(service Service) (Service, bool, error) {
+	return defaultNode().PutService(service)
+}
+
+// PutService registers the service on the node, replacing any service with
+// the same name and port.
+func (n *Node) PutService(service Service) (Service, bool, error) {
+	if err := ValidateService(service); err != nil {
+		return Service{}, false, err
+	}
+	service = n.withRegistrationDefaults(service)
+	created := n.replaceLocalService(service)
+	common.Logger.Infof("Updating service %s", service.Name)
+	return service, created, n.publishLocalServices()
+}
+
+// DeregisterService stops providing the services with the given name, and
+// port if it is not empty, and withdraws them from the network.
+func DeregisterService(name, port string) ([]Service, error) {
+	return defaultNode().DeregisterService(name, port)
+}
+
+// DeregisterService stops providing the services with the given name, and
+// port if it is not empty, on the node.
+func (n *Node) DeregisterService(name, port string) ([]Service, error) {
+	removed := n.removeLocalServices(name, port)
+	if len(removed) == 0 {
+		return nil, ErrServiceNotFound
+	}
+	common.Logger.Infof("Deregistering service %s", name)
+	return removed, n.publishLocalServices()
+}
+
+// LocalServices returns the services provided by this node.
+func LocalServices() []Service {
+	return defaultNode().LocalServices()
+}
+
+// LocalServices returns the services provided by the node.
+func (n *Node) LocalServices() []Service {
+	return n.snapshotLocalServices()
+}
+
 // ReannounceLocalServices re-publishes this node's service entry, used after reconnects
 func ReannounceLocalServices() {
-	host, _ := GetP2PNode(nil)
-	ctx := context.Background()
-	store, _ := GetCRDTStore()
-	key := ds.NewKey(host.ID().String())
+	defaultNode().ReannounceLocalServices()
+}
+
+// ReannounceLocalServices re-publishes the node's entry and services.
+func (n *Node) ReannounceLocalServices() {
 	// refresh hardware and services
-	myself.Hardware.GPUs = platform.GetGPUInfo()
-	myself.Service = snapshotLocalServices()
-	if viper.GetString("public-addr") != "" {
-		myself.PublicAddress = viper.GetString("public-addr")
-	}
-	value, err := json.Marshal(myself)
+	hardware := platform.GetHardwareSpec()
+	err := n.publishSelf(func(self *Peer) {
+		self.Hardware = hardware
+		n.withLocalServices(self)
+	}, n.publishPeer)
 	if err != nil {
-		common.Logger.Error("Error marshalling self during reannounce: ", err)
-		return
-	}
-	UpdateNodeTableHook(key, value)
-	if err := store.Put(ctx, key, value); err != nil {
 		common.Logger.Warn("Failed to reannounce local services: ", err)
 	} else {
 		common.Logger.Info("Re-announced local services to network")
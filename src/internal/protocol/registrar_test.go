@@ -1,14 +1,17 @@
 package protocol
 
-import "testing"
+import (
+	"errors"
+	"testing"
+)
 
 func TestLocalServiceSnapshot(t *testing.T) {
 	// start with empty registry
-	localServices = nil
-	addLocalService(Service{Name: "llm", Host: "localhost", Port: "8000", IdentityGroup: []string{"model=a"}})
-	addLocalService(Service{Name: "llm", Host: "localhost", Port: "8000", IdentityGroup: []string{"model=b"}})
+	n := newNode()
+	n.addLocalService(Service{Name: "llm", Host: "localhost", Port: "8000", IdentityGroup: []string{"model=a"}})
+	n.addLocalService(Service{Name: "llm", Host: "localhost", Port: "8000", IdentityGroup: []string{"model=b"}})
 
-	snap := snapshotLocalServices()
+	snap := n.snapshotLocalServices()
 	if len(snap) != 1 {
 		t.Fatalf("expected 1 service after dedupe, got %d", len(snap))
 	}
@@ -16,3 +19,64 @@ func TestLocalServiceSnapshot(t *testing.T) {
 		t.Fatalf("expected merged identity groups, got %v", snap[0].IdentityGroup)
 	}
 }
+
+func TestReplaceAndRemoveLocalServices(t *testing.T) {
+	n := newNode()
+	if !n.replaceLocalService(Service{Name: "llm", Port: "8000", IdentityGroup: []string{"model=a"}}) {
+		t.Fatal("expected a new service")
+	}
+	if n.replaceLocalService(Service{Name: "llm", Port: "8000", IdentityGroup: []string{"model=b"}}) {
+		t.Fatal("expected the service to be replaced")
+	}
+	n.replaceLocalService(Service{Name: "llm", Port: "8001"})
+	n.replaceLocalService(Service{Name: "vision", Port: "9000"})
+
+	snap := n.snapshotLocalServices()
+	if len(snap) != 3 || len(snap[0].IdentityGroup) != 1 || snap[0].IdentityGroup[0] != "model=b" {
+		t.Fatalf("unexpected services after replace: %+v", snap)
+	}
+
+	if removed := n.removeLocalServices("llm", "8001"); len(removed) != 1 || removed[0].Port != "8001" {
+		t.Fatalf("expected only the service on port 8001 to be removed, got %+v", removed)
+	}
+	if removed := n.removeLocalServices("llm", ""); len(removed) != 1 {
+		t.Fatalf("expected the remaining llm service to be removed, got %+v", removed)
+	}
+	if _, err := DeregisterService("llm", ""); !errors.Is(err, ErrServiceNotFound) {
+		t.Fatalf("expected ErrServiceNotFound, got %v", err)
+	}
+	if snap := n.snapshotLocalServices(); len(snap) != 1 || snap[0].Name != "vision" {
+		t.Fatalf("unexpected services after removal: %+v", snap)
+	}
+}
+
+func TestValidateService(t *testing.T) {
+	valid := []Service{
+		{Name: "llm", Port: "8080"},
+		{Name: "llm", Upstream: "https://10.0.0.5:8443/v1", HealthPath: "/health"},
+		{Name: "llm", Port: "8080", HealthCheck: &HealthCheck{Interval: "30s", FailureThreshold: 5}},
+	}
+	for _, s := range valid {
+		if err := ValidateService(s); err != nil {
+			t.Fatalf("expected %+v to be valid, got %v", s, err)
+		}
+	}
+	invalid := []Service{
+		{Port: "8080"},
+		{Name: "llm"},
+		{Name: "a/b", Port: "8080"},
+		{Name: "llm", Port: "http"},
+		{Name: "llm", Port: "70000"},
+		{Name: "llm", Upstream: "ftp://host"},
+		{Name: "llm", Upstream: "localhost:8080"},
+		{Name: "llm", Port: "8080", HealthPath: "health"},
+		{Name: "llm", Port: "8080", HealthCheck: &HealthCheck{Interval: "soon"}},
+		{Name: "llm", Port: "8080", HealthCheck: &HealthCheck{Timeout: "-1s"}},
+		{Name: "llm", Port: "8080", HealthCheck: &HealthCheck{SuccessThreshold: -1}},
+	}
+	for _, s := range invalid {
+		if err := ValidateService(s); !errors.Is(err, ErrInvalidService) {
+			t.Fatalf("expected %+v to be invalid, got %v", s, err)
+		}
+	}
+}
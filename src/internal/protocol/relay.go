@@ -0,0 +1,127 @@
+package protocol
+
+import (
+	"context"
+	"opentela/internal/common"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	relayv2 "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// How traffic to a connected peer flows, set locally in Peer.Connection.
+const (
+	ConnectionDirect  = "direct"
+	ConnectionRelayed = "relayed"
+)
+
+// Defaults of the relay service. Workers behind NAT serve requests through
+// their relay, so relayed connections are allowed far more than the libp2p
+// defaults of 2 minutes and 128KiB, enough for long streamed completions.
+const (
+	defaultRelayDuration = 30 * time.Minute
+	defaultRelayData     = 1 << 30
+)
+
+// relayResources returns the limits of the relay service of a node built
+// from cfg.
+func relayResources(cfg NodeConfig) relayv2.Resources {
+	rc := relayv2.DefaultResources()
+	rc.Limit = &relayv2.RelayLimit{Duration: defaultRelayDuration, Data: defaultRelayData}
+	if cfg.RelayDuration > 0 {
+		rc.Limit.Duration = cfg.RelayDuration
+	}
+	if cfg.RelayData > 0 {
+		rc.Limit.Data = cfg.RelayData
+	}
+	if cfg.RelayReservations > 0 {
+		rc.MaxReservations = cfg.RelayReservations
+	}
+	if cfg.RelayCircuits > 0 {
+		rc.MaxCircuits = cfg.RelayCircuits
+	}
+	return rc
+}
+
+// isRelayCandidate reports whether a node behind NAT may reserve a relay
+// slot on the peer: relays, and heads with a public address. Both run the
+// relay service.
+func isRelayCandidate(peer Peer) bool {
+	if peer.Status == LEFT || peer.Incompatible {
+		return false
+	}
+	return hasRole(peer, RoleRelay) || (peer.PublicAddress != "" && hasRole(peer, RoleHead))
+}
+
+// relayPeers returns the peer source autorelay reserves slots from when AutoNAT
+// finds the node is not reachable. Candidates come from the node table, with
+// their public address when they publish one; autorelay adds the addresses
+// the peerstore already knows.
+func (n *Node) relayPeers(tcpPort string) func(ctx context.Context, num int) <-chan peer.AddrInfo {
+	return func(ctx context.Context, num int) <-chan peer.AddrInfo {
+		candidates := n.table.snapshot(isRelayCandidate)
+		out := make(chan peer.AddrInfo, min(num, len(candidates)))
+		defer close(out)
+		for _, p := range candidates {
+			if len(out) == cap(out) {
+				break
+			}
+			id, err := peer.Decode(p.ID)
+			if err != nil {
+				continue
+			}
+			info := peer.AddrInfo{ID: id}
+			if p.PublicAddress != "" {
+				addr, err := multiaddr.NewMultiaddr("/ip4/" + p.PublicAddress + "/tcp/" + tcpPort)
+				if err == nil {
+					info.Addrs = append(info.Addrs, addr)
+				}
+			}
+			out <- info
+		}
+		common.Logger.Debugf("Offering %d relay candidates to autorelay", len(out))
+		return out
+	}
+}
+
+// connectionKind tells whether traffic to the peer goes over a direct
+// connection or only through a relay, or returns "" if h has no connection
+// to the peer.
+func connectionKind(h host.Host, id peer.ID) string {
+	conns := h.Network().ConnsToPeer(id)
+	if len(conns) == 0 {
+		return ""
+	}
+	for _, c := range conns {
+		if !isRelayedConn(c) {
+			return ConnectionDirect
+		}
+	}
+	return ConnectionRelayed
+}
+
+func isRelayedConn(c network.Conn) bool {
+	if c.Stat().Limited {
+		return true
+	}
+	_, err := c.RemoteMultiaddr().ValueForProtocol(multiaddr.P_CIRCUIT)
+	return err == nil
+}
+
+// annotateConnections sets how traffic flows to each peer of table.
+func (n *Node) annotateConnections(table NodeTable) {
+	if n.host == nil {
+		return
+	}
+	for key, p := range table {
+		id, err := peer.Decode(p.ID)
+		if err != nil {
+			continue
+		}
+		p.Connection = connectionKind(n.host, id)
+		table[key] = p
+	}
+}
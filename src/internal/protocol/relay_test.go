@@ -0,0 +1,144 @@
+package protocol
+
+import (
+	"context"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/client"
+	relayv2 "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+	"github.com/multiformats/go-multiaddr"
+)
+
+func newPeerID(t *testing.T) peer.ID {
+	t.Helper()
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := peer.IDFromPrivateKey(priv)
+	return id
+}
+
+func TestIsRelayCandidate(t *testing.T) {
+	cases := []struct {
+		name string
+		peer Peer
+		want bool
+	}{
+		{"relay", Peer{Role: []string{RoleRelay}}, true},
+		{"public head", Peer{Role: []string{RoleHead}, PublicAddress: "1.2.3.4"}, true},
+		{"private head", Peer{Role: []string{RoleHead}}, false},
+		{"public worker", Peer{Role: []string{RoleWorker}, PublicAddress: "1.2.3.4"}, false},
+		{"left relay", Peer{Role: []string{RoleRelay}, Status: LEFT}, false},
+	}
+	for _, c := range cases {
+		if got := isRelayCandidate(c.peer); got != c.want {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestRelayResources(t *testing.T) {
+	rc := relayResources(NodeConfig{})
+	if rc.Limit == nil || rc.Limit.Duration != defaultRelayDuration || rc.Limit.Data != defaultRelayData {
+		t.Fatalf("expected finite default limits, got %+v", rc.Limit)
+	}
+	rc = relayResources(NodeConfig{RelayDuration: time.Minute, RelayData: 1 << 20, RelayReservations: 4, RelayCircuits: 2})
+	if rc.Limit.Duration != time.Minute || rc.Limit.Data != 1<<20 || rc.MaxReservations != 4 || rc.MaxCircuits != 2 {
+		t.Fatalf("expected the configured limits, got %+v (%+v)", rc, rc.Limit)
+	}
+}
+
+func TestRelayOnlyServesAdmittedPeers(t *testing.T) {
+	n := newNode()
+	gater := &aclGater{acl: n.acl, foreign: &n.foreign}
+	allowed, denied, foreign := newPeerID(t), newPeerID(t), newPeerID(t)
+	_ = n.acl.setStatic(ACL{Deny: ACLRules{Peers: []string{denied.String()}, CIDRs: []string{"10.0.0.0/8"}}})
+	n.foreign.mark(foreign)
+	public := multiaddr.StringCast("/ip4/1.2.3.4/tcp/4001")
+
+	if !gater.AllowReserve(allowed, public) || !gater.AllowConnect(allowed, public, allowed) {
+		t.Fatal("expected an admitted peer to be relayed")
+	}
+	if gater.AllowReserve(allowed, multiaddr.StringCast("/ip4/10.1.2.3/tcp/4001")) {
+		t.Fatal("expected a reservation from a denied network to be refused")
+	}
+	for _, p := range []peer.ID{denied, foreign} {
+		if gater.AllowReserve(p, public) || gater.AllowConnect(p, public, allowed) || gater.AllowConnect(allowed, public, p) {
+			t.Fatalf("expected %s not to be relayed", p)
+		}
+	}
+}
+
+func TestRelayPeersFromTable(t *testing.T) {
+	n := newNode()
+	relay, head, worker := newPeerID(t), newPeerID(t), newPeerID(t)
+	n.table.set("/"+relay.String(), Peer{ID: relay.String(), Role: []string{RoleRelay}})
+	n.table.set("/"+head.String(), Peer{ID: head.String(), Role: []string{RoleHead}, PublicAddress: "1.2.3.4"})
+	n.table.set("/"+worker.String(), Peer{ID: worker.String(), Role: []string{RoleWorker}})
+
+	got := map[peer.ID][]multiaddr.Multiaddr{}
+	for info := range n.relayPeers("43905")(context.Background(), 10) {
+		got[info.ID] = info.Addrs
+	}
+	if len(got) != 2 {
+		t.Fatalf("expected the relay and the public head, got %v", got)
+	}
+	if addrs := got[head]; len(addrs) != 1 || addrs[0].String() != "/ip4/1.2.3.4/tcp/43905" {
+		t.Fatalf("expected the public address of the head, got %v", addrs)
+	}
+	if _, ok := got[relay]; !ok {
+		t.Fatal("expected the relay to be offered")
+	}
+
+	if count := len(n.relayPeers("43905")(context.Background(), 1)); count != 1 {
+		t.Fatalf("expected at most 1 candidate, got %d", count)
+	}
+}
+
+func TestConnectionKindThroughRelay(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	newHost := func(opts ...libp2p.Option) host.Host {
+		h, err := libp2p.New(append(opts, libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = h.Close() })
+		return h
+	}
+	relay := newHost(libp2p.EnableRelayService(relayv2.WithInfiniteLimits()), libp2p.ForceReachabilityPublic())
+	worker := newHost()
+	head := newHost()
+
+	relayInfo := peer.AddrInfo{ID: relay.ID(), Addrs: relay.Addrs()}
+	if err := worker.Connect(ctx, relayInfo); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Reserve(ctx, worker, relayInfo); err != nil {
+		t.Fatalf("failed to reserve a relay slot: %v", err)
+	}
+	if connectionKind(head, worker.ID()) != "" {
+		t.Fatal("expected no connection before dialing")
+	}
+
+	circuit, err := multiaddr.NewMultiaddr(relay.Addrs()[0].String() + "/p2p/" + relay.ID().String() + "/p2p-circuit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := head.Connect(ctx, peer.AddrInfo{ID: worker.ID(), Addrs: []multiaddr.Multiaddr{circuit}}); err != nil {
+		t.Fatalf("failed to connect through the relay: %v", err)
+	}
+	if got := connectionKind(head, worker.ID()); got != ConnectionRelayed {
+		t.Fatalf("expected a relayed connection, got %q", got)
+	}
+	if got := connectionKind(worker, relay.ID()); got != ConnectionDirect {
+		t.Fatalf("expected a direct connection to the relay, got %q", got)
+	}
+}
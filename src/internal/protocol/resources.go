@@ -0,0 +1,194 @@
+package protocol
+
+import (
+	"errors"
+	"opentela/internal/common"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
+	"github.com/libp2p/go-libp2p/p2p/net/connmgr"
+	"github.com/pbnjay/memory"
+)
+
+// Tags under which the connection manager protects connections from being
+// trimmed.
+const (
+	connTagBootstrap     = "opentela-bootstrap"
+	connTagRoutingTarget = "opentela-routing-target"
+)
+
+var errNoResourceStats = errors.New("the resource manager of the host does not report its usage")
+
+// resourceLimits scales the default libp2p limits to maxMemory bytes and
+// maxFDs file descriptors. Either defaults, when zero, to what libp2p scales
+// to on its own: an eighth of the memory of the system and half of the file
+// descriptors the process may open.
+func resourceLimits(maxMemory int64, maxFDs int) rcmgr.ConcreteLimitConfig {
+	scaling := rcmgr.DefaultLimits
+	libp2p.SetDefaultServiceLimits(&scaling)
+	auto := scaling.AutoScale()
+	if maxMemory <= 0 && maxFDs <= 0 {
+		return auto
+	}
+	if maxMemory <= 0 {
+		maxMemory = int64(memory.TotalMemory()) / 8
+	}
+	if maxFDs <= 0 {
+		// the system scope gets all the descriptors it is scaled with
+		maxFDs = int(auto.ToPartialLimitConfig().System.FD)
+	}
+	return scaling.Scale(maxMemory, maxFDs)
+}
+
+// resourceOptions returns the resource and connection managers of a host
+// built from cfg. The connection manager is left out if cfg has no high
+// watermark.
+func resourceOptions(cfg NodeConfig) ([]libp2p.Option, rcmgr.ConcreteLimitConfig, error) {
+	limits := resourceLimits(cfg.MaxMemory, cfg.MaxFDs)
+	rm, err := rcmgr.NewResourceManager(rcmgr.NewFixedLimiter(limits))
+	if err != nil {
+		return nil, limits, err
+	}
+	opts := []libp2p.Option{libp2p.ResourceManager(rm)}
+	if cfg.ConnHighWater > 0 {
+		var cmOpts []connmgr.Option
+		if cfg.ConnGracePeriod > 0 {
+			cmOpts = append(cmOpts, connmgr.WithGracePeriod(cfg.ConnGracePeriod))
+		}
+		cm, err := connmgr.NewConnManager(cfg.ConnLowWater, cfg.ConnHighWater, cmOpts...)
+		if err != nil {
+			_ = rm.Close()
+			return nil, limits, err
+		}
+		opts = append(opts, libp2p.ConnectionManager(cm))
+	}
+	system := limits.ToPartialLimitConfig().System
+	common.Logger.Infof("Resource limits: %v connections, %v streams, %v file descriptors, %v bytes of memory",
+		system.Conns, system.Streams, system.FD, system.Memory)
+	return opts, limits, nil
+}
+
+// protectRoutingTarget keeps the connections to the peer open when the
+// connection manager trims them as long as requests may be routed to it, and
+// lets them be trimmed once the peer left or is removed from the table.
+func (n *Node) protectRoutingTarget(peerID string) {
+	id, err := peer.Decode(peerID)
+	if err != nil || n.host == nil {
+		return
+	}
+	p, err := n.GetPeerFromTable(peerID)
+	if err == nil && p.Status != LEFT && isRoutingTarget(p) {
+		n.host.ConnManager().Protect(id, connTagRoutingTarget)
+	} else {
+		n.host.ConnManager().Unprotect(id, connTagRoutingTarget)
+	}
+}
+
+// ResourceUsage is what a resource scope of the host currently uses.
+type ResourceUsage struct {
+	StreamsInbound  int   `json:"streams_inbound"`
+	StreamsOutbound int   `json:"streams_outbound"`
+	ConnsInbound    int   `json:"conns_inbound"`
+	ConnsOutbound   int   `json:"conns_outbound"`
+	FD              int   `json:"fd"`
+	Memory          int64 `json:"memory"`
+}
+
+func resourceUsage(stat network.ScopeStat) ResourceUsage {
+	return ResourceUsage{
+		StreamsInbound:  stat.NumStreamsInbound,
+		StreamsOutbound: stat.NumStreamsOutbound,
+		ConnsInbound:    stat.NumConnsInbound,
+		ConnsOutbound:   stat.NumConnsOutbound,
+		FD:              stat.NumFD,
+		Memory:          stat.Memory,
+	}
+}
+
+// ConnectionStats describes the connections of the host and the watermarks
+// the connection manager trims them between.
+type ConnectionStats struct {
+	Count     int `json:"count"`
+	Protected int `json:"protected"`
+	LowWater  int `json:"low_water"`
+	HighWater int `json:"high_water"`
+}
+
+// ResourceStats is the resource usage of the host, by scope.
+type ResourceStats struct {
+	System    ResourceUsage            `json:"system"`
+	Transient ResourceUsage            `json:"transient"`
+	Services  map[string]ResourceUsage `json:"services"`
+	Protocols map[string]ResourceUsage `json:"protocols"`
+	Peers     map[string]ResourceUsage `json:"peers"`
+	// Limits are the limits of the system scope
+	Limits      rcmgr.ResourceLimits `json:"limits"`
+	Connections ConnectionStats      `json:"connections"`
+}
+
+// GetResourceManagerStats logs the resource usage of the default node.
+func GetResourceManagerStats() {
+	defaultNode().GetResourceManagerStats()
+}
+
+// GetResourceManagerStats logs the resource usage of the host of the node.
+func (n *Node) GetResourceManagerStats() {
+	stats, err := n.ResourceStats()
+	if err != nil {
+		common.Logger.Info("Resource Manager stats not available: ", err)
+		return
+	}
+	common.Logger.Infof("Resource Manager Stats - System: Conns=%d (in:%d out:%d), Streams=%d (in:%d out:%d), Memory=%d",
+		stats.System.ConnsInbound+stats.System.ConnsOutbound,
+		stats.System.ConnsInbound,
+		stats.System.ConnsOutbound,
+		stats.System.StreamsInbound+stats.System.StreamsOutbound,
+		stats.System.StreamsInbound,
+		stats.System.StreamsOutbound,
+		stats.System.Memory,
+	)
+}
+
+// ResourceStats returns the resource usage of the host of the node.
+func (n *Node) ResourceStats() (ResourceStats, error) {
+	h, err := n.hostOrStart()
+	if err != nil {
+		return ResourceStats{}, err
+	}
+	state, ok := h.Network().ResourceManager().(rcmgr.ResourceManagerState)
+	if !ok {
+		return ResourceStats{}, errNoResourceStats
+	}
+	stat := state.Stat()
+	stats := ResourceStats{
+		System:    resourceUsage(stat.System),
+		Transient: resourceUsage(stat.Transient),
+		Services:  make(map[string]ResourceUsage, len(stat.Services)),
+		Protocols: make(map[string]ResourceUsage, len(stat.Protocols)),
+		Peers:     make(map[string]ResourceUsage, len(stat.Peers)),
+		Limits:    n.limits.ToPartialLimitConfig().System,
+	}
+	for name, s := range stat.Services {
+		stats.Services[name] = resourceUsage(s)
+	}
+	for proto, s := range stat.Protocols {
+		stats.Protocols[string(proto)] = resourceUsage(s)
+	}
+	for id, s := range stat.Peers {
+		stats.Peers[id.String()] = resourceUsage(s)
+	}
+
+	stats.Connections.Count = len(h.Network().Conns())
+	for _, id := range h.Network().Peers() {
+		if h.ConnManager().IsProtected(id, "") {
+			stats.Connections.Protected++
+		}
+	}
+	if n.cfg != nil {
+		stats.Connections.LowWater = n.cfg.ConnLowWater
+		stats.Connections.HighWater = n.cfg.ConnHighWater
+	}
+	return stats, nil
+}
@@ -0,0 +1,97 @@
+package protocol
+
+import (
+	"context"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
+	"github.com/spf13/viper"
+)
+
+func TestResourceLimitsFromConfig(t *testing.T) {
+	small := resourceLimits(256<<20, 512).ToPartialLimitConfig().System
+	large := resourceLimits(4<<30, 4096).ToPartialLimitConfig().System
+	if small.FD != 512 || large.FD != 4096 {
+		t.Fatalf("expected the configured descriptors, got %v and %v", small.FD, large.FD)
+	}
+	if small.Conns >= large.Conns || small.Memory >= large.Memory {
+		t.Fatalf("expected limits to scale with memory, got %+v and %+v", small, large)
+	}
+	if auto := resourceLimits(0, 0).ToPartialLimitConfig().System; auto.FD == rcmgr.DefaultLimit {
+		t.Fatal("expected scaled limits without configuration")
+	}
+}
+
+func TestResourceSettings(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+	viper.Set("seed", "0")
+	viper.Set("resources.max_memory", "2GiB")
+	viper.Set("connmgr.high_water", 300)
+	viper.Set("relay.max_data", "64MiB")
+	cfg, err := ConfigFromViper()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MaxMemory != 2<<30 || cfg.ConnHighWater != 300 || cfg.RelayData != 64<<20 {
+		t.Fatalf("unexpected resource settings: %+v", cfg)
+	}
+	viper.Set("resources.max_memory", "lots")
+	if _, err := ConfigFromViper(); err == nil {
+		t.Fatal("expected an invalid size to be rejected")
+	}
+}
+
+func TestResourceStatsAndProtection(t *testing.T) {
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := NewNode(NodeConfig{
+		Identity:        priv,
+		Mode:            "standalone",
+		TCPPort:         "0",
+		UDPPort:         "0",
+		InMemory:        true,
+		ConnLowWater:    10,
+		ConnHighWater:   20,
+		ConnGracePeriod: time.Second,
+	})
+	if err := n.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start node: %v", err)
+	}
+	defer n.Close()
+
+	stats, err := n.ResourceStats()
+	if err != nil {
+		t.Fatalf("expected resource stats: %v", err)
+	}
+	if stats.Connections.LowWater != 10 || stats.Connections.HighWater != 20 {
+		t.Fatalf("expected the configured watermarks, got %+v", stats.Connections)
+	}
+	if stats.Limits.Conns == rcmgr.DefaultLimit {
+		t.Fatalf("expected the system limits, got %+v", stats.Limits)
+	}
+
+	worker, observer := newPeerID(t), newPeerID(t)
+	n.table.set("/"+worker.String(), Peer{ID: worker.String(), Role: []string{RoleWorker}})
+	n.table.set("/"+observer.String(), Peer{ID: observer.String(), Role: []string{RoleObserver}})
+	n.protectRoutingTarget(worker.String())
+	n.protectRoutingTarget(observer.String())
+	cm := n.Host().ConnManager()
+	if !cm.IsProtected(worker, connTagRoutingTarget) {
+		t.Fatal("expected the worker to be protected")
+	}
+	if cm.IsProtected(observer, connTagRoutingTarget) {
+		t.Fatal("expected the observer not to be protected")
+	}
+
+	n.table.set("/"+worker.String(), Peer{ID: worker.String(), Role: []string{RoleWorker}, Status: LEFT})
+	n.protectRoutingTarget(worker.String())
+	if cm.IsProtected(worker, connTagRoutingTarget) {
+		t.Fatal("expected the worker to be unprotected once it left")
+	}
+}
@@ -0,0 +1,110 @@
+package protocol
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/spf13/viper"
+)
+
+// Roles a node can run as, published in Peer.Role.
+const (
+	// RoleHead accepts public requests and routes them to workers. It also
+	// relays for peers behind NAT and may serve requests itself, which is
+	// what every node did before roles existed.
+	RoleHead = "head"
+	// RoleWorker serves requests routed to it and does nothing else.
+	RoleWorker = "worker"
+	// RoleRelay only helps other peers connect: it relays and bootstraps.
+	RoleRelay = "relay"
+	// RoleObserver follows the node table without taking part in it.
+	RoleObserver = "observer"
+)
+
+const defaultRole = RoleHead
+
+// roleBehavior is what a role enables on the node.
+type roleBehavior struct {
+	// publicRoutes mounts the /v1/service routes forwarding requests to
+	// workers
+	publicRoutes bool
+	// relayService and natService let other peers relay through and probe
+	// their reachability with this node
+	relayService bool
+	natService   bool
+	// routingTarget makes the node eligible for routed requests
+	routingTarget bool
+	// dhtClient keeps the node out of the DHT routing tables
+	dhtClient bool
+	// bootstrap lets a node with a public address serve as a bootstrap
+	bootstrap bool
+}
+
+var roleBehaviors = map[string]roleBehavior{
+	RoleHead:     {publicRoutes: true, relayService: true, natService: true, routingTarget: true, bootstrap: true},
+	RoleWorker:   {routingTarget: true},
+	RoleRelay:    {relayService: true, natService: true, bootstrap: true},
+	RoleObserver: {dhtClient: true},
+}
+
+// ValidateRole checks that role is one of the known roles.
+func ValidateRole(role string) error {
+	if _, ok := roleBehaviors[role]; !ok {
+		return fmt.Errorf("unknown role %q, expected one of head, worker, relay or observer", role)
+	}
+	return nil
+}
+
+// NodeRole returns the role this node runs as, from the role setting.
+func NodeRole() string {
+	role := viper.GetString("role")
+	if role == "" {
+		return defaultRole
+	}
+	return role
+}
+
+func nodeBehavior() roleBehavior {
+	return roleBehaviors[NodeRole()]
+}
+
+// ServesPublicRoutes reports whether this node accepts requests to be routed
+// to other peers.
+func ServesPublicRoutes() bool {
+	return nodeBehavior().publicRoutes
+}
+
+// ServesPublicRoutes reports whether the node accepts requests to be routed
+// to other peers.
+func (n *Node) ServesPublicRoutes() bool {
+	cfg, err := n.config()
+	if err != nil || cfg.Role == "" {
+		return roleBehaviors[defaultRole].publicRoutes
+	}
+	return roleBehaviors[cfg.Role].publicRoutes
+}
+
+// hasRole reports whether the peer runs one of roles. Peers from releases
+// without roles publish none and are treated as heads.
+func hasRole(peer Peer, roles ...string) bool {
+	if len(peer.Role) == 0 {
+		return slices.Contains(roles, defaultRole)
+	}
+	for _, role := range peer.Role {
+		if slices.Contains(roles, role) {
+			return true
+		}
+	}
+	return false
+}
+
+// isRoutingTarget reports whether requests may be routed to the peer.
+func isRoutingTarget(peer Peer) bool {
+	return hasRole(peer, RoleHead, RoleWorker)
+}
+
+// isBootstrapCandidate reports whether the peer can be handed out as a
+// bootstrap to other nodes.
+func isBootstrapCandidate(peer Peer) bool {
+	return peer.PublicAddress != "" && hasRole(peer, RoleHead, RoleRelay)
+}
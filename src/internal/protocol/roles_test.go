@@ -0,0 +1,62 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestNodeRole(t *testing.T) {
+	defer viper.Set("role", "")
+	viper.Set("role", "")
+	if NodeRole() != RoleHead || !ServesPublicRoutes() {
+		t.Fatal("expected nodes without a role to behave as heads")
+	}
+	viper.Set("role", RoleWorker)
+	if ServesPublicRoutes() || nodeBehavior().relayService {
+		t.Fatal("expected workers to neither route nor relay")
+	}
+	viper.Set("role", RoleObserver)
+	if !nodeBehavior().dhtClient || nodeBehavior().routingTarget {
+		t.Fatal("expected observers to stay out of the DHT and of routing")
+	}
+	if err := ValidateRole("gateway"); err == nil {
+		t.Fatal("expected an unknown role to be rejected")
+	}
+}
+
+func TestRolesDriveRoutingAndBootstraps(t *testing.T) {
+	cases := []struct {
+		peer      Peer
+		target    bool
+		bootstrap bool
+	}{
+		{Peer{PublicAddress: "1.2.3.4"}, true, true},
+		{Peer{Role: []string{RoleHead}, PublicAddress: "1.2.3.4"}, true, true},
+		{Peer{Role: []string{RoleWorker}, PublicAddress: "1.2.3.4"}, true, false},
+		{Peer{Role: []string{RoleRelay}, PublicAddress: "1.2.3.4"}, false, true},
+		{Peer{Role: []string{RoleRelay}}, false, false},
+		{Peer{Role: []string{RoleObserver}, PublicAddress: "1.2.3.4"}, false, false},
+	}
+	for _, c := range cases {
+		if got := isRoutingTarget(c.peer); got != c.target {
+			t.Errorf("isRoutingTarget(%v) = %v, want %v", c.peer.Role, got, c.target)
+		}
+		if got := isBootstrapCandidate(c.peer); got != c.bootstrap {
+			t.Errorf("isBootstrapCandidate(%v, %q) = %v, want %v", c.peer.Role, c.peer.PublicAddress, got, c.bootstrap)
+		}
+	}
+}
+
+func TestProvidersSkipNonTargetRoles(t *testing.T) {
+	table := cleanNodeTable()
+	llm := Service{Name: "llm", IdentityGroup: []string{"all"}}
+	worker := routablePeer("worker", llm)
+	worker.Role = []string{RoleWorker}
+	table.set("/worker", worker)
+	table.set("/relay", Peer{ID: "relay", Role: []string{RoleRelay}, Connected: true, Service: []Service{llm}})
+	providers, err := GetAllProviders("llm")
+	if err != nil || len(providers) != 1 || providers[0].ID != "worker" {
+		t.Fatalf("expected only the worker to be a provider, got %+v (%v)", providers, err)
+	}
+}
@@ -0,0 +1,120 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"opentela/internal/common"
+	"os"
+	"path"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/pnet"
+	"github.com/libp2p/go-libp2p/p2p/transport/tcp"
+	"github.com/libp2p/go-libp2p/p2p/transport/websocket"
+)
+
+const swarmKeyHeader = "/key/swarm/psk/1.0.0/\n/base16/\n"
+
+// DefaultSwarmKeyPath is where the swarm key is read from and written to when
+// network.swarm_key is not set.
+func DefaultSwarmKeyPath() (string, error) {
+	return path.Join(common.GetKeysPath(), "swarm.key"), nil
+}
+
+// GenerateSwarmKey returns a new random swarm key in the format understood by
+// libp2p (and IPFS), ready to be written to a file.
+func GenerateSwarmKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return []byte(swarmKeyHeader + hex.EncodeToString(key) + "\n"), nil
+}
+
+// WriteSwarmKey generates a swarm key and writes it to keyPath. An existing
+// key is only replaced if force is set, since replacing it disconnects the
+// node from the rest of its private network.
+func WriteSwarmKey(keyPath string, force bool) error {
+	if _, err := os.Stat(keyPath); err == nil && !force {
+		return fmt.Errorf("swarm key %s already exists", keyPath)
+	}
+	data, err := GenerateSwarmKey()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(keyPath), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(keyPath, data, 0600)
+}
+
+// LoadSwarmKey reads and decodes the swarm key at keyPath.
+func LoadSwarmKey(keyPath string) (pnet.PSK, error) {
+	data, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	psk, err := pnet.DecodeV1PSK(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid swarm key %s: %w", keyPath, err)
+	}
+	return psk, nil
+}
+
+// SwarmKeyFingerprint identifies a swarm key without revealing it, so that
+// operators can compare keys across nodes.
+func SwarmKeyFingerprint(psk pnet.PSK) string {
+	sum := sha256.Sum256(psk)
+	return hex.EncodeToString(sum[:8])
+}
+
+// transportOptions returns the libp2p transports and listen addresses of the
+// node. In a private network, the swarm key is loaded and only
+// PSK-compatible transports (TCP and websocket) are enabled: QUIC and
+// WebTransport bring their own encryption and cannot be used with a PSK.
+func (n *Node) transportOptions(cfg NodeConfig) ([]libp2p.Option, error) {
+	listen := []string{
+		"/ip4/0.0.0.0/tcp/" + cfg.TCPPort,
+		"/ip4/0.0.0.0/tcp/" + cfg.TCPPort + "/ws",
+	}
+	if !cfg.PrivateNetwork {
+		n.privateNetwork = ""
+		listen = append(listen, "/ip4/0.0.0.0/udp/"+cfg.UDPPort+"/quic")
+		return []libp2p.Option{libp2p.DefaultTransports, libp2p.ListenAddrStrings(listen...)}, nil
+	}
+	keyPath := cfg.SwarmKeyPath
+	if keyPath == "" {
+		var err error
+		if keyPath, err = DefaultSwarmKeyPath(); err != nil {
+			return nil, err
+		}
+	}
+	psk, err := LoadSwarmKey(keyPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("private network mode is enabled but there is no swarm key at %s; create one with `otela key swarm` and copy it to every node of the network", keyPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	n.privateNetwork = SwarmKeyFingerprint(psk)
+	return []libp2p.Option{
+		libp2p.PrivateNetwork(psk),
+		libp2p.Transport(tcp.NewTCPTransport),
+		libp2p.Transport(websocket.New),
+		libp2p.ListenAddrStrings(listen...),
+	}, nil
+}
+
+// explainDialError adds a hint to connection errors in private network mode:
+// peers using another swarm key fail the handshake with errors that do not
+// say why.
+func (n *Node) explainDialError(err error) error {
+	if err == nil || n.privateNetwork == "" || isTransientNetworkError(err) {
+		return err
+	}
+	return fmt.Errorf("%w (this node is in a private network with swarm key %s; the peer may use a different swarm key or none)", err, n.privateNetwork)
+}
@@ -0,0 +1,87 @@
+package protocol
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/pnet"
+	"github.com/libp2p/go-libp2p/p2p/transport/tcp"
+)
+
+func TestSwarmKeyRoundTrip(t *testing.T) {
+	keyPath := filepath.Join(t.TempDir(), "keys", "swarm.key")
+	if err := WriteSwarmKey(keyPath, false); err != nil {
+		t.Fatalf("WriteSwarmKey failed: %v", err)
+	}
+	psk, err := LoadSwarmKey(keyPath)
+	if err != nil || len(psk) != 32 {
+		t.Fatalf("expected a 32 byte key, got %d (%v)", len(psk), err)
+	}
+	if err := WriteSwarmKey(keyPath, false); err == nil {
+		t.Fatal("expected an existing key not to be replaced")
+	}
+	if err := WriteSwarmKey(keyPath, true); err != nil {
+		t.Fatalf("expected force to replace the key: %v", err)
+	}
+	replaced, _ := LoadSwarmKey(keyPath)
+	if SwarmKeyFingerprint(replaced) == SwarmKeyFingerprint(psk) {
+		t.Fatal("expected a new key")
+	}
+}
+
+func TestTransportOptionsPrivateNetwork(t *testing.T) {
+	keyPath := filepath.Join(t.TempDir(), "swarm.key")
+	n := newNode()
+	cfg := NodeConfig{TCPPort: "0", UDPPort: "0", PrivateNetwork: true, SwarmKeyPath: keyPath}
+
+	if _, err := n.transportOptions(cfg); err == nil || !strings.Contains(err.Error(), "otela key swarm") {
+		t.Fatalf("expected a missing key to explain how to create one, got %v", err)
+	}
+	_ = WriteSwarmKey(keyPath, false)
+	if _, err := n.transportOptions(cfg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n.privateNetwork == "" {
+		t.Fatal("expected the swarm key fingerprint to be recorded")
+	}
+}
+
+func newPSKHost(t *testing.T, psk pnet.PSK) host.Host {
+	t.Helper()
+	h, err := libp2p.New(
+		libp2p.PrivateNetwork(psk),
+		libp2p.Transport(tcp.NewTCPTransport),
+		libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"),
+	)
+	if err != nil {
+		t.Fatalf("failed to create host: %v", err)
+	}
+	t.Cleanup(func() { _ = h.Close() })
+	return h
+}
+
+func TestPrivateNetworksDoNotConnect(t *testing.T) {
+	dir := t.TempDir()
+	_ = WriteSwarmKey(filepath.Join(dir, "a"), false)
+	_ = WriteSwarmKey(filepath.Join(dir, "b"), false)
+	a, _ := LoadSwarmKey(filepath.Join(dir, "a"))
+	b, _ := LoadSwarmKey(filepath.Join(dir, "b"))
+
+	connect := func(from, to host.Host) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return from.Connect(ctx, peer.AddrInfo{ID: to.ID(), Addrs: to.Addrs()})
+	}
+	if err := connect(newPSKHost(t, a), newPSKHost(t, a)); err != nil {
+		t.Fatalf("expected peers sharing a key to connect: %v", err)
+	}
+	if err := connect(newPSKHost(t, a), newPSKHost(t, b)); err == nil {
+		t.Fatal("expected peers with different keys not to connect")
+	}
+}
@@ -0,0 +1,242 @@
+package protocol
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Types of the events emitted when the node table changes.
+const (
+	PeerJoined            string = "peer_joined"
+	PeerLeft              string = "peer_left"
+	PeerDisconnected      string = "peer_disconnected"
+	ServiceAdded          string = "service_added"
+	ServiceRemoved        string = "service_removed"
+	IdentityGroupsChanged string = "identity_groups_changed"
+)
+
+const (
+	// number of past events kept for clients resuming a stream
+	tableEventHistory = 1024
+	// events buffered per subscriber before it is considered too slow and
+	// dropped; it can resume from its last event ID
+	tableEventBuffer = 256
+)
+
+// TableEvent describes a single change in the node table.
+type TableEvent struct {
+	// ID is "<epoch>-<sequence>", where epoch identifies this process so
+	// that IDs from before a restart are never mistaken for current ones.
+	ID     string `json:"id"`
+	Type   string `json:"type"`
+	PeerID string `json:"peer_id"`
+	Time   int64  `json:"time"`
+	// Peer is the new state of the peer for peer_* events.
+	Peer *Peer `json:"peer,omitempty"`
+	// Service, IdentityGroup and PreviousIdentityGroup are set for service_*
+	// and identity_groups_changed events.
+	Service               string   `json:"service,omitempty"`
+	IdentityGroup         []string `json:"identity_group,omitempty"`
+	PreviousIdentityGroup []string `json:"previous_identity_group,omitempty"`
+
+	seq uint64
+}
+
+// TableWatch is a subscription to node table events. Depending on the cursor
+// it was opened with, it either starts with a full Snapshot of the table (as
+// of Cursor) or with the Backlog of events the client missed. Events is
+// closed when the subscriber falls too far behind.
+type TableWatch struct {
+	Snapshot NodeTable
+	Cursor   string
+	Backlog  []TableEvent
+	Events   <-chan TableEvent
+}
+
+// eventLog numbers table events, keeps the most recent ones in a ring buffer
+// and fans them out to subscribers. It is only written to while the owning
+// peerTable holds its write lock, which keeps the event order identical to
+// the order in which the table changed.
+type eventLog struct {
+	mu          sync.Mutex
+	epoch       int64
+	seq         uint64
+	ring        []TableEvent
+	next        int
+	subscribers map[chan TableEvent]struct{}
+}
+
+func newEventLog(size int) *eventLog {
+	return &eventLog{
+		epoch:       time.Now().UnixNano(),
+		ring:        make([]TableEvent, 0, size),
+		subscribers: make(map[chan TableEvent]struct{}),
+	}
+}
+
+func (l *eventLog) cursor(seq uint64) string {
+	return fmt.Sprintf("%d-%d", l.epoch, seq)
+}
+
+func (l *eventLog) publish(events []TableEvent) {
+	if len(events) == 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now().Unix()
+	for _, event := range events {
+		l.seq++
+		event.seq = l.seq
+		event.ID = l.cursor(l.seq)
+		event.Time = now
+		if len(l.ring) < cap(l.ring) {
+			l.ring = append(l.ring, event)
+		} else {
+			l.ring[l.next] = event
+			l.next = (l.next + 1) % cap(l.ring)
+		}
+		for ch := range l.subscribers {
+			select {
+			case ch <- event:
+			default:
+				delete(l.subscribers, ch)
+				close(ch)
+			}
+		}
+	}
+}
+
+// subscribe registers a new subscriber. If lastID names an event that is
+// still in the history, the events after it are returned as the backlog and
+// ok is true; otherwise the caller has to send a fresh snapshot.
+func (l *eventLog) subscribe(lastID string) (backlog []TableEvent, cursor string, ch chan TableEvent, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ch = make(chan TableEvent, tableEventBuffer)
+	l.subscribers[ch] = struct{}{}
+	cursor = l.cursor(l.seq)
+
+	seq, valid := l.parseID(lastID)
+	if !valid || seq > l.seq {
+		return nil, cursor, ch, false
+	}
+	history := l.history()
+	if seq < l.seq && (len(history) == 0 || seq+1 < history[0].seq) {
+		// the client missed events we no longer have
+		return nil, cursor, ch, false
+	}
+	for _, event := range history {
+		if event.seq > seq {
+			backlog = append(backlog, event)
+		}
+	}
+	return backlog, cursor, ch, true
+}
+
+func (l *eventLog) unsubscribe(ch chan TableEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.subscribers[ch]; ok {
+		delete(l.subscribers, ch)
+		close(ch)
+	}
+}
+
+// history returns the buffered events, oldest first.
+func (l *eventLog) history() []TableEvent {
+	out := make([]TableEvent, 0, len(l.ring))
+	out = append(out, l.ring[l.next:]...)
+	return append(out, l.ring[:l.next]...)
+}
+
+func (l *eventLog) parseID(id string) (uint64, bool) {
+	epoch, seq, found := strings.Cut(id, "-")
+	if !found || epoch != strconv.FormatInt(l.epoch, 10) {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(seq, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+// diffPeer computes the events that turn the entry before into after for the
+// peer stored under key. A missing entry is passed with present set to false.
+// Peers that have LEFT are treated as providing no services.
+func diffPeer(key string, before Peer, hadBefore bool, after Peer, hasAfter bool) []TableEvent {
+	peerID := strings.TrimPrefix(key, "/")
+	wasActive := hadBefore && before.Status != LEFT
+	isActive := hasAfter && after.Status != LEFT
+
+	var events []TableEvent
+	peerEvent := func(eventType string, peer Peer) {
+		events = append(events, TableEvent{Type: eventType, PeerID: peerID, Peer: &peer})
+	}
+	switch {
+	case wasActive && !isActive:
+		peer := before
+		if hasAfter {
+			peer = after
+		}
+		peerEvent(PeerLeft, peer)
+	case !wasActive && isActive:
+		peerEvent(PeerJoined, after)
+	case wasActive && isActive && before.Connected && !after.Connected:
+		peerEvent(PeerDisconnected, after)
+	case wasActive && isActive && !before.Connected && after.Connected:
+		// a disconnected peer that comes back is announced as joining again
+		peerEvent(PeerJoined, after)
+	}
+
+	var oldServices, newServices map[string][]string
+	if wasActive {
+		oldServices = serviceGroups(before)
+	}
+	if isActive {
+		newServices = serviceGroups(after)
+	}
+	for _, name := range sortedKeys(newServices) {
+		groups := newServices[name]
+		previous, existed := oldServices[name]
+		switch {
+		case !existed:
+			events = append(events, TableEvent{Type: ServiceAdded, PeerID: peerID, Service: name, IdentityGroup: groups})
+		case !slices.Equal(previous, groups):
+			events = append(events, TableEvent{Type: IdentityGroupsChanged, PeerID: peerID, Service: name, IdentityGroup: groups, PreviousIdentityGroup: previous})
+		}
+	}
+	for _, name := range sortedKeys(oldServices) {
+		if _, ok := newServices[name]; !ok {
+			events = append(events, TableEvent{Type: ServiceRemoved, PeerID: peerID, Service: name, IdentityGroup: oldServices[name]})
+		}
+	}
+	return events
+}
+
+// serviceGroups maps each service name of the peer to its sorted, deduplicated
+// identity groups.
+func serviceGroups(peer Peer) map[string][]string {
+	out := make(map[string][]string, len(peer.Service))
+	for _, service := range peer.Service {
+		groups := append(out[service.Name], service.IdentityGroup...)
+		sort.Strings(groups)
+		out[service.Name] = slices.Compact(groups)
+	}
+	return out
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,142 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+)
+
+func eventTypes(events []TableEvent) []string {
+	types := make([]string, 0, len(events))
+	for _, e := range events {
+		types = append(types, e.Type)
+	}
+	return types
+}
+
+func expectTypes(t *testing.T, events []TableEvent, want ...string) {
+	t.Helper()
+	got := eventTypes(events)
+	if len(got) != len(want) {
+		t.Fatalf("expected events %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected events %v, got %v", want, got)
+		}
+	}
+}
+
+func TestDiffPeerLifecycle(t *testing.T) {
+	llm := Service{Name: "llm", IdentityGroup: []string{"model=x"}}
+	joined := routablePeer("a", llm)
+
+	expectTypes(t, diffPeer("/a", Peer{}, false, joined, true), PeerJoined, ServiceAdded)
+
+	// only LastSeen changed
+	refreshed := joined
+	refreshed.LastSeen = 42
+	expectTypes(t, diffPeer("/a", joined, true, refreshed, true))
+
+	changed := routablePeer("a", Service{Name: "llm", IdentityGroup: []string{"model=y", "model=x"}})
+	events := diffPeer("/a", joined, true, changed, true)
+	expectTypes(t, events, IdentityGroupsChanged)
+	if events[0].Service != "llm" || len(events[0].IdentityGroup) != 2 || len(events[0].PreviousIdentityGroup) != 1 {
+		t.Fatalf("unexpected identity change event: %+v", events[0])
+	}
+
+	moved := routablePeer("a", Service{Name: "vision"})
+	expectTypes(t, diffPeer("/a", changed, true, moved, true), ServiceAdded, ServiceRemoved)
+
+	disconnected := moved
+	disconnected.Connected = false
+	expectTypes(t, diffPeer("/a", moved, true, disconnected, true), PeerDisconnected)
+	expectTypes(t, diffPeer("/a", disconnected, true, moved, true), PeerJoined)
+
+	left := moved
+	left.Status = LEFT
+	expectTypes(t, diffPeer("/a", moved, true, left, true), PeerLeft, ServiceRemoved)
+	// tombstone cleanup of a peer that already left is not another departure
+	expectTypes(t, diffPeer("/a", left, true, Peer{}, false))
+	expectTypes(t, diffPeer("/a", moved, true, Peer{}, false), PeerLeft, ServiceRemoved)
+}
+
+func TestPeerTableWatchSnapshotThenEvents(t *testing.T) {
+	table := newPeerTable()
+	table.set("/a", routablePeer("a"))
+
+	watch, cancel := table.watch("")
+	defer cancel()
+	if _, ok := watch.Snapshot["/a"]; !ok || len(watch.Backlog) != 0 {
+		t.Fatalf("expected a snapshot with peer a, got %+v", watch)
+	}
+
+	table.set("/b", routablePeer("b"))
+	select {
+	case event := <-watch.Events:
+		if event.Type != PeerJoined || event.PeerID != "b" {
+			t.Fatalf("unexpected event %+v", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no event delivered")
+	}
+}
+
+func TestPeerTableWatchResume(t *testing.T) {
+	table := newPeerTable()
+	first, cancel := table.watch("")
+	cancel()
+
+	table.set("/a", routablePeer("a"))
+	table.set("/b", routablePeer("b"))
+
+	watch, cancel := table.watch(first.Cursor)
+	defer cancel()
+	if watch.Snapshot != nil {
+		t.Fatal("expected to resume without a snapshot")
+	}
+	expectTypes(t, watch.Backlog, PeerJoined, PeerJoined)
+
+	// resuming from the last event replays nothing
+	caughtUp, cancel := table.watch(watch.Backlog[1].ID)
+	defer cancel()
+	if caughtUp.Snapshot != nil || len(caughtUp.Backlog) != 0 {
+		t.Fatalf("expected an empty backlog, got %+v", caughtUp)
+	}
+
+	for _, id := range []string{"garbage", "1-1", watch.Cursor + "0"} {
+		stale, cancel := table.watch(id)
+		cancel()
+		if stale.Snapshot == nil {
+			t.Fatalf("expected a snapshot for unknown event ID %q", id)
+		}
+	}
+}
+
+func TestPeerTableWatchHistoryOverflow(t *testing.T) {
+	table := newPeerTable()
+	first, cancel := table.watch("")
+	cancel()
+	for i := 0; i <= tableEventHistory; i++ {
+		table.set("/a", routablePeer("a"))
+		table.remove("/a")
+	}
+	watch, cancel := table.watch(first.Cursor)
+	defer cancel()
+	if watch.Snapshot == nil {
+		t.Fatal("expected a snapshot once the missed events were evicted")
+	}
+}
+
+func TestPeerTableWatchDropsSlowSubscriber(t *testing.T) {
+	table := newPeerTable()
+	watch, cancel := table.watch("")
+	defer cancel()
+	for i := 0; i <= tableEventBuffer; i++ {
+		table.set("/a", routablePeer("a"))
+		table.remove("/a")
+	}
+	for range watch.Events {
+	}
+	// unsubscribing after being dropped must not panic
+	cancel()
+}
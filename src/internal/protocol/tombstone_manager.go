@@ -1,7 +1,10 @@
 package protocol
 
 import (
+	"cmp"
 	"context"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
@@ -14,6 +17,9 @@ import (
 type TombstoneManager struct {
 	store     *crdt.Datastore
 	retention time.Duration
+	// node owns the table LEFT peers are collected from, the default node
+	// if nil
+	node *Node
 }
 
 var (
@@ -42,13 +48,14 @@ func (tm *TombstoneManager) CleanupLeftNodes(ctx context.Context) (int, error) {
 	for _, key := range candidates {
 		// key is raw, e.g. "Qm..." or "/Qm..."
 		// ds.NewKey handles standardizing it.
-		if err := tm.store.Delete(ctx, ds.NewKey(key)); err != nil {
+		peerID := strings.TrimPrefix(ds.NewKey(key).String(), "/")
+		if err := deletePeerEntries(ctx, tm.store, peerID); err != nil {
 			common.Logger.Errorf("Failed to delete left node %s: %v", key, err)
 		} else {
 			removedCount++
 			// Also remove from the in-memory table so a rejoining
 			// node with the same peer ID starts with a clean slate.
-			DeleteNodeTableHook(ds.NewKey(key))
+			tm.owner().DeleteNodeTableHook(ds.NewKey(key))
 		}
 	}
 
@@ -56,17 +63,45 @@ func (tm *TombstoneManager) CleanupLeftNodes(ctx context.Context) (int, error) {
 }
 
 func (tm *TombstoneManager) collectCandidates() []string {
-	tableUpdateSem <- struct{}{}
-	defer func() { <-tableUpdateSem }()
-
-	table := *getNodeTable()
 	limit := time.Now().Add(-tm.retention).Unix()
 	var candidates []string
 
-	for key, peer := range table {
-		if peer.Status == LEFT && peer.LastSeen < limit {
+	for key, peer := range tm.leftPeers() {
+		if peer.LastSeen < limit {
 			candidates = append(candidates, key)
 		}
 	}
 	return candidates
 }
+
+func (tm *TombstoneManager) owner() *Node {
+	if tm.node != nil {
+		return tm.node
+	}
+	return defaultNode()
+}
+
+func (tm *TombstoneManager) leftPeers() NodeTable {
+	return tm.owner().table.snapshot(func(p Peer) bool { return p.Status == LEFT })
+}
+
+// PendingTombstone is a peer that left the network, kept in the table until
+// the retention period has passed.
+type PendingTombstone struct {
+	ID       string `json:"id"`
+	LastSeen int64  `json:"last_seen"`
+	// CleanupAt is the Unix time after which the next cleanup removes the
+	// peer
+	CleanupAt int64 `json:"cleanup_at"`
+}
+
+// Pending lists the LEFT peers waiting to be cleaned up, oldest first.
+func (tm *TombstoneManager) Pending() []PendingTombstone {
+	retention := int64(tm.retention / time.Second)
+	pending := []PendingTombstone{}
+	for key, peer := range tm.leftPeers() {
+		pending = append(pending, PendingTombstone{ID: strings.TrimPrefix(key, "/"), LastSeen: peer.LastSeen, CleanupAt: peer.LastSeen + retention})
+	}
+	slices.SortFunc(pending, func(a, b PendingTombstone) int { return cmp.Compare(a.LastSeen, b.LastSeen) })
+	return pending
+}
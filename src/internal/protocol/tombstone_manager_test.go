@@ -79,11 +79,9 @@ func (m *MockDAGService) RemoveMany(ctx context.Context, cids []cid.Cid) error {
 }
 
 // cleanNodeTable is a test helper that empties the global in-memory node table.
-func cleanNodeTable() *NodeTable {
+func cleanNodeTable() *peerTable {
 	table := getNodeTable()
-	for k := range *table {
-		delete(*table, k)
-	}
+	table.reset()
 	return table
 }
 
@@ -110,7 +108,7 @@ func TestCleanupLeftNodes(t *testing.T) {
 		LastSeen:  time.Now().Unix(),
 		Connected: true,
 	}
-	(*table)["/active-node"] = activePeer
+	table.set("/active-node", activePeer)
 
 	// Case 2: Left Node, recent (Should NOT be cleaned up)
 	recentLeftPeer := Peer{
@@ -119,7 +117,7 @@ func TestCleanupLeftNodes(t *testing.T) {
 		// LastSeen within retention period (e.g. 1s ago < 2s)
 		LastSeen: time.Now().Add(-1 * time.Second).Unix(),
 	}
-	(*table)["/recent-left-node"] = recentLeftPeer
+	table.set("/recent-left-node", recentLeftPeer)
 	keyRecent := ds.NewKey("recent-left-node")
 	_ = crdtStore.Put(context.Background(), keyRecent, []byte("some-data"))
 
@@ -130,7 +128,7 @@ func TestCleanupLeftNodes(t *testing.T) {
 		// LastSeen older than retention (e.g. 5s ago > 2s)
 		LastSeen: time.Now().Add(-5 * time.Second).Unix(),
 	}
-	(*table)["/old-left-node"] = oldLeftPeer
+	table.set("/old-left-node", oldLeftPeer)
 	keyOld := ds.NewKey("old-left-node")
 	if err := crdtStore.Put(context.Background(), keyOld, []byte("some-data")); err != nil {
 		t.Fatalf("Failed to put old node: %v", err)
@@ -153,17 +151,17 @@ func TestCleanupLeftNodes(t *testing.T) {
 	}
 
 	// Verify 'active-node' is still in table
-	if _, ok := (*table)["/active-node"]; !ok {
+	if _, ok := table.get("/active-node"); !ok {
 		t.Error("Active node should still be in the in-memory table")
 	}
 
 	// Verify 'recent-left-node' is still in table (not yet past retention)
-	if _, ok := (*table)["/recent-left-node"]; !ok {
+	if _, ok := table.get("/recent-left-node"); !ok {
 		t.Error("Recent left node should still be in the in-memory table")
 	}
 
 	// Verify 'old-left-node' was removed from the in-memory table
-	if _, ok := (*table)["/old-left-node"]; ok {
+	if _, ok := table.get("/old-left-node"); ok {
 		t.Error("Old left node should have been removed from the in-memory table after cleanup")
 	}
 
@@ -205,20 +203,20 @@ func TestRejoinAfterLeave(t *testing.T) {
 	if err := crdtStore.Put(ctx, keyDS, []byte("initial-data")); err != nil {
 		t.Fatalf("Failed to put initial data: %v", err)
 	}
-	(*table)[peerKey] = Peer{
+	table.set(peerKey, Peer{
 		ID:        peerID,
 		Status:    CONNECTED,
 		LastSeen:  time.Now().Unix(),
 		Connected: true,
-	}
+	})
 
 	// 3. Peer leaves — mark as LEFT with an old LastSeen (past retention)
-	(*table)[peerKey] = Peer{
+	table.set(peerKey, Peer{
 		ID:        peerID,
 		Status:    LEFT,
 		Connected: false,
 		LastSeen:  time.Now().Add(-5 * time.Second).Unix(),
-	}
+	})
 
 	// Sanity: collectCandidates should find it
 	candidates := tm.collectCandidates()
@@ -230,12 +228,12 @@ func TestRejoinAfterLeave(t *testing.T) {
 	if err := crdtStore.Put(ctx, keyDS, []byte("rejoined-data")); err != nil {
 		t.Fatalf("Failed to put rejoin data: %v", err)
 	}
-	(*table)[peerKey] = Peer{
+	table.set(peerKey, Peer{
 		ID:        peerID,
 		Status:    CONNECTED,
 		LastSeen:  time.Now().Unix(),
 		Connected: true,
-	}
+	})
 
 	// 5. Run cleanup — the rejoined peer must NOT be collected
 	candidates = tm.collectCandidates()
@@ -265,7 +263,7 @@ func TestRejoinAfterLeave(t *testing.T) {
 	}
 
 	// 7. Verify peer is still in the in-memory table as CONNECTED
-	p, ok := (*table)[peerKey]
+	p, ok := table.get(peerKey)
 	if !ok {
 		t.Fatal("Rejoined peer should be in the in-memory table")
 	}
@@ -303,12 +301,12 @@ func TestRejoinAfterCleanup(t *testing.T) {
 	if err := crdtStore.Put(ctx, keyDS, []byte("original")); err != nil {
 		t.Fatalf("Failed to put: %v", err)
 	}
-	(*table)[peerKey] = Peer{
+	table.set(peerKey, Peer{
 		ID:        peerID,
 		Status:    LEFT,
 		Connected: false,
 		LastSeen:  time.Now().Add(-5 * time.Second).Unix(),
-	}
+	})
 
 	// 3. Cleanup runs — peer is deleted from store and table
 	count, err := tm.CleanupLeftNodes(ctx)
@@ -324,7 +322,7 @@ func TestRejoinAfterCleanup(t *testing.T) {
 		t.Fatal("Peer should have been deleted from CRDT store")
 	}
 	// Verify gone from table
-	if _, ok := (*table)[peerKey]; ok {
+	if _, ok := table.get(peerKey); ok {
 		t.Fatal("Peer should have been removed from in-memory table")
 	}
 
@@ -332,12 +330,12 @@ func TestRejoinAfterCleanup(t *testing.T) {
 	if err := crdtStore.Put(ctx, keyDS, []byte("comeback")); err != nil {
 		t.Fatalf("Failed to put rejoin data after cleanup: %v", err)
 	}
-	(*table)[peerKey] = Peer{
+	table.set(peerKey, Peer{
 		ID:        peerID,
 		Status:    CONNECTED,
 		LastSeen:  time.Now().Unix(),
 		Connected: true,
-	}
+	})
 
 	// 5. Verify the new data is visible
 	has, _ := crdtStore.Has(ctx, keyDS)
@@ -362,7 +360,7 @@ func TestRejoinAfterCleanup(t *testing.T) {
 	}
 
 	// Peer is still connected
-	p, ok := (*table)[peerKey]
+	p, ok := table.get(peerKey)
 	if !ok {
 		t.Fatal("Rejoined peer should still be in the table")
 	}
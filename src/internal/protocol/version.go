@@ -0,0 +1,233 @@
+package protocol
+
+import (
+	"fmt"
+	"opentela/internal/common"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// Versions of the node table protocol: the shape of the entries exchanged
+// through the CRDT and the protocols nodes talk to each other with. A node
+// speaks every version from MinProtocolVersion to ProtocolVersion.
+const (
+	// ProtocolVersion 3 introduced snapshots of the CRDT store, version 2
+	// per-service keys and signed entries.
+	ProtocolVersion = 3
+	// MinProtocolVersion 1 is the legacy single-entry layout, still
+	// understood and migrated on read. Its entries are unsigned, so it is
+	// only spoken while signatures are not required.
+	MinProtocolVersion = 1
+	// signedProtocolVersion is the first version whose entries are signed.
+	signedProtocolVersion = 2
+	// snapshotProtocolVersion is the first version whose nodes start from
+	// CRDT snapshots and do not need the blocks they cover.
+	snapshotProtocolVersion = 3
+)
+
+// protocolIDPrefix is the prefix of the protocol IDs advertising the
+// supported versions over identify, one per version.
+const protocolIDPrefix = "/opentela/protocol/"
+
+// ProtocolRange is the range of protocol versions a node speaks.
+type ProtocolRange struct {
+	Min int `json:"min"`
+	Max int `json:"max"`
+}
+
+func (r ProtocolRange) String() string {
+	if r.Min == r.Max {
+		return strconv.Itoa(r.Max)
+	}
+	return fmt.Sprintf("%d-%d", r.Min, r.Max)
+}
+
+// compatible reports whether two nodes share a protocol version.
+func (r ProtocolRange) compatible(other ProtocolRange) bool {
+	return max(r.Min, other.Min) <= min(r.Max, other.Max)
+}
+
+// localProtocols returns the range of protocol versions of this node. Peers
+// only speaking versions predating signed entries are incompatible unless
+// signatures are not required.
+func (n *Node) localProtocols() ProtocolRange {
+	if n.requireSignatures() {
+		return ProtocolRange{Min: signedProtocolVersion, Max: ProtocolVersion}
+	}
+	return ProtocolRange{Min: MinProtocolVersion, Max: ProtocolVersion}
+}
+
+// legacyProtocols is the range assumed for peers that do not publish one,
+// which predate version negotiation.
+var legacyProtocols = ProtocolRange{Min: 1, Max: 1}
+
+// BuildVersion is the release this node runs, or "dev" for builds without
+// version information.
+func BuildVersion() string {
+	if common.JSONVersion.Version == "" {
+		return "dev"
+	}
+	return common.JSONVersion.Version
+}
+
+// peerProtocols holds the protocol ranges peers advertised over identify,
+// which are known before their node table entries arrive.
+type peerProtocols struct {
+	mu     sync.RWMutex
+	ranges map[string]ProtocolRange
+}
+
+func (p *peerProtocols) get(id string) (ProtocolRange, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	r, ok := p.ranges[id]
+	return r, ok
+}
+
+func (p *peerProtocols) set(id string, r ProtocolRange) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ranges == nil {
+		p.ranges = make(map[string]ProtocolRange)
+	}
+	p.ranges[id] = r
+}
+
+// forget drops the range of a peer, which advertises it again over identify
+// when it reconnects.
+func (p *peerProtocols) forget(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.ranges, id)
+}
+
+// protocolsOf returns the protocol range of a peer, preferring what it
+// advertised over identify to what it published.
+func (n *Node) protocolsOf(p Peer) ProtocolRange {
+	if r, ok := n.protocols.get(p.ID); ok {
+		return r
+	}
+	if p.Protocol != nil {
+		return *p.Protocol
+	}
+	return legacyProtocols
+}
+
+// isCompatible reports whether this node shares a protocol version with the
+// peer.
+func (n *Node) isCompatible(p Peer) bool {
+	return n.localProtocols().compatible(n.protocolsOf(p))
+}
+
+// peersReadSnapshots reports whether every peer in the node table that has
+// not left speaks a protocol version reading CRDT snapshots. Older nodes walk
+// the DAG down past snapshots, so the blocks covered by a snapshot are only
+// pruned once none is left.
+func (n *Node) peersReadSnapshots() bool {
+	for _, p := range n.table.snapshot(func(p Peer) bool { return p.Status != LEFT }) {
+		if n.protocolsOf(p).Max < snapshotProtocolVersion {
+			return false
+		}
+	}
+	return true
+}
+
+// advertiseProtocols registers one protocol ID per version in r, so that
+// identify tells peers which versions this node speaks. The streams carry
+// nothing.
+func advertiseProtocols(h host.Host, r ProtocolRange) {
+	for v := r.Min; v <= r.Max; v++ {
+		h.SetStreamHandler(protocol.ID(protocolIDPrefix+strconv.Itoa(v)), func(s network.Stream) {
+			_ = s.Close()
+		})
+	}
+}
+
+// protocolsFromIdentify extracts the protocol range from the protocol IDs a
+// peer advertised. Peers advertising none predate negotiation.
+func protocolsFromIdentify(protocols []protocol.ID) (ProtocolRange, bool) {
+	var r ProtocolRange
+	found := false
+	for _, id := range protocols {
+		v, err := strconv.Atoi(strings.TrimPrefix(string(id), protocolIDPrefix))
+		if !strings.HasPrefix(string(id), protocolIDPrefix) || err != nil {
+			continue
+		}
+		if !found || v < r.Min {
+			r.Min = v
+		}
+		if !found || v > r.Max {
+			r.Max = v
+		}
+		found = true
+	}
+	return r, found
+}
+
+// checkPeerProtocols records the protocol range a peer advertised and flags
+// its entry in the node table if it is incompatible.
+func (n *Node) checkPeerProtocols(id peer.ID, protocols []protocol.ID) {
+	r, ok := protocolsFromIdentify(protocols)
+	if !ok {
+		return
+	}
+	n.protocols.set(id.String(), r)
+	local := n.localProtocols()
+	compatible := local.compatible(r)
+	if !compatible {
+		common.Logger.Warnf("Peer [%s] speaks protocol versions %s, this node speaks %s; it will not be routed to", id, r, local)
+	}
+	n.table.patch("/"+id.String(), func(p Peer) Peer {
+		p.Incompatible = !compatible
+		return p
+	})
+}
+
+// VersionSummary describes the mix of versions in the network.
+type VersionSummary struct {
+	Build    string        `json:"build"`
+	Protocol ProtocolRange `json:"protocol"`
+	// Builds and Protocols count the known peers by release and by
+	// protocol range
+	Builds    map[string]int `json:"builds"`
+	Protocols map[string]int `json:"protocols"`
+	// Incompatible lists the peers sharing no protocol version with this
+	// node
+	Incompatible []string `json:"incompatible"`
+}
+
+// GetVersionSummary summarizes the versions in the node table of the default
+// node.
+func GetVersionSummary() VersionSummary {
+	return defaultNode().GetVersionSummary()
+}
+
+// GetVersionSummary summarizes the versions of the peers in the node table
+// that have not left.
+func (n *Node) GetVersionSummary() VersionSummary {
+	summary := VersionSummary{
+		Build:        BuildVersion(),
+		Protocol:     n.localProtocols(),
+		Builds:       make(map[string]int),
+		Protocols:    make(map[string]int),
+		Incompatible: []string{},
+	}
+	for _, p := range n.table.snapshot(func(p Peer) bool { return p.Status != LEFT }) {
+		build := p.Version
+		if build == "" {
+			build = "unknown"
+		}
+		summary.Builds[build]++
+		summary.Protocols[n.protocolsOf(p).String()]++
+		if !n.isCompatible(p) {
+			summary.Incompatible = append(summary.Incompatible, p.ID)
+		}
+	}
+	return summary
+}
@@ -0,0 +1,128 @@
+package protocol
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+func TestProtocolRangeCompatibility(t *testing.T) {
+	cases := []struct {
+		a, b ProtocolRange
+		want bool
+	}{
+		{ProtocolRange{1, 2}, ProtocolRange{1, 1}, true},
+		{ProtocolRange{1, 2}, ProtocolRange{2, 3}, true},
+		{ProtocolRange{2, 2}, ProtocolRange{1, 1}, false},
+		{ProtocolRange{1, 2}, ProtocolRange{3, 4}, false},
+	}
+	for _, c := range cases {
+		if got := c.a.compatible(c.b); got != c.want {
+			t.Errorf("%s compatible with %s = %v, want %v", c.a, c.b, got, c.want)
+		}
+	}
+	// peers publishing no protocol range predate signed entries
+	if NewNode(NodeConfig{}).isCompatible(Peer{ID: "legacy"}) {
+		t.Fatal("expected legacy peers to be incompatible while signatures are required")
+	}
+	if !NewNode(NodeConfig{AllowUnsigned: true}).isCompatible(Peer{ID: "legacy"}) {
+		t.Fatal("expected legacy peers to be compatible when signatures are not required")
+	}
+}
+
+func TestProtocolsFromIdentify(t *testing.T) {
+	r, ok := protocolsFromIdentify([]protocol.ID{"/ipfs/id/1.0.0", protocolIDPrefix + "3", protocolIDPrefix + "2", protocolIDPrefix + "x"})
+	if !ok || r != (ProtocolRange{2, 3}) {
+		t.Fatalf("unexpected range %v (%v)", r, ok)
+	}
+	if _, ok := protocolsFromIdentify([]protocol.ID{"/ipfs/id/1.0.0"}); ok {
+		t.Fatal("expected no range for peers advertising none")
+	}
+}
+
+func TestIncompatiblePeersAreNotRouted(t *testing.T) {
+	table := cleanNodeTable()
+	_, id := testSigningKey(t)
+	pid, _ := peer.Decode(id)
+	n := defaultNode()
+	previous := n.cfg
+	n.cfg = &NodeConfig{AllowUnsigned: true}
+	t.Cleanup(func() {
+		n.cfg = previous
+		n.protocols.mu.Lock()
+		delete(n.protocols.ranges, id)
+		n.protocols.mu.Unlock()
+	})
+	llm := Service{Name: "llm", IdentityGroup: []string{"all"}}
+	table.set("/old", Peer{ID: "old", Version: "v0.1.0", Connected: true, Service: []Service{llm}})
+	table.set("/future", Peer{ID: "future", Version: "v9.0.0", Protocol: &ProtocolRange{Min: 5, Max: 6}, Connected: true, Service: []Service{llm}})
+	table.set("/"+id, Peer{ID: id, Connected: true, Service: []Service{llm}})
+
+	n.checkPeerProtocols(pid, []protocol.ID{protocolIDPrefix + "7"})
+	if p, _ := GetPeerFromTable(id); !p.Incompatible {
+		t.Fatal("expected the peer to be flagged from identify")
+	}
+	providers, err := GetAllProviders("llm")
+	if err != nil || len(providers) != 1 || providers[0].ID != "old" {
+		t.Fatalf("expected only the legacy peer to be routed to, got %+v (%v)", providers, err)
+	}
+
+	summary := GetVersionSummary()
+	if summary.Builds["v0.1.0"] != 1 || summary.Builds["unknown"] != 1 || summary.Protocols["1"] != 1 || summary.Protocols["5-6"] != 1 {
+		t.Fatalf("unexpected summary %+v", summary)
+	}
+	if len(summary.Incompatible) != 2 {
+		t.Fatalf("expected two incompatible peers, got %v", summary.Incompatible)
+	}
+}
+
+func TestIdentifiedProtocolsAreForgotten(t *testing.T) {
+	n := newNode()
+	_, id := testSigningKey(t)
+	pid, _ := peer.Decode(id)
+	llm := Service{Name: "llm", IdentityGroup: []string{"all"}}
+	service, _ := json.Marshal(llm)
+
+	// services of a peer that advertised no shared version are not routed
+	// to, even before its metadata arrives
+	n.checkPeerProtocols(pid, []protocol.ID{protocolIDPrefix + "7"})
+	n.UpdateNodeTableHook(serviceKey(id, llm), service)
+	if p, _ := n.GetPeerFromTable(id); !p.Incompatible {
+		t.Fatal("expected the peer to be flagged from its service entry")
+	}
+
+	left, _ := json.Marshal(Peer{ID: id, Status: LEFT})
+	n.UpdateNodeTableHook(metaKey(id), left)
+	if _, ok := n.protocols.get(id); ok {
+		t.Fatal("expected the range of a peer that left to be forgotten")
+	}
+
+	n.checkPeerProtocols(pid, []protocol.ID{protocolIDPrefix + "7"})
+	n.DeleteNodeTableHook(metaKey(id))
+	if _, ok := n.protocols.get(id); ok {
+		t.Fatal("expected the range of a removed peer to be forgotten")
+	}
+}
+
+func TestSnapshotsArePrunedOnceEveryPeerReadsThem(t *testing.T) {
+	n := newNode()
+	n.table.set("/current", Peer{ID: "current", Protocol: &currentProtocols})
+	n.table.set("/gone", Peer{ID: "gone", Status: LEFT})
+	if !n.peersReadSnapshots() {
+		t.Fatal("expected peers that left not to hold pruning back")
+	}
+	n.table.set("/signed", Peer{ID: "signed", Protocol: &ProtocolRange{Min: 1, Max: 2}})
+	if n.peersReadSnapshots() {
+		t.Fatal("expected a peer predating snapshots to hold pruning back")
+	}
+	_, id := testSigningKey(t)
+	pid, _ := peer.Decode(id)
+	n.table.set("/"+id, Peer{ID: id})
+	n.table.set("/signed", Peer{ID: "signed", Status: LEFT})
+	n.checkPeerProtocols(pid, []protocol.ID{protocolIDPrefix + "2", protocolIDPrefix + "3"})
+	if !n.peersReadSnapshots() {
+		t.Fatal("expected the versions advertised over identify to count")
+	}
+}
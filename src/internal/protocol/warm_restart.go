@@ -0,0 +1,127 @@
+package protocol
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"opentela/internal/common"
+	"strconv"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	badger "github.com/ipfs/go-ds-badger"
+)
+
+// StoreSchemaVersion is the version of the layout of the persisted CRDT
+// store. A store written with another version is cleared on startup rather
+// than reused. Bump it whenever a release cannot read the store of the
+// previous one.
+const StoreSchemaVersion = 1
+
+// schemaKey holds the schema version of the persisted store. It lives outside
+// of the CRDT namespace and is never replicated.
+var schemaKey = ds.NewKey("/opentela/schema")
+
+// openPersistedStore opens the badger store at dbPath, clearing it first if
+// it was written with another schema version.
+func openPersistedStore(ctx context.Context, dbPath string) (*badger.Datastore, error) {
+	store, err := badger.NewDatastore(dbPath, &badger.DefaultOptions)
+	if err != nil {
+		return nil, err
+	}
+	reusable, err := checkStoreSchema(ctx, store)
+	if err != nil {
+		_ = store.Close()
+		return nil, err
+	}
+	if !reusable {
+		common.Logger.Warnf("Persisted node table at %s has another schema version, clearing it", dbPath)
+		if err := store.Close(); err != nil {
+			return nil, err
+		}
+		if err := common.RemoveDir(dbPath); err != nil {
+			return nil, err
+		}
+		if store, err = badger.NewDatastore(dbPath, &badger.DefaultOptions); err != nil {
+			return nil, err
+		}
+	}
+	if err := store.Put(ctx, schemaKey, []byte(strconv.Itoa(StoreSchemaVersion))); err != nil {
+		_ = store.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// checkStoreSchema reports whether store can be reused: it is empty or was
+// written with the current schema version. Stores of releases predating the
+// version have none and are not reused.
+func checkStoreSchema(ctx context.Context, store ds.Datastore) (bool, error) {
+	value, err := store.Get(ctx, schemaKey)
+	if err == nil {
+		return string(value) == strconv.Itoa(StoreSchemaVersion), nil
+	}
+	if !errors.Is(err, ds.ErrNotFound) {
+		return false, fmt.Errorf("error while reading the store schema version: %w", err)
+	}
+	results, err := store.Query(ctx, query.Query{KeysOnly: true, Limit: 1})
+	if err != nil {
+		return false, err
+	}
+	entries, err := results.Rest()
+	if err != nil {
+		return false, err
+	}
+	return len(entries) == 0, nil
+}
+
+// restoreTable rebuilds the node table from the entries the store kept from a
+// previous run. Other peers are added disconnected, as the put hook does for
+// peers it has not seen yet, until they are verified again. The services this
+// node provided are restored as local services.
+func (n *Node) restoreTable(ctx context.Context) error {
+	results, err := n.store.Query(ctx, query.Query{})
+	if err != nil {
+		return err
+	}
+	entries, err := results.Rest()
+	if err != nil {
+		return err
+	}
+	peers, services := 0, 0
+	for _, e := range entries {
+		key := ds.NewKey(e.Key)
+		entry, ok := parseEntryKey(key)
+		if !ok {
+			continue
+		}
+		if entry.peerID != n.host.ID().String() {
+			n.putHook(key, e.Value)
+			if entry.kind != serviceEntry {
+				peers++
+			}
+			continue
+		}
+		if entry.kind != serviceEntry {
+			continue
+		}
+		env, ok := n.acceptEntry(key, e.Value)
+		if !ok || env.Removed {
+			continue
+		}
+		var service Service
+		if err := json.Unmarshal(env.Payload, &service); err != nil {
+			common.Logger.Warn("Ignoring persisted local service: ", err)
+			continue
+		}
+		// health checks demote it again if it did not come back
+		service.Status = CONNECTED
+		n.addLocalService(service)
+		services++
+	}
+	if peers > 0 || services > 0 {
+		common.Logger.Infof("Restored %d peers and %d local services from the persisted node table", peers, services)
+	}
+	return nil
+}
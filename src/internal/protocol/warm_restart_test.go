@@ -0,0 +1,119 @@
+package protocol
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	badger "github.com/ipfs/go-ds-badger"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestCheckStoreSchema(t *testing.T) {
+	ctx := context.Background()
+	cases := []struct {
+		name    string
+		entries map[string]string
+		want    bool
+	}{
+		{"empty", nil, true},
+		{"current", map[string]string{schemaKey.String(): "1", "/a": "x"}, true},
+		{"other version", map[string]string{schemaKey.String(): "0", "/a": "x"}, false},
+		{"no version", map[string]string{"/a": "x"}, false},
+	}
+	for _, c := range cases {
+		store := dssync.MutexWrap(ds.NewMapDatastore())
+		for k, v := range c.entries {
+			_ = store.Put(ctx, ds.NewKey(k), []byte(v))
+		}
+		got, err := checkStoreSchema(ctx, store)
+		if err != nil || got != c.want {
+			t.Errorf("%s: got %v (%v), want %v", c.name, got, err, c.want)
+		}
+	}
+}
+
+func TestOpenPersistedStoreClearsOtherSchema(t *testing.T) {
+	ctx := context.Background()
+	dbPath := filepath.Join(t.TempDir(), "db")
+	old, err := badger.NewDatastore(dbPath, &badger.DefaultOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = old.Put(ctx, schemaKey, []byte("0"))
+	_ = old.Put(ctx, ds.NewKey("/stale"), []byte("x"))
+	_ = old.Close()
+
+	store, err := openPersistedStore(ctx, dbPath)
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	defer store.Close()
+	if ok, _ := store.Has(ctx, ds.NewKey("/stale")); ok {
+		t.Fatal("expected the store of another schema to be cleared")
+	}
+	if ok, _ := checkStoreSchema(ctx, store); !ok {
+		t.Fatal("expected the current schema version to be recorded")
+	}
+}
+
+func TestWarmRestartRestoresTable(t *testing.T) {
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := NodeConfig{
+		Identity: priv,
+		Mode:     "standalone",
+		Role:     RoleWorker,
+		TCPPort:  "0",
+		UDPPort:  "0",
+		DBPath:   filepath.Join(t.TempDir(), "db"),
+	}
+	ctx := context.Background()
+
+	first := NewNode(cfg)
+	if err := first.Start(ctx); err != nil {
+		t.Fatalf("failed to start node: %v", err)
+	}
+	first.InitializeMyself("owner")
+	if _, err := first.RegisterService(Service{Name: "llm", Port: "8000"}); err != nil {
+		t.Fatalf("failed to register service: %v", err)
+	}
+	// an entry replicated from another peer
+	otherKey, _, _ := crypto.GenerateEd25519Key(rand.Reader)
+	otherID, _ := peer.IDFromPrivateKey(otherKey)
+	meta, _ := json.Marshal(Peer{ID: otherID.String(), Role: []string{RoleWorker}})
+	sealed, err := sealEntry(otherKey, metaKey(otherID.String()), meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := first.Store().Put(ctx, metaKey(otherID.String()), sealed); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.Close(); err != nil {
+		t.Fatalf("failed to close node: %v", err)
+	}
+
+	second := NewNode(cfg)
+	if err := second.Start(ctx); err != nil {
+		t.Fatalf("failed to restart node: %v", err)
+	}
+	defer second.Close()
+	services := second.LocalServices()
+	if len(services) != 1 || services[0].Name != "llm" || services[0].Status != CONNECTED {
+		t.Fatalf("expected the local service to be restored, got %+v", services)
+	}
+	p, err := second.GetPeerFromTable(otherID.String())
+	if err != nil {
+		t.Fatalf("expected the other peer to be restored: %v", err)
+	}
+	if p.Connected {
+		t.Fatal("restored peers must stay disconnected until verified")
+	}
+}
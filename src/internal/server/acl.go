@@ -0,0 +1,32 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"opentela/internal/protocol"
+
+	"github.com/gin-gonic/gin"
+)
+
+func getACL(c *gin.Context) {
+	c.JSON(http.StatusOK, nodeOf(c).GetACL())
+}
+
+// putACL replaces the access lists set at runtime. The static lists from the
+// config stay in effect.
+func putACL(c *gin.Context) {
+	var acl protocol.ACL
+	if err := c.ShouldBindJSON(&acl); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := nodeOf(c).SetACL(c.Request.Context(), acl); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, protocol.ErrInvalidACL) {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, nodeOf(c).GetACL())
+}
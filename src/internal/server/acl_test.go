@@ -0,0 +1,44 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"opentela/internal/protocol"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestACLEndpoints(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	g := r.Group("/v1/acl", localOnly())
+	g.GET("", getACL)
+	g.PUT("", putACL)
+	defer func() { _ = protocol.SetACL(t.Context(), protocol.ACL{}) }()
+
+	do := func(method, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, "/v1/acl", strings.NewReader(body))
+		req.RemoteAddr = "127.0.0.1:5555"
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("PUT", `{"deny":{"cidrs":["not-a-cidr"]}}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = do("PUT", `{"deny":{"cidrs":["10.0.0.0/8"],"owners":["rogue-wallet"]}}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = do("GET", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var state protocol.ACLState
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &state))
+	assert.Equal(t, []string{"10.0.0.0/8"}, state.Dynamic.Deny.CIDRs)
+	assert.Equal(t, []string{"rogue-wallet"}, state.Dynamic.Deny.Owners)
+}
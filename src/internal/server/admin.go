@@ -0,0 +1,26 @@
+package server
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// localOnly restricts a route to clients connecting over the loopback
+// interface. Requests arriving through the p2p listener carry a peer ID as
+// their remote address and are rejected as well. X-Forwarded-For and similar
+// headers are deliberately ignored.
+func localOnly() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		host, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+		if err != nil {
+			host = c.Request.RemoteAddr
+		}
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "this endpoint is only available from the local host"})
+			return
+		}
+		c.Next()
+	}
+}
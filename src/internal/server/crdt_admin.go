@@ -0,0 +1,95 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"opentela/internal/protocol"
+	crdt "opentela/internal/protocol/go-ds-crdt"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The /v1/dnt/_crdt routes let operators look inside the CRDT store when
+// nodes disagree on the table. They are only served to the local host.
+
+func getCRDTStats(c *gin.Context) {
+	stats, err := nodeOf(c).CRDTStats(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, stats)
+}
+
+func getCRDTDAG(c *gin.Context) {
+	c.Header("Content-Type", "text/vnd.graphviz; charset=utf-8")
+	c.Status(http.StatusOK)
+	if err := nodeOf(c).WriteDAG(c.Request.Context(), c.Writer); err != nil {
+		// the status is sent already; the graph is cut short
+		_ = c.Error(err)
+	}
+}
+
+func repairCRDT(c *gin.Context) {
+	err := nodeOf(c).RepairCRDT()
+	switch {
+	case errors.Is(err, protocol.ErrRepairRunning):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusAccepted, gin.H{"status": "repairing"})
+	}
+}
+
+func snapshotCRDT(c *gin.Context) {
+	snapshot, err := nodeOf(c).SnapshotCRDT(c.Request.Context())
+	switch {
+	case errors.Is(err, crdt.ErrSnapshotBusy):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusOK, gin.H{"snapshot": snapshot})
+	}
+}
+
+// compactCRDT compacts the store now. The optional older_than (a duration)
+// and limit query parameters override the retention and batch settings.
+func compactCRDT(c *gin.Context) {
+	var olderThan time.Duration
+	if v := c.Query("older_than"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "older_than must be a positive duration"})
+			return
+		}
+		olderThan = d
+	}
+	var limit int
+	if v := c.Query("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a positive integer"})
+			return
+		}
+		limit = l
+	}
+	result, err := nodeOf(c).CompactCRDT(c.Request.Context(), olderThan, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "removed": result})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"removed": result})
+}
+
+func listCRDTTombstones(c *gin.Context) {
+	pending, err := nodeOf(c).PendingTombstones()
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"peers": pending})
+}
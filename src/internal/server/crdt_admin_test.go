@@ -0,0 +1,100 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"opentela/internal/protocol"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCRDTAdminEndpoints(t *testing.T) {
+	c := newTestCluster(t, protocol.RoleWorker)
+	n := c.nodes[0]
+	base := n.api.URL + "/v1/dnt/_crdt"
+
+	var stats protocol.CRDTStats
+	getJSON(t, base+"/stats", &stats)
+	assert.NotEmpty(t, stats.Heads, "the entries of the node must have produced heads")
+	assert.NotZero(t, stats.MaxHeight)
+
+	resp, err := http.Get(base + "/dag")
+	require.NoError(t, err)
+	dot, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("Content-Type"), "text/vnd.graphviz")
+	assert.True(t, strings.HasPrefix(string(dot), "digraph"), "expected a DOT graph, got %q", dot)
+
+	// a peer that left two days ago, past the default retention
+	left := "12D3KooWJ7BrgG4dF1u9wB3XAGKTd7Lw1R6CQqp38zdc6PGBHFcM"
+	peer, _ := json.Marshal(protocol.Peer{ID: left, Status: protocol.LEFT, LastSeen: time.Now().Add(-48 * time.Hour).Unix()})
+	n.node.UpdateNodeTableHook(ds.NewKey(left), peer)
+	var pending struct {
+		Peers []protocol.PendingTombstone `json:"peers"`
+	}
+	getJSON(t, base+"/tombstones", &pending)
+	require.Len(t, pending.Peers, 1)
+	assert.Equal(t, left, pending.Peers[0].ID)
+	assert.Less(t, pending.Peers[0].CleanupAt, time.Now().Unix())
+
+	var compacted struct {
+		Removed protocol.CompactionResult `json:"removed"`
+	}
+	postJSON(t, base+"/compact", http.StatusOK, &compacted)
+	assert.Equal(t, 1, compacted.Removed.LeftPeers)
+	getJSON(t, base+"/tombstones", &pending)
+	assert.Empty(t, pending.Peers)
+
+	resp, err = http.Post(base+"/compact?older_than=-1h", "", nil)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// entries of the other nodes may be in flight, which makes snapshots wait
+	var snapshot struct {
+		Snapshot string `json:"snapshot"`
+	}
+	c.eventually(func() bool {
+		resp, err := http.Post(base+"/snapshot", "", nil)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		return resp.StatusCode == http.StatusOK && json.NewDecoder(resp.Body).Decode(&snapshot) == nil
+	}, "a snapshot")
+	getJSON(t, base+"/stats", &stats)
+	assert.Equal(t, snapshot.Snapshot, stats.Snapshot)
+	assert.Greater(t, stats.SnapshotHeight, uint64(0))
+
+	postJSON(t, base+"/repair", http.StatusAccepted, nil)
+	c.eventually(func() bool {
+		getJSON(t, base+"/stats", &stats)
+		return !stats.Repairing && !stats.Dirty
+	}, "the repair to finish")
+}
+
+func getJSON(t *testing.T, url string, out any) {
+	t.Helper()
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(out))
+}
+
+func postJSON(t *testing.T, url string, status int, out any) {
+	t.Helper()
+	resp, err := http.Post(url, "application/json", nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, status, resp.StatusCode)
+	if out != nil {
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(out))
+	}
+}
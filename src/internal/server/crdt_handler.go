@@ -10,36 +10,46 @@ import (
 )
 
 func listPeers(c *gin.Context) {
-	addrs := protocol.ConnectedPeers()
+	addrs := nodeOf(c).ConnectedPeers()
 	c.JSON(200, gin.H{"peers": addrs})
 }
 
 func listPeersWithStatus(c *gin.Context) {
 	// Get all peers from node table
-	peers := protocol.AllPeers()
+	peers := nodeOf(c).AllPeers()
 	c.JSON(200, gin.H{"peers": peers})
 }
 
 func listBootstraps(c *gin.Context) {
-	addrs := protocol.ConnectedBootstraps()
+	addrs := nodeOf(c).ConnectedBootstraps()
 	c.JSON(200, gin.H{"bootstraps": addrs})
 }
 
 func getResourceStats(c *gin.Context) {
-	// Call the resource manager stats function from protocol package
-	protocol.GetResourceManagerStats()
-
-	// Also return current connection count
-	connectedPeers := protocol.ConnectedPeers()
-	allPeers := protocol.AllPeers()
-
-	c.JSON(200, gin.H{
+	node := nodeOf(c)
+	connectedPeers := node.ConnectedPeers()
+	allPeers := node.AllPeers()
+	response := gin.H{
 		"connected_peers":        len(connectedPeers),
 		"total_peers_known":      len(allPeers),
 		"connected_peer_details": connectedPeers,
 		"all_peer_details":       allPeers,
-		"message":                "Resource manager stats logged to console",
-	})
+	}
+	// hosts of in-memory networks have no resource manager to report
+	if stats, err := node.ResourceStats(); err == nil {
+		response["resources"] = stats
+	} else {
+		response["error"] = err.Error()
+	}
+	c.JSON(200, response)
+}
+
+func listQuarantine(c *gin.Context) {
+	c.JSON(200, gin.H{"entries": nodeOf(c).QuarantinedEntries()})
+}
+
+func getVersions(c *gin.Context) {
+	c.JSON(200, nodeOf(c).GetVersionSummary())
 }
 
 func updateLocal(c *gin.Context) {
@@ -49,7 +59,7 @@ func updateLocal(c *gin.Context) {
 		return
 	}
 	peer.Connected = true
-	protocol.UpdateNodeTable(peer)
+	nodeOf(c).UpdateNodeTable(peer)
 }
 
 func deleteLocal(c *gin.Context) {
@@ -58,7 +68,7 @@ func deleteLocal(c *gin.Context) {
 		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
-	protocol.AnnounceLeave()
+	nodeOf(c).AnnounceLeave()
 }
 
 func getDNT(c *gin.Context) {
@@ -66,5 +76,5 @@ func getDNT(c *gin.Context) {
 		{ingest.TimestampField: time.Now(), "event": "DNT Lookup"},
 	}
 	IngestEvents(events)
-	c.JSON(200, protocol.GetConnectedPeers())
+	c.JSON(200, nodeOf(c).GetConnectedPeers())
 }
@@ -92,8 +92,7 @@ func TestGetResourceStats(t *testing.T) {
 	req, _ := http.NewRequest("GET", "/resources", nil)
 	r.ServeHTTP(w, req)
 
-	// It calls protocol.GetResourceManagerStats() which might log to console.
-	// And returns JSON.
+	// The resource usage of the host is returned along with the peer counts.
 
 	assert.Equal(t, 200, w.Code)
 
@@ -102,4 +101,9 @@ func TestGetResourceStats(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Contains(t, response, "connected_peers")
 	assert.Contains(t, response, "total_peers_known")
+	resources, ok := response["resources"].(map[string]interface{})
+	if assert.True(t, ok, "expected resource usage, got %v", response["error"]) {
+		assert.Contains(t, resources, "system")
+		assert.Contains(t, resources, "connections")
+	}
 }
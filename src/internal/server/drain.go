@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"opentela/internal/common"
+	"opentela/internal/protocol"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+)
+
+const defaultDrainTimeout = 10 * time.Minute
+
+type drainRequest struct {
+	// Timeout is how long to wait for in-flight requests before leaving,
+	// e.g. "90s" or "15m". Defaults to drain.timeout.
+	Timeout string `json:"timeout"`
+}
+
+// drainState remembers the ongoing drain so that repeated calls do not
+// restart the countdown.
+type drainState struct {
+	mu       sync.Mutex
+	started  bool
+	deadline time.Time
+}
+
+var drain = &drainState{}
+
+// start announces this node as draining and, in the background, waits
+// until the in-flight requests tracked by t complete or the timeout expires
+// before announcing the node as LEFT. Calling it while a drain is already in
+// progress returns the existing deadline.
+func (d *drainState) start(t *requestTracker, timeout time.Duration, announce, leave func()) (time.Time, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.started {
+		return d.deadline, false
+	}
+	d.started = true
+	d.deadline = time.Now().Add(timeout)
+
+	announce()
+	go func(deadline time.Time) {
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		defer cancel()
+		if err := t.Wait(ctx); err != nil {
+			common.Logger.Warnf("Drain deadline reached with %d requests still in flight", t.Count())
+		} else {
+			common.Logger.Info("All in-flight requests completed")
+		}
+		leave()
+	}(d.deadline)
+	return d.deadline, true
+}
+
+func drainTimeout(raw string) (time.Duration, error) {
+	if raw == "" {
+		if configured := viper.GetDuration("drain.timeout"); configured > 0 {
+			return configured, nil
+		}
+		return defaultDrainTimeout, nil
+	}
+	timeout, err := time.ParseDuration(raw)
+	if err != nil {
+		return 0, err
+	}
+	if timeout <= 0 {
+		return 0, errors.New("timeout must be positive")
+	}
+	return timeout, nil
+}
+
+func drainLocal(c *gin.Context) {
+	var req drainRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	timeout, err := drainTimeout(req.Timeout)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid timeout: " + err.Error()})
+		return
+	}
+	node := nodeOf(c)
+	deadline, started := drain.start(inflight, timeout, node.AnnounceDraining, node.AnnounceLeave)
+	status := http.StatusAccepted
+	if !started {
+		status = http.StatusOK
+	}
+	c.JSON(status, gin.H{
+		"status":    protocol.DRAINING,
+		"in_flight": inflight.Count(),
+		"deadline":  deadline.Format(time.RFC3339),
+	})
+}
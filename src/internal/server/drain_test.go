@@ -0,0 +1,132 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestTrackerCountsAndWaits(t *testing.T) {
+	tracker := newRequestTracker()
+	assert.NoError(t, tracker.Wait(context.Background()))
+
+	done1 := tracker.begin()
+	done2 := tracker.begin()
+	assert.Equal(t, int64(2), tracker.Count())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, tracker.Wait(ctx), context.DeadlineExceeded)
+
+	done1()
+	done1() // calling done twice must not double count
+	assert.Equal(t, int64(1), tracker.Count())
+	done2()
+	assert.Equal(t, int64(0), tracker.Count())
+	assert.NoError(t, tracker.Wait(context.Background()))
+}
+
+func TestTrackInflightMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tracker := newRequestTracker()
+	seen := int64(-1)
+	r := gin.New()
+	r.GET("/work", trackInflight(tracker), func(c *gin.Context) {
+		seen = tracker.Count()
+		c.Status(http.StatusOK)
+	})
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/work", nil)
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, int64(1), seen)
+	assert.Equal(t, int64(0), tracker.Count())
+}
+
+func TestDrainLeavesOnceInflightFinishes(t *testing.T) {
+	tracker := newRequestTracker()
+	done := tracker.begin()
+	announced := false
+	left := make(chan struct{})
+
+	d := &drainState{}
+	_, started := d.start(tracker, time.Minute, func() { announced = true }, func() { close(left) })
+	assert.True(t, started)
+	assert.True(t, announced)
+
+	select {
+	case <-left:
+		t.Fatal("left before in-flight request finished")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	done()
+	select {
+	case <-left:
+	case <-time.After(time.Second):
+		t.Fatal("did not leave after in-flight request finished")
+	}
+}
+
+func TestDrainLeavesAtDeadline(t *testing.T) {
+	tracker := newRequestTracker()
+	defer tracker.begin()()
+	left := make(chan struct{})
+
+	d := &drainState{}
+	d.start(tracker, 20*time.Millisecond, func() {}, func() { close(left) })
+
+	select {
+	case <-left:
+	case <-time.After(time.Second):
+		t.Fatal("did not leave at deadline")
+	}
+}
+
+func TestDrainIsIdempotent(t *testing.T) {
+	tracker := newRequestTracker()
+	defer tracker.begin()()
+	announcements := 0
+
+	d := &drainState{}
+	first, started := d.start(tracker, time.Minute, func() { announcements++ }, func() {})
+	assert.True(t, started)
+	second, started := d.start(tracker, time.Hour, func() { announcements++ }, func() {})
+	assert.False(t, started)
+	assert.Equal(t, first, second)
+	assert.Equal(t, 1, announcements)
+}
+
+func TestDrainTimeout(t *testing.T) {
+	timeout, err := drainTimeout("")
+	assert.NoError(t, err)
+	assert.Equal(t, defaultDrainTimeout, timeout)
+
+	timeout, err = drainTimeout("90s")
+	assert.NoError(t, err)
+	assert.Equal(t, 90*time.Second, timeout)
+
+	for _, raw := range []string{"soon", "-1s", "0s"} {
+		_, err := drainTimeout(raw)
+		assert.Error(t, err, "expected error for %q", raw)
+	}
+}
+
+func TestDrainLocalRejectsInvalidTimeout(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/_drain", drainLocal)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/_drain", strings.NewReader(`{"timeout":"later"}`))
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"opentela/internal/protocol"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+)
+
+const eventStreamHeartbeat = 15 * time.Second
+
+var (
+	eventStreamsClosed    = make(chan struct{})
+	closeEventStreamsOnce sync.Once
+)
+
+// closeEventStreams ends every open event stream. It is registered to run on
+// server shutdown, since long-lived streams would otherwise hold the server
+// open for the whole grace period.
+func closeEventStreams() {
+	closeEventStreamsOnce.Do(func() { close(eventStreamsClosed) })
+}
+
+// streamTableEvents serves node table changes as server-sent events. The
+// stream starts with a "snapshot" event carrying the whole table, unless the
+// client resumes with a Last-Event-ID header (or last_event_id query
+// parameter) that is still in the server's history, in which case the missed
+// events are replayed instead.
+func streamTableEvents(c *gin.Context) {
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("last_event_id")
+	}
+	watch, cancel := nodeOf(c).WatchNodeTable(lastEventID)
+	defer cancel()
+
+	c.Header("Content-Type", sse.ContentType)
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	if watch.Snapshot != nil {
+		c.Render(-1, sse.Event{Id: watch.Cursor, Event: "snapshot", Data: watch.Snapshot})
+	}
+	for _, event := range watch.Backlog {
+		renderTableEvent(c, event)
+	}
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(eventStreamHeartbeat)
+	defer heartbeat.Stop()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case event, ok := <-watch.Events:
+			if !ok {
+				// too slow to keep up, the client reconnects and resumes
+				return false
+			}
+			renderTableEvent(c, event)
+			return true
+		case <-heartbeat.C:
+			_, err := io.WriteString(w, ": ping\n\n")
+			return err == nil
+		case <-c.Request.Context().Done():
+			return false
+		case <-eventStreamsClosed:
+			return false
+		}
+	})
+}
+
+func renderTableEvent(c *gin.Context, event protocol.TableEvent) {
+	c.Render(-1, sse.Event{Id: event.ID, Event: event.Type, Data: event})
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"opentela/internal/protocol"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type sseEvent struct {
+	id, event, data string
+}
+
+// readSSE parses server-sent events from the response body onto a channel.
+func readSSE(resp *http.Response) <-chan sseEvent {
+	out := make(chan sseEvent, 16)
+	go func() {
+		defer close(out)
+		scanner := bufio.NewScanner(resp.Body)
+		var ev sseEvent
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				if ev.event != "" {
+					out <- ev
+				}
+				ev = sseEvent{}
+			case strings.HasPrefix(line, "id:"):
+				ev.id = strings.TrimSpace(strings.TrimPrefix(line, "id:"))
+			case strings.HasPrefix(line, "event:"):
+				ev.event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+			case strings.HasPrefix(line, "data:"):
+				ev.data = strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+			}
+		}
+	}()
+	return out
+}
+
+func nextSSE(t *testing.T, events <-chan sseEvent) sseEvent {
+	t.Helper()
+	select {
+	case ev, ok := <-events:
+		require.True(t, ok, "stream closed")
+		return ev
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+	return sseEvent{}
+}
+
+func TestStreamTableEvents(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/events", streamTableEvents)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	peerID := fmt.Sprintf("events-peer-%d", time.Now().UnixNano())
+	resp, err := http.Get(srv.URL + "/events")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Contains(t, resp.Header.Get("Content-Type"), "text/event-stream")
+	events := readSSE(resp)
+
+	snapshot := nextSSE(t, events)
+	assert.Equal(t, "snapshot", snapshot.event)
+	assert.NotEmpty(t, snapshot.id)
+
+	peer := protocol.Peer{ID: peerID, Connected: true, Service: []protocol.Service{{Name: "llm", IdentityGroup: []string{"model=x"}}}}
+	value, _ := json.Marshal(peer)
+	protocol.UpdateNodeTableHook(ds.NewKey(peerID), value)
+
+	joined := nextSSE(t, events)
+	assert.Equal(t, protocol.PeerJoined, joined.event)
+	var payload protocol.TableEvent
+	require.NoError(t, json.Unmarshal([]byte(joined.data), &payload))
+	assert.Equal(t, peerID, payload.PeerID)
+	assert.Equal(t, joined.id, payload.ID)
+
+	added := nextSSE(t, events)
+	assert.Equal(t, protocol.ServiceAdded, added.event)
+
+	// a client resuming after the join only gets what came after it
+	protocol.DeleteNodeTableHook(ds.NewKey(peerID))
+	req, _ := http.NewRequest("GET", srv.URL+"/events", nil)
+	req.Header.Set("Last-Event-ID", added.id)
+	resumed, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resumed.Body.Close()
+	replayed := readSSE(resumed)
+	assert.Equal(t, protocol.PeerLeft, nextSSE(t, replayed).event)
+	assert.Equal(t, protocol.ServiceRemoved, nextSSE(t, replayed).event)
+}
@@ -0,0 +1,292 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"opentela/internal/protocol"
+
+	"github.com/gin-gonic/gin"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// harnessModel is the model the fake backends serve.
+const harnessModel = "harness-model"
+
+// convergenceTimeout bounds how long the harness waits for the node tables
+// to converge.
+const convergenceTimeout = 30 * time.Second
+
+// testCluster runs OpenTela nodes on an in-memory libp2p network. Every node
+// serves the HTTP API over libp2p, as in production, and on a local test
+// server; workers also get a fake OpenAI-compatible backend.
+type testCluster struct {
+	t     *testing.T
+	net   mocknet.Mocknet
+	nodes []*testNode
+}
+
+type testNode struct {
+	node    *protocol.Node
+	role    string
+	api     *httptest.Server
+	backend *httptest.Server
+}
+
+// ID returns the peer ID of the node.
+func (n *testNode) ID() string {
+	return n.node.ID()
+}
+
+// newTestCluster starts one node per role, links them all and waits until the
+// heads can route to every worker.
+func newTestCluster(t *testing.T, roles ...string) *testCluster {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	c := &testCluster{t: t, net: mocknet.New()}
+	t.Cleanup(func() { _ = c.net.Close() })
+	for _, role := range roles {
+		c.addNode(role)
+	}
+	if err := c.net.LinkAll(); err != nil {
+		t.Fatalf("failed to link the nodes: %v", err)
+	}
+	if err := c.net.ConnectAllButSelf(); err != nil {
+		t.Fatalf("failed to connect the nodes: %v", err)
+	}
+	for _, n := range c.nodes {
+		if n.backend == nil {
+			continue
+		}
+		_, err := n.node.RegisterService(protocol.Service{
+			Name:          "llm",
+			Upstream:      n.backend.URL,
+			IdentityGroup: []string{"model=" + harnessModel},
+		})
+		if err != nil {
+			t.Fatalf("failed to register the backend of %s: %v", n.ID(), err)
+		}
+	}
+	for i, n := range c.nodes {
+		if n.role == protocol.RoleHead {
+			c.waitForProviders(i, c.workers()...)
+		}
+	}
+	return c
+}
+
+func (c *testCluster) addNode(role string) {
+	c.t.Helper()
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		c.t.Fatalf("failed to generate key: %v", err)
+	}
+	addr, _ := ma.NewMultiaddr(fmt.Sprintf("/ip4/10.0.0.%d/tcp/4001", len(c.nodes)+1))
+	h, err := c.net.AddPeer(priv, addr)
+	if err != nil {
+		c.t.Fatalf("failed to add peer: %v", err)
+	}
+	node := protocol.NewNode(protocol.NodeConfig{
+		Host:     h,
+		Mode:     "standalone",
+		Role:     role,
+		InMemory: true,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	c.t.Cleanup(func() {
+		cancel()
+		_ = node.Close()
+	})
+	if err := node.Start(ctx); err != nil {
+		c.t.Fatalf("failed to start node: %v", err)
+	}
+	node.InitializeMyself("harness")
+
+	n := &testNode{node: node, role: role}
+	router := newRouter(node)
+	p2pSrv := &http.Server{Handler: router}
+	go func() { _ = p2pSrv.Serve(P2PListener(node)) }()
+	c.t.Cleanup(func() { _ = p2pSrv.Close() })
+	n.api = httptest.NewServer(router)
+	c.t.Cleanup(n.api.Close)
+	if role == protocol.RoleWorker {
+		n.backend = newFakeBackend(node.ID())
+		c.t.Cleanup(n.backend.Close)
+	}
+	c.nodes = append(c.nodes, n)
+}
+
+// newFakeBackend serves OpenAI-style completions naming the worker that
+// served them.
+func newFakeBackend(worker string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/v1/") {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"object": "chat.completion",
+			"model":  harnessModel,
+			"worker": worker,
+			"choices": []map[string]any{
+				{"index": 0, "message": map[string]string{"role": "assistant", "content": "hi"}},
+			},
+		})
+	}))
+}
+
+// node returns the i-th node of the cluster.
+func (c *testCluster) node(i int) *testNode {
+	return c.nodes[i]
+}
+
+// workers returns the indexes of the worker nodes.
+func (c *testCluster) workers() []int {
+	var out []int
+	for i, n := range c.nodes {
+		if n.role == protocol.RoleWorker {
+			out = append(out, i)
+		}
+	}
+	return out
+}
+
+// complete sends a chat completion through the public route of node i and
+// returns the status and the peer that served it, from X-Computing-Node.
+func (c *testCluster) complete(i int) (int, string) {
+	c.t.Helper()
+	body := `{"model":"` + harnessModel + `","messages":[{"role":"user","content":"hello"}]}`
+	resp, err := http.Post(c.nodes[i].api.URL+"/v1/service/llm/v1/chat/completions", "application/json", strings.NewReader(body))
+	if err != nil {
+		c.t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode, resp.Header.Get("X-Computing-Node")
+}
+
+// servedBy sends n completions through node i and counts the peers serving
+// them. Failed requests are counted under the empty peer ID.
+func (c *testCluster) servedBy(i, n int) map[string]int {
+	c.t.Helper()
+	counts := make(map[string]int)
+	for range n {
+		status, worker := c.complete(i)
+		if status != http.StatusOK {
+			worker = ""
+		}
+		counts[worker]++
+	}
+	return counts
+}
+
+// providers returns the peers node i would route llm requests to.
+func (c *testCluster) providers(i int) map[string]bool {
+	ids := make(map[string]bool)
+	providers, _ := c.nodes[i].node.GetAllProviders("llm")
+	for _, p := range providers {
+		ids[p.ID] = true
+	}
+	return ids
+}
+
+// waitForProviders waits until node i routes llm requests to exactly the
+// given nodes.
+func (c *testCluster) waitForProviders(i int, want ...int) {
+	c.t.Helper()
+	c.eventually(func() bool {
+		got := c.providers(i)
+		if len(got) != len(want) {
+			return false
+		}
+		for _, j := range want {
+			if !got[c.nodes[j].ID()] {
+				return false
+			}
+		}
+		return true
+	}, "node %d to route to nodes %v", i, want)
+}
+
+// eventually polls cond until it holds or the convergence timeout expires.
+func (c *testCluster) eventually(cond func() bool, format string, args ...any) {
+	c.t.Helper()
+	deadline := time.Now().Add(convergenceTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			c.t.Fatalf("timed out waiting for "+format, args...)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// disconnect cuts the link between nodes i and j and closes their
+// connections.
+func (c *testCluster) disconnect(i, j int) {
+	c.t.Helper()
+	a, b := c.nodes[i].node.Host().ID(), c.nodes[j].node.Host().ID()
+	if err := c.net.UnlinkPeers(a, b); err != nil {
+		c.t.Fatalf("failed to unlink nodes %d and %d: %v", i, j, err)
+	}
+	_ = c.net.DisconnectPeers(a, b)
+	_ = c.net.DisconnectPeers(b, a)
+}
+
+// connect links nodes i and j again and connects them.
+func (c *testCluster) connect(i, j int) {
+	c.t.Helper()
+	a, b := c.nodes[i].node.Host().ID(), c.nodes[j].node.Host().ID()
+	if _, err := c.net.LinkPeers(a, b); err != nil {
+		c.t.Fatalf("failed to link nodes %d and %d: %v", i, j, err)
+	}
+	if _, err := c.net.ConnectPeers(a, b); err != nil {
+		c.t.Fatalf("failed to connect nodes %d and %d: %v", i, j, err)
+	}
+}
+
+// partition splits the cluster in two: no node of side can reach a node
+// outside of it.
+func (c *testCluster) partition(side ...int) {
+	c.t.Helper()
+	in := make(map[int]bool)
+	for _, i := range side {
+		in[i] = true
+	}
+	for i := range c.nodes {
+		for j := range c.nodes {
+			if i < j && in[i] != in[j] {
+				c.disconnect(i, j)
+			}
+		}
+	}
+}
+
+// heal reconnects the two sides of a partition.
+func (c *testCluster) heal(side ...int) {
+	c.t.Helper()
+	in := make(map[int]bool)
+	for _, i := range side {
+		in[i] = true
+	}
+	for i := range c.nodes {
+		for j := range c.nodes {
+			if i < j && in[i] != in[j] {
+				c.connect(i, j)
+			}
+		}
+	}
+}
+
+// leave makes node i announce that it leaves the network.
+func (c *testCluster) leave(i int) {
+	c.nodes[i].node.AnnounceLeave()
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"context"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// requestTracker counts requests that are currently being served so that
+// drain and shutdown can wait for them to finish.
+type requestTracker struct {
+	mu    sync.Mutex
+	count int64
+	idle  chan struct{}
+}
+
+func newRequestTracker() *requestTracker {
+	idle := make(chan struct{})
+	close(idle)
+	return &requestTracker{idle: idle}
+}
+
+var inflight = newRequestTracker()
+
+// begin registers a new in-flight request and returns the function that
+// must be called once the request is done.
+func (t *requestTracker) begin() func() {
+	t.mu.Lock()
+	if t.count == 0 {
+		t.idle = make(chan struct{})
+	}
+	t.count++
+	t.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			t.mu.Lock()
+			t.count--
+			if t.count == 0 {
+				close(t.idle)
+			}
+			t.mu.Unlock()
+		})
+	}
+}
+
+// Count returns the number of requests currently in flight.
+func (t *requestTracker) Count() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.count
+}
+
+// Wait blocks until no request is in flight or the context is done.
+func (t *requestTracker) Wait(ctx context.Context) error {
+	t.mu.Lock()
+	idle := t.idle
+	t.mu.Unlock()
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// trackInflight is a middleware that keeps the given tracker up to date for
+// every request passing through it, including long-lived streams.
+func trackInflight(t *requestTracker) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		done := t.begin()
+		defer done()
+		c.Next()
+	}
+}
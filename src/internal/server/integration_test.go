@@ -0,0 +1,76 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	"opentela/internal/protocol"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	head    = 0
+	worker1 = 1
+	worker2 = 2
+)
+
+func newHeadAndTwoWorkers(t *testing.T) *testCluster {
+	if testing.Short() {
+		t.Skip("integration test")
+	}
+	return newTestCluster(t, protocol.RoleHead, protocol.RoleWorker, protocol.RoleWorker)
+}
+
+func TestClusterRoutesToWorkers(t *testing.T) {
+	c := newHeadAndTwoWorkers(t)
+
+	served := c.servedBy(head, 40)
+	assert.Zero(t, served[""], "every request must succeed")
+	assert.Positive(t, served[c.node(worker1).ID()])
+	assert.Positive(t, served[c.node(worker2).ID()])
+	assert.NotContains(t, served, c.node(head).ID(), "the head serves no llm")
+
+	// workers do not route public requests
+	resp, err := http.Post(c.node(worker1).api.URL+"/v1/service/llm/v1/chat/completions", "application/json", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestClusterReroutesAroundDisconnectedWorker(t *testing.T) {
+	c := newHeadAndTwoWorkers(t)
+
+	c.disconnect(head, worker1)
+	c.waitForProviders(head, worker2)
+	assert.Equal(t, map[string]int{c.node(worker2).ID(): 10}, c.servedBy(head, 10))
+
+	c.connect(head, worker1)
+	c.waitForProviders(head, worker1, worker2)
+	assert.Positive(t, c.servedBy(head, 40)[c.node(worker1).ID()])
+}
+
+func TestClusterConvergesAfterPartition(t *testing.T) {
+	c := newHeadAndTwoWorkers(t)
+
+	c.partition(worker2)
+	c.waitForProviders(head, worker1)
+	_, err := c.node(worker2).node.RegisterService(protocol.Service{Name: "embeddings", Upstream: c.node(worker2).backend.URL})
+	require.NoError(t, err)
+
+	c.heal(worker2)
+	c.waitForProviders(head, worker1, worker2)
+	c.eventually(func() bool {
+		providers, _ := c.node(head).node.GetAllProviders("embeddings")
+		return len(providers) == 1 && providers[0].ID == c.node(worker2).ID()
+	}, "the service registered during the partition to reach the head")
+}
+
+func TestClusterStopsRoutingToLeftWorker(t *testing.T) {
+	c := newHeadAndTwoWorkers(t)
+
+	c.leave(worker1)
+	c.waitForProviders(head, worker2)
+	assert.Equal(t, map[string]int{c.node(worker2).ID(): 10}, c.servedBy(head, 10))
+}
@@ -0,0 +1,30 @@
+package server
+
+import (
+	"opentela/internal/protocol"
+
+	"github.com/gin-gonic/gin"
+)
+
+// nodeContextKey is the gin context key holding the node a request is served
+// by.
+const nodeContextKey = "opentela.node"
+
+// withNode makes the handlers of the router operate on node.
+func withNode(node *protocol.Node) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(nodeContextKey, node)
+		c.Next()
+	}
+}
+
+// nodeOf returns the node serving the request, the default node unless the
+// router was built with withNode.
+func nodeOf(c *gin.Context) *protocol.Node {
+	if v, ok := c.Get(nodeContextKey); ok {
+		if node, ok := v.(*protocol.Node); ok {
+			return node
+		}
+	}
+	return protocol.DefaultNode()
+}
@@ -5,12 +5,11 @@ import (
 	"opentela/internal/protocol"
 
 	gostream "github.com/libp2p/go-libp2p-gostream"
-	p2phttp "github.com/libp2p/go-libp2p-http"
 )
 
-func P2PListener() net.Listener {
-	host, _ := protocol.GetP2PNode(nil)
-	protocol.MarkSelfAsBootstrap()
-	listener, _ := gostream.Listen(host, p2phttp.DefaultP2PProtocol)
+// P2PListener accepts the HTTP requests other peers send to node.
+func P2PListener(node *protocol.Node) net.Listener {
+	node.MarkSelfAsBootstrap()
+	listener, _ := gostream.Listen(node.Host(), node.P2PHTTPProtocol())
 	return listener
 }
@@ -2,14 +2,18 @@ package server
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/http/httputil"
 	"net/url"
+	"opentela/internal/protocol"
 	"testing"
 
 	"github.com/gin-gonic/gin"
+	ds "github.com/ipfs/go-datastore"
 )
 
 // Custom recorder that implements CloseNotify
@@ -101,3 +105,39 @@ func BenchmarkProxyRequest_1MB(b *testing.B) {
 		}
 	})
 }
+
+// BenchmarkRouting measures candidate selection for a service request against
+// node tables of increasing size: the lookup of exact identity group matches
+// through the index of the node table.
+func BenchmarkRouting(b *testing.B) {
+	body := []byte(`{"model":"m7","messages":[{"role":"user","content":"hi"}]}`)
+	node := protocol.DefaultNode()
+	b.Cleanup(func() {
+		for i := 0; i < 5000; i++ {
+			protocol.DeleteNodeTableHook(ds.NewKey(fmt.Sprintf("bench-peer-%d", i)))
+		}
+	})
+	for _, n := range []int{1000, 5000} {
+		for i := 0; i < n; i++ {
+			id := fmt.Sprintf("bench-peer-%d", i)
+			p := protocol.Peer{
+				ID:        id,
+				Connected: true,
+				Service: []protocol.Service{{
+					Name:          "bench-llm",
+					IdentityGroup: []string{fmt.Sprintf("model=m%d", i%50)},
+				}},
+			}
+			value, _ := json.Marshal(p)
+			protocol.UpdateNodeTableHook(ds.NewKey(id), value)
+		}
+		b.Run(fmt.Sprintf("peers/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_, candidates, err := routingCandidates(node, "bench-llm", body, 0)
+				if err != nil || len(candidates) == 0 {
+					b.Fatal("expected candidates")
+				}
+			}
+		})
+	}
+}
@@ -13,36 +13,14 @@ import (
 	"opentela/internal/protocol"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/axiomhq/axiom-go/axiom"
 	"github.com/axiomhq/axiom-go/axiom/ingest"
 	"github.com/buger/jsonparser"
 	"github.com/gin-gonic/gin"
-	p2phttp "github.com/libp2p/go-libp2p-http"
 )
 
-var (
-	globalTransport *http.Transport
-	transportOnce   sync.Once
-)
-
-func getGlobalTransport() *http.Transport {
-	transportOnce.Do(func() {
-		node, _ := protocol.GetP2PNode(nil)
-		globalTransport = &http.Transport{
-			ResponseHeaderTimeout: 10 * time.Minute, // Allow up to 10 minutes for response headers
-			IdleConnTimeout:       90 * time.Second, // Keep connections alive for 90 seconds
-			DisableKeepAlives:     false,            // Enable keep-alives for better performance
-			MaxIdleConns:          100,
-			MaxIdleConnsPerHost:   10,
-		}
-		globalTransport.RegisterProtocol("libp2p", p2phttp.NewTransport(node))
-	})
-	return globalTransport
-}
-
 func ErrorHandler(res http.ResponseWriter, req *http.Request, err error) {
 	if _, werr := fmt.Fprintf(res, "ERROR: %s", err.Error()); werr != nil {
 		common.Logger.Error("Error writing error response: ", werr)
@@ -83,7 +61,7 @@ func P2PForwardHandler(c *gin.Context) {
 	requestPath := c.Param("path")
 
 	// Log event as before
-	event := []axiom.Event{{ingest.TimestampField: time.Now(), "event": "P2P Forward", "from": &protocol.MyID, "to": requestPeer, "path": requestPath}}
+	event := []axiom.Event{{ingest.TimestampField: time.Now(), "event": "P2P Forward", "from": nodeOf(c).ID(), "to": requestPeer, "path": requestPath}}
 	IngestEvents(event)
 
 	target := url.URL{
@@ -103,7 +81,7 @@ func P2PForwardHandler(c *gin.Context) {
 
 	proxy := httputil.NewSingleHostReverseProxy(&target)
 	proxy.Director = director
-	proxy.Transport = getGlobalTransport()
+	proxy.Transport = peerTransport(nodeOf(c), requestPeer)
 	proxy.ErrorHandler = ErrorHandler
 	proxy.ModifyResponse = rewriteHeader()
 	proxy.ServeHTTP(c.Writer, c.Request)
@@ -113,7 +91,7 @@ func P2PForwardHandler(c *gin.Context) {
 func ServiceForwardHandler(c *gin.Context) {
 	serviceName := c.Param("service")
 	requestPath := c.Param("path")
-	service, err := protocol.GetService(serviceName)
+	service, err := nodeOf(c).GetService(serviceName)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
@@ -124,6 +102,18 @@ func ServiceForwardHandler(c *gin.Context) {
 		Host:   service.Host + ":" + service.Port,
 		Path:   requestPath,
 	}
+	if service.Upstream != "" {
+		upstream, err := url.Parse(service.Upstream)
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": "invalid upstream for service " + serviceName})
+			return
+		}
+		target = url.URL{
+			Scheme: upstream.Scheme,
+			Host:   upstream.Host,
+			Path:   strings.TrimSuffix(upstream.Path, "/") + requestPath,
+		}
+	}
 	director := func(req *http.Request) {
 		req.Host = target.Host
 		req.URL.Host = req.Host
@@ -137,8 +127,8 @@ func ServiceForwardHandler(c *gin.Context) {
 	// However, if we want shared settings (timeouts), we can use ours.
 	// NOTE: standard http transport doesn't support libp2p.
 	// Ideally we separate p2p transport from standard http transport, OR register protocols on one.
-	// Our getGlobalTransport() has registered libp2p, so it works for both (http falls back to standard).
-	proxy.Transport = getGlobalTransport()
+	// Our nodeTransport() has registered libp2p, so it works for both (http falls back to standard).
+	proxy.Transport = nodeTransport(nodeOf(c))
 
 	proxy.ServeHTTP(c.Writer, c.Request)
 }
@@ -169,7 +159,8 @@ func selectCandidates(providers []protocol.Peer, serviceName string, body []byte
 	var exactCandidates, wildcardCandidates, catchAllCandidates []string
 	for _, provider := range providers {
 		for _, service := range provider.Service {
-			if service.Name == serviceName {
+			// a connected peer may still have an unhealthy or draining instance
+			if service.Name == serviceName && protocol.IsServiceRoutable(service) {
 				// Track the best (highest-priority) match for this provider.
 				// 0 = no match, 1 = catch-all, 2 = wildcard, 3 = exact
 				bestMatch := 0
@@ -232,6 +223,90 @@ func selectCandidates(providers []protocol.Peer, serviceName string, body []byte
 	return candidates
 }
 
+// exactProviders returns the providers of the service advertising an identity
+// group that the request matches exactly, looked up in the identity index of
+// the node table rather than by scanning every provider.
+func exactProviders(node *protocol.Node, serviceName string, body []byte) []protocol.Peer {
+	var out []protocol.Peer
+	seen := make(map[string]struct{})
+	requested := make(map[string]string)
+	for _, group := range node.IdentityGroups(serviceName) {
+		key, value, ok := strings.Cut(group, "=")
+		if !ok || value == "*" {
+			continue
+		}
+		got, parsed := requested[key]
+		if !parsed {
+			got, _ = jsonparser.GetString(body, key)
+			requested[key] = got
+		}
+		if got != value {
+			continue
+		}
+		peers, _ := node.GetProvidersWithIdentity(serviceName, group)
+		for _, p := range peers {
+			if _, ok := seen[p.ID]; !ok {
+				seen[p.ID] = struct{}{}
+				out = append(out, p)
+			}
+		}
+	}
+	return out
+}
+
+// routingCandidates returns the providers of the service along with the IDs of
+// those eligible for the request, see selectCandidates. All providers are only
+// scanned when there is no exact match.
+func routingCandidates(node *protocol.Node, serviceName string, body []byte, fallbackLevel int) ([]protocol.Peer, []string, error) {
+	providers := exactProviders(node, serviceName, body)
+	if candidates := selectCandidates(providers, serviceName, body, 0); len(candidates) > 0 {
+		return providers, candidates, nil
+	}
+	providers, err := node.GetAllProviders(serviceName)
+	if err != nil {
+		return nil, nil, err
+	}
+	return providers, selectCandidates(providers, serviceName, body, fallbackLevel), nil
+}
+
+// candidateLoad returns the lowest load reported by the serviceName services
+// of the peer, or false if none of them reported a recent load.
+func candidateLoad(providers []protocol.Peer, peerID, serviceName string, now time.Time) (float64, bool) {
+	best, found := 0.0, false
+	for _, provider := range providers {
+		if provider.ID != peerID {
+			continue
+		}
+		for _, service := range provider.Service {
+			if service.Name != serviceName || service.Load == nil || service.Load.IsStale(now) {
+				continue
+			}
+			if score := service.Load.Score(); !found || score < best {
+				best, found = score, true
+			}
+		}
+	}
+	return best, found
+}
+
+// pickCandidate chooses the peer to forward to with the power of two choices:
+// of two random candidates, the less loaded one is picked. Candidates that do
+// not report their load are picked at random.
+func pickCandidate(providers []protocol.Peer, serviceName string, candidates []string, now time.Time) string {
+	i := rand.Intn(len(candidates))
+	if len(candidates) == 1 {
+		return candidates[i]
+	}
+	first := candidates[i]
+	second := candidates[(i+1+rand.Intn(len(candidates)-1))%len(candidates)]
+	firstLoad, ok1 := candidateLoad(providers, first, serviceName, now)
+	secondLoad, ok2 := candidateLoad(providers, second, serviceName, now)
+	if ok1 && ok2 && secondLoad < firstLoad {
+		return second
+	}
+	return first
+}
+
 // in case of global service, we need to forward the request to the service, identified by the service name and identity group
 func GlobalServiceForwardHandler(c *gin.Context) {
 	// Set a longer timeout for AI/ML services
@@ -250,11 +325,6 @@ func GlobalServiceForwardHandler(c *gin.Context) {
 
 	serviceName := c.Param("service")
 	requestPath := c.Param("path")
-	providers, err := protocol.GetAllProviders(serviceName)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
 
 	// Determine fallback level from the X-Otela-Fallback request header.
 	// 0 (default): exact match only
@@ -262,24 +332,24 @@ func GlobalServiceForwardHandler(c *gin.Context) {
 	// 2: allow wildcard + catch-all fallback
 	fallbackLevel := parseFallbackLevel(c.GetHeader("X-Otela-Fallback"))
 
-	candidates := selectCandidates(providers, serviceName, bodyBytes, fallbackLevel)
+	providers, candidates, err := routingCandidates(nodeOf(c), serviceName, bodyBytes, fallbackLevel)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	if len(candidates) == 0 {
 		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "No provider found for the requested service."})
 		return
 	}
 
-	// randomly select one of the candidates
-	// here's where we can implement a load balancing algorithm
-	randomIndex := rand.Intn(len(candidates))
-
 	// Re-construct body for forwarding since we read it
 	// (Already done above: c.Request.Body = io.NopCloser(bytes.NewBuffer(bodyBytes)))
 
-	targetPeer := candidates[randomIndex]
+	targetPeer := pickCandidate(providers, serviceName, candidates, time.Now())
 	// replace the request path with the _service path
 	requestPath = "/v1/_service/" + serviceName + requestPath
 
-	event := []axiom.Event{{ingest.TimestampField: time.Now(), "event": "Service Forward", "from": protocol.MyID, "to": targetPeer, "path": requestPath, "service": serviceName}}
+	event := []axiom.Event{{ingest.TimestampField: time.Now(), "event": "Service Forward", "from": nodeOf(c).ID(), "to": targetPeer, "path": requestPath, "service": serviceName}}
 	IngestEvents(event)
 
 	common.Logger.Info("Forwarding request to: ", targetPeer)
@@ -298,7 +368,7 @@ func GlobalServiceForwardHandler(c *gin.Context) {
 	}
 	proxy := httputil.NewSingleHostReverseProxy(&target)
 	proxy.Director = director
-	proxy.Transport = getGlobalTransport()
+	proxy.Transport = peerTransport(nodeOf(c), targetPeer)
 	proxy.ErrorHandler = ErrorHandler
 	proxy.ModifyResponse = func(r *http.Response) error {
 		if err := rewriteHeader()(r); err != nil {
@@ -1,9 +1,12 @@
 package server
 
 import (
+	"encoding/json"
 	"opentela/internal/protocol"
 	"testing"
+	"time"
 
+	ds "github.com/ipfs/go-datastore"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -12,7 +15,7 @@ import (
 // ---------------------------------------------------------------------------
 
 func peer(id string, services ...protocol.Service) protocol.Peer {
-	return protocol.Peer{ID: id, Service: services}
+	return protocol.Peer{ID: id, Protocol: &protocol.ProtocolRange{Min: protocol.ProtocolVersion, Max: protocol.ProtocolVersion}, Service: services}
 }
 
 func svc(name string, identityGroups ...string) protocol.Service {
@@ -279,3 +282,99 @@ func TestSelectCandidates_ProviderNotAddedTwice(t *testing.T) {
 	assert.Len(t, got, 1)
 	assert.Equal(t, "peer-a", got[0])
 }
+
+// ---------------------------------------------------------------------------
+// selectCandidates – service health
+// ---------------------------------------------------------------------------
+
+func TestSelectCandidates_SkipsUnhealthyService(t *testing.T) {
+	unhealthy := svc("llm", "model=gpt4")
+	unhealthy.Status = protocol.UNHEALTHY
+	providers := []protocol.Peer{
+		peer("peer-sick", unhealthy),
+		peer("peer-ok", svc("llm", "model=gpt4")),
+	}
+	body := []byte(`{"model":"gpt4"}`)
+	got := selectCandidates(providers, "llm", body, 0)
+	assert.Equal(t, []string{"peer-ok"}, got)
+}
+
+func TestSelectCandidates_HealthyInstanceOfSamePeerStillMatches(t *testing.T) {
+	unhealthy := svc("llm", "model=gpt4")
+	unhealthy.Status = protocol.UNHEALTHY
+	providers := []protocol.Peer{
+		peer("peer-a", unhealthy, svc("llm", "model=gpt4")),
+	}
+	body := []byte(`{"model":"gpt4"}`)
+	got := selectCandidates(providers, "llm", body, 0)
+	assert.Equal(t, []string{"peer-a"}, got)
+}
+
+// ---------------------------------------------------------------------------
+// pickCandidate
+// ---------------------------------------------------------------------------
+
+func loaded(name string, running int, updatedAt time.Time) protocol.Service {
+	s := svc(name, "all")
+	s.Load = &protocol.ServiceLoad{RequestsRunning: running, UpdatedAt: updatedAt.Unix()}
+	return s
+}
+
+func TestPickCandidate_PrefersLessLoaded(t *testing.T) {
+	now := time.Now()
+	providers := []protocol.Peer{
+		peer("busy", loaded("llm", 50, now)),
+		peer("idle", loaded("llm", 0, now)),
+	}
+	for i := 0; i < 50; i++ {
+		assert.Equal(t, "idle", pickCandidate(providers, "llm", []string{"busy", "idle"}, now))
+	}
+}
+
+func TestPickCandidate_IgnoresStaleLoad(t *testing.T) {
+	now := time.Now()
+	providers := []protocol.Peer{
+		peer("busy", loaded("llm", 50, now)),
+		peer("stale", loaded("llm", 0, now.Add(-time.Hour))),
+	}
+	picked := map[string]bool{}
+	for i := 0; i < 200; i++ {
+		picked[pickCandidate(providers, "llm", []string{"busy", "stale"}, now)] = true
+	}
+	assert.True(t, picked["busy"] && picked["stale"], "expected a random choice without a recent load on both sides")
+}
+
+func TestPickCandidate_Single(t *testing.T) {
+	assert.Equal(t, "only", pickCandidate(nil, "llm", []string{"only"}, time.Now()))
+}
+
+// ---------------------------------------------------------------------------
+// routingCandidates
+// ---------------------------------------------------------------------------
+
+func TestRoutingCandidates_IndexedExactMatch(t *testing.T) {
+	node := protocol.NewNode(protocol.NodeConfig{})
+	add := func(p protocol.Peer) {
+		p.Connected = true
+		p.Role = []string{protocol.RoleWorker}
+		value, _ := json.Marshal(p)
+		node.UpdateNodeTableHook(ds.NewKey(p.ID), value)
+	}
+	add(peer("a", svc("llm", "model=gpt4")))
+	add(peer("b", svc("llm", "model=llama")))
+	add(peer("c", svc("llm", "model=*")))
+
+	providers, got, err := routingCandidates(node, "llm", []byte(`{"model":"gpt4"}`), 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, got)
+	assert.Len(t, providers, 1, "an exact match must not scan every provider")
+
+	// without an exact match, every provider is considered
+	providers, got, err = routingCandidates(node, "llm", []byte(`{"model":"mistral"}`), 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"c"}, got)
+	assert.Len(t, providers, 3)
+
+	_, _, err = routingCandidates(node, "vision", []byte(`{"model":"gpt4"}`), 2)
+	assert.Error(t, err)
+}
@@ -82,7 +82,8 @@ func StartServer() {
 	}
 	owner := ""
 
-	protocol.InitializeMyself(owner)
+	node := protocol.DefaultNode()
+	node.InitializeMyself(owner)
 	_, cancelCtx := protocol.GetCRDTStore()
 	defer cancelCtx()
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL)
@@ -90,9 +91,57 @@ func StartServer() {
 
 	initTracer()
 	gin.SetMode(gin.ReleaseMode)
+	r := newRouter(node)
+
+	go protocol.StartTicker()
+	subProcess := viper.GetString("subprocess")
+	if subProcess != "" {
+		go process.StartCriticalProcess(subProcess)
+	}
+	p2plistener := P2PListener(node)
+	srv := &http.Server{
+		Addr:    "0.0.0.0:" + viper.GetString("port"),
+		Handler: r,
+	}
+	p2pSrv := &http.Server{Handler: r}
+	srv.RegisterOnShutdown(closeEventStreams)
+	p2pSrv.RegisterOnShutdown(closeEventStreams)
+	go func() {
+		if err := p2pSrv.Serve(p2plistener); err != nil && err != http.ErrServerClosed {
+			common.Logger.Errorf("http.Serve: %s", err)
+		}
+	}()
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			common.ReportError(err, "Server failed to start")
+		}
+	}()
+	go protocol.RegisterLocalServices(ctx)
+	go node.StartHealthChecks(ctx)
+	go node.StartLoadReporter(ctx)
+	<-ctx.Done()
+	// restore default signal handling so that a second signal exits immediately
+	stop()
+	common.Logger.Info("Shutting down server gracefully")
+	// heads stop routing to us while we finish the streams we already have
+	node.AnnounceLeave()
+	shutdownServers(inflight, shutdownGracePeriod(), srv, p2pSrv)
+	// the node table is kept for a warm restart unless the slate is cleaned
+	if err := node.Close(); err != nil {
+		common.Logger.Warn("Error while closing the node: ", err)
+	}
+	if viper.GetBool("cleanslate") {
+		protocol.ClearCRDTStore()
+	}
+	common.Logger.Info("Server exiting")
+}
+
+// newRouter builds the HTTP API of node.
+func newRouter(node *protocol.Node) *gin.Engine {
 	r := gin.Default()
 	r.Use(corsHeader())
 	r.Use(gin.Recovery())
+	r.Use(withNode(node))
 	// Initialize OpenAPI/Swagger documentation
 	r.GET("/openapi.yaml", func(c *gin.Context) {
 		c.Header("Content-Type", "application/yaml")
@@ -107,25 +156,45 @@ func StartServer() {
 	// Prometheus metrics
 	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
 
-	go protocol.StartTicker()
-	subProcess := viper.GetString("subprocess")
-	if subProcess != "" {
-		go process.StartCriticalProcess(subProcess)
-	}
 	v1 := r.Group("/v1")
 	{
 		v1.GET("/health", healthStatusCheck)
 		crdtGroup := v1.Group("/dnt")
 		{
 			crdtGroup.GET("/table", getDNT)
+			crdtGroup.GET("/events", streamTableEvents)
 			crdtGroup.GET("/peers", listPeers)
 			crdtGroup.GET("/peers_status", listPeersWithStatus)
 			crdtGroup.GET("/bootstraps", listBootstraps)
 			crdtGroup.GET("/stats", getResourceStats) // Add resource manager stats endpoint
-			crdtGroup.POST("/_node", updateLocal)
-			crdtGroup.DELETE("/_node", deleteLocal)
+			crdtGroup.GET("/quarantine", listQuarantine)
+			crdtGroup.GET("/versions", getVersions)
+			crdtGroup.POST("/_node", localOnly(), updateLocal)
+			crdtGroup.DELETE("/_node", localOnly(), deleteLocal)
+			crdtGroup.POST("/_drain", localOnly(), drainLocal)
+			adminGroup := crdtGroup.Group("/_crdt", localOnly())
+			{
+				adminGroup.GET("/stats", getCRDTStats)
+				adminGroup.GET("/dag", getCRDTDAG)
+				adminGroup.GET("/tombstones", listCRDTTombstones)
+				adminGroup.POST("/repair", repairCRDT)
+				adminGroup.POST("/compact", compactCRDT)
+				adminGroup.POST("/snapshot", snapshotCRDT)
+			}
+		}
+		servicesGroup := v1.Group("/services", localOnly())
+		{
+			servicesGroup.GET("", listServices)
+			servicesGroup.POST("", registerService)
+			servicesGroup.PUT("/:name", putService)
+			servicesGroup.DELETE("/:name", deregisterService)
+		}
+		aclGroup := v1.Group("/acl", localOnly())
+		{
+			aclGroup.GET("", getACL)
+			aclGroup.PUT("", putACL)
 		}
-		p2pGroup := v1.Group("/p2p")
+		p2pGroup := v1.Group("/p2p", trackInflight(inflight))
 		{
 			p2pGroup.PATCH("/:peerId/*path", P2PForwardHandler)
 			p2pGroup.POST("/:peerId/*path", P2PForwardHandler)
@@ -133,15 +202,18 @@ func StartServer() {
 			p2pGroup.GET("/:peerId/*path", P2PForwardHandler)
 			p2pGroup.DELETE("/:peerId/*path", P2PForwardHandler)
 		}
-		globalServiceGroup := v1.Group("/service")
-		{
-			globalServiceGroup.GET("/:service/*path", GlobalServiceForwardHandler)
-			globalServiceGroup.POST("/:service/*path", GlobalServiceForwardHandler)
-			globalServiceGroup.PUT("/:service/*path", GlobalServiceForwardHandler)
-			globalServiceGroup.PATCH("/:service/*path", GlobalServiceForwardHandler)
-			globalServiceGroup.DELETE("/:service/*path", GlobalServiceForwardHandler)
+		// only heads route requests to other peers
+		if node.ServesPublicRoutes() {
+			globalServiceGroup := v1.Group("/service", trackInflight(inflight))
+			{
+				globalServiceGroup.GET("/:service/*path", GlobalServiceForwardHandler)
+				globalServiceGroup.POST("/:service/*path", GlobalServiceForwardHandler)
+				globalServiceGroup.PUT("/:service/*path", GlobalServiceForwardHandler)
+				globalServiceGroup.PATCH("/:service/*path", GlobalServiceForwardHandler)
+				globalServiceGroup.DELETE("/:service/*path", GlobalServiceForwardHandler)
+			}
 		}
-		serviceGroup := v1.Group("/_service")
+		serviceGroup := v1.Group("/_service", trackInflight(inflight))
 		{
 			serviceGroup.GET("/:service/*path", ServiceForwardHandler)
 			serviceGroup.POST("/:service/*path", ServiceForwardHandler)
@@ -150,35 +222,5 @@ func StartServer() {
 			serviceGroup.DELETE("/:service/*path", ServiceForwardHandler)
 		}
 	}
-	p2plistener := P2PListener()
-	srv := &http.Server{
-		Addr:    "0.0.0.0:" + viper.GetString("port"),
-		Handler: r,
-	}
-	go func() {
-		err := http.Serve(p2plistener, r)
-		if err != nil {
-			common.Logger.Errorf("http.Serve: %s", err)
-		}
-	}()
-	go func() {
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			common.ReportError(err, "Server failed to start")
-		}
-	}()
-	go func() {
-		protocol.RegisterLocalServices()
-	}()
-	<-ctx.Done()
-	// shutting down...
-	protocol.AnnounceLeave()
-	protocol.ClearCRDTStore()
-	time.Sleep(5 * time.Second)
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	common.Logger.Info("Shutting down server gracefully")
-	defer cancel()
-	if err := srv.Shutdown(ctx); err != nil {
-		common.ReportError(err, "Server shutdown failed")
-	}
-	common.Logger.Info("Server exiting")
+	return r
 }
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"opentela/internal/protocol"
+
+	"github.com/gin-gonic/gin"
+)
+
+// serviceRequest is the body of the service registration endpoints.
+type serviceRequest struct {
+	Name          string   `json:"name"`
+	Port          string   `json:"port"`
+	Upstream      string   `json:"upstream"`
+	IdentityGroup []string `json:"identity_group"`
+	HealthPath    string   `json:"health_path"`
+	// HealthCheck overrides the health.* settings for this service
+	HealthCheck *protocol.HealthCheck `json:"health_check"`
+}
+
+func (r serviceRequest) service() protocol.Service {
+	return protocol.Service{
+		Name:          r.Name,
+		Port:          r.Port,
+		Upstream:      r.Upstream,
+		IdentityGroup: r.IdentityGroup,
+		HealthPath:    r.HealthPath,
+		HealthCheck:   r.HealthCheck,
+	}
+}
+
+func serviceErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, protocol.ErrInvalidService):
+		return http.StatusBadRequest
+	case errors.Is(err, protocol.ErrServiceExists):
+		return http.StatusConflict
+	case errors.Is(err, protocol.ErrServiceNotFound):
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+func listServices(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"services": nodeOf(c).LocalServices()})
+}
+
+// registerService registers a new local service and announces it.
+func registerService(c *gin.Context) {
+	var req serviceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	service, err := nodeOf(c).RegisterService(req.service())
+	if err != nil {
+		c.JSON(serviceErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, service)
+}
+
+// putService registers the named service or replaces the one with the same
+// port.
+func putService(c *gin.Context) {
+	var req serviceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	name := c.Param("name")
+	if req.Name != "" && req.Name != name {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "service name in body does not match the path"})
+		return
+	}
+	req.Name = name
+	service, created, err := nodeOf(c).PutService(req.service())
+	if err != nil {
+		c.JSON(serviceErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	c.JSON(status, service)
+}
+
+// deregisterService removes the named services, only the one on the given
+// port if the port query parameter is set, and withdraws them from the
+// network.
+func deregisterService(c *gin.Context) {
+	removed, err := nodeOf(c).DeregisterService(c.Param("name"), c.Query("port"))
+	if err != nil {
+		c.JSON(serviceErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"removed": removed})
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func servicesRouter() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	g := r.Group("/v1/services", localOnly())
+	g.GET("", listServices)
+	g.POST("", registerService)
+	g.PUT("/:name", putService)
+	g.DELETE("/:name", deregisterService)
+	return r
+}
+
+func TestLocalOnly(t *testing.T) {
+	r := servicesRouter()
+	for remote, want := range map[string]int{
+		"127.0.0.1:5555": http.StatusOK,
+		"[::1]:5555":     http.StatusOK,
+		"10.0.0.7:5555":  http.StatusForbidden,
+		// the p2p listener reports the remote peer ID
+		"12D3KooWJ7BrgG4dF1u9wB3XAGKTd7Lw1R6CQqp38zdc6PGBHFcM": http.StatusForbidden,
+	} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/v1/services", nil)
+		req.RemoteAddr = remote
+		req.Header.Set("X-Forwarded-For", "127.0.0.1")
+		r.ServeHTTP(w, req)
+		assert.Equal(t, want, w.Code, "remote %s", remote)
+	}
+}
+
+func TestServiceEndpointsRejectInvalidRequests(t *testing.T) {
+	r := servicesRouter()
+	cases := []struct {
+		method, path, body string
+		want               int
+	}{
+		{"POST", "/v1/services", `{"name":"llm"}`, http.StatusBadRequest},
+		{"POST", "/v1/services", `{"name":"llm","port":"not-a-port"}`, http.StatusBadRequest},
+		{"POST", "/v1/services", `not json`, http.StatusBadRequest},
+		{"PUT", "/v1/services/llm", `{"name":"vision","port":"8080"}`, http.StatusBadRequest},
+		{"DELETE", "/v1/services/does-not-exist", ``, http.StatusNotFound},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(c.method, c.path, strings.NewReader(c.body))
+		req.RemoteAddr = "127.0.0.1:5555"
+		r.ServeHTTP(w, req)
+		assert.Equal(t, c.want, w.Code, "%s %s %s", c.method, c.path, c.body)
+	}
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"opentela/internal/common"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const defaultShutdownGracePeriod = 2 * time.Minute
+
+func shutdownGracePeriod() time.Duration {
+	if grace := viper.GetDuration("shutdown.grace_period"); grace > 0 {
+		return grace
+	}
+	return defaultShutdownGracePeriod
+}
+
+// shutdownServers stops every server from accepting new connections right
+// away and waits, up to grace, for the requests tracked by t to complete.
+// Servers that still have active connections when the grace period is over
+// are closed forcibly. It returns as soon as the last request finishes.
+func shutdownServers(t *requestTracker, grace time.Duration, servers ...*http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+
+	common.Logger.Infof("Waiting up to %s for %d in-flight requests", grace, t.Count())
+
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				common.Logger.Warnf("Grace period expired, closing remaining connections: %v", err)
+				if cerr := srv.Close(); cerr != nil {
+					common.Logger.Error("Error while closing server: ", cerr)
+				}
+			}
+		}(srv)
+	}
+	wg.Wait()
+
+	if err := t.Wait(ctx); err != nil {
+		common.Logger.Warnf("Shutting down with %d requests still in flight", t.Count())
+		return
+	}
+	common.Logger.Info("All in-flight requests completed")
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startTestServer serves a gin router with a tracked, blocking route and a
+// route to probe the server with, and returns the server, its address, the
+// channel closed once the blocking route is entered and the one that releases
+// it.
+func startTestServer(t *testing.T, tracker *requestTracker) (*http.Server, string, chan struct{}, chan struct{}) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	r := gin.New()
+	r.GET("/stream", trackInflight(tracker), func(c *gin.Context) {
+		close(entered)
+		<-release
+		c.String(http.StatusOK, "done")
+	})
+	r.GET("/ping", func(c *gin.Context) {
+		c.String(http.StatusOK, "pong")
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := &http.Server{Handler: r}
+	go func() { _ = srv.Serve(ln) }()
+	return srv, "http://" + ln.Addr().String(), entered, release
+}
+
+func TestShutdownServersWaitsForInflight(t *testing.T) {
+	tracker := newRequestTracker()
+	srv, addr, entered, release := startTestServer(t, tracker)
+
+	result := make(chan int, 1)
+	go func() {
+		resp, err := http.Get(addr + "/stream")
+		if err != nil {
+			result <- 0
+			return
+		}
+		resp.Body.Close()
+		result <- resp.StatusCode
+	}()
+	<-entered
+
+	finished := make(chan struct{})
+	go func() {
+		shutdownServers(tracker, time.Minute, srv)
+		close(finished)
+	}()
+
+	// new connections are refused as soon as shutdown starts
+	assert.Eventually(t, func() bool {
+		resp, err := http.Get(addr + "/ping")
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err != nil
+	}, time.Second, 10*time.Millisecond)
+
+	select {
+	case <-finished:
+		t.Fatal("shutdown returned while a request was still in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case <-finished:
+	case <-time.After(2 * time.Second):
+		t.Fatal("shutdown did not return after the last request completed")
+	}
+	assert.Equal(t, http.StatusOK, <-result)
+	assert.Equal(t, int64(0), tracker.Count())
+}
+
+func TestShutdownServersHonoursGracePeriod(t *testing.T) {
+	tracker := newRequestTracker()
+	srv, addr, entered, release := startTestServer(t, tracker)
+	defer close(release)
+
+	go func() {
+		if resp, err := http.Get(addr + "/stream"); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-entered
+
+	start := time.Now()
+	shutdownServers(tracker, 100*time.Millisecond, srv)
+	assert.Less(t, time.Since(start), 2*time.Second)
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"net/http"
+	"opentela/internal/protocol"
+	"sync"
+	"time"
+
+	p2phttp "github.com/libp2p/go-libp2p-http"
+)
+
+// transports holds the transports of each node, so that requests leave
+// through the host of the node serving them: one for its local services and
+// one per peer it forwards requests to. The transport of a peer is closed and
+// dropped when the peer leaves or disconnects, see evictPeerTransports.
+var transports = struct {
+	sync.Mutex
+	byNode map[*protocol.Node]*nodeTransports
+}{byNode: make(map[*protocol.Node]*nodeTransports)}
+
+type nodeTransports struct {
+	local  *http.Transport
+	byPeer map[string]*http.Transport
+}
+
+func newTransport(node *protocol.Node) *http.Transport {
+	t := &http.Transport{
+		ResponseHeaderTimeout: 10 * time.Minute, // Allow up to 10 minutes for response headers
+		IdleConnTimeout:       90 * time.Second, // Keep connections alive for 90 seconds
+		DisableKeepAlives:     false,            // Enable keep-alives for better performance
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   10,
+	}
+	t.RegisterProtocol("libp2p", p2phttp.NewTransport(node.Host(), p2phttp.ProtocolOption(node.P2PHTTPProtocol())))
+	return t
+}
+
+// transportsOf returns the transports of node, to be used with transports
+// locked.
+func transportsOf(node *protocol.Node) *nodeTransports {
+	nt, ok := transports.byNode[node]
+	if !ok {
+		nt = &nodeTransports{local: newTransport(node), byPeer: make(map[string]*http.Transport)}
+		transports.byNode[node] = nt
+		go evictPeerTransports(node)
+	}
+	return nt
+}
+
+// nodeTransport returns the transport of node for its local services.
+func nodeTransport(node *protocol.Node) *http.Transport {
+	transports.Lock()
+	defer transports.Unlock()
+	return transportsOf(node).local
+}
+
+// peerTransport returns the transport of node for requests forwarded to peer.
+func peerTransport(node *protocol.Node, peer string) *http.Transport {
+	transports.Lock()
+	defer transports.Unlock()
+	nt := transportsOf(node)
+	t, ok := nt.byPeer[peer]
+	if !ok {
+		t = newTransport(node)
+		nt.byPeer[peer] = t
+	}
+	return t
+}
+
+// dropPeerTransport closes the idle connections of the transport of node to
+// peer and forgets it. Requests still in flight complete on their
+// connections.
+func dropPeerTransport(node *protocol.Node, peer string) {
+	transports.Lock()
+	defer transports.Unlock()
+	nt, ok := transports.byNode[node]
+	if !ok {
+		return
+	}
+	if t, ok := nt.byPeer[peer]; ok {
+		t.CloseIdleConnections()
+		delete(nt.byPeer, peer)
+	}
+}
+
+// evictPeerTransports drops the transports to peers that leave or disconnect
+// from the node table of node.
+func evictPeerTransports(node *protocol.Node) {
+	lastEventID := ""
+	for {
+		watch, cancel := node.WatchNodeTable(lastEventID)
+		if watch.Snapshot != nil {
+			// events were missed, drop what is no longer connected
+			transports.Lock()
+			var gone []string
+			for peer := range transports.byNode[node].byPeer {
+				if p, ok := watch.Snapshot["/"+peer]; !ok || !p.Connected || p.Status == protocol.LEFT {
+					gone = append(gone, peer)
+				}
+			}
+			transports.Unlock()
+			for _, peer := range gone {
+				dropPeerTransport(node, peer)
+			}
+		}
+		lastEventID = watch.Cursor
+		for _, event := range watch.Backlog {
+			lastEventID = evictOn(node, event)
+		}
+		for event := range watch.Events {
+			lastEventID = evictOn(node, event)
+		}
+		// the watch was dropped for falling behind, resume from the last event
+		cancel()
+	}
+}
+
+func evictOn(node *protocol.Node, event protocol.TableEvent) string {
+	if event.Type == protocol.PeerLeft || event.Type == protocol.PeerDisconnected {
+		dropPeerTransport(node, event.PeerID)
+	}
+	return event.ID
+}
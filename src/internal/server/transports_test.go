@@ -0,0 +1,39 @@
+package server
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"opentela/internal/protocol"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeerTransportsAreDroppedWhenPeersGo(t *testing.T) {
+	node := protocol.NewNode(protocol.NodeConfig{})
+	set := func(p protocol.Peer) {
+		value, _ := json.Marshal(p)
+		node.UpdateNodeTableHook(ds.NewKey(p.ID), value)
+	}
+	hasTransport := func(peer string) bool {
+		transports.Lock()
+		defer transports.Unlock()
+		_, ok := transports.byNode[node].byPeer[peer]
+		return ok
+	}
+	set(protocol.Peer{ID: "leaving", Connected: true})
+	set(protocol.Peer{ID: "flaky", Connected: true})
+
+	leaving := peerTransport(node, "leaving")
+	assert.Same(t, leaving, peerTransport(node, "leaving"), "transports must be reused")
+	peerTransport(node, "flaky")
+
+	set(protocol.Peer{ID: "leaving", Status: protocol.LEFT})
+	set(protocol.Peer{ID: "flaky", Connected: false})
+	assert.Eventually(t, func() bool {
+		return !hasTransport("leaving") && !hasTransport("flaky")
+	}, time.Second, 10*time.Millisecond)
+	assert.NotSame(t, leaving, peerTransport(node, "leaving"))
+}
@@ -236,3 +236,30 @@ func InitializeWallet() (*WalletManager, error) {
 	}
 	return wm, nil
 }
+
+// Sign signs message with the private key of the managed account publicKey.
+func (wm *WalletManager) Sign(publicKey string, message []byte) ([]byte, error) {
+	for _, acc := range wm.accounts {
+		if acc.PublicKey != publicKey {
+			continue
+		}
+		private, err := base64.StdEncoding.DecodeString(acc.Private)
+		if err != nil || len(private) != ed25519.PrivateKeySize {
+			return nil, fmt.Errorf("account %s has no usable private key", publicKey)
+		}
+		return ed25519.Sign(ed25519.PrivateKey(private), message), nil
+	}
+	return nil, fmt.Errorf("no managed account %s", publicKey)
+}
+
+// Verify reports whether signature is a signature of message by the account
+// publicKey, encoded in base58 for Solana accounts or base64 for OCF ones.
+func Verify(publicKey string, message, signature []byte) bool {
+	pub, err := base58.Decode(publicKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		if pub, err = base64.StdEncoding.DecodeString(publicKey); err != nil || len(pub) != ed25519.PublicKeySize {
+			return false
+		}
+	}
+	return ed25519.Verify(ed25519.PublicKey(pub), message, signature)
+}
@@ -673,4 +673,49 @@ func TestInitializeWallet(t *testing.T) {
 			t.Error("Wallet manager should be nil when initialization fails")
 		}
 	})
-}
\ No newline at end of file
+}
+func TestWalletManagerSignAndVerify(t *testing.T) {
+	ocfDir := filepath.Join(t.TempDir(), ".ocf")
+	if err := os.MkdirAll(ocfDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	wm := &WalletManager{
+		storageDir:  ocfDir,
+		storagePath: filepath.Join(ocfDir, "accounts.json"),
+		accounts:    []Account{},
+	}
+	account, err := wm.AddSolanaAccount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := []byte("message")
+
+	signature, err := wm.Sign(account.PublicKey, message)
+	if err != nil {
+		t.Fatalf("Unexpected error signing: %v", err)
+	}
+	if !Verify(account.PublicKey, message, signature) {
+		t.Error("Expected the signature to verify")
+	}
+	if Verify(account.PublicKey, []byte("other message"), signature) {
+		t.Error("Expected the signature of another message to be rejected")
+	}
+	if Verify("not-a-key", message, signature) {
+		t.Error("Expected an invalid public key to be rejected")
+	}
+	if _, err := wm.Sign("unknown", message); err == nil {
+		t.Error("Expected signing for an unknown account to fail")
+	}
+
+	// OCF accounts use base64 public keys
+	public, private, _ := ed25519.GenerateKey(rand.Reader)
+	wm.accounts = append(wm.accounts, Account{
+		Type:      WalletTypeOCF,
+		PublicKey: base64.StdEncoding.EncodeToString(public),
+		Private:   base64.StdEncoding.EncodeToString(private),
+	})
+	signature, err = wm.Sign(base64.StdEncoding.EncodeToString(public), message)
+	if err != nil || !Verify(base64.StdEncoding.EncodeToString(public), message, signature) {
+		t.Errorf("Expected OCF accounts to sign and verify, got %v", err)
+	}
+}